@@ -0,0 +1,220 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"strings"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultBlobContentType = "application/octet-stream"
+
+// cellContentTypes are the content types of cells read as blobs, other than bytes uploaded with a content type
+var cellContentTypes = map[string]string{
+	cellTypeString: "text/plain; charset=utf-8",
+	cellTypeInt:    "text/plain; charset=utf-8",
+	cellTypeFloat:  "text/plain; charset=utf-8",
+	cellTypeBool:   "text/plain; charset=utf-8",
+	cellTypeJSON:   "application/json",
+	cellTypeBytes:  defaultBlobContentType,
+}
+
+var errBlobTooLarge = errors.New("blob is over the max size")
+
+// putCell streams the request body (or the first part of multipart bodies) into a cell, without
+// buffering it in memory. The cell is stored as bytes with the content type of the upload
+func (s *server) putCell(c *gin.Context) {
+	params, err := parseRequiredRequestParams(c, "table", "key", "column")
+	if err != nil {
+		return
+	}
+	if _, err := s.authorizeColumns(c, params["table"], auth.PermissionWrite, params["column"]); err != nil {
+		return
+	}
+	ttl, err := parseTTL(c)
+	if err != nil {
+		return
+	}
+
+	body, contentType, err := blobBody(c)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": fmt.Sprintf("Could not read the request body, %v", err),
+		})
+		return
+	}
+
+	schema, err := s.validateRow(c, params["table"], params["key"], map[string]cellValue{
+		params["column"]: {Type: cellTypeBytes, ContentType: contentType},
+	})
+	if err != nil {
+		return
+	}
+	blob := &blobReader{r: body, maxSize: -1}
+	if schema != nil && schema.Columns[params["column"]].MaxSize > 0 {
+		blob.maxSize = int64(schema.Columns[params["column"]].MaxSize)
+	}
+
+	expiresAt := cellExpiry(ttl, schema)
+
+	columnPath := fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], params["key"], params["column"])
+	attrs, err := s.bucket.WriteObjectStream(c.Request.Context(), columnPath,
+		io.MultiReader(bytes.NewReader(blobHeader(contentType)), blob), &store.WriteOptions{ExpiresAt: expiresAt})
+	s.invalidateCells(c.Request.Context(), columnPath)
+	if errors.Is(err, errBlobTooLarge) {
+		c.JSON(400, gin.H{
+			"error": fmt.Sprintf("Row key '%s' does not match the schema of table '%s'", params["key"], params["table"]),
+			"violations": []string{
+				fmt.Sprintf("Column '%s' value is over the max size of %d bytes", params["column"], blob.maxSize),
+			},
+		})
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		errorMsg := "Internal error, check server logs"
+		if errors.Is(err, store.ErrRateLimited) {
+			errorMsg = "Bucket is rate limiting, column was not set"
+		}
+		c.JSON(500, gin.H{
+			"error": errorMsg,
+		})
+		return
+	}
+	s.publishChanges(c.Request.Context(), params["table"],
+		setEvent(params["key"], map[string]string{params["column"]: attrs.Generation}))
+
+	c.JSON(200, addExpiry(gin.H{
+		"success": fmt.Sprintf("Set column '%s' in row key '%s' of table '%s'",
+			params["column"], params["key"], params["table"]),
+		"contentType": contentType,
+		"size":        blob.size,
+		"generation":  attrs.Generation,
+	}, expiresAt))
+}
+
+// getCell streams a cell back with the content type it was uploaded with, cells set as JSON values
+// are returned as text (or JSON for json values)
+func (s *server) getCell(c *gin.Context) {
+	allowCORSForBrowsers(c)
+	params, err := parseRequiredRequestParams(c, "table", "key", "column")
+	if err != nil {
+		return
+	}
+	if _, err := s.authorizeColumns(c, params["table"], auth.PermissionRead, params["column"]); err != nil {
+		return
+	}
+
+	columnPath := fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], params["key"], params["column"])
+	r, attrs, err := s.bucket.ReadObjectStream(c.Request.Context(), columnPath)
+	if err == nil && attrs.IsExpired() {
+		r.Close()
+		err = store.ErrObjectNotExist
+	}
+	if errors.Is(err, store.ErrObjectNotExist) {
+		c.JSON(404, gin.H{
+			"error": fmt.Sprintf("Column '%s' not found in row key '%s' of table '%s'", params["column"], params["key"], params["table"]),
+		})
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	defer r.Close()
+
+	blob := bufio.NewReader(r)
+	contentType, err := readBlobContentType(blob)
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+
+	c.Header("X-Generation", attrs.Generation)
+	c.DataFromReader(200, -1, contentType, blob, nil)
+}
+
+// blobBody returns the body of blob uploads and its content type, which is the first part of multipart bodies
+func blobBody(c *gin.Context) (io.Reader, string, error) {
+	contentType := c.ContentType()
+	if contentType == "" {
+		return c.Request.Body, defaultBlobContentType, nil
+	}
+	if contentType != "multipart/form-data" && contentType != "multipart/mixed" {
+		if _, _, err := mime.ParseMediaType(c.GetHeader("Content-Type")); err != nil {
+			return nil, "", err
+		}
+		return c.Request.Body, c.GetHeader("Content-Type"), nil
+	}
+
+	multipartReader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	part, err := multipartReader.NextPart()
+	if err != nil {
+		return nil, "", err
+	}
+	partContentType := part.Header.Get("Content-Type")
+	if partContentType == "" {
+		return part, defaultBlobContentType, nil
+	}
+	if _, _, err := mime.ParseMediaType(partContentType); err != nil {
+		return nil, "", err
+	}
+	return part, partContentType, nil
+}
+
+// readBlobContentType reads the type header of a cell, returning the content type of the data after it
+func readBlobContentType(r *bufio.Reader) (string, error) {
+	header, _ := r.Peek(2)
+	if len(header) < 2 || header[0] != cellHeader {
+		return cellContentTypes[cellTypeString], nil
+	}
+
+	if header[1] == blobTag {
+		r.Discard(2)
+		contentType, err := r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("Failed to read the content type of blob: %v", err)
+		}
+		return strings.TrimSuffix(contentType, "\n"), nil
+	}
+	for cellType, tag := range cellTypeTags {
+		if header[1] == tag {
+			r.Discard(2)
+			return cellContentTypes[cellType], nil
+		}
+	}
+	return cellContentTypes[cellTypeString], nil
+}
+
+// blobReader counts the bytes of uploaded blobs, failing with errBlobTooLarge if over maxSize (-1 for no limit)
+type blobReader struct {
+	r       io.Reader
+	size    int64
+	maxSize int64
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.size += int64(n)
+	if b.maxSize > -1 && b.size > b.maxSize {
+		return n, errBlobTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/adrianchifor/Bigbucket/cache"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/tracing"
+	"github.com/gin-gonic/gin"
+)
+
+// readCellObject reads a cell object from the read cache if enabled, reading it from the bucket on misses.
+// With cache peers, cells owned by another peer are read through its cache
+func (s *server) readCellObject(ctx context.Context, object string) ([]byte, *store.ObjectAttrs, error) {
+	if s.cache == nil {
+		return s.bucket.ReadObject(ctx, object)
+	}
+	if s.peers != nil {
+		if owner, self := s.peers.Owner(object); !self {
+			data, attrs, err := s.peers.Fetch(ctx, owner, object)
+			if err == nil || errors.Is(err, store.ErrObjectNotExist) {
+				return data, attrs, err
+			}
+			log.Printf("Failed to read '%s' from cache peer, reading the bucket: %v", object, err)
+			return s.bucket.ReadObject(ctx, object)
+		}
+	}
+
+	data, attrs, epoch, cached := s.cache.Get(object)
+	if cached {
+		return data, attrs, nil
+	}
+
+	data, attrs, err := s.bucket.ReadObject(ctx, object)
+	if err == nil {
+		s.cache.Add(object, data, attrs, epoch)
+	}
+	return data, attrs, err
+}
+
+// invalidateCells removes cell objects from the read cache (and the caches of peers), after they were written
+// or deleted (even if that failed, as the bucket might have applied it)
+func (s *server) invalidateCells(ctx context.Context, objects ...string) {
+	if s.cache == nil || len(objects) == 0 {
+		return
+	}
+	s.cache.Remove(objects...)
+	if s.peers != nil {
+		// Not canceled with the request, so peers don't keep stale cells if the client went away
+		s.peers.Invalidate(tracing.Detach(ctx), objects)
+	}
+}
+
+// getPeerCell serves a cell object through the read cache, to the peers which don't own it
+func (s *server) getPeerCell(c *gin.Context) {
+	if !s.peers.Authorized(c.Request) {
+		c.JSON(401, gin.H{"error": "Invalid or missing cache peer secret"})
+		return
+	}
+	// Object paths have slashes, so they can't be validated like other parameters
+	object := c.Query("object")
+	if strings.Count(object, "/") != 3 || !strings.HasPrefix(object, "bigbucket/") {
+		c.JSON(400, gin.H{"error": "Please provide a cell object (bigbucket/<table>/<key>/<column>) as 'object'"})
+		return
+	}
+
+	data, attrs, epoch, cached := s.cache.Get(object)
+	if !cached {
+		var err error
+		data, attrs, err = s.bucket.ReadObject(c.Request.Context(), object)
+		if errors.Is(err, store.ErrObjectNotExist) {
+			c.JSON(404, gin.H{"error": "Object not found"})
+			return
+		}
+		if err != nil {
+			log.Print(err)
+			c.JSON(500, gin.H{
+				"error": "Internal error, check server logs",
+			})
+			return
+		}
+		s.cache.Add(object, data, attrs, epoch)
+	}
+
+	cache.WriteObjectHeaders(c.Writer.Header(), attrs)
+	c.Data(200, "application/octet-stream", data)
+}
+
+// invalidatePeerCells removes the cells written or deleted by a peer from the read cache
+func (s *server) invalidatePeerCells(c *gin.Context) {
+	if !s.peers.Authorized(c.Request) {
+		c.JSON(401, gin.H{"error": "Invalid or missing cache peer secret"})
+		return
+	}
+	var payload cache.InvalidateRequest
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(400, gin.H{"error": "Please provide the objects to invalidate as a JSON payload"})
+		return
+	}
+
+	s.cache.Remove(payload.Objects...)
+	c.JSON(200, gin.H{"success": "Invalidated"})
+}
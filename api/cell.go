@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Types of cell values
+const (
+	cellTypeString = "string"
+	cellTypeInt    = "int"
+	cellTypeFloat  = "float"
+	cellTypeBool   = "bool"
+	cellTypeJSON   = "json"
+	cellTypeBytes  = "bytes"
+)
+
+// cellHeader is the first byte of typed cells, followed by the tag of their type. Cells without it are strings,
+// so plain string cells (and cells written before values were typed) are stored and read as they are
+const cellHeader = 0x00
+
+var cellTypeTags = map[string]byte{
+	cellTypeString: 's',
+	cellTypeInt:    'i',
+	cellTypeFloat:  'f',
+	cellTypeBool:   'b',
+	cellTypeJSON:   'j',
+	cellTypeBytes:  'y',
+}
+
+// blobTag is the tag of bytes cells uploaded with a content type, followed by the content type and a newline
+const blobTag = 'c'
+
+// bytesKey is the only key of JSON objects holding base64 encoded bytes, e.g. {"$bytes": "aGVsbG8="}
+const bytesKey = "$bytes"
+
+// cellValue is a typed cell value, returned in responses as its native JSON type
+type cellValue struct {
+	Type string
+	// ContentType of bytes values uploaded as blobs, empty if unknown
+	ContentType string
+	// Data is the text of the value (JSON for json values), or the raw bytes of bytes values
+	Data []byte
+}
+
+func stringCell(value string) cellValue {
+	return cellValue{Type: cellTypeString, Data: []byte(value)}
+}
+
+// parseCellValue parses a value of a JSON payload. Objects with only the '$bytes' key are base64 encoded bytes,
+// other objects and arrays are json values
+func parseCellValue(raw json.RawMessage) (cellValue, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return cellValue{}, errors.New("value is empty")
+	}
+
+	switch raw[0] {
+	case '"':
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return cellValue{}, err
+		}
+		return stringCell(value), nil
+	case 't', 'f':
+		return cellValue{Type: cellTypeBool, Data: raw}, nil
+	case 'n':
+		return cellValue{}, errors.New("null values are not supported, delete the column instead")
+	case '{':
+		var bytesValue map[string]string
+		if json.Unmarshal(raw, &bytesValue) == nil && len(bytesValue) == 1 {
+			if encoded, exists := bytesValue[bytesKey]; exists {
+				data, err := base64.StdEncoding.DecodeString(encoded)
+				if err != nil {
+					return cellValue{}, errors.New("'$bytes' has to be a base64 encoded string")
+				}
+				return cellValue{Type: cellTypeBytes, Data: data}, nil
+			}
+		}
+		fallthrough
+	case '[':
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, raw); err != nil {
+			return cellValue{}, err
+		}
+		return cellValue{Type: cellTypeJSON, Data: compacted.Bytes()}, nil
+	default:
+		number := string(raw)
+		if !strings.ContainsAny(number, ".eE") {
+			if _, err := strconv.ParseInt(number, 10, 64); err != nil {
+				return cellValue{}, errors.New("integer overflows int64")
+			}
+			return cellValue{Type: cellTypeInt, Data: raw}, nil
+		}
+		if _, err := strconv.ParseFloat(number, 64); err != nil {
+			return cellValue{}, errors.New("float overflows float64")
+		}
+		return cellValue{Type: cellTypeFloat, Data: raw}, nil
+	}
+}
+
+// decodeCellValue decodes the data of a cell object
+func decodeCellValue(data []byte) cellValue {
+	if len(data) < 2 || data[0] != cellHeader {
+		return cellValue{Type: cellTypeString, Data: data}
+	}
+	if data[1] == blobTag {
+		if contentType, blob, found := bytes.Cut(data[2:], []byte("\n")); found {
+			return cellValue{Type: cellTypeBytes, ContentType: string(contentType), Data: blob}
+		}
+	}
+	for cellType, tag := range cellTypeTags {
+		if data[1] == tag {
+			return cellValue{Type: cellType, Data: data[2:]}
+		}
+	}
+	return cellValue{Type: cellTypeString, Data: data}
+}
+
+// encode returns the data of the cell object, with the type header unless it's a plain string
+func (value cellValue) encode() []byte {
+	if value.Type == cellTypeString && (len(value.Data) == 0 || value.Data[0] != cellHeader) {
+		return value.Data
+	}
+	if value.Type == cellTypeBytes && value.ContentType != "" {
+		return append(blobHeader(value.ContentType), value.Data...)
+	}
+	return append([]byte{cellHeader, cellTypeTags[value.Type]}, value.Data...)
+}
+
+// blobHeader returns the header of bytes cells with a content type
+func blobHeader(contentType string) []byte {
+	return append([]byte{cellHeader, blobTag}, contentType+"\n"...)
+}
+
+// MarshalJSON returns the value as its native JSON type, bytes as {"$bytes": "<base64>"}
+func (value cellValue) MarshalJSON() ([]byte, error) {
+	switch value.Type {
+	case cellTypeInt, cellTypeFloat, cellTypeBool, cellTypeJSON:
+		return value.Data, nil
+	case cellTypeBytes:
+		return json.Marshal(map[string]string{bytesKey: base64.StdEncoding.EncodeToString(value.Data)})
+	default:
+		return json.Marshal(string(value.Data))
+	}
+}
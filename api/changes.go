@@ -0,0 +1,456 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/tracing"
+	"github.com/adrianchifor/Bigbucket/utils"
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+)
+
+// Operations of change events
+const (
+	changeOpSet          = "set"
+	changeOpDelete       = "delete"
+	changeOpDeleteColumn = "deleteColumn"
+	changeOpDeleteTable  = "deleteTable"
+)
+
+const (
+	changesDefaultLimit   = 100
+	changesMaxLimit       = 1000
+	changesDefaultTimeout = 30 * time.Second
+	changesMaxTimeout     = 5 * time.Minute
+	// changesPollInterval is how often watchers list the change log, for changes logged by other instances
+	changesPollInterval = 2 * time.Second
+	eventStreamType     = "text/event-stream"
+)
+
+// changeCursorRegex matches the change log segment names returned as cursors
+var changeCursorRegex = regexp.MustCompile(`^[0-9]{20}-[0-9a-f]{8}$`)
+
+// changeEvent is a mutation of a table recorded in the change log
+type changeEvent struct {
+	Table       string            `json:"table"`
+	Op          string            `json:"op"`
+	Key         string            `json:"key,omitempty"`
+	Columns     []string          `json:"columns,omitempty"`
+	Generations map[string]string `json:"generations,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+}
+
+// changeSegment holds the events of a write request, stored in an object of the change log
+type changeSegment struct {
+	name   string
+	events []changeEvent
+}
+
+// changeNotifier wakes up the watchers of a table when this instance logs changes of it
+type changeNotifier struct {
+	mutex   sync.Mutex
+	waiting map[string]chan struct{}
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{waiting: make(map[string]chan struct{})}
+}
+
+// wait returns a channel closed when changes of the table are next logged by this instance
+func (n *changeNotifier) wait(table string) <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	wake, exists := n.waiting[table]
+	if !exists {
+		wake = make(chan struct{})
+		n.waiting[table] = wake
+	}
+	return wake
+}
+
+func (n *changeNotifier) notify(table string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if wake, exists := n.waiting[table]; exists {
+		close(wake)
+		delete(n.waiting, table)
+	}
+}
+
+// setEvent is the change event of the columns set in a row, with their new generations
+func setEvent(key string, generations map[string]string) changeEvent {
+	columns := []string{}
+	for column := range generations {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return changeEvent{Op: changeOpSet, Key: key, Columns: columns, Generations: generations}
+}
+
+// batchSetEvents returns the change events of the cells written by a batch, ordered by row key
+func batchSetEvents(results map[string]map[string]cellResult) []changeEvent {
+	rowKeys := []string{}
+	for rowKey := range results {
+		rowKeys = append(rowKeys, rowKey)
+	}
+	sort.Strings(rowKeys)
+
+	events := []changeEvent{}
+	for _, rowKey := range rowKeys {
+		generations := map[string]string{}
+		for column, result := range results[rowKey] {
+			if result.Generation != "" {
+				generations[column] = result.Generation
+			}
+		}
+		if len(generations) > 0 {
+			events = append(events, setEvent(rowKey, generations))
+		}
+	}
+	return events
+}
+
+// deleteEvents returns the change events of the cell objects deleted from rows, ordered by row key.
+// Failed deletes are keyed by 'key/column'
+func deleteEvents(objects []string, deletesFailed map[string]error) []changeEvent {
+	rowKeys := []string{}
+	rowColumns := map[string][]string{}
+	for _, object := range objects {
+		objectSplit := strings.Split(object, "/")
+		rowKey, column := objectSplit[2], objectSplit[3]
+		if _, failed := deletesFailed[rowKey+"/"+column]; failed {
+			continue
+		}
+		if _, exists := rowColumns[rowKey]; !exists {
+			rowKeys = append(rowKeys, rowKey)
+		}
+		rowColumns[rowKey] = append(rowColumns[rowKey], column)
+	}
+	sort.Strings(rowKeys)
+
+	events := []changeEvent{}
+	for _, rowKey := range rowKeys {
+		sort.Strings(rowColumns[rowKey])
+		events = append(events, changeEvent{Op: changeOpDelete, Key: rowKey, Columns: rowColumns[rowKey]})
+	}
+	return events
+}
+
+// logChanges writes the events of a write request to a new segment of the change log of the table, if enabled.
+// The mutations already happened, so failures are logged and not returned
+func (s *server) logChanges(ctx context.Context, table string, events ...changeEvent) {
+	if s.changes == nil || len(events) == 0 {
+		return
+	}
+
+	timestamp := time.Now().UTC()
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	for _, event := range events {
+		event.Table = table
+		event.Timestamp = timestamp
+		if err := encoder.Encode(&event); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	// Not canceled with the request, so changes are logged even if the client went away
+	named := time.Now()
+	object := utils.ChangesPrefix + table + "/" + utils.NewOrderedID()
+	if _, err := s.bucket.WriteObject(tracing.Detach(ctx), object, buf.Bytes(), nil); err != nil {
+		log.Printf("Failed to write %d change events to the change log (%s): %v", len(events), object, err)
+		return
+	}
+	if elapsed := time.Since(named); s.changesSettle > 0 && elapsed >= s.changesSettle {
+		log.Printf("Change log segment %s took %v to write, longer than the settle window (%v), so readers "+
+			"may have skipped it", object, elapsed, s.changesSettle)
+	}
+	s.changes.notify(table)
+}
+
+// readChanges reads up to limit segments of the change log of a table after the cursor, in order. Segments
+// are named by the time they're logged, so only the ones older than the settle window are read, as newer
+// ones can still be written before them. Columns not readable by the caller are redacted, and events left
+// without columns dropped
+func (s *server) readChanges(ctx context.Context, table string, cursor string, limit int,
+	access *auth.Access) ([]changeSegment, error) {
+	prefix := utils.ChangesPrefix + table + "/"
+	settled := fmt.Sprintf("%s%020d", prefix, time.Now().Add(-s.changesSettle).UnixNano())
+	objects, err := s.bucket.ListObjects(ctx, prefix, "", limit+1,
+		&store.ListOptions{StartOffset: prefix + cursor, EndOffset: settled})
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []changeSegment{}
+	for _, object := range objects {
+		if object != prefix+cursor && len(segments) < limit {
+			segments = append(segments, changeSegment{name: strings.TrimPrefix(object, prefix)})
+		}
+	}
+	if len(segments) == 0 {
+		return segments, nil
+	}
+
+	segmentsJobPool := parallel.CustomJobPool(parallel.JobPoolConfig{
+		WorkerCount:  len(segments),
+		JobQueueSize: len(segments) * 10,
+	})
+	defer segmentsJobPool.Close()
+
+	readsFailed := make([]error, len(segments))
+	for i := range segments {
+		i := i
+		utils.AddJob(ctx, segmentsJobPool, "read", func(ctx context.Context) {
+			data, _, err := s.bucket.ReadObject(ctx, prefix+segments[i].name)
+			if errors.Is(err, store.ErrObjectNotExist) {
+				// Deleted by the cleaner after the retention period since listed
+				return
+			}
+			if err != nil {
+				readsFailed[i] = err
+				return
+			}
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			for decoder.More() {
+				var event changeEvent
+				if err := decoder.Decode(&event); err != nil {
+					readsFailed[i] = fmt.Errorf("Invalid change log segment '%s': %v", segments[i].name, err)
+					return
+				}
+				if redactChangeEvent(&event, access) {
+					segments[i].events = append(segments[i].events, event)
+				}
+			}
+		})
+	}
+
+	if err := segmentsJobPool.Wait(); err != nil {
+		return nil, err
+	}
+	for _, err := range readsFailed {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// redactChangeEvent removes the columns of the event not readable by the caller, returning false
+// if none is left
+func redactChangeEvent(event *changeEvent, access *auth.Access) bool {
+	if event.Op == changeOpDeleteTable || access.AllColumns() {
+		return true
+	}
+	columns := []string{}
+	for _, column := range event.Columns {
+		if access.ColumnAllowed(column) {
+			columns = append(columns, column)
+		} else {
+			delete(event.Generations, column)
+		}
+	}
+	event.Columns = columns
+	return len(columns) > 0
+}
+
+// parseChangesCursor parses 'since' as a cursor returned by a previous call, or a RFC 3339 time
+// to read the changes logged from then
+func parseChangesCursor(since string) (string, error) {
+	if since == "" || changeCursorRegex.MatchString(since) {
+		return since, nil
+	}
+	sinceTime, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d", sinceTime.UnixNano()), nil
+}
+
+func (s *server) getChanges(c *gin.Context) {
+	if s.changes == nil {
+		c.JSON(404, gin.H{
+			"error": "Change log is disabled, run with --changelog to enable it",
+		})
+		return
+	}
+	tableMap, err := parseRequiredRequestParams(c, "table")
+	if err != nil {
+		return
+	}
+	optionalMap, err := parseOptionalRequestParams(c, "since", "limit", "watch", "timeout")
+	if err != nil {
+		return
+	}
+	params := utils.MergeMaps(tableMap, optionalMap)
+	access, err := s.authorize(c, params["table"], auth.PermissionRead)
+	if err != nil {
+		return
+	}
+
+	since := params["since"]
+	streamed := strings.Contains(c.GetHeader("Accept"), eventStreamType)
+	if lastEventID := c.GetHeader("Last-Event-ID"); streamed && lastEventID != "" {
+		// Reconnecting event streams resume after the last segment received
+		since = lastEventID
+	}
+	cursor, err := parseChangesCursor(since)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": "'since' parameter has to be a cursor returned by a previous call or a RFC 3339 time",
+		})
+		return
+	}
+
+	limit := changesDefaultLimit
+	if params["limit"] != "" {
+		limit, err = strconv.Atoi(params["limit"])
+		if err != nil || limit < 1 || limit > changesMaxLimit {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("'limit' parameter has to be an integer between 1 and %d", changesMaxLimit)})
+			return
+		}
+	}
+
+	if streamed {
+		s.streamChanges(c, params["table"], cursor, limit, access)
+		return
+	}
+
+	watch := false
+	if params["watch"] != "" {
+		watch, err = strconv.ParseBool(params["watch"])
+		if err != nil {
+			c.JSON(400, gin.H{"error": "'watch' parameter has to be a boolean"})
+			return
+		}
+	}
+	timeout := changesDefaultTimeout
+	if params["timeout"] != "" {
+		timeoutSeconds, err := strconv.Atoi(params["timeout"])
+		timeout = time.Duration(timeoutSeconds) * time.Second
+		if err != nil || timeout < time.Second || timeout > changesMaxTimeout {
+			c.JSON(400, gin.H{
+				"error": fmt.Sprintf("'timeout' parameter has to be an integer of seconds between 1 and %d",
+					int(changesMaxTimeout.Seconds())),
+			})
+			return
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	events := []changeEvent{}
+	for {
+		// Waiting starts before reading, so changes logged in between aren't missed
+		wake := s.changes.wait(params["table"])
+		segments, err := s.readChanges(c.Request.Context(), params["table"], cursor, limit, access)
+		if err != nil {
+			log.Print(err)
+			c.JSON(500, gin.H{
+				"error": "Internal error, check server logs",
+			})
+			return
+		}
+		for _, segment := range segments {
+			events = append(events, segment.events...)
+			cursor = segment.name
+		}
+
+		if len(events) > 0 || len(segments) == limit || !watch || !time.Now().Before(deadline) {
+			break
+		}
+		if !s.waitForChanges(c.Request.Context(), wake, time.Until(deadline)) {
+			return
+		}
+	}
+
+	c.JSON(200, gin.H{"table": params["table"], "changes": events, "cursor": cursor})
+}
+
+// streamChanges streams the changes of a table as server-sent events until the client goes away, each event
+// as JSON data with the cursor of its segment as id
+func (s *server) streamChanges(c *gin.Context, table string, cursor string, limit int, access *auth.Access) {
+	c.Header("Content-Type", eventStreamType)
+	c.Header("Cache-Control", "no-cache")
+	c.Status(200)
+	c.Writer.Flush()
+
+	for {
+		wake := s.changes.wait(table)
+		segments, err := s.readChanges(c.Request.Context(), table, cursor, limit, access)
+		if err != nil {
+			if c.Request.Context().Err() == nil {
+				log.Print(err)
+			}
+			return
+		}
+
+		for _, segment := range segments {
+			for i, event := range segment.events {
+				data, err := json.Marshal(&event)
+				if err != nil {
+					log.Print(err)
+					return
+				}
+				// The id is set on the last event of a segment, so reconnecting resumes after whole segments
+				if i == len(segment.events)-1 {
+					fmt.Fprintf(c.Writer, "id: %s\n", segment.name)
+				}
+				fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+			}
+			cursor = segment.name
+		}
+		if len(segments) == limit {
+			c.Writer.Flush()
+			continue
+		}
+		// Comment lines keep the connection open through proxies
+		fmt.Fprint(c.Writer, ":\n\n")
+		c.Writer.Flush()
+
+		if !s.waitForChanges(c.Request.Context(), wake, changesPollInterval) {
+			return
+		}
+	}
+}
+
+// waitForChanges waits for changes logged by this instance (and their settle window), or until the next poll
+// of the change log for changes of other instances. Returns false if the client went away
+func (s *server) waitForChanges(ctx context.Context, wake <-chan struct{}, timeout time.Duration) bool {
+	if timeout > changesPollInterval {
+		timeout = changesPollInterval
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-wake:
+		// The segment was named before it was written, so it's readable once settled from now
+		settleTimer := time.NewTimer(s.changesSettle)
+		defer settleTimer.Stop()
+		select {
+		case <-settleTimer.C:
+		case <-ctx.Done():
+			return false
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
@@ -1,23 +1,32 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sort"
 	"strings"
 
+	"github.com/adrianchifor/Bigbucket/auth"
 	"github.com/adrianchifor/Bigbucket/store"
 	"github.com/adrianchifor/Bigbucket/utils"
 	"github.com/gin-gonic/gin"
 )
 
-func listColumns(c *gin.Context) {
+// columnsListPageSize is the page size of the listing for the first row of a table, past its state objects
+const columnsListPageSize = 3
+
+func (s *server) listColumns(c *gin.Context) {
 	params, err := parseRequiredRequestParams(c, "table")
 	if err != nil {
 		return
 	}
+	access, err := s.authorize(c, params["table"], auth.PermissionRead)
+	if err != nil {
+		return
+	}
 
-	tables, _, err := getTables()
+	tables, _, err := s.getTables(c.Request.Context())
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -32,7 +41,7 @@ func listColumns(c *gin.Context) {
 		return
 	}
 
-	columns, _, err := getColumns(params["table"])
+	columns, _, err := s.getColumns(c.Request.Context(), params["table"])
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -41,16 +50,26 @@ func listColumns(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{"table": params["table"], "columns": columns})
+	allowedColumns := []string{}
+	for _, column := range columns {
+		if access.ColumnAllowed(column) {
+			allowedColumns = append(allowedColumns, column)
+		}
+	}
+
+	c.JSON(200, gin.H{"table": params["table"], "columns": allowedColumns})
 }
 
-func deleteColumn(c *gin.Context) {
+func (s *server) deleteColumn(c *gin.Context) {
 	params, err := parseRequiredRequestParams(c, "table", "column")
 	if err != nil {
 		return
 	}
+	if _, err := s.authorizeColumns(c, params["table"], auth.PermissionDelete, params["column"]); err != nil {
+		return
+	}
 
-	tables, _, err := getTables()
+	tables, _, err := s.getTables(c.Request.Context())
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -65,7 +84,7 @@ func deleteColumn(c *gin.Context) {
 		return
 	}
 
-	columns, columnsToDelete, err := getColumns(params["table"])
+	columns, columnsToDelete, err := s.getColumns(c.Request.Context(), params["table"])
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -80,7 +99,7 @@ func deleteColumn(c *gin.Context) {
 		})
 	} else {
 		columnsToDelete = append(columnsToDelete, params["column"])
-		err = utils.WriteState(fmt.Sprintf("bigbucket/%s/.delete_columns", params["table"]), columnsToDelete)
+		err = utils.WriteState(c.Request.Context(), s.bucket, fmt.Sprintf("bigbucket/%s/.delete_columns", params["table"]), columnsToDelete)
 		if err != nil {
 			log.Print(err)
 			c.JSON(500, gin.H{
@@ -88,29 +107,26 @@ func deleteColumn(c *gin.Context) {
 			})
 			return
 		}
+		s.publishChanges(c.Request.Context(), params["table"],
+			changeEvent{Op: changeOpDeleteColumn, Columns: []string{params["column"]}})
 		c.JSON(200, gin.H{
 			"success": fmt.Sprintf("Column '%s' marked for deletion in table '%s'", params["column"], params["table"]),
 		})
 	}
 }
 
-func getColumns(table string) (columns []string, columnsToDelete []string, err error) {
+func (s *server) getColumns(ctx context.Context, table string) (columns []string, columnsToDelete []string, err error) {
 	columns = []string{}
-	objects, err := store.ListObjects(fmt.Sprintf("bigbucket/%s/", table), "", 2)
+	firstKey, err := s.firstRowKey(ctx, table)
 	if err != nil {
 		return nil, nil, err
 	}
-	if len(objects) < 2 {
+	if firstKey == "" {
 		return columns, nil, nil
 	}
-	indexDelete := utils.Search(objects, fmt.Sprintf("bigbucket/%s/.delete_columns", table))
-	if indexDelete > -1 {
-		objects = utils.RemoveIndex(objects, indexDelete)
-	}
 
-	firstKey := strings.Split(objects[0], "/")[2]
 	firstKeyPath := fmt.Sprintf("bigbucket/%s/%s/", table, firstKey)
-	objects, err = store.ListObjects(firstKeyPath, "", 0)
+	objects, err := s.bucket.ListObjects(ctx, firstKeyPath, "", 0, nil)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -123,7 +139,7 @@ func getColumns(table string) (columns []string, columnsToDelete []string, err e
 	}
 
 	// Remove columns marked for deletion from results
-	columnsToDelete = utils.GetState(fmt.Sprintf("bigbucket/%s/.delete_columns", table))
+	columnsToDelete = utils.GetState(ctx, s.bucket, fmt.Sprintf("bigbucket/%s/.delete_columns", table))
 	for _, columnToDelete := range columnsToDelete {
 		index := utils.Search(columns, columnToDelete)
 		if index > -1 {
@@ -134,3 +150,29 @@ func getColumns(table string) (columns []string, columnsToDelete []string, err e
 	sort.Strings(columns)
 	return columns, columnsToDelete, nil
 }
+
+// firstRowKey returns the first row key of a table, empty if it has no rows. Table state objects (e.g. .schema,
+// .delete_columns, .webhooks) can be listed before the first row, so the listing is paged past them
+func (s *server) firstRowKey(ctx context.Context, table string) (string, error) {
+	tablePath := fmt.Sprintf("bigbucket/%s/", table)
+	opts := &store.ListOptions{}
+	for {
+		objects, err := s.bucket.ListObjects(ctx, tablePath, "", columnsListPageSize, opts)
+		if err != nil {
+			return "", err
+		}
+		for _, object := range objects {
+			if object == opts.StartOffset {
+				continue
+			}
+			if objectSplit := strings.Split(object, "/"); len(objectSplit) > 3 && !strings.HasPrefix(objectSplit[2], ".") {
+				return objectSplit[2], nil
+			}
+		}
+		if len(objects) < columnsListPageSize {
+			return "", nil
+		}
+		// Start offsets are inclusive, so the last object is listed again and skipped
+		opts.StartOffset = objects[len(objects)-1]
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// columnFilter reports whether a column is included in read results
+type columnFilter func(column string) bool
+
+// authorize checks the caller has the permission on the table, responding with 403 if not. All columns are
+// allowed when policies are disabled
+func (s *server) authorize(c *gin.Context, table string, permission string) (*auth.Access, error) {
+	if s.policies == nil {
+		return auth.FullAccess, nil
+	}
+	principal := s.policies.Principal(c.Request, auth.GetIdentity(c))
+	access := s.policies.Authorize(principal, table, permission)
+	if access == nil {
+		c.JSON(403, gin.H{
+			"error": fmt.Sprintf("%s is not allowed to %s table '%s'", describePrincipal(principal), permission, table),
+		})
+		return nil, fmt.Errorf("Principal '%s' denied %s on table '%s'", principal, permission, table)
+	}
+	return access, nil
+}
+
+// authorizeColumns checks the caller has the permission on the table and all the columns, responding with 403 if not
+func (s *server) authorizeColumns(c *gin.Context, table string, permission string, columns ...string) (*auth.Access, error) {
+	access, err := s.authorize(c, table, permission)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range columns {
+		if !access.ColumnAllowed(column) {
+			principal := s.policies.Principal(c.Request, auth.GetIdentity(c))
+			c.JSON(403, gin.H{
+				"error": fmt.Sprintf("%s is not allowed to %s column '%s' in table '%s'",
+					describePrincipal(principal), permission, column, table),
+			})
+			return nil, fmt.Errorf("Principal '%s' denied %s on column '%s' in table '%s'", principal, permission, column, table)
+		}
+	}
+	return access, nil
+}
+
+// authorizeAllColumns checks the caller has the permission on the table without column limits, responding
+// with 403 if not. Needed by operations on whole rows or tables, which affect all columns
+func (s *server) authorizeAllColumns(c *gin.Context, table string, permission string) error {
+	access, err := s.authorize(c, table, permission)
+	if err != nil {
+		return err
+	}
+	if !access.AllColumns() {
+		principal := s.policies.Principal(c.Request, auth.GetIdentity(c))
+		c.JSON(403, gin.H{
+			"error": fmt.Sprintf("%s is only allowed to %s some columns in table '%s', this needs all columns",
+				describePrincipal(principal), permission, table),
+		})
+		return errors.New("Principal denied operation on all columns")
+	}
+	return nil
+}
+
+// allowedTables filters the tables the caller has any permission on
+func (s *server) allowedTables(c *gin.Context, tables []string) []string {
+	if s.policies == nil {
+		return tables
+	}
+	principal := s.policies.Principal(c.Request, auth.GetIdentity(c))
+	allowed := []string{}
+	for _, table := range tables {
+		if s.policies.AuthorizeAny(principal, table) {
+			allowed = append(allowed, table)
+		}
+	}
+	return allowed
+}
+
+// readableColumns filters the requested columns (all if empty) to the ones allowed by the access, so
+// other columns are redacted from read results
+func readableColumns(columns []string, access *auth.Access) columnFilter {
+	return func(column string) bool {
+		if len(columns) > 0 && utils.Search(columns, column) == -1 {
+			return false
+		}
+		return access.ColumnAllowed(column)
+	}
+}
+
+// cellColumns returns the columns of the cells to write
+func cellColumns(cells map[string]cellValue) []string {
+	columns := make([]string, 0, len(cells))
+	for column := range cells {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func describePrincipal(principal string) string {
+	if principal == "" {
+		return "Anonymous caller"
+	}
+	return fmt.Sprintf("Principal '%s'", principal)
+}
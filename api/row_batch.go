@@ -0,0 +1,338 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/utils"
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+)
+
+// batchWorkerCount is the max number of parallel bucket requests of a batch
+const batchWorkerCount = 100
+
+// cellResult is the per-cell result of a batch request
+type cellResult struct {
+	Generation string `json:"generation,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (s *server) setRows(c *gin.Context) {
+	params, err := parseRequiredRequestParams(c, "table")
+	if err != nil {
+		return
+	}
+	ttl, err := parseTTL(c)
+	if err != nil {
+		return
+	}
+
+	var jsonPayload map[string]map[string]json.RawMessage
+	if err := c.BindJSON(&jsonPayload); err != nil {
+		c.JSON(400, gin.H{
+			"error": "Could not parse JSON payload, needs to follow { rowKey string: { column string: value } }",
+		})
+		return
+	}
+	if len(jsonPayload) == 0 {
+		c.JSON(400, gin.H{
+			"error": "Nothing to set, JSON payload is empty. Needs to follow { rowKey string: { column string: value } }",
+		})
+		return
+	}
+
+	rows := make(map[string]map[string]cellValue)
+	cellsCount := 0
+	for rowKey, columns := range jsonPayload {
+		rowKey := strings.TrimSpace(rowKey)
+		if rowKey == "" || !isObjectNameValid(rowKey) {
+			c.JSON(400, gin.H{
+				"error": fmt.Sprintf("Row keys cannot be empty, start with '.' nor contain the following characters: %s", invalidChars),
+			})
+			return
+		}
+		if len(columns) == 0 {
+			c.JSON(400, gin.H{
+				"error": fmt.Sprintf("Nothing to set in row key '%s', its columns are empty", rowKey),
+			})
+			return
+		}
+		cleanedColumns, err := cleanColumns(c, columns)
+		if err != nil {
+			return
+		}
+		rows[rowKey] = cleanedColumns
+		cellsCount += len(cleanedColumns)
+	}
+
+	writtenColumns := []string{}
+	for _, columns := range rows {
+		writtenColumns = append(writtenColumns, cellColumns(columns)...)
+	}
+	if _, err := s.authorizeColumns(c, params["table"], auth.PermissionWrite, writtenColumns...); err != nil {
+		return
+	}
+
+	schema, err := s.readSchema(c.Request.Context(), params["table"])
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+
+	workerCount := cellsCount
+	if workerCount > batchWorkerCount {
+		workerCount = batchWorkerCount
+	}
+	batchJobPool := parallel.CustomJobPool(parallel.JobPoolConfig{
+		WorkerCount:  workerCount,
+		JobQueueSize: workerCount * 10,
+	})
+	defer batchJobPool.Close()
+
+	// Rows are checked in parallel, as required columns missing from their payload are checked in the bucket
+	violations := make(map[string][]string)
+	var violationsErr error
+	violationsMutex := &sync.Mutex{}
+	for rowKey, columns := range rows {
+		rowKey := rowKey
+		columns := columns
+		utils.AddJob(c.Request.Context(), batchJobPool, "stat", func(ctx context.Context) {
+			rowViolations, err := s.rowViolations(ctx, schema, params["table"], rowKey, columns)
+
+			violationsMutex.Lock()
+			defer violationsMutex.Unlock()
+
+			if err != nil {
+				violationsErr = err
+			} else if len(rowViolations) > 0 {
+				violations[rowKey] = rowViolations
+			}
+		})
+	}
+	if err := batchJobPool.Wait(); err != nil {
+		violationsErr = err
+	}
+	if violationsErr != nil {
+		log.Print(violationsErr)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if len(violations) > 0 {
+		c.JSON(400, gin.H{
+			"error":      fmt.Sprintf("%d rows do not match the schema of table '%s', nothing was set", len(violations), params["table"]),
+			"violations": violations,
+		})
+		return
+	}
+	expiresAt := cellExpiry(ttl, schema)
+
+	results := make(map[string]map[string]cellResult)
+	for rowKey := range rows {
+		results[rowKey] = make(map[string]cellResult)
+	}
+	writesFailed := 0
+	bucketRateLimit := false
+	resultsMutex := &sync.Mutex{}
+	objects := []string{}
+
+	for rowKey, columns := range rows {
+		rowKey := rowKey
+		for column, value := range columns {
+			column := column
+			value := value
+			object := fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], rowKey, column)
+			objects = append(objects, object)
+			utils.AddJob(c.Request.Context(), batchJobPool, "write", func(ctx context.Context) {
+				attrs, err := s.bucket.WriteObject(ctx, object, value.encode(), &store.WriteOptions{ExpiresAt: expiresAt})
+
+				resultsMutex.Lock()
+				defer resultsMutex.Unlock()
+
+				if err != nil {
+					log.Print(err)
+					writesFailed++
+					errorMsg := "Failed to persist, check server logs"
+					if errors.Is(err, store.ErrRateLimited) {
+						bucketRateLimit = true
+						errorMsg = "Failed to persist, bucket is rate limiting"
+					}
+					results[rowKey][column] = cellResult{Error: errorMsg}
+					return
+				}
+				results[rowKey][column] = cellResult{Generation: attrs.Generation}
+			})
+		}
+	}
+
+	err = batchJobPool.Wait()
+	s.invalidateCells(c.Request.Context(), objects...)
+	s.publishChanges(c.Request.Context(), params["table"], batchSetEvents(results)...)
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if writesFailed > 0 {
+		errorMsg := fmt.Sprintf("Check server logs, %d of %d columns failed to persist", writesFailed, cellsCount)
+		if bucketRateLimit {
+			errorMsg = fmt.Sprintf("Bucket is rate limiting, %d of %d columns failed to persist", writesFailed, cellsCount)
+		}
+		c.JSON(500, gin.H{
+			"error": errorMsg,
+			"rows":  results,
+		})
+		return
+	}
+
+	c.JSON(200, addExpiry(gin.H{
+		"success": fmt.Sprintf("Set %d rows in table '%s'", len(rows), params["table"]),
+		"rows":    results,
+	}, expiresAt))
+}
+
+// getRowsPayload is the JSON payload of batch reads
+type getRowsPayload struct {
+	Keys    []string `json:"keys"`
+	Columns []string `json:"columns"`
+}
+
+func (s *server) getRowsBatch(c *gin.Context) {
+	allowCORSForBrowsers(c)
+	params, err := parseRequiredRequestParams(c, "table")
+	if err != nil {
+		return
+	}
+
+	var jsonPayload getRowsPayload
+	if err := c.BindJSON(&jsonPayload); err != nil || len(jsonPayload.Keys) == 0 || len(jsonPayload.Columns) == 0 {
+		c.JSON(400, gin.H{
+			"error": "Could not parse JSON payload, needs to follow { \"keys\": [ string ], \"columns\": [ string ] }",
+		})
+		return
+	}
+	results := make(map[string]map[string]interface{})
+	for _, rowKey := range jsonPayload.Keys {
+		if !isBatchNameValid(c, rowKey) {
+			return
+		}
+		// Duplicate keys are only read once
+		results[rowKey] = make(map[string]interface{})
+	}
+	for _, column := range jsonPayload.Columns {
+		if !isBatchNameValid(c, column) {
+			return
+		}
+	}
+	access, err := s.authorize(c, params["table"], auth.PermissionRead)
+	if err != nil {
+		return
+	}
+	// Columns redacted by access policies are not read, so rows with only those columns are missing
+	allowedColumns := []string{}
+	for _, column := range jsonPayload.Columns {
+		if access.ColumnAllowed(column) {
+			allowedColumns = append(allowedColumns, column)
+		}
+	}
+
+	workerCount := len(results) * len(allowedColumns)
+	if workerCount > batchWorkerCount {
+		workerCount = batchWorkerCount
+	}
+	readsJobPool := parallel.CustomJobPool(parallel.JobPoolConfig{
+		WorkerCount:  workerCount,
+		JobQueueSize: workerCount * 10,
+	})
+	defer readsJobPool.Close()
+
+	readsFailed := 0
+	bucketRateLimit := false
+	resultsMutex := &sync.Mutex{}
+
+	for rowKey := range results {
+		rowKey := rowKey
+		for _, column := range allowedColumns {
+			column := column
+			utils.AddJob(c.Request.Context(), readsJobPool, "read", func(ctx context.Context) {
+				columnPath := fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], rowKey, column)
+				columnValue, err := s.readCellValue(ctx, columnPath)
+
+				resultsMutex.Lock()
+				defer resultsMutex.Unlock()
+
+				if errors.Is(err, store.ErrObjectNotExist) {
+					return
+				}
+				if err != nil {
+					log.Print(err, fmt.Sprintf(" (%s)", columnPath))
+					readsFailed++
+					if errors.Is(err, store.ErrRateLimited) {
+						bucketRateLimit = true
+					}
+					return
+				}
+				results[rowKey][column] = columnValue
+			})
+		}
+	}
+
+	err = readsJobPool.Wait()
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if readsFailed > 0 {
+		errorMsg := fmt.Sprintf("Check server logs, %d columns failed to be read", readsFailed)
+		if bucketRateLimit {
+			errorMsg = fmt.Sprintf("Bucket is rate limiting, %d columns failed to be read", readsFailed)
+		}
+		c.JSON(500, gin.H{
+			"error": errorMsg,
+		})
+		return
+	}
+
+	missingKeys := []string{}
+	for rowKey, columns := range results {
+		if len(columns) == 0 {
+			missingKeys = append(missingKeys, rowKey)
+			delete(results, rowKey)
+		}
+	}
+	sort.Strings(missingKeys)
+
+	c.JSON(200, gin.H{
+		"rows":        results,
+		"missingKeys": missingKeys,
+	})
+}
+
+// isBatchNameValid validates a row key or column of a batch payload, responding with 400 if invalid
+func isBatchNameValid(c *gin.Context, name string) bool {
+	if strings.TrimSpace(name) == "" || !isObjectNameValid(name) {
+		c.JSON(400, gin.H{
+			"error": fmt.Sprintf("Row keys and columns cannot be empty, start with '.' nor contain the following characters: %s", invalidChars),
+		})
+		return false
+	}
+	return true
+}
@@ -1,40 +1,54 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
 
+	"github.com/adrianchifor/Bigbucket/auth"
 	"github.com/adrianchifor/Bigbucket/store"
 	"github.com/adrianchifor/Bigbucket/utils"
 	"github.com/adrianchifor/go-parallel"
 	"github.com/gin-gonic/gin"
 )
 
-func deleteRows(c *gin.Context) {
+func (s *server) deleteRows(c *gin.Context) {
 	params, err := parseRequiredRequestParams(c, "table")
 	if err != nil {
 		return
 	}
+	if err := s.authorizeAllColumns(c, params["table"], auth.PermissionDelete); err != nil {
+		return
+	}
 	rowKey, rowPrefix, err := parseExclusiveRequestParams(c, "key", "prefix")
 	if err != nil {
 		return
 	}
-	if rowKey == "" && rowPrefix == "" {
+	keyRange, err := parseRowRange(c)
+	if err != nil {
+		return
+	}
+	if err := keyRange.rejectWithKey(c, rowKey); err != nil {
+		return
+	}
+	if rowKey == "" && rowPrefix == "" && !keyRange.isSet() {
 		c.JSON(400, gin.H{
-			"error": "Please provide one of 'key' or 'prefix' as a querystring parameter. " +
+			"error": "Please provide one of 'key', 'prefix' or a row range ('start', 'startAfter', 'end') " +
+				"as querystring parameters. " +
 				"To delete the table use DELETE /api/table?table=<table-name>",
 		})
 		return
 	}
 
 	keyPath := fmt.Sprintf("bigbucket/%s/%s/", params["table"], rowKey)
-	if rowPrefix != "" {
+	if rowPrefix != "" || rowKey == "" {
 		keyPath = fmt.Sprintf("bigbucket/%s/%s", params["table"], rowPrefix)
 	}
 
-	objects, err := store.ListObjects(keyPath, "", 0)
+	objects, _, err := s.scanRows(c.Request.Context(), params["table"], keyPath, "", keyRange, 0)
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -44,7 +58,9 @@ func deleteRows(c *gin.Context) {
 	}
 	if len(objects) == 0 {
 		errMsg := fmt.Sprintf("Row key '%s' not found in table '%s'", rowKey, params["table"])
-		if rowPrefix != "" {
+		if keyRange.isSet() {
+			errMsg = fmt.Sprintf("Rows in key range not found in table '%s'", params["table"])
+		} else if rowPrefix != "" {
 			errMsg = fmt.Sprintf("Rows with key prefix '%s' not found in table '%s'", rowPrefix, params["table"])
 		}
 		c.JSON(404, gin.H{
@@ -64,8 +80,8 @@ func deleteRows(c *gin.Context) {
 
 	for _, object := range objects {
 		object := object
-		deleteJobPool.AddJob(func() {
-			err := store.DeleteObject(object)
+		utils.AddJob(c.Request.Context(), deleteJobPool, "delete", func(ctx context.Context) {
+			err := s.bucket.DeleteObject(ctx, object)
 			if err != nil {
 				objectSplit := strings.Split(object, "/")
 				failedKey := objectSplit[2]
@@ -80,6 +96,8 @@ func deleteRows(c *gin.Context) {
 	}
 
 	err = deleteJobPool.Wait()
+	s.invalidateCells(c.Request.Context(), objects...)
+	s.publishChanges(c.Request.Context(), params["table"], deleteEvents(objects, deletesFailed)...)
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -92,7 +110,7 @@ func deleteRows(c *gin.Context) {
 		bucketRateLimit := false
 		for keyColumn, deleteErr := range deletesFailed {
 			log.Print(deleteErr)
-			if !bucketRateLimit && strings.Contains(deleteErr.Error(), "429") {
+			if !bucketRateLimit && errors.Is(deleteErr, store.ErrRateLimited) {
 				bucketRateLimit = true
 			}
 			keyColumnsFailed = append(keyColumnsFailed, keyColumn)
@@ -109,7 +127,7 @@ func deleteRows(c *gin.Context) {
 	}
 
 	successMsg := fmt.Sprintf("Row with key '%s' was deleted from table '%s'", rowKey, params["table"])
-	if rowPrefix != "" {
+	if rowKey == "" {
 		rowsFound := []string{}
 		for _, object := range objects {
 			objectKey := strings.Split(object, "/")[2]
@@ -117,7 +135,11 @@ func deleteRows(c *gin.Context) {
 				rowsFound = append(rowsFound, objectKey)
 			}
 		}
-		successMsg = fmt.Sprintf("%d rows with key prefix '%s' were deleted from table '%s'", len(rowsFound), rowPrefix, params["table"])
+		if keyRange.isSet() {
+			successMsg = fmt.Sprintf("%d rows in key range were deleted from table '%s'", len(rowsFound), params["table"])
+		} else {
+			successMsg = fmt.Sprintf("%d rows with key prefix '%s' were deleted from table '%s'", len(rowsFound), rowPrefix, params["table"])
+		}
 	}
 	c.JSON(200, gin.H{
 		"success": successMsg,
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+const incrementMaxAttempts = 20
+
+var (
+	errIncrementNotInteger = errors.New("cell value is not an integer")
+	errIncrementOverflow   = errors.New("cell value overflows int64")
+	errIncrementConflict   = errors.New("too many concurrent updates")
+)
+
+func (s *server) incrementCell(c *gin.Context) {
+	params, err := parseRequiredRequestParams(c, "table", "key", "column")
+	if err != nil {
+		return
+	}
+	if _, err := s.authorizeColumns(c, params["table"], auth.PermissionWrite, params["column"]); err != nil {
+		return
+	}
+	byMap, err := parseOptionalRequestParams(c, "by")
+	if err != nil {
+		return
+	}
+
+	by := int64(1)
+	if byMap["by"] != "" {
+		by, err = strconv.ParseInt(byMap["by"], 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "'by' parameter has to be a 64-bit integer"})
+			return
+		}
+	}
+
+	// Cell values are integers, so the column has to allow them. The incremented value is validated before it's written
+	schema, err := s.validateRow(c, params["table"], params["key"], map[string]cellValue{
+		params["column"]: {Type: cellTypeInt, Data: []byte("0")},
+	})
+	if err != nil {
+		return
+	}
+
+	columnPath := fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], params["key"], params["column"])
+	value, attrs, err := s.incrementObject(c.Request.Context(), columnPath, params["column"], by, schema)
+	var violations incrementViolations
+	if errors.As(err, &violations) {
+		c.JSON(400, gin.H{
+			"error": fmt.Sprintf("Incremented value of column '%s' in row key '%s' does not match the schema of table '%s'",
+				params["column"], params["key"], params["table"]),
+			"violations": violations,
+		})
+		return
+	}
+	if errors.Is(err, errIncrementNotInteger) || errors.Is(err, errIncrementOverflow) {
+		c.JSON(400, gin.H{
+			"error": fmt.Sprintf("Cannot increment column '%s' in row key '%s' of table '%s', %v",
+				params["column"], params["key"], params["table"], err),
+		})
+		return
+	}
+	if errors.Is(err, errIncrementConflict) {
+		c.JSON(409, gin.H{
+			"error": fmt.Sprintf("Column '%s' in row key '%s' of table '%s' is being updated concurrently, try again",
+				params["column"], params["key"], params["table"]),
+		})
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		errorMsg := "Internal error, check server logs"
+		if errors.Is(err, store.ErrRateLimited) {
+			errorMsg = "Bucket is rate limiting, column was not incremented"
+		}
+		c.JSON(500, gin.H{
+			"error": errorMsg,
+		})
+		return
+	}
+	s.publishChanges(c.Request.Context(), params["table"],
+		setEvent(params["key"], map[string]string{params["column"]: attrs.Generation}))
+
+	c.JSON(200, addExpiry(gin.H{
+		"table":      params["table"],
+		"key":        params["key"],
+		"column":     params["column"],
+		"value":      value,
+		"generation": attrs.Generation,
+	}, attrs.ExpiresAt))
+}
+
+// incrementViolations is returned by incrementObject with the schema violations of the incremented value
+type incrementViolations []string
+
+func (violations incrementViolations) Error() string {
+	return "incremented value does not match the table schema: " + strings.Join(violations, ", ")
+}
+
+// incrementObject adds 'by' to the integer value of an object (missing or expired objects start at 0),
+// in a read-modify-write loop with generation preconditions, retrying on concurrent updates. The object
+// is written as an integer cell if it matches the column of the table schema (can be nil), and keeps its
+// expiry time, new objects expire after the default TTL of the table schema
+func (s *server) incrementObject(ctx context.Context, object string, column string, by int64,
+	schema *tableSchema) (int64, *store.ObjectAttrs, error) {
+	for attempt := 0; attempt < incrementMaxAttempts; attempt++ {
+		if attempt > 0 {
+			// Backoff with jitter, so concurrent writers don't keep colliding
+			backoff := time.Duration(attempt*10+rand.Intn(20)) * time.Millisecond
+			select {
+			case <-ctx.Done():
+				return 0, nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		current := cellValue{Type: cellTypeInt, Data: []byte("0")}
+		generation := store.NoGeneration
+		expiresAt := cellExpiry(nil, schema)
+		data, attrs, err := s.bucket.ReadObject(ctx, object)
+		if err == nil {
+			// Expired objects are overwritten, so the precondition is still on their generation
+			generation = attrs.Generation
+			if !attrs.IsExpired() {
+				current = decodeCellValue(data)
+				expiresAt = attrs.ExpiresAt
+			}
+		} else if !errors.Is(err, store.ErrObjectNotExist) {
+			return 0, nil, err
+		}
+		if current.Type != cellTypeString && current.Type != cellTypeInt {
+			return 0, nil, errIncrementNotInteger
+		}
+		currentInt, err := strconv.ParseInt(strings.TrimSpace(string(current.Data)), 10, 64)
+		if err != nil {
+			return 0, nil, errIncrementNotInteger
+		}
+
+		if (by > 0 && currentInt > math.MaxInt64-by) || (by < 0 && currentInt < math.MinInt64-by) {
+			return 0, nil, errIncrementOverflow
+		}
+		value := currentInt + by
+
+		// Strings holding integers become integer cells, like the values validated by the schema
+		updated := cellValue{Type: cellTypeInt, Data: []byte(strconv.FormatInt(value, 10))}
+		if schema != nil {
+			if violations := schema.columnViolations(column, updated); len(violations) > 0 {
+				return 0, nil, incrementViolations(violations)
+			}
+		}
+		attrs, err = s.bucket.WriteObject(ctx, object, updated.encode(),
+			&store.WriteOptions{IfGenerationMatch: generation, ExpiresAt: expiresAt})
+		s.invalidateCells(ctx, object)
+		if errors.Is(err, store.ErrPreconditionFailed) {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return value, attrs, nil
+	}
+
+	return 0, nil, errIncrementConflict
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+// scanPageSize is the max number of objects listed per bucket request when scanning rows
+const scanPageSize = 1000
+
+// scanRows lists the objects under keyPath (or row key prefixes if delimiter is '/') of rows within
+// the key range. Stops after rowsLimit rows (0 for no limit), returning true if there are more rows after them
+func (s *server) scanRows(ctx context.Context, table string, keyPath string, delimiter string,
+	keyRange *rowRange, rowsLimit int) ([]string, bool, error) {
+	objects := []string{}
+	morePages, err := s.walkRows(ctx, table, keyPath, delimiter, keyRange, rowsLimit, func(object string) error {
+		objects = append(objects, object)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return objects, morePages, nil
+}
+
+// walkRows calls fn for each object listed by scanRows in lexicographic order, listing in pages
+// of scanPageSize so large tables don't hit the bucket request timeout. Stops if fn returns an error
+func (s *server) walkRows(ctx context.Context, table string, keyPath string, delimiter string,
+	keyRange *rowRange, rowsLimit int, fn func(object string) error) (bool, error) {
+	opts := keyRange.listOptions("bigbucket/" + table + "/")
+	if opts == nil {
+		opts = &store.ListOptions{}
+	}
+
+	rowsCount := 0
+	lastRowKey := ""
+	for {
+		page, err := s.bucket.ListObjects(ctx, keyPath, delimiter, scanPageSize, opts)
+		if err != nil {
+			return false, err
+		}
+
+		for _, object := range page {
+			if object == opts.StartOffset {
+				// Last object of the previous page, start offsets are inclusive
+				continue
+			}
+			objectSplit := strings.Split(object, "/")
+			if len(objectSplit) < 4 || !keyRange.contains(objectSplit[2]) {
+				// Skip table state objects (e.g. bigbucket/<table>/.delete_columns) and rows out of range
+				continue
+			}
+			if objectSplit[2] != lastRowKey {
+				if rowsLimit > 0 && rowsCount == rowsLimit {
+					return true, nil
+				}
+				rowsCount++
+				lastRowKey = objectSplit[2]
+			}
+			if err := fn(object); err != nil {
+				return false, err
+			}
+		}
+
+		if len(page) < scanPageSize {
+			return false, nil
+		}
+		opts = &store.ListOptions{StartOffset: page[len(page)-1], EndOffset: opts.EndOffset}
+	}
+}
+
+// parsePageToken sets the key range to start after the row key in the 'pageToken' querystring parameter,
+// returning true if it was set
+func parsePageToken(c *gin.Context, keyRange *rowRange) (bool, error) {
+	tokenMap, err := parseOptionalRequestParams(c, "pageToken")
+	if err != nil {
+		return false, err
+	}
+	if tokenMap["pageToken"] == "" {
+		return false, nil
+	}
+
+	rowKey, err := base64.RawURLEncoding.DecodeString(tokenMap["pageToken"])
+	if err != nil || len(rowKey) == 0 || !isObjectNameValid(string(rowKey)) {
+		c.JSON(400, gin.H{
+			"error": "'pageToken' parameter is invalid, use the 'nextPageToken' of the previous page",
+		})
+		return false, errors.New("Failed to parse 'pageToken' querystring parameter")
+	}
+	if keyRange.end != "" && string(rowKey) >= keyRange.end {
+		c.JSON(400, gin.H{
+			"error": "'pageToken' parameter is after 'end'",
+		})
+		return false, errors.New("Failed to validate 'pageToken' querystring parameter")
+	}
+
+	keyRange.start = ""
+	keyRange.startAfter = string(rowKey)
+	return true, nil
+}
+
+// nextPageToken returns the opaque token of the page after the row key (bigbucket/<table>/<key>/...)
+// of the last object
+func nextPageToken(objects []string) string {
+	if len(objects) == 0 {
+		return ""
+	}
+	return rowKeyPageToken(strings.Split(objects[len(objects)-1], "/")[2])
+}
+
+// rowKeyPageToken returns the opaque token of the page after the row key
+func rowKeyPageToken(rowKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(rowKey))
+}
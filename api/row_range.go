@@ -0,0 +1,96 @@
+package api
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+// rowRange is a range of row keys to scan, from the 'start'/'startAfter' and 'end' querystring parameters
+type rowRange struct {
+	start      string
+	startAfter string
+	end        string
+}
+
+func parseRowRange(c *gin.Context) (*rowRange, error) {
+	start, startAfter, err := parseExclusiveRequestParams(c, "start", "startAfter")
+	if err != nil {
+		return nil, err
+	}
+	endMap, err := parseOptionalRequestParams(c, "end")
+	if err != nil {
+		return nil, err
+	}
+
+	keyRange := &rowRange{start: start, startAfter: startAfter, end: endMap["end"]}
+	from := keyRange.start
+	if from == "" {
+		from = keyRange.startAfter
+	}
+	if from != "" && keyRange.end != "" && from >= keyRange.end {
+		c.JSON(400, gin.H{
+			"error": "'end' has to be after 'start'/'startAfter', it's exclusive",
+		})
+		return nil, errors.New("Failed to validate row range querystring parameters")
+	}
+
+	return keyRange, nil
+}
+
+func (r *rowRange) isSet() bool {
+	return r.start != "" || r.startAfter != "" || r.end != ""
+}
+
+// rejectWithKey responds with 400 if both a row key and a range are set
+func (r *rowRange) rejectWithKey(c *gin.Context, rowKey string) error {
+	if rowKey != "" && r.isSet() {
+		c.JSON(400, gin.H{
+			"error": "Please provide only one of 'key' or a row range ('start', 'startAfter', 'end') as querystring parameters",
+		})
+		return errors.New("Failed to parse 'key' and row range querystring parameters")
+	}
+	return nil
+}
+
+// contains returns true if the row key is within the range
+func (r *rowRange) contains(rowKey string) bool {
+	if r.start != "" && rowKey < r.start {
+		return false
+	}
+	if r.startAfter != "" && rowKey <= r.startAfter {
+		return false
+	}
+	if r.end != "" && rowKey >= r.end {
+		return false
+	}
+	return true
+}
+
+// listOptions returns the range of object names to list in the table path (bigbucket/<table>/).
+// Object names are '<row key>/<column>', so the offsets can include a few rows out of range,
+// which have to be filtered out with contains
+func (r *rowRange) listOptions(tablePath string) *store.ListOptions {
+	if !r.isSet() {
+		return nil
+	}
+
+	opts := &store.ListOptions{}
+	if r.start != "" {
+		opts.StartOffset = tablePath + r.start
+	} else if r.startAfter != "" {
+		opts.StartOffset = tablePath + r.startAfter
+	}
+	if r.end != "" {
+		// Row keys that are a prefix of 'end' sort after it as objects when the next char in 'end'
+		// sorts before '/' (e.g. 'key/' > 'key-1'), so end the listing before that char instead
+		end := r.end
+		if i := strings.IndexFunc(end, func(char rune) bool { return char < '/' }); i > -1 {
+			end = end[:i] + "0"
+		}
+		opts.EndOffset = tablePath + end
+	}
+	return opts
+}
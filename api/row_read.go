@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sort"
@@ -8,13 +10,14 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/adrianchifor/Bigbucket/auth"
 	"github.com/adrianchifor/Bigbucket/store"
 	"github.com/adrianchifor/Bigbucket/utils"
 	"github.com/adrianchifor/go-parallel"
 	"github.com/gin-gonic/gin"
 )
 
-func getRows(c *gin.Context) {
+func (s *server) getRows(c *gin.Context) {
 	allowCORSForBrowsers(c)
 	tableMap, err := parseRequiredRequestParams(c, "table")
 	if err != nil {
@@ -24,23 +27,90 @@ func getRows(c *gin.Context) {
 	if err != nil {
 		return
 	}
-	columnsCountMap, err := parseOptionalRequestParams(c, "columns", "limit")
+	keyRange, err := parseRowRange(c)
+	if err != nil {
+		return
+	}
+	paged, err := parsePageToken(c, keyRange)
+	if err != nil {
+		return
+	}
+	if err := keyRange.rejectWithKey(c, rowKey); err != nil {
+		return
+	}
+	columnsCountMap, err := parseOptionalRequestParams(c, "columns", "limit", "generations")
+	if err != nil {
+		return
+	}
+	version, versions, err := parseExclusiveRequestParams(c, "version", "versions")
 	if err != nil {
 		return
 	}
 	params := utils.MergeMaps(tableMap, columnsCountMap)
+	access, err := s.authorize(c, params["table"], auth.PermissionRead)
+	if err != nil {
+		return
+	}
 
 	columnsList := []string{}
 	if params["columns"] != "" {
 		columnsList = strings.Split(params["columns"], ",")
 	}
+	includeColumn := readableColumns(columnsList, access)
+
+	// When a specific cell version is requested
+	if version != "" {
+		if rowKey == "" || len(columnsList) != 1 {
+			c.JSON(400, gin.H{
+				"error": "Please provide 'key' and a single column in 'columns' when reading a specific 'version'",
+			})
+			return
+		}
+		if _, err := s.authorizeColumns(c, params["table"], auth.PermissionRead, columnsList[0]); err != nil {
+			return
+		}
+		s.getCellVersion(c, params["table"], rowKey, columnsList[0], version)
+		return
+	}
+
+	readCell := s.readCellValue
+	if versions != "" {
+		versionsInt, err := strconv.Atoi(versions)
+		if err != nil || versionsInt < 1 {
+			c.JSON(400, gin.H{"error": "'versions' parameter has to be an integer greater than 0"})
+			return
+		}
+		readCell = s.cellVersionsReader(versionsInt)
+	}
+	if params["generations"] != "" {
+		withGenerations, err := strconv.ParseBool(params["generations"])
+		if err != nil {
+			c.JSON(400, gin.H{"error": "'generations' parameter has to be a boolean"})
+			return
+		}
+		if withGenerations && versions != "" {
+			c.JSON(400, gin.H{
+				"error": "Please provide only one of 'versions' or 'generations' as a querystring parameter",
+			})
+			return
+		}
+		if withGenerations {
+			readCell = s.readCellGeneration
+		}
+	}
 
-	results := make(map[string]map[string]string)
+	results := make(map[string]map[string]interface{})
 
 	// When a specific key and columns are requested (no queries, direct fetches)
 	if rowKey != "" && len(columnsList) > 0 {
+		allowedColumns := []string{}
+		for _, column := range columnsList {
+			if includeColumn(column) {
+				allowedColumns = append(allowedColumns, column)
+			}
+		}
 		var err error
-		results[rowKey], err = getRowColumns(params["table"], rowKey, columnsList)
+		results[rowKey], err = s.getRowColumns(c.Request.Context(), params["table"], rowKey, allowedColumns, readCell)
 		if err != nil {
 			log.Print(err)
 			c.JSON(500, gin.H{
@@ -48,6 +118,10 @@ func getRows(c *gin.Context) {
 			})
 			return
 		}
+		if acceptsNDJSON(c) {
+			writeNDJSONRow(c, rowKey, results[rowKey])
+			return
+		}
 		c.JSON(200, results)
 		return
 	}
@@ -69,24 +143,48 @@ func getRows(c *gin.Context) {
 		keyPath = fmt.Sprintf("bigbucket/%s/%s", params["table"], rowPrefix)
 	}
 
-	objects, err := store.ListObjects(keyPath, "", 0)
-	if err != nil {
-		log.Print(err)
-		c.JSON(500, gin.H{
-			"error": "Internal error, check server logs",
-		})
-		return
-	}
-	if len(objects) == 0 {
+	notFound := func() {
+		if paged {
+			// Rows of the last page were deleted since
+			c.JSON(200, results)
+			return
+		}
 		errMsg := fmt.Sprintf("Table '%s' not found", params["table"])
 		if rowKey != "" {
 			errMsg = fmt.Sprintf("Row key '%s' not found in table '%s'", rowKey, params["table"])
+		} else if keyRange.isSet() {
+			errMsg = fmt.Sprintf("Rows in key range not found in table '%s'", params["table"])
 		} else if rowPrefix != "" {
 			errMsg = fmt.Sprintf("Rows with key prefix '%s' not found in table '%s'", rowPrefix, params["table"])
 		}
 		c.JSON(404, gin.H{
 			"error": errMsg,
 		})
+	}
+
+	if acceptsNDJSON(c) {
+		found, err := s.streamRows(c, params["table"], keyPath, keyRange, includeColumn, rowsLimitInt, readCell)
+		if err != nil {
+			log.Print(err)
+			c.JSON(500, gin.H{
+				"error": "Internal error, check server logs",
+			})
+		} else if !found {
+			notFound()
+		}
+		return
+	}
+
+	objects, morePages, err := s.scanRows(c.Request.Context(), params["table"], keyPath, "", keyRange, rowsLimitInt)
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if len(objects) == 0 {
+		notFound()
 		return
 	}
 
@@ -109,8 +207,8 @@ func getRows(c *gin.Context) {
 		objectSplit := strings.Split(object, "/")
 		objectKey := objectSplit[2]
 		objectColumn := objectSplit[3]
-		if len(columnsList) > 0 && utils.Search(columnsList, objectColumn) == -1 {
-			// Skip if current column is not in specified columns
+		if !includeColumn(objectColumn) {
+			// Skip if current column is not in specified columns, or redacted by access policies
 			continue
 		}
 
@@ -124,19 +222,19 @@ func getRows(c *gin.Context) {
 				}
 				rowsAdded++
 			}
-			results[objectKey] = make(map[string]string)
+			results[objectKey] = make(map[string]interface{})
 		}
 		resultsMutex.Unlock()
 
-		rowsJobPool.AddJob(func() {
-			columnValue, err := store.ReadObject(object)
+		utils.AddJob(c.Request.Context(), rowsJobPool, "read", func(ctx context.Context) {
+			columnValue, err := readCell(ctx, object)
 			if err != nil {
-				log.Print(err, fmt.Sprintf(" (%s)", object))
+				logReadError(err, object)
 				return
 			}
 			resultsMutex.Lock()
 			defer resultsMutex.Unlock()
-			results[objectKey][objectColumn] = string(columnValue)
+			results[objectKey][objectColumn] = columnValue
 		})
 	}
 
@@ -149,11 +247,27 @@ func getRows(c *gin.Context) {
 		return
 	}
 
+	for rowKey, columns := range results {
+		if len(columns) == 0 {
+			// All cells of the row expired or were deleted since listed
+			delete(results, rowKey)
+		}
+	}
+	if len(results) == 0 && !morePages {
+		notFound()
+		return
+	}
+
+	if morePages {
+		// Response body is keyed by row keys, so the token is returned as a header
+		c.Header("X-Next-Page-Token", nextPageToken(objects))
+	}
 	c.JSON(200, results)
 }
 
-func getRowColumns(table string, rowKey string, columns []string) (map[string]string, error) {
-	results := make(map[string]string)
+func (s *server) getRowColumns(ctx context.Context, table string, rowKey string, columns []string,
+	readCell cellReader) (map[string]interface{}, error) {
+	results := make(map[string]interface{})
 	resultsMutex := &sync.Mutex{}
 
 	columnsJobPool := parallel.CustomJobPool(parallel.JobPoolConfig{
@@ -164,16 +278,16 @@ func getRowColumns(table string, rowKey string, columns []string) (map[string]st
 
 	for _, column := range columns {
 		column := column
-		columnsJobPool.AddJob(func() {
+		utils.AddJob(ctx, columnsJobPool, "read", func(ctx context.Context) {
 			columnPath := fmt.Sprintf("bigbucket/%s/%s/%s", table, rowKey, column)
-			columnValue, err := store.ReadObject(columnPath)
+			columnValue, err := readCell(ctx, columnPath)
 			if err != nil {
-				log.Print(err, fmt.Sprintf(" (%s)", columnPath))
+				logReadError(err, columnPath)
 				return
 			}
 			resultsMutex.Lock()
 			defer resultsMutex.Unlock()
-			results[column] = string(columnValue)
+			results[column] = columnValue
 		})
 	}
 
@@ -185,8 +299,51 @@ func getRowColumns(table string, rowKey string, columns []string) (map[string]st
 	return results, nil
 }
 
-func getRowsCount(c *gin.Context) {
-	rows, table, err := listRowKeys(c)
+// logReadError logs errors of cell reads, other than cells not found as they expired or were deleted since listed
+func logReadError(err error, object string) {
+	if !errors.Is(err, store.ErrObjectNotExist) {
+		log.Print(err, fmt.Sprintf(" (%s)", object))
+	}
+}
+
+// cellReader reads a cell object into the value returned in responses
+type cellReader func(ctx context.Context, object string) (interface{}, error)
+
+// cellGeneration is the value of a cell with its generation, to be used in conditional writes
+type cellGeneration struct {
+	Value      cellValue `json:"value"`
+	Generation string    `json:"generation"`
+}
+
+// readLiveCell reads a cell object, expired cells are not found even if the cleaner didn't delete them yet
+func (s *server) readLiveCell(ctx context.Context, object string) ([]byte, *store.ObjectAttrs, error) {
+	data, attrs, err := s.readCellObject(ctx, object)
+	if err == nil && attrs.IsExpired() {
+		return nil, nil, store.ErrObjectNotExist
+	}
+	return data, attrs, err
+}
+
+// readCellValue reads the latest value of a cell
+func (s *server) readCellValue(ctx context.Context, object string) (interface{}, error) {
+	data, _, err := s.readLiveCell(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCellValue(data), nil
+}
+
+// readCellGeneration reads the latest value of a cell with its generation
+func (s *server) readCellGeneration(ctx context.Context, object string) (interface{}, error) {
+	data, attrs, err := s.readLiveCell(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	return cellGeneration{Value: decodeCellValue(data), Generation: attrs.Generation}, nil
+}
+
+func (s *server) getRowsCount(c *gin.Context) {
+	rows, table, _, err := s.listRowKeys(c, false)
 	if err != nil {
 		return
 	}
@@ -194,8 +351,8 @@ func getRowsCount(c *gin.Context) {
 	c.JSON(200, gin.H{"table": table, "rowsCount": strconv.Itoa(len(rows))})
 }
 
-func listRows(c *gin.Context) {
-	rows, table, err := listRowKeys(c)
+func (s *server) listRows(c *gin.Context) {
+	rows, table, pageToken, err := s.listRowKeys(c, true)
 	if err != nil {
 		return
 	}
@@ -207,33 +364,68 @@ func listRows(c *gin.Context) {
 	}
 	sort.Strings(rowKeys)
 
+	if pageToken != "" {
+		c.JSON(200, gin.H{"table": table, "rowKeys": rowKeys, "nextPageToken": pageToken})
+		return
+	}
 	c.JSON(200, gin.H{"table": table, "rowKeys": rowKeys})
 }
 
-func listRowKeys(c *gin.Context) ([]string, string, error) {
+// listRowKeys lists the row key prefixes (bigbucket/<table>/<key>/) of a table, if paginate is set
+// the 'limit' and 'pageToken' parameters are used and the token of the next page is returned
+func (s *server) listRowKeys(c *gin.Context, paginate bool) ([]string, string, string, error) {
 	tableMap, err := parseRequiredRequestParams(c, "table")
 	if err != nil {
-		return nil, "", err
+		return nil, "", "", err
 	}
 	prefixMap, err := parseOptionalRequestParams(c, "prefix")
 	if err != nil {
-		return nil, "", err
+		return nil, "", "", err
+	}
+	keyRange, err := parseRowRange(c)
+	if err != nil {
+		return nil, "", "", err
 	}
 	params := utils.MergeMaps(tableMap, prefixMap)
+	if _, err := s.authorize(c, params["table"], auth.PermissionRead); err != nil {
+		return nil, "", "", err
+	}
+
+	rowsLimitInt := 0
+	if paginate {
+		if _, err := parsePageToken(c, keyRange); err != nil {
+			return nil, "", "", err
+		}
+		limitMap, err := parseOptionalRequestParams(c, "limit")
+		if err != nil {
+			return nil, "", "", err
+		}
+		if limitMap["limit"] != "" {
+			rowsLimitInt, err = strconv.Atoi(limitMap["limit"])
+			if err != nil {
+				c.JSON(400, gin.H{"error": "'limit' parameter has to be an integer"})
+				return nil, "", "", err
+			}
+		}
+	}
 
 	keysPath := fmt.Sprintf("bigbucket/%s/", params["table"])
 	if params["prefix"] != "" {
 		keysPath = fmt.Sprintf("bigbucket/%s/%s", params["table"], params["prefix"])
 	}
 
-	rows, err := store.ListObjects(keysPath, "/", 0)
+	rows, morePages, err := s.scanRows(c.Request.Context(), params["table"], keysPath, "/", keyRange, rowsLimitInt)
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
 			"error": "Internal error, check server logs",
 		})
-		return nil, "", err
+		return nil, "", "", err
 	}
 
-	return rows, params["table"], nil
+	pageToken := ""
+	if morePages {
+		pageToken = nextPageToken(rows)
+	}
+	return rows, params["table"], pageToken, nil
 }
@@ -1,79 +1,156 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/adrianchifor/Bigbucket/auth"
 	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/utils"
 	"github.com/adrianchifor/go-parallel"
 	"github.com/gin-gonic/gin"
 )
 
-func setRow(c *gin.Context) {
+func (s *server) setRow(c *gin.Context) {
 	params, err := parseRequiredRequestParams(c, "table", "key")
 	if err != nil {
 		return
 	}
+	conditionsMap, err := parseOptionalRequestParams(c, "ifGenerations")
+	if err != nil {
+		return
+	}
+	conditions, err := parseGenerationConditions(conditionsMap["ifGenerations"])
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	ttl, err := parseTTL(c)
+	if err != nil {
+		return
+	}
 
-	var jsonPayload map[string]string
+	var jsonPayload map[string]json.RawMessage
 	if err := c.BindJSON(&jsonPayload); err != nil {
 		c.JSON(400, gin.H{
-			"error": "Could not parse JSON payload, needs to follow { column string: value string }",
+			"error": "Could not parse JSON payload, needs to follow { column string: value }",
 		})
 		return
 	}
 	if len(jsonPayload) == 0 {
 		c.JSON(400, gin.H{
-			"error": "Nothing to set, JSON payload is empty. Needs to follow { column string: value string }",
+			"error": "Nothing to set, JSON payload is empty. Needs to follow { column string: value }",
 		})
 		return
 	}
 
-	cleanedJsonPayload := make(map[string]string)
-	for column, value := range jsonPayload {
-		column := strings.TrimSpace(column)
-		if column == "" {
-			c.JSON(400, gin.H{
-				"error": "Columns cannot be empty",
-			})
-			return
-		}
-		if !isObjectNameValid(column) {
+	cleanedJsonPayload, err := cleanColumns(c, jsonPayload)
+	if err != nil {
+		return
+	}
+	for column := range conditions {
+		if _, exists := cleanedJsonPayload[column]; !exists {
 			c.JSON(400, gin.H{
-				"error": fmt.Sprintf("Columns cannot start with '.' nor contain the following characters: %s", invalidChars),
+				"error": fmt.Sprintf("Column '%s' in 'ifGenerations' is not in the JSON payload", column),
 			})
 			return
 		}
+	}
+	if _, err := s.authorizeColumns(c, params["table"], auth.PermissionWrite, cellColumns(cleanedJsonPayload)...); err != nil {
+		return
+	}
+	schema, err := s.validateRow(c, params["table"], params["key"], cleanedJsonPayload)
+	if err != nil {
+		return
+	}
+	expiresAt := cellExpiry(ttl, schema)
 
-		cleanedJsonPayload[column] = value
+	// Preconditions are checked before writing, so a conditional write with stale generations sets nothing
+	conflicts, err := s.checkGenerations(c.Request.Context(), params["table"], params["key"], conditions)
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if len(conflicts) > 0 {
+		c.JSON(412, gin.H{
+			"error":       fmt.Sprintf("Generation preconditions failed, no columns were set: %s", conflicts),
+			"conflicts":   conflicts,
+			"written":     []string{},
+			"generations": map[string]string{},
+		})
+		return
 	}
 
-	columnsJobPool := parallel.CustomJobPool(parallel.JobPoolConfig{
-		WorkerCount:  len(cleanedJsonPayload),
-		JobQueueSize: len(cleanedJsonPayload) * 10,
-	})
-	defer columnsJobPool.Close()
+	// Columns with preconditions are written first, so if one is changed concurrently after the check, the
+	// columns without preconditions are not written
+	conditionalColumns := map[string]cellValue{}
+	unconditionalColumns := map[string]cellValue{}
+	for column, value := range cleanedJsonPayload {
+		if _, exists := conditions[column]; exists {
+			conditionalColumns[column] = value
+		} else {
+			unconditionalColumns[column] = value
+		}
+	}
 
 	writesFailed := map[string]error{}
-	writesFailedMutex := &sync.Mutex{}
+	generations := map[string]string{}
+	writesMutex := &sync.Mutex{}
+	objects := []string{}
 
-	for column, value := range cleanedJsonPayload {
-		column := column
-		value := value
-		columnsJobPool.AddJob(func() {
-			err := store.WriteObject(fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], params["key"], column), []byte(value))
-			if err != nil {
-				writesFailedMutex.Lock()
-				defer writesFailedMutex.Unlock()
-
-				writesFailed[column] = err
-			}
+	writeColumns := func(columns map[string]cellValue) error {
+		if len(columns) == 0 {
+			return nil
+		}
+		columnsJobPool := parallel.CustomJobPool(parallel.JobPoolConfig{
+			WorkerCount:  len(columns),
+			JobQueueSize: len(columns) * 10,
 		})
+		defer columnsJobPool.Close()
+
+		for column, value := range columns {
+			column := column
+			value := value
+			object := fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], params["key"], column)
+			objects = append(objects, object)
+			utils.AddJob(c.Request.Context(), columnsJobPool, "write", func(ctx context.Context) {
+				opts := &store.WriteOptions{IfGenerationMatch: conditions[column], ExpiresAt: expiresAt}
+				attrs, err := s.bucket.WriteObject(ctx, object, value.encode(), opts)
+
+				writesMutex.Lock()
+				defer writesMutex.Unlock()
+
+				if errors.Is(err, store.ErrPreconditionFailed) {
+					conflicts = append(conflicts, column)
+				} else if err != nil {
+					writesFailed[column] = err
+				} else {
+					generations[column] = attrs.Generation
+				}
+			})
+		}
+		return columnsJobPool.Wait()
 	}
 
-	err = columnsJobPool.Wait()
+	err = writeColumns(conditionalColumns)
+	if err == nil && len(conflicts) == 0 {
+		err = writeColumns(unconditionalColumns)
+	}
+	s.invalidateCells(c.Request.Context(), objects...)
+	if len(generations) > 0 {
+		s.publishChanges(c.Request.Context(), params["table"], setEvent(params["key"], generations))
+	}
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -86,7 +163,7 @@ func setRow(c *gin.Context) {
 		bucketRateLimit := false
 		for column, writeErr := range writesFailed {
 			log.Print(writeErr)
-			if !bucketRateLimit && strings.Contains(writeErr.Error(), "429") {
+			if !bucketRateLimit && errors.Is(writeErr, store.ErrRateLimited) {
 				bucketRateLimit = true
 			}
 			columnsFailed = append(columnsFailed, column)
@@ -101,8 +178,126 @@ func setRow(c *gin.Context) {
 		})
 		return
 	}
+	if len(conflicts) > 0 {
+		// Changed concurrently between the check and the write, other columns with preconditions might be set
+		sort.Strings(conflicts)
+		written := []string{}
+		for column := range generations {
+			written = append(written, column)
+		}
+		sort.Strings(written)
+		c.JSON(412, gin.H{
+			"error": fmt.Sprintf("Generation preconditions failed, columns %s were changed concurrently, only "+
+				"columns %s were set", conflicts, written),
+			"conflicts":   conflicts,
+			"written":     written,
+			"generations": generations,
+		})
+		return
+	}
 
-	c.JSON(200, gin.H{
-		"success": fmt.Sprintf("Set row key '%s' in table '%s'", params["key"], params["table"]),
+	c.JSON(200, addExpiry(gin.H{
+		"success":     fmt.Sprintf("Set row key '%s' in table '%s'", params["key"], params["table"]),
+		"generations": generations,
+	}, expiresAt))
+}
+
+// checkGenerations returns the columns of a row whose current generation doesn't match their precondition
+func (s *server) checkGenerations(ctx context.Context, table string, key string,
+	conditions map[string]string) ([]string, error) {
+	conflicts := []string{}
+	if len(conditions) == 0 {
+		return conflicts, nil
+	}
+
+	statJobPool := parallel.CustomJobPool(parallel.JobPoolConfig{
+		WorkerCount:  len(conditions),
+		JobQueueSize: len(conditions) * 10,
 	})
+	defer statJobPool.Close()
+
+	var statErr error
+	statMutex := &sync.Mutex{}
+	for column, generation := range conditions {
+		column := column
+		generation := generation
+		object := fmt.Sprintf("bigbucket/%s/%s/%s", table, key, column)
+		utils.AddJob(ctx, statJobPool, "stat", func(ctx context.Context) {
+			currentGeneration := store.NoGeneration
+			attrs, err := s.bucket.StatObject(ctx, object)
+			if err == nil {
+				currentGeneration = attrs.Generation
+			}
+
+			statMutex.Lock()
+			defer statMutex.Unlock()
+
+			if err != nil && !errors.Is(err, store.ErrObjectNotExist) {
+				statErr = err
+			} else if currentGeneration != generation {
+				conflicts = append(conflicts, column)
+			}
+		})
+	}
+
+	if err := statJobPool.Wait(); err != nil {
+		return nil, err
+	}
+	if statErr != nil {
+		return nil, statErr
+	}
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
+
+// cleanColumns trims and validates the columns of a row payload and parses their typed values,
+// responding with 400 if invalid
+func cleanColumns(c *gin.Context, columns map[string]json.RawMessage) (map[string]cellValue, error) {
+	cleanedColumns := make(map[string]cellValue)
+	for column, value := range columns {
+		column := strings.TrimSpace(column)
+		if column == "" {
+			c.JSON(400, gin.H{
+				"error": "Columns cannot be empty",
+			})
+			return nil, errors.New("Empty column in JSON payload")
+		}
+		if !isObjectNameValid(column) {
+			c.JSON(400, gin.H{
+				"error": fmt.Sprintf("Columns cannot start with '.' nor contain the following characters: %s", invalidChars),
+			})
+			return nil, errors.New("Invalid column in JSON payload")
+		}
+
+		cell, err := parseCellValue(value)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": fmt.Sprintf("Value of column '%s' is invalid, %v", column, err),
+			})
+			return nil, err
+		}
+
+		cleanedColumns[column] = cell
+	}
+
+	return cleanedColumns, nil
+}
+
+// parseGenerationConditions parses 'column:generation' pairs separated by commas
+func parseGenerationConditions(param string) (map[string]string, error) {
+	conditions := make(map[string]string)
+	if param == "" {
+		return conditions, nil
+	}
+
+	for _, condition := range strings.Split(param, ",") {
+		column, generation, found := strings.Cut(strings.TrimSpace(condition), ":")
+		if !found || column == "" || generation == "" {
+			return nil, errors.New("'ifGenerations' parameter has to follow 'column:generation,column:generation', " +
+				"use generation 0 for columns that must not exist")
+		}
+		conditions[column] = generation
+	}
+
+	return conditions, nil
 }
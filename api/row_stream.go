@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/adrianchifor/Bigbucket/utils"
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	// streamWindow is the max number of rows read ahead of the one being streamed, bounding memory
+	streamWindow = 64
+)
+
+// streamedRow is a line of NDJSON responses, its columns are read in parallel by the job pool
+type streamedRow struct {
+	Key     string                 `json:"key"`
+	Columns map[string]interface{} `json:"columns"`
+	mutex   sync.Mutex
+	reads   sync.WaitGroup
+}
+
+// acceptsNDJSON returns true if the client asked for a streamed response, one JSON row per line
+func acceptsNDJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), ndjsonContentType)
+}
+
+// writeNDJSONRow writes a single row as NDJSON response
+func writeNDJSONRow(c *gin.Context, rowKey string, columns map[string]interface{}) {
+	c.Header("Content-Type", ndjsonContentType)
+	c.Status(200)
+	if err := json.NewEncoder(c.Writer).Encode(&streamedRow{Key: rowKey, Columns: columns}); err != nil {
+		log.Print(err)
+	}
+}
+
+// streamRows streams the rows within keyPath and the key range as NDJSON, in key order. Columns are read
+// in parallel for up to streamWindow rows ahead, the scan waits for slow clients before reading more rows.
+// Returns false if no rows were found, or an error if the scan failed before anything was streamed
+func (s *server) streamRows(c *gin.Context, table string, keyPath string, keyRange *rowRange, includeColumn columnFilter,
+	rowsLimit int, readCell cellReader) (bool, error) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	rows := make(chan *streamedRow, streamWindow)
+	var scanErr error
+	var morePages bool
+
+	go func() {
+		defer close(rows)
+
+		readsJobPool := parallel.MediumJobPool()
+		defer readsJobPool.Close()
+
+		var row *streamedRow
+		morePages, scanErr = s.walkRows(ctx, table, keyPath, "", keyRange, rowsLimit, func(object string) error {
+			objectSplit := strings.Split(object, "/")
+			if strings.HasSuffix(object, "/") || len(objectSplit) < 4 {
+				// Skip if object is not column
+				return nil
+			}
+			objectKey := objectSplit[2]
+			objectColumn := objectSplit[3]
+			if !includeColumn(objectColumn) {
+				// Skip if current column is not in specified columns, or redacted by access policies
+				return nil
+			}
+
+			if row == nil || row.Key != objectKey {
+				if row != nil {
+					row.reads.Done()
+				}
+				// Held until all columns of the row are added
+				row = &streamedRow{Key: objectKey, Columns: make(map[string]interface{})}
+				row.reads.Add(1)
+				select {
+				case rows <- row:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			currentRow := row
+			currentRow.reads.Add(1)
+			utils.AddJob(ctx, readsJobPool, "read", func(ctx context.Context) {
+				defer currentRow.reads.Done()
+				columnValue, err := readCell(ctx, object)
+				if err != nil {
+					logReadError(err, object)
+					return
+				}
+				currentRow.mutex.Lock()
+				defer currentRow.mutex.Unlock()
+				currentRow.Columns[objectColumn] = columnValue
+			})
+			return nil
+		})
+		if row != nil {
+			row.reads.Done()
+		}
+	}()
+
+	// Wait for the first row, so errors and empty results can still be returned with a status code
+	firstRow, ok := <-rows
+	if !ok {
+		return false, scanErr
+	}
+
+	c.Header("Content-Type", ndjsonContentType)
+	c.Status(200)
+	encoder := json.NewEncoder(c.Writer)
+	lastRowKey := ""
+	var writeErr error
+	for row := firstRow; row != nil; row = <-rows {
+		row.reads.Wait()
+		if writeErr != nil {
+			// Client is gone, drain the rows so the scan can stop
+			continue
+		}
+		if len(row.Columns) == 0 {
+			// All cells of the row expired or were deleted since listed
+			lastRowKey = row.Key
+			continue
+		}
+		if writeErr = encoder.Encode(row); writeErr != nil {
+			log.Print(writeErr)
+			cancel()
+			continue
+		}
+		c.Writer.Flush()
+		lastRowKey = row.Key
+	}
+	if writeErr != nil {
+		return true, nil
+	}
+
+	// Headers are already sent, so scan errors and the next page token are returned as the last line
+	if scanErr != nil {
+		log.Print(scanErr)
+		encoder.Encode(gin.H{"error": "Internal error, check server logs"})
+	} else if morePages {
+		encoder.Encode(gin.H{"nextPageToken": rowKeyPageToken(lastRowKey)})
+	}
+	return true, nil
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+// cellVersion is the value of a cell at a specific version
+type cellVersion struct {
+	Version string    `json:"version"`
+	Updated time.Time `json:"updated"`
+	Value   cellValue `json:"value"`
+}
+
+// cellVersionInfo describes a cell version, without its value
+type cellVersionInfo struct {
+	Version string    `json:"version"`
+	Updated time.Time `json:"updated"`
+	Size    int64     `json:"size"`
+}
+
+func (s *server) listCellVersions(c *gin.Context) {
+	allowCORSForBrowsers(c)
+	params, err := parseRequiredRequestParams(c, "table", "key", "column")
+	if err != nil {
+		return
+	}
+	if _, err := s.authorizeColumns(c, params["table"], auth.PermissionRead, params["column"]); err != nil {
+		return
+	}
+
+	columnPath := fmt.Sprintf("bigbucket/%s/%s/%s", params["table"], params["key"], params["column"])
+	versions, err := s.bucket.ListObjectVersions(c.Request.Context(), columnPath)
+	if errors.Is(err, store.ErrObjectNotExist) {
+		c.JSON(404, gin.H{
+			"error": fmt.Sprintf("Column '%s' not found in row key '%s' of table '%s'", params["column"], params["key"], params["table"]),
+		})
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+
+	versionInfos := make([]cellVersionInfo, len(versions))
+	for i, version := range versions {
+		versionInfos[i] = cellVersionInfo{Version: version.Version, Updated: version.Updated, Size: version.Size}
+	}
+
+	c.JSON(200, gin.H{
+		"table":    params["table"],
+		"key":      params["key"],
+		"column":   params["column"],
+		"versions": versionInfos,
+	})
+}
+
+func (s *server) getCellVersion(c *gin.Context, table string, rowKey string, column string, version string) {
+	columnPath := fmt.Sprintf("bigbucket/%s/%s/%s", table, rowKey, column)
+	columnValue, err := s.bucket.ReadObjectVersion(c.Request.Context(), columnPath, version)
+	if errors.Is(err, store.ErrObjectNotExist) {
+		c.JSON(404, gin.H{
+			"error": fmt.Sprintf("Version '%s' of column '%s' not found in row key '%s' of table '%s'", version, column, rowKey, table),
+		})
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+
+	c.JSON(200, map[string]map[string]cellValue{
+		rowKey: {column: decodeCellValue(columnValue)},
+	})
+}
+
+// cellVersionsReader returns a cellReader of the latest versions of a cell (up to maxVersions), newest first
+func (s *server) cellVersionsReader(maxVersions int) cellReader {
+	return func(ctx context.Context, object string) (interface{}, error) {
+		versions, err := s.bucket.ListObjectVersions(ctx, object)
+		if err != nil {
+			return nil, err
+		}
+		if versions[0].IsExpired() {
+			// Previous versions of expired cells are only kept by the bucket versioning
+			return nil, store.ErrObjectNotExist
+		}
+		if len(versions) > maxVersions {
+			versions = versions[:maxVersions]
+		}
+
+		cellVersions := make([]cellVersion, len(versions))
+		for i, version := range versions {
+			data, err := s.bucket.ReadObjectVersion(ctx, object, version.Version)
+			if err != nil {
+				return nil, err
+			}
+			cellVersions[i] = cellVersion{Version: version.Version, Updated: version.Updated, Value: decodeCellValue(data)}
+		}
+
+		return cellVersions, nil
+	}
+}
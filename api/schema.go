@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	schemaModeFlexible = "flexible"
+	schemaModeStrict   = "strict"
+)
+
+// columnTypes validate cell values of columns with a type in the table schema. String values are also
+// accepted if they can be parsed as the type, as clients might stringify them. Columns without a type
+// accept any value
+var columnTypes = map[string]func(value cellValue) bool{
+	cellTypeString: func(value cellValue) bool { return value.Type == cellTypeString },
+	cellTypeInt: func(value cellValue) bool {
+		if value.Type != cellTypeString {
+			return value.Type == cellTypeInt
+		}
+		_, err := strconv.ParseInt(string(value.Data), 10, 64)
+		return err == nil
+	},
+	cellTypeFloat: func(value cellValue) bool {
+		if value.Type != cellTypeString {
+			return value.Type == cellTypeInt || value.Type == cellTypeFloat
+		}
+		_, err := strconv.ParseFloat(string(value.Data), 64)
+		return err == nil
+	},
+	cellTypeBool: func(value cellValue) bool {
+		if value.Type != cellTypeString {
+			return value.Type == cellTypeBool
+		}
+		_, err := strconv.ParseBool(string(value.Data))
+		return err == nil
+	},
+	cellTypeJSON: func(value cellValue) bool {
+		if value.Type != cellTypeString {
+			return value.Type != cellTypeBytes
+		}
+		return json.Valid(value.Data)
+	},
+	cellTypeBytes: func(value cellValue) bool { return value.Type == cellTypeBytes },
+}
+
+// tableSchema is enforced on writes to a table, stored as JSON in bigbucket/<table>/.schema
+type tableSchema struct {
+	// Mode is 'flexible' (default) to allow columns not in the schema, or 'strict' to reject them
+	Mode    string                  `json:"mode"`
+	Columns map[string]columnSchema `json:"columns"`
+	// TTL is the default time to live of cells written to the table (e.g. 24h), unless set on writes
+	TTL string `json:"ttl,omitempty"`
+}
+
+type columnSchema struct {
+	// Required columns have to be in the payload of writes, unless they're already set in the row
+	Required bool `json:"required,omitempty"`
+	// Type of the cell values, one of string, int, float, bool, json or bytes. Empty for any type
+	Type string `json:"type,omitempty"`
+	// MaxSize of the cell values in bytes, 0 for no limit
+	MaxSize int `json:"maxSize,omitempty"`
+}
+
+func schemaObject(table string) string {
+	return fmt.Sprintf("bigbucket/%s/.schema", table)
+}
+
+func (s *server) setSchema(c *gin.Context) {
+	params, err := parseRequiredRequestParams(c, "table")
+	if err != nil {
+		return
+	}
+	if err := s.authorizeAllColumns(c, params["table"], auth.PermissionAdmin); err != nil {
+		return
+	}
+
+	var schema tableSchema
+	if err := c.BindJSON(&schema); err != nil {
+		c.JSON(400, gin.H{
+			"error": "Could not parse JSON payload, needs to follow { mode string, columns: { column string: " +
+				"{ required bool, type string, maxSize int } }, ttl string }",
+		})
+		return
+	}
+	if err := schema.validate(); err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if _, err := s.bucket.WriteObject(c.Request.Context(), schemaObject(params["table"]), data, nil); err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"success": fmt.Sprintf("Schema set for table '%s'", params["table"]),
+	})
+}
+
+func (s *server) getSchema(c *gin.Context) {
+	allowCORSForBrowsers(c)
+	params, err := parseRequiredRequestParams(c, "table")
+	if err != nil {
+		return
+	}
+	if _, err := s.authorize(c, params["table"], auth.PermissionRead); err != nil {
+		return
+	}
+
+	schema, err := s.readSchema(c.Request.Context(), params["table"])
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if schema == nil {
+		c.JSON(404, gin.H{
+			"error": fmt.Sprintf("Schema not found for table '%s'", params["table"]),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{"table": params["table"], "schema": schema})
+}
+
+// readSchema reads the schema of a table, nil if the table has none
+func (s *server) readSchema(ctx context.Context, table string) (*tableSchema, error) {
+	data, _, err := s.bucket.ReadObject(ctx, schemaObject(table))
+	if errors.Is(err, store.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var schema tableSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("Failed to parse schema of table '%s': %v", table, err)
+	}
+	return &schema, nil
+}
+
+func (schema *tableSchema) validate() error {
+	if schema.Mode == "" {
+		schema.Mode = schemaModeFlexible
+	}
+	if schema.Mode != schemaModeFlexible && schema.Mode != schemaModeStrict {
+		return fmt.Errorf("Schema mode has to be '%s' or '%s'", schemaModeFlexible, schemaModeStrict)
+	}
+	if schema.Mode == schemaModeStrict && len(schema.Columns) == 0 {
+		return errors.New("Schema in strict mode needs at least one column")
+	}
+
+	if schema.TTL != "" {
+		if ttl, err := time.ParseDuration(schema.TTL); err != nil || ttl <= 0 {
+			return errors.New("Schema ttl has to be a positive duration (e.g. 30s, 15m, 24h)")
+		}
+	}
+
+	for column, columnSchema := range schema.Columns {
+		if column == "" || !isObjectNameValid(column) {
+			return fmt.Errorf("Schema columns cannot be empty, start with '.' nor contain the following characters: %s", invalidChars)
+		}
+		if _, exists := columnTypes[columnSchema.Type]; columnSchema.Type != "" && !exists {
+			return fmt.Errorf("Type of column '%s' has to be one of string, int, float, bool, json or bytes", column)
+		}
+		if columnSchema.MaxSize < 0 {
+			return fmt.Errorf("Max size of column '%s' cannot be negative", column)
+		}
+	}
+
+	return nil
+}
+
+// defaultTTL returns the default time to live of cells written to the table, 0 if they don't expire
+func (schema *tableSchema) defaultTTL() time.Duration {
+	ttl, _ := time.ParseDuration(schema.TTL)
+	return ttl
+}
+
+// columnViolations returns the schema violations of a value written to a column
+func (schema *tableSchema) columnViolations(column string, value cellValue) []string {
+	violations := []string{}
+	columnSchema, exists := schema.Columns[column]
+	if !exists {
+		if schema.Mode == schemaModeStrict {
+			violations = append(violations, fmt.Sprintf("Column '%s' is not in the schema", column))
+		}
+		return violations
+	}
+	if validType, exists := columnTypes[columnSchema.Type]; exists && !validType(value) {
+		violations = append(violations, fmt.Sprintf("Column '%s' value is not of type %s", column, columnSchema.Type))
+	}
+	if columnSchema.MaxSize > 0 && len(value.Data) > columnSchema.MaxSize {
+		violations = append(violations, fmt.Sprintf("Column '%s' value is over the max size of %d bytes",
+			column, columnSchema.MaxSize))
+	}
+	return violations
+}
+
+// rowViolations returns the schema violations of the columns written to a row, in column order.
+// Required columns missing from the payload are checked in the bucket, in case they're already set
+func (s *server) rowViolations(ctx context.Context, schema *tableSchema, table string, rowKey string,
+	columns map[string]cellValue) ([]string, error) {
+	violations := []string{}
+	if schema == nil {
+		return violations, nil
+	}
+
+	for column, value := range columns {
+		violations = append(violations, schema.columnViolations(column, value)...)
+	}
+
+	for column, columnSchema := range schema.Columns {
+		if _, exists := columns[column]; exists || !columnSchema.Required {
+			continue
+		}
+		attrs, err := s.bucket.StatObject(ctx, fmt.Sprintf("bigbucket/%s/%s/%s", table, rowKey, column))
+		if errors.Is(err, store.ErrObjectNotExist) || (err == nil && attrs.IsExpired()) {
+			violations = append(violations, fmt.Sprintf("Column '%s' is required", column))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(violations)
+	return violations, nil
+}
+
+// validateRow responds with 400 and the violations if the columns written to a row don't match the table schema.
+// Returns the table schema, nil if the table has none
+func (s *server) validateRow(c *gin.Context, table string, rowKey string,
+	columns map[string]cellValue) (*tableSchema, error) {
+	schema, err := s.readSchema(c.Request.Context(), table)
+	if err == nil {
+		var violations []string
+		violations, err = s.rowViolations(c.Request.Context(), schema, table, rowKey, columns)
+		if err == nil && len(violations) > 0 {
+			c.JSON(400, gin.H{
+				"error":      fmt.Sprintf("Row key '%s' does not match the schema of table '%s'", rowKey, table),
+				"violations": violations,
+			})
+			return nil, errors.New("Row does not match table schema")
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return nil, err
+	}
+	return schema, nil
+}
@@ -1,31 +1,125 @@
 package api
 
 import (
+	"crypto/tls"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/cache"
+	"github.com/adrianchifor/Bigbucket/metrics"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/tracing"
 	"github.com/adrianchifor/Bigbucket/utils"
+	"github.com/adrianchifor/Bigbucket/webhook"
 	"github.com/gin-gonic/gin"
 )
 
-// RunServer runs the HTTP server+router for API
-func RunServer(port int) {
+// Options holds the optional features of the API router
+type Options struct {
+	// Authenticator checks the credentials of API requests, nil to allow all requests
+	Authenticator *auth.Authenticator
+	// Policies authorize callers on tables and columns, nil to allow all callers everything
+	Policies *auth.Policies
+	// Cache caches cell reads, invalidated by the writes and deletes of this server, nil to always read the bucket
+	Cache *cache.LRU
+	// Peers share the cache between API replicas, each caching the cells it owns. Needs Cache, nil to not share it
+	Peers *cache.Peers
+	// ChangeLog records the mutations of tables in the bucket, served by GET /api/changes
+	ChangeLog bool
+	// ChangeLogSettle holds back change log segments from readers until they're that old, so segments written
+	// slowly or by instances with clocks behind aren't skipped by cursors already past them
+	ChangeLogSettle time.Duration
+	// Webhooks delivers the mutations of tables to the webhooks set on them, nil to disable webhooks
+	Webhooks *webhook.Dispatcher
+	// TLSConfig serves HTTPS (and verifies client certificates if set up) when running the server, nil for HTTP
+	TLSConfig *tls.Config
+}
+
+// server holds the dependencies shared by the API handlers
+type server struct {
+	bucket   store.Backend
+	policies *auth.Policies
+	cache    *cache.LRU
+	peers    *cache.Peers
+	// changes wakes up the watchers of the change log, nil if it's disabled
+	changes       *changeNotifier
+	changesSettle time.Duration
+	webhooks      *webhook.Dispatcher
+}
+
+// NewRouter creates the router for API, with handlers using the given bucket backend. Options can be nil
+func NewRouter(bucket store.Backend, opts *Options) *gin.Engine {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s := &server{bucket: bucket, policies: opts.Policies, cache: opts.Cache, peers: opts.Peers, webhooks: opts.Webhooks}
+	if opts.ChangeLog {
+		s.changes = newChangeNotifier()
+		s.changesSettle = opts.ChangeLogSettle
+	}
 	router := gin.Default()
+	router.Use(metrics.Middleware("api"), tracing.Middleware("api"))
 
 	apiRoute := router.Group("/api")
+	if opts.Authenticator != nil {
+		apiRoute.Use(opts.Authenticator.Middleware())
+	}
 	{
-		apiRoute.GET("/table", listTables)
-		apiRoute.DELETE("/table", deleteTable)
+		apiRoute.GET("/identity", getIdentity)
+
+		apiRoute.GET("/table", s.listTables)
+		apiRoute.PUT("/table", s.setSchema)
+		apiRoute.GET("/table/schema", s.getSchema)
+		apiRoute.PUT("/table/webhooks", s.setWebhooks)
+		apiRoute.GET("/table/webhooks", s.getWebhooks)
+		apiRoute.DELETE("/table", s.deleteTable)
 
-		apiRoute.GET("/column", listColumns)
-		apiRoute.DELETE("/column", deleteColumn)
+		apiRoute.GET("/column", s.listColumns)
+		apiRoute.DELETE("/column", s.deleteColumn)
 
-		apiRoute.GET("/row", getRows)
-		apiRoute.GET("/row/count", getRowsCount)
-		apiRoute.GET("/row/list", listRows)
-		apiRoute.POST("/row", setRow)
-		apiRoute.DELETE("/row", deleteRows)
+		apiRoute.GET("/row", s.getRows)
+		apiRoute.GET("/row/count", s.getRowsCount)
+		apiRoute.GET("/row/list", s.listRows)
+		apiRoute.GET("/row/versions", s.listCellVersions)
+		apiRoute.POST("/row", s.setRow)
+		apiRoute.POST("/row/increment", s.incrementCell)
+		apiRoute.POST("/rows", s.setRows)
+		apiRoute.POST("/rows/get", s.getRowsBatch)
+		apiRoute.DELETE("/row", s.deleteRows)
+
+		apiRoute.GET("/cell", s.getCell)
+		apiRoute.PUT("/cell", s.putCell)
+
+		apiRoute.GET("/changes", s.getChanges)
 	}
 	router.GET("/health", func(c *gin.Context) {
 		c.String(200, "UP")
 	})
+	router.GET("/metrics", metrics.Handler())
+	if s.cache != nil && s.peers != nil {
+		router.GET(cache.PeerCellPath, s.getPeerCell)
+		router.POST(cache.PeerInvalidatePath, s.invalidatePeerCells)
+	}
+
+	return router
+}
 
-	utils.RunServer(port, router)
+// getIdentity returns the authenticated caller, to check which identity the API sees for an API key or token
+func getIdentity(c *gin.Context) {
+	identity := auth.GetIdentity(c)
+	if identity == nil {
+		c.JSON(404, gin.H{
+			"error": "Authentication is disabled, run with --auth-config to enable it",
+		})
+		return
+	}
+	c.JSON(200, identity)
+}
+
+// RunServer runs the HTTP (or HTTPS) server+router for API
+func RunServer(port int, bucket store.Backend, opts *Options) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	utils.RunTLSServer(port, NewRouter(bucket, opts), opts.TLSConfig)
 }
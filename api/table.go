@@ -1,17 +1,18 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sort"
 
-	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/auth"
 	"github.com/adrianchifor/Bigbucket/utils"
 	"github.com/gin-gonic/gin"
 )
 
-func listTables(c *gin.Context) {
-	tables, _, err := getTables()
+func (s *server) listTables(c *gin.Context) {
+	tables, _, err := s.getTables(c.Request.Context())
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -20,16 +21,19 @@ func listTables(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{"tables": tables})
+	c.JSON(200, gin.H{"tables": s.allowedTables(c, tables)})
 }
 
-func deleteTable(c *gin.Context) {
+func (s *server) deleteTable(c *gin.Context) {
 	params, err := parseRequiredRequestParams(c, "table")
 	if err != nil {
 		return
 	}
+	if err := s.authorizeAllColumns(c, params["table"], auth.PermissionAdmin); err != nil {
+		return
+	}
 
-	tables, tablesToDelete, err := getTables()
+	tables, tablesToDelete, err := s.getTables(c.Request.Context())
 	if err != nil {
 		log.Print(err)
 		c.JSON(500, gin.H{
@@ -44,7 +48,7 @@ func deleteTable(c *gin.Context) {
 		})
 	} else {
 		tablesToDelete = append(tablesToDelete, params["table"])
-		err = utils.WriteState("bigbucket/.delete_tables", tablesToDelete)
+		err = utils.WriteState(c.Request.Context(), s.bucket, "bigbucket/.delete_tables", tablesToDelete)
 		if err != nil {
 			log.Print(err)
 			c.JSON(500, gin.H{
@@ -52,21 +56,22 @@ func deleteTable(c *gin.Context) {
 			})
 			return
 		}
+		s.publishChanges(c.Request.Context(), params["table"], changeEvent{Op: changeOpDeleteTable})
 		c.JSON(200, gin.H{
 			"success": fmt.Sprintf("Table '%s' marked for deletion", params["table"]),
 		})
 	}
 }
 
-func getTables() (tables []string, tablesToDelete []string, err error) {
-	objects, err := store.ListObjects("bigbucket/", "/", 0)
+func (s *server) getTables(ctx context.Context) (tables []string, tablesToDelete []string, err error) {
+	objects, err := s.bucket.ListObjects(ctx, "bigbucket/", "/", 0, nil)
 	if err != nil {
 		return nil, nil, err
 	}
 	tables = utils.CleanupTables(objects)
 
 	// Remove tables marked for deletion from results
-	tablesToDelete = utils.GetState("bigbucket/.delete_tables")
+	tablesToDelete = utils.GetState(ctx, s.bucket, "bigbucket/.delete_tables")
 	for _, tableToDelete := range tablesToDelete {
 		index := utils.Search(tables, tableToDelete)
 		if index > -1 {
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseTTL parses the optional 'ttl' parameter of writes as a duration (e.g. 30m, 24h), responding with 400
+// if invalid. Returns nil if not set, so the default TTL of the table schema is used. A ttl of 0 disables it
+func parseTTL(c *gin.Context) (*time.Duration, error) {
+	ttlMap, err := parseOptionalRequestParams(c, "ttl")
+	if err != nil {
+		return nil, err
+	}
+	if ttlMap["ttl"] == "" {
+		return nil, nil
+	}
+
+	ttl, err := time.ParseDuration(ttlMap["ttl"])
+	if err != nil || ttl < 0 {
+		c.JSON(400, gin.H{
+			"error": "'ttl' parameter has to be a positive duration (e.g. 30s, 15m, 24h), or 0 for no expiry",
+		})
+		return nil, errors.New("Failed to parse 'ttl' querystring parameter")
+	}
+	return &ttl, nil
+}
+
+// cellExpiry returns the expiry time of cells written now with the ttl parameter, or the default TTL
+// of the table schema (can be nil) if not set. Zero if the cells don't expire
+func cellExpiry(ttl *time.Duration, schema *tableSchema) time.Time {
+	if ttl == nil && schema != nil {
+		defaultTTL := schema.defaultTTL()
+		ttl = &defaultTTL
+	}
+	if ttl == nil || *ttl == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(*ttl)
+}
+
+// addExpiry adds the expiry time of written cells to the response body, if they expire
+func addExpiry(body gin.H, expiresAt time.Time) gin.H {
+	if !expiresAt.IsZero() {
+		body["expiresAt"] = expiresAt.UTC().Format(time.RFC3339)
+	}
+	return body
+}
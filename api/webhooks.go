@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+// publishChanges records the events of a write request in the change log and delivers them to the webhooks
+// of the table, if enabled
+func (s *server) publishChanges(ctx context.Context, table string, events ...changeEvent) {
+	s.logChanges(ctx, table, events...)
+	s.notifyWebhooks(table, events...)
+}
+
+// notifyWebhooks queues the events for delivery to the webhooks of the table, if enabled
+func (s *server) notifyWebhooks(table string, events ...changeEvent) {
+	if s.webhooks == nil || len(events) == 0 {
+		return
+	}
+	webhookEvents := []webhook.Event{}
+	for _, event := range events {
+		webhookEvents = append(webhookEvents, webhook.Event{
+			Op:          event.Op,
+			Key:         event.Key,
+			Columns:     event.Columns,
+			Generations: event.Generations,
+		})
+	}
+	s.webhooks.Notify(table, webhookEvents)
+}
+
+func (s *server) setWebhooks(c *gin.Context) {
+	if !s.webhooksEnabled(c) {
+		return
+	}
+	params, err := parseRequiredRequestParams(c, "table")
+	if err != nil {
+		return
+	}
+	if err := s.authorizeAllColumns(c, params["table"], auth.PermissionAdmin); err != nil {
+		return
+	}
+
+	var config webhook.Config
+	if err := c.BindJSON(&config); err != nil {
+		c.JSON(400, gin.H{
+			"error": "Could not parse JSON payload, needs to follow { webhooks: [ { name string, url string, " +
+				"secret string, keyPrefix string, columns []string } ] }",
+		})
+		return
+	}
+	if err := config.Validate(); err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	object := webhook.ConfigObject(params["table"])
+	if len(config.Webhooks) == 0 {
+		err = s.bucket.DeleteObject(c.Request.Context(), object)
+		if errors.Is(err, store.ErrObjectNotExist) {
+			err = nil
+		}
+	} else {
+		var data []byte
+		data, err = json.Marshal(config)
+		if err == nil {
+			_, err = s.bucket.WriteObject(c.Request.Context(), object, data, nil)
+		}
+	}
+	s.webhooks.Reload(params["table"])
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"success": fmt.Sprintf("%d webhooks set for table '%s'", len(config.Webhooks), params["table"]),
+	})
+}
+
+func (s *server) getWebhooks(c *gin.Context) {
+	if !s.webhooksEnabled(c) {
+		return
+	}
+	params, err := parseRequiredRequestParams(c, "table")
+	if err != nil {
+		return
+	}
+	if err := s.authorizeAllColumns(c, params["table"], auth.PermissionAdmin); err != nil {
+		return
+	}
+
+	config, err := webhook.ReadConfig(c.Request.Context(), s.bucket, params["table"])
+	if err != nil {
+		log.Print(err)
+		c.JSON(500, gin.H{
+			"error": "Internal error, check server logs",
+		})
+		return
+	}
+	if config == nil {
+		config = &webhook.Config{}
+	}
+
+	// Secrets are write only
+	c.JSON(200, gin.H{"table": params["table"], "webhooks": config.Redacted().Webhooks})
+}
+
+// webhooksEnabled responds with 404 if webhooks are disabled
+func (s *server) webhooksEnabled(c *gin.Context) bool {
+	if s.webhooks == nil {
+		c.JSON(404, gin.H{
+			"error": "Webhooks are disabled, run with --webhooks to enable them",
+		})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MethodAPIKey is the authentication method of callers using an API key, sent in the X-API-Key header
+	MethodAPIKey = "apiKey"
+	// MethodJWT is the authentication method of callers using a JWT, sent as Authorization bearer token
+	MethodJWT = "jwt"
+
+	apiKeyHeader = "X-API-Key"
+	identityKey  = "bigbucket.identity"
+)
+
+var (
+	// ErrNoCredentials is returned when the request has no API key nor bearer token
+	ErrNoCredentials = errors.New("auth: no credentials")
+	// ErrInvalidCredentials is returned when the API key or bearer token of the request is not valid
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+)
+
+// Config is the authentication config, loaded from a JSON file. API keys and JWTs can be enabled together
+type Config struct {
+	APIKeys []APIKeyConfig `json:"apiKeys"`
+	JWT     *JWTConfig     `json:"jwt"`
+}
+
+// APIKeyConfig is a static API key, only its hash is kept in the config
+type APIKeyConfig struct {
+	// Name is the identity of callers using the key
+	Name string `json:"name"`
+	// SHA256 is the hex encoded SHA-256 hash of the key
+	SHA256 string `json:"sha256"`
+}
+
+// JWTConfig validates JWT bearer tokens (e.g. OIDC ID tokens) against the keys of a JWKS
+type JWTConfig struct {
+	// JWKS is the URL (http:// or https://) or file path of the JSON Web Key Set
+	JWKS     string `json:"jwks"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// SubjectClaim is the claim used as identity of callers. Default: sub
+	SubjectClaim string `json:"subjectClaim"`
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	// Subject is the API key name or the subject claim of the JWT
+	Subject string `json:"subject"`
+	// Method is MethodAPIKey or MethodJWT
+	Method string `json:"method"`
+	// Claims of the JWT, nil for API keys
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// Authenticator checks the API key or bearer token of requests
+type Authenticator struct {
+	// apiKeys maps the hashes of API keys to their names
+	apiKeys map[[sha256.Size]byte]string
+	jwt     *jwtVerifier
+}
+
+// LoadConfig reads the authentication config from a JSON file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read auth config: %v", err)
+	}
+
+	var config Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Failed to parse auth config: %v", err)
+	}
+	return &config, nil
+}
+
+// NewAuthenticator validates the config and creates its authenticator. JWKS URLs are fetched once here,
+// so misconfigurations fail on startup
+func NewAuthenticator(config *Config) (*Authenticator, error) {
+	if len(config.APIKeys) == 0 && config.JWT == nil {
+		return nil, errors.New("Auth config needs at least one of 'apiKeys' or 'jwt'")
+	}
+
+	a := &Authenticator{apiKeys: make(map[[sha256.Size]byte]string)}
+	for _, apiKey := range config.APIKeys {
+		if apiKey.Name == "" {
+			return nil, errors.New("API keys in auth config need a 'name'")
+		}
+		hash, err := hex.DecodeString(apiKey.SHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("API key '%s' in auth config needs 'sha256' as a hex encoded SHA-256 hash", apiKey.Name)
+		}
+		a.apiKeys[*(*[sha256.Size]byte)(hash)] = apiKey.Name
+	}
+
+	if config.JWT != nil {
+		verifier, err := newJWTVerifier(*config.JWT)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = verifier
+	}
+
+	return a, nil
+}
+
+// Authenticate returns the identity of the request caller, from the X-API-Key header or the
+// Authorization bearer token
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return a.authenticateAPIKey(key)
+	}
+
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if !strings.HasPrefix(authorization, "Bearer ") || token == "" {
+		return nil, ErrNoCredentials
+	}
+	if a.jwt == nil {
+		return nil, fmt.Errorf("%w: bearer tokens are not enabled", ErrInvalidCredentials)
+	}
+	return a.jwt.verify(token)
+}
+
+func (a *Authenticator) authenticateAPIKey(key string) (*Identity, error) {
+	hash := sha256.Sum256([]byte(key))
+	// Compare with every key hash, so the time taken doesn't depend on which key matched
+	name := ""
+	for keyHash, keyName := range a.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], keyHash[:]) == 1 {
+			name = keyName
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+	return &Identity{Subject: name, Method: MethodAPIKey}, nil
+}
+
+// Middleware responds with 401 to requests without valid credentials, the identity of the caller
+// is available to handlers with GetIdentity
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, err := a.Authenticate(c.Request)
+		if err != nil {
+			errorMsg := "Please provide an API key in the X-API-Key header or a bearer token in the Authorization header"
+			if !errors.Is(err, ErrNoCredentials) {
+				log.Printf("Authentication failed: %v", err)
+				errorMsg = "Invalid API key or bearer token"
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="bigbucket"`)
+			c.AbortWithStatusJSON(401, gin.H{
+				"error": errorMsg,
+			})
+			return
+		}
+
+		c.Set(identityKey, identity)
+		c.Next()
+	}
+}
+
+// GetIdentity returns the authenticated caller of the request, nil if authentication is disabled
+func GetIdentity(c *gin.Context) *Identity {
+	if identity, exists := c.Get(identityKey); exists {
+		return identity.(*Identity)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	// jwtLeeway is the clock skew allowed when checking the exp and nbf claims
+	jwtLeeway = time.Minute
+	// jwksRefreshInterval is how often keys of JWKS URLs are refreshed, to pick up rotated keys
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits refreshes on unknown key IDs, so bad tokens can't flood the JWKS URL
+	jwksMinRefreshInterval = 30 * time.Second
+	// minRSAKeySize is the minimum size in bits of the RSA keys of a JWKS, smaller keys are skipped
+	minRSAKeySize = 2048
+)
+
+// jwtAlgorithms are the supported signature algorithms, symmetric and 'none' algorithms are rejected
+var jwtAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+}
+
+// jwtVerifier verifies the signature and claims of JWTs, with the keys of a JWKS URL or file
+type jwtVerifier struct {
+	config JWTConfig
+	client *http.Client
+
+	mutex       sync.RWMutex
+	keys        []jose.JSONWebKey
+	refreshedAt time.Time
+}
+
+func newJWTVerifier(config JWTConfig) (*jwtVerifier, error) {
+	if config.JWKS == "" || config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("JWT auth config needs 'jwks', 'issuer' and 'audience'")
+	}
+	if config.SubjectClaim == "" {
+		config.SubjectClaim = "sub"
+	}
+
+	v := &jwtVerifier{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := v.refreshKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// verify returns the identity of a valid token, signed by a key of the JWKS with the configured issuer and audience
+func (v *jwtVerifier) verify(token string) (*Identity, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil || len(parsed.Headers) != 1 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+	header := parsed.Headers[0]
+	if !jwtAlgorithms[header.Algorithm] {
+		return nil, fmt.Errorf("%w: unsupported algorithm '%s'", ErrInvalidCredentials, header.Algorithm)
+	}
+
+	var claims map[string]interface{}
+	var registered jwt.Claims
+	verified := false
+	for _, key := range v.signingKeys(header.KeyID) {
+		if key.Algorithm != "" && key.Algorithm != header.Algorithm {
+			continue
+		}
+		if err := parsed.Claims(key.Key, &claims, &registered); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature does not match any key of the JWKS", ErrInvalidCredentials)
+	}
+	if err := v.checkClaims(registered); err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims[v.config.SubjectClaim].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: missing '%s' claim", ErrInvalidCredentials, v.config.SubjectClaim)
+	}
+	return &Identity{Subject: subject, Method: MethodJWT, Claims: claims}, nil
+}
+
+func (v *jwtVerifier) checkClaims(claims jwt.Claims) error {
+	if claims.Expiry == nil {
+		return fmt.Errorf("%w: missing 'exp' claim", ErrInvalidCredentials)
+	}
+	expected := jwt.Expected{Issuer: v.config.Issuer, Audience: jwt.Audience{v.config.Audience}}
+	if err := claims.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return nil
+}
+
+// signingKeys returns the keys that may have signed a token, refreshing the keys of JWKS URLs when stale
+// or when the key ID of the token is unknown (keys were rotated)
+func (v *jwtVerifier) signingKeys(kid string) []jose.JSONWebKey {
+	keys := v.matchingKeys(kid)
+	if isURL(v.config.JWKS) && v.claimRefresh(len(keys) == 0) {
+		// Not canceled with the request, as the refresh is claimed for all requests
+		if err := v.refreshKeys(context.Background()); err != nil {
+			// Keep using the previous keys
+			log.Print(err)
+		}
+		keys = v.matchingKeys(kid)
+	}
+	return keys
+}
+
+// claimRefresh returns true if the keys are due a refresh, so only one of the concurrent requests refreshes them.
+// Failed refreshes are retried on the same intervals
+func (v *jwtVerifier) claimRefresh(unknownKey bool) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	sinceRefresh := time.Since(v.refreshedAt)
+	if sinceRefresh > jwksRefreshInterval || (unknownKey && sinceRefresh > jwksMinRefreshInterval) {
+		v.refreshedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// matchingKeys returns the key with the key ID, or all keys for tokens without key ID
+func (v *jwtVerifier) matchingKeys(kid string) []jose.JSONWebKey {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	if kid == "" {
+		return v.keys
+	}
+	for _, key := range v.keys {
+		if key.KeyID == kid {
+			return []jose.JSONWebKey{key}
+		}
+	}
+	return nil
+}
+
+// refreshKeys loads the signing keys of the JWKS URL or file
+func (v *jwtVerifier) refreshKeys(ctx context.Context) error {
+	data, err := v.readJWKS(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to read JWKS '%s': %v", v.config.JWKS, err)
+	}
+
+	// Keys are parsed one by one, so a key of an unsupported type doesn't fail the whole set
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return fmt.Errorf("Failed to parse JWKS '%s': %v", v.config.JWKS, err)
+	}
+
+	keys := []jose.JSONWebKey{}
+	for _, rawKey := range jwks.Keys {
+		var key jose.JSONWebKey
+		if err := json.Unmarshal(rawKey, &key); err != nil {
+			// Other keys of the set are still usable
+			log.Printf("Skipping key of JWKS '%s': %v", v.config.JWKS, err)
+			continue
+		}
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if err := checkSigningKey(key); err != nil {
+			log.Printf("Skipping key '%s' of JWKS '%s': %v", key.KeyID, v.config.JWKS, err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS '%s' has no RSA or EC signing keys", v.config.JWKS)
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.keys = keys
+	v.refreshedAt = time.Now()
+	return nil
+}
+
+func (v *jwtVerifier) readJWKS(ctx context.Context) ([]byte, error) {
+	if !isURL(v.config.JWKS) {
+		return os.ReadFile(v.config.JWKS)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", v.config.JWKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("response status code is %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// checkSigningKey returns an error if the key of a JWKS can't verify tokens: only RSA keys of at least
+// minRSAKeySize bits and EC public keys are used
+func checkSigningKey(key jose.JSONWebKey) error {
+	switch publicKey := key.Key.(type) {
+	case *rsa.PublicKey:
+		if publicKey.N.BitLen() < minRSAKeySize {
+			return fmt.Errorf("RSA key size of %d bits is under %d bits", publicKey.N.BitLen(), minRSAKeySize)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		return nil
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return errors.New("private keys cannot be in a JWKS")
+	default:
+		return fmt.Errorf("unsupported key type %T", key.Key)
+	}
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
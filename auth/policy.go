@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// PermissionRead allows reading rows, cells, columns and the table schema
+	PermissionRead = "read"
+	// PermissionWrite allows setting rows and cells
+	PermissionWrite = "write"
+	// PermissionDelete allows deleting rows and columns
+	PermissionDelete = "delete"
+	// PermissionAdmin allows all of the above, plus setting the table schema and deleting the table
+	PermissionAdmin = "admin"
+
+	// AnyPrincipal matches all callers in policies, including the ones without a principal
+	AnyPrincipal = "*"
+)
+
+// PolicyConfig is the access policies config, loaded from a YAML or JSON file
+type PolicyConfig struct {
+	// PrincipalHeader is the request header identifying callers, only to be set by a trusted proxy
+	PrincipalHeader string   `yaml:"principalHeader"`
+	Policies        []Policy `yaml:"policies"`
+}
+
+// Policy grants permissions on tables and columns to principals
+type Policy struct {
+	// Principals are the caller identities the policy applies to, or AnyPrincipal
+	Principals []string `yaml:"principals"`
+	// Tables are table names or patterns (e.g. events_*)
+	Tables      []string `yaml:"tables"`
+	Permissions []string `yaml:"permissions"`
+	// Columns are column names or patterns the policy is limited to, all columns if empty
+	Columns []string `yaml:"columns"`
+	// ExcludeColumns are column names or patterns excluded from the policy (e.g. PII columns)
+	ExcludeColumns []string `yaml:"excludeColumns"`
+}
+
+// Policies authorizes callers on tables and columns. Callers are denied anything not granted by a policy
+type Policies struct {
+	principalHeader string
+	policies        []Policy
+}
+
+// Access is what a caller is allowed on a table for a permission, limited to some columns or not
+type Access struct {
+	grants []Policy
+}
+
+// FullAccess allows all columns, used when policies are disabled
+var FullAccess = &Access{grants: []Policy{{}}}
+
+// LoadPolicies reads the access policies config from a YAML or JSON file
+func LoadPolicies(path string) (*PolicyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy file: %v", err)
+	}
+
+	var config PolicyConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Failed to parse policy file: %v", err)
+	}
+	return &config, nil
+}
+
+// NewPolicies validates the config and creates its policies
+func NewPolicies(config *PolicyConfig) (*Policies, error) {
+	if len(config.Policies) == 0 {
+		return nil, errors.New("Policy file needs at least one policy in 'policies'")
+	}
+
+	for i, policy := range config.Policies {
+		if len(policy.Principals) == 0 || len(policy.Tables) == 0 || len(policy.Permissions) == 0 {
+			return nil, fmt.Errorf("Policy %d needs 'principals', 'tables' and 'permissions'", i+1)
+		}
+		for _, permission := range policy.Permissions {
+			switch permission {
+			case PermissionRead, PermissionWrite, PermissionDelete, PermissionAdmin:
+			default:
+				return nil, fmt.Errorf("Policy %d has unknown permission '%s', expected one of read, write, delete or admin",
+					i+1, permission)
+			}
+		}
+		for _, pattern := range concat(policy.Tables, policy.Columns, policy.ExcludeColumns) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Policy %d has invalid pattern '%s'", i+1, pattern)
+			}
+		}
+	}
+
+	return &Policies{
+		principalHeader: config.PrincipalHeader,
+		policies:        config.Policies,
+	}, nil
+}
+
+// Principal returns the identity of the request caller used in policies: the authenticated identity, the
+// common name of a verified client certificate, or the principal header. Empty if none of them are set
+func (p *Policies) Principal(r *http.Request, identity *Identity) string {
+	if identity != nil {
+		return identity.Subject
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if p.principalHeader != "" {
+		return strings.TrimSpace(r.Header.Get(p.principalHeader))
+	}
+	return ""
+}
+
+// Authorize returns the access of the principal on the table for the permission, nil if denied
+func (p *Policies) Authorize(principal string, table string, permission string) *Access {
+	access := &Access{}
+	for _, policy := range p.policies {
+		if policy.grants(principal, table, permission) {
+			access.grants = append(access.grants, policy)
+		}
+	}
+	if len(access.grants) == 0 {
+		return nil
+	}
+	return access
+}
+
+// AuthorizeAny reports whether the principal has any permission on the table
+func (p *Policies) AuthorizeAny(principal string, table string) bool {
+	for _, permission := range []string{PermissionRead, PermissionWrite, PermissionDelete} {
+		if p.Authorize(principal, table, permission) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy *Policy) grants(principal string, table string, permission string) bool {
+	principalMatch := false
+	for _, policyPrincipal := range policy.Principals {
+		if policyPrincipal == AnyPrincipal || (principal != "" && policyPrincipal == principal) {
+			principalMatch = true
+			break
+		}
+	}
+	permissionMatch := false
+	for _, policyPermission := range policy.Permissions {
+		if policyPermission == permission || policyPermission == PermissionAdmin {
+			permissionMatch = true
+			break
+		}
+	}
+	return principalMatch && permissionMatch && matchAny(policy.Tables, table)
+}
+
+// ColumnAllowed reports whether the column is allowed by any of the granting policies
+func (a *Access) ColumnAllowed(column string) bool {
+	for _, policy := range a.grants {
+		if (len(policy.Columns) == 0 || matchAny(policy.Columns, column)) && !matchAny(policy.ExcludeColumns, column) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllColumns reports whether the access is not limited to some columns
+func (a *Access) AllColumns() bool {
+	for _, policy := range a.grants {
+		if len(policy.Columns) == 0 && len(policy.ExcludeColumns) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether the name matches any of the names or patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+func concat(lists ...[]string) []string {
+	result := []string{}
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+	return result
+}
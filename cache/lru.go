@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/store"
+)
+
+// entryOverhead approximates the memory of an entry besides its key and data (list element, attrs, map slot)
+const entryOverhead = 200
+
+// LRU caches the decompressed data and attributes of objects, evicting the least recently used ones
+// over maxBytes and expiring them after ttl
+type LRU struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	entries  *list.List
+	items    map[string]*list.Element
+	// epoch is increased by every invalidation, so reads which started before it don't cache stale data
+	epoch uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type entry struct {
+	object   string
+	data     []byte
+	attrs    *store.ObjectAttrs
+	cachedAt time.Time
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.object) + len(e.data) + entryOverhead)
+}
+
+// Stats are the counters and size of a cache
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+// NewLRU creates a cache holding up to maxBytes of objects, each for up to ttl
+func NewLRU(maxBytes int64, ttl time.Duration) *LRU {
+	return &LRU{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached data and attributes of an object. On a miss it returns the epoch to pass to Add
+// once the object is read from the bucket
+func (l *LRU) Get(object string) ([]byte, *store.ObjectAttrs, uint64, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if element, exists := l.items[object]; exists {
+		e := element.Value.(*entry)
+		if time.Since(e.cachedAt) < l.ttl {
+			l.entries.MoveToFront(element)
+			l.hits++
+			return e.data, e.attrs, l.epoch, true
+		}
+		l.removeElement(element)
+	}
+	l.misses++
+	return nil, nil, l.epoch, false
+}
+
+// Add caches the data and attributes of an object read at epoch, unless the cache was invalidated since
+// as the read could have raced with a write or delete. Data must not be modified after
+func (l *LRU) Add(object string, data []byte, attrs *store.ObjectAttrs, epoch uint64) {
+	e := &entry{object: object, data: data, attrs: attrs, cachedAt: time.Now()}
+	if e.size() > l.maxBytes {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if epoch != l.epoch {
+		return
+	}
+	if element, exists := l.items[object]; exists {
+		l.removeElement(element)
+	}
+	l.items[object] = l.entries.PushFront(e)
+	l.size += e.size()
+
+	for l.size > l.maxBytes {
+		l.removeElement(l.entries.Back())
+		l.evictions++
+	}
+}
+
+// Remove invalidates the cached objects
+func (l *LRU) Remove(objects ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.epoch++
+	for _, object := range objects {
+		if element, exists := l.items[object]; exists {
+			l.removeElement(element)
+		}
+	}
+}
+
+// RemoveFunc invalidates the cached objects with a name under prefix, for which match (if not nil) returns true
+func (l *LRU) RemoveFunc(prefix string, match func(object string) bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.epoch++
+	for object, element := range l.items {
+		if strings.HasPrefix(object, prefix) && (match == nil || match(object)) {
+			l.removeElement(element)
+		}
+	}
+}
+
+// Stats returns the hits, misses and evictions since the cache was created, and its current size
+func (l *LRU) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return Stats{
+		Hits:      l.hits,
+		Misses:    l.misses,
+		Evictions: l.evictions,
+		Entries:   len(l.items),
+		Bytes:     l.size,
+	}
+}
+
+func (l *LRU) removeElement(element *list.Element) {
+	e := l.entries.Remove(element).(*entry)
+	delete(l.items, e.object)
+	l.size -= e.size()
+}
@@ -0,0 +1,332 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/tracing"
+)
+
+// Routes of the API serving peers
+const (
+	PeerCellPath       = "/peer/cell"
+	PeerInvalidatePath = "/peer/invalidate"
+)
+
+// PeerSecretHeader holds the secret shared by peers, requests to the peer routes without it are rejected
+const PeerSecretHeader = "X-Bigbucket-Peer-Secret"
+
+// Headers of the attributes of cells served to peers
+const (
+	versionHeader    = "X-Bigbucket-Version"
+	generationHeader = "X-Bigbucket-Generation"
+	updatedHeader    = "X-Bigbucket-Updated"
+	expiresAtHeader  = "X-Bigbucket-Expires-At"
+)
+
+const (
+	// srvPrefix prefixes the DNS SRV name to discover peers with, instead of a static list
+	srvPrefix         = "srv:"
+	discoveryInterval = 30 * time.Second
+	peerTimeout       = 2 * time.Second
+)
+
+// InvalidateRequest is the JSON payload broadcast to peers to invalidate cells written or deleted
+type InvalidateRequest struct {
+	Objects []string `json:"objects"`
+}
+
+// Peers are the API replicas sharing a cache, each caching the objects it owns on a consistent hash ring
+// and reading the others from their owner
+type Peers struct {
+	self    string
+	secret  string
+	srvName string
+	client  *http.Client
+
+	mutex   sync.RWMutex
+	members []string
+	ring    *ring
+
+	stopDiscovery context.CancelFunc
+	discovery     sync.WaitGroup
+}
+
+// NewPeers creates the peers of this replica, reachable by the others at the self URL. Peers is a comma separated
+// list of peer URLs (e.g. http://10.0.0.2:8080), or 'srv:<name>' to discover them with DNS SRV records
+func NewPeers(self string, peers string, secret string) (*Peers, error) {
+	self, err := parsePeerURL(self)
+	if err != nil {
+		return nil, fmt.Errorf("Cache self URL is invalid: %v", err)
+	}
+	if secret == "" {
+		return nil, errors.New("Cache peer secret is required, peers serve cells without authentication")
+	}
+
+	p := &Peers{
+		self:   self,
+		secret: secret,
+		client: &http.Client{Timeout: peerTimeout},
+	}
+	if strings.HasPrefix(peers, srvPrefix) {
+		p.srvName = strings.TrimPrefix(peers, srvPrefix)
+		members, err := p.discover(context.Background())
+		if err != nil {
+			// Peers might not be up yet, e.g. during the first deploy
+			log.Printf("Failed to discover cache peers, retrying in %v: %v", discoveryInterval, err)
+		}
+		p.setMembers(members)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopDiscovery = cancel
+		p.discovery.Add(1)
+		go p.runDiscovery(ctx)
+		return p, nil
+	}
+
+	members := []string{}
+	for _, peer := range strings.Split(peers, ",") {
+		if strings.TrimSpace(peer) == "" {
+			continue
+		}
+		member, err := parsePeerURL(strings.TrimSpace(peer))
+		if err != nil {
+			return nil, fmt.Errorf("Cache peer URL '%s' is invalid: %v", peer, err)
+		}
+		members = append(members, member)
+	}
+	p.setMembers(members)
+	return p, nil
+}
+
+func parsePeerURL(peer string) (string, error) {
+	peerURL, err := url.Parse(peer)
+	if err != nil {
+		return "", err
+	}
+	if (peerURL.Scheme != "http" && peerURL.Scheme != "https") || peerURL.Host == "" {
+		return "", errors.New("has to be http(s)://<host>:<port>")
+	}
+	return fmt.Sprintf("%s://%s", peerURL.Scheme, peerURL.Host), nil
+}
+
+// setMembers updates the peers on the ring, this replica is always one of them
+func (p *Peers) setMembers(peers []string) {
+	members := []string{p.self}
+	for _, peer := range peers {
+		if peer != p.self {
+			members = append(members, peer)
+		}
+	}
+	sort.Strings(members)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if strings.Join(members, ",") == strings.Join(p.members, ",") {
+		return
+	}
+	if p.members != nil {
+		log.Printf("Cache peers changed to %v", members)
+	}
+	p.members = members
+	p.ring = newRing(members)
+}
+
+// discover resolves the peers from the DNS SRV records, with the scheme of the self URL
+func (p *Peers) discover(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", p.srvName)
+	if err != nil {
+		return nil, err
+	}
+	scheme := strings.SplitN(p.self, "://", 2)[0]
+	peers := []string{}
+	for _, record := range records {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, record.Target)
+		if err != nil || len(addrs) == 0 {
+			log.Printf("Failed to resolve cache peer %s: %v", record.Target, err)
+			continue
+		}
+		peers = append(peers, fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(addrs[0], strconv.Itoa(int(record.Port)))))
+	}
+	return peers, nil
+}
+
+// runDiscovery refreshes the peers from the DNS SRV records until the context is canceled by Close
+func (p *Peers) runDiscovery(ctx context.Context) {
+	defer p.discovery.Done()
+
+	ticker := time.NewTicker(discoveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		discoverCtx, cancel := context.WithTimeout(ctx, peerTimeout)
+		peers, err := p.discover(discoverCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to discover cache peers, keeping %v: %v", p.Members(), err)
+			continue
+		}
+		p.setMembers(peers)
+	}
+}
+
+// Close stops the discovery of peers with DNS SRV records, waiting for a discovery in progress
+func (p *Peers) Close() {
+	if p.stopDiscovery != nil {
+		p.stopDiscovery()
+	}
+	p.discovery.Wait()
+}
+
+// Members returns the URLs of the peers, including this replica
+func (p *Peers) Members() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.members
+}
+
+// Owner returns the URL of the peer owning the object, and if it's this replica
+func (p *Peers) Owner(object string) (string, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	owner := p.ring.owner(object)
+	return owner, owner == p.self
+}
+
+// Authorized checks the request is from a peer, sent with the shared secret
+func (p *Peers) Authorized(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(PeerSecretHeader)), []byte(p.secret)) == 1
+}
+
+func (p *Peers) newRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(PeerSecretHeader, p.secret)
+	tracing.Inject(ctx, req.Header)
+	return req, nil
+}
+
+// Fetch reads an object through the cache of the peer owning it
+func (p *Peers) Fetch(ctx context.Context, peer string, object string) ([]byte, *store.ObjectAttrs, error) {
+	req, err := p.newRequest(ctx, "GET", peer+PeerCellPath+"?object="+url.QueryEscape(object), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, nil, fmt.Errorf("%w: %s", store.ErrObjectNotExist, object)
+	}
+	if resp.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("Cache peer %s returned %d for '%s'", peer, resp.StatusCode, object)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs, err := readObjectHeaders(resp.Header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cache peer %s returned invalid attributes for '%s': %v", peer, object, err)
+	}
+	attrs.Name = object
+	attrs.Size = int64(len(data))
+	return data, attrs, nil
+}
+
+// Invalidate broadcasts the objects to invalidate to the other peers, failures are logged as the peers
+// still expire them after the cache TTL
+func (p *Peers) Invalidate(ctx context.Context, objects []string) {
+	payload, err := json.Marshal(InvalidateRequest{Objects: objects})
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, peer := range p.Members() {
+		if peer == p.self {
+			continue
+		}
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			req, err := p.newRequest(ctx, "POST", peer+PeerInvalidatePath, bytes.NewReader(payload))
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := p.client.Do(req)
+			if err != nil {
+				log.Printf("Failed to invalidate %d cells on cache peer %s: %v", len(objects), peer, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				log.Printf("Failed to invalidate %d cells on cache peer %s: returned %d", len(objects), peer, resp.StatusCode)
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// WriteObjectHeaders sets the headers of the attributes of a cell served to a peer
+func WriteObjectHeaders(header http.Header, attrs *store.ObjectAttrs) {
+	header.Set(versionHeader, attrs.Version)
+	header.Set(generationHeader, attrs.Generation)
+	if !attrs.Updated.IsZero() {
+		header.Set(updatedHeader, attrs.Updated.Format(time.RFC3339Nano))
+	}
+	if !attrs.ExpiresAt.IsZero() {
+		header.Set(expiresAtHeader, attrs.ExpiresAt.Format(time.RFC3339Nano))
+	}
+}
+
+func readObjectHeaders(header http.Header) (*store.ObjectAttrs, error) {
+	attrs := &store.ObjectAttrs{
+		Version:    header.Get(versionHeader),
+		Generation: header.Get(generationHeader),
+	}
+	var err error
+	if value := header.Get(updatedHeader); value != "" {
+		if attrs.Updated, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return nil, err
+		}
+	}
+	if value := header.Get(expiresAtHeader); value != "" {
+		if attrs.ExpiresAt, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
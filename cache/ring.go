@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points of each peer on the ring, so objects spread evenly between peers
+const ringReplicas = 100
+
+// ring consistently hashes objects to peers, adding or removing a peer only moves the objects it owns
+type ring struct {
+	points []uint32
+	peers  map[uint32]string
+}
+
+func newRing(peers []string) *ring {
+	r := &ring{peers: make(map[uint32]string, len(peers)*ringReplicas)}
+	for _, peer := range peers {
+		for i := 0; i < ringReplicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			r.points = append(r.points, point)
+			r.peers[point] = peer
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// owner returns the peer owning the object, the first one clockwise from its hash on the ring
+func (r *ring) owner(object string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(object))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.peers[r.points[i]]
+}
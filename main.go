@@ -1,36 +1,90 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/cache"
+	"github.com/adrianchifor/Bigbucket/metrics"
 	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/tracing"
+	"github.com/adrianchifor/Bigbucket/webhook"
 	"github.com/adrianchifor/Bigbucket/worker"
 )
 
 const version string = "0.2.11"
 
 var (
-	port            int
-	cleanerFlag     bool
-	cleanerInterval int
-	cleanerHttpFlag bool
-	versionFlag     bool
+	bucketURL           string
+	port                int
+	cleanerFlag         bool
+	cleanerInterval     int
+	cleanerHttpFlag     bool
+	authConfigPath      string
+	policyFilePath      string
+	tlsCertPath         string
+	tlsKeyPath          string
+	tlsClientCAPath     string
+	tracingFlag         bool
+	cacheSize           int
+	cacheTTL            int
+	cachePeers          string
+	cacheSelf           string
+	cachePeerSecret     string
+	changeLogFlag       bool
+	changeLogRetention  int
+	changeLogSettle     int
+	webhooksFlag        bool
+	webhookAttempts     int
+	deadLetterRetention int
+	versionFlag         bool
 )
 
 func init() {
-	flag.StringVar(&store.BucketName, "bucket", "", "Bucket name (required, e.g. gs://<bucket-name>)")
+	flag.StringVar(&bucketURL, "bucket", "", "Bucket URL (required, e.g. gs://<bucket-name>, s3://<bucket-name>, file:///<path> or mem://)")
 	flag.IntVar(&port, "port", 0, "Server port (default 8080)")
 	flag.BoolVar(&cleanerFlag, "cleaner", false, "Run Bigbucket in cleaner mode (default false). "+
-		"Will garbage collect tables and columns marked for deletion. Executes based on --cleaner-interval")
+		"Will garbage collect tables and columns marked for deletion and expired cells. Executes based on --cleaner-interval")
 	flag.IntVar(&cleanerInterval, "cleaner-interval", 0, "Bigbucket cleaner interval (default 0, runs only once). "+
 		"To run cleaner every hour, you can set --cleaner-interval 3600")
 	flag.BoolVar(&cleanerHttpFlag, "cleaner-http", false, "Run Bigbucket in cleaner HTTP mode (default false). "+
 		"Executes on HTTP POST to /; to be used with https://cloud.google.com/scheduler/docs/creating")
+	flag.StringVar(&authConfigPath, "auth-config", "", "Path to the JSON auth config with API keys and/or JWT settings (default none, API is open)")
+	flag.StringVar(&policyFilePath, "policy-file", "", "Path to the YAML/JSON access policies per table and column (default none, all callers are allowed everything)")
+	flag.StringVar(&tlsCertPath, "tls-cert", "", "Path to the PEM certificate to serve the API over HTTPS (needs --tls-key)")
+	flag.StringVar(&tlsKeyPath, "tls-key", "", "Path to the PEM private key of --tls-cert")
+	flag.StringVar(&tlsClientCAPath, "tls-client-ca", "", "Path to the PEM CA certificates to verify client certificates, "+
+		"identifying callers in access policies (needs --tls-cert)")
+	flag.IntVar(&cacheSize, "cache-size", 0, "Max size in MB of the in-process cache of cell reads (default 0, disabled)")
+	flag.IntVar(&cacheTTL, "cache-ttl", 0, "Seconds cell reads are cached for (default 60). "+
+		"Writes and deletes of other replicas or the cleaner are seen at most that late")
+	flag.StringVar(&cachePeers, "cache-peers", "", "Comma separated URLs of the API replicas sharing the read cache, "+
+		"or srv:<name> to discover them with DNS SRV records (default none, cache is per replica). Needs --cache-size")
+	flag.StringVar(&cacheSelf, "cache-self", "", "URL of this replica as reached by the --cache-peers (e.g. http://10.0.0.1:8080)")
+	flag.StringVar(&cachePeerSecret, "cache-peer-secret", "", "Secret shared by the --cache-peers to authenticate their requests")
+	flag.BoolVar(&changeLogFlag, "changelog", false, "Record the mutations of tables in a change log in the bucket, "+
+		"served by /api/changes (default false)")
+	flag.IntVar(&changeLogRetention, "changelog-retention", 0, "Hours change log segments are kept for before the cleaner "+
+		"deletes them (default 168, -1 keeps them forever)")
+	flag.IntVar(&changeLogSettle, "changelog-settle", 0, "Seconds change log segments are held back from readers, "+
+		"longer than bucket writes take and the clock skew between replicas so tailers don't skip any (default 5)")
+	flag.BoolVar(&webhooksFlag, "webhooks", false, "Deliver the mutations of tables to the webhooks set on them "+
+		"with /api/table/webhooks (default false)")
+	flag.IntVar(&webhookAttempts, "webhook-attempts", 0, "Delivery attempts to webhooks before recording a dead letter "+
+		"in the bucket (default 5)")
+	flag.IntVar(&deadLetterRetention, "deadletter-retention", 0, "Hours webhook dead letters are kept for before the cleaner "+
+		"deletes them (default 168, -1 keeps them forever)")
+	flag.BoolVar(&tracingFlag, "tracing", false, "Export OpenTelemetry traces with OTLP over HTTP (default false). "+
+		"Configured by the standard OTEL_EXPORTER_OTLP_* env vars, e.g. OTEL_EXPORTER_OTLP_ENDPOINT")
 	flag.BoolVar(&versionFlag, "version", false, "Version")
 	flag.Parse()
 }
@@ -47,24 +101,46 @@ func main() {
 	}
 
 	parseEnvVars()
-	initBucket()
+	bucket := initBucket()
+	worker.ChangeLogRetention = time.Duration(changeLogRetention) * time.Hour
+	worker.DeadLetterRetention = time.Duration(deadLetterRetention) * time.Hour
 
 	if cleanerFlag {
-		worker.RunCleaner(cleanerInterval)
+		shutdownTracing := initTracing("bigbucket-cleaner")
+		worker.RunCleaner(cleanerInterval, bucket)
+		shutdownTracing()
 		os.Exit(0)
 	}
 	if cleanerHttpFlag {
-		worker.RunCleanerHttp(port)
+		shutdownTracing := initTracing("bigbucket-cleaner")
+		worker.RunCleanerHttp(port, bucket)
+		shutdownTracing()
 		os.Exit(0)
 	}
 
-	api.RunServer(port)
+	shutdownTracing := initTracing("bigbucket")
+	readCache := initCache()
+	peers, closePeers := initCachePeers()
+	webhooks, closeWebhooks := initWebhooks(bucket)
+	api.RunServer(port, bucket, &api.Options{
+		Authenticator:   initAuthenticator(),
+		Policies:        initPolicies(),
+		Cache:           readCache,
+		Peers:           peers,
+		ChangeLog:       changeLogFlag,
+		ChangeLogSettle: time.Duration(changeLogSettle) * time.Second,
+		Webhooks:        webhooks,
+		TLSConfig:       initTLSConfig(),
+	})
+	closeWebhooks()
+	closePeers()
+	shutdownTracing()
 }
 
 func parseEnvVars() {
-	if store.BucketName == "" {
+	if bucketURL == "" {
 		if value, ok := os.LookupEnv("BUCKET"); ok {
-			store.BucketName = value
+			bucketURL = value
 		} else {
 			flag.PrintDefaults()
 			os.Exit(1)
@@ -107,18 +183,308 @@ func parseEnvVars() {
 			cleanerHttpFlag = true
 		}
 	}
+
+	if cacheSize == 0 {
+		if value, ok := os.LookupEnv("CACHE_SIZE"); ok {
+			valueInt, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Println("'CACHE_SIZE' environment variable cannot be cast to integer")
+				os.Exit(1)
+			}
+			cacheSize = valueInt
+		}
+	}
+
+	if cacheTTL == 0 {
+		if value, ok := os.LookupEnv("CACHE_TTL"); ok {
+			valueInt, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Println("'CACHE_TTL' environment variable cannot be cast to integer")
+				os.Exit(1)
+			}
+			cacheTTL = valueInt
+		} else {
+			cacheTTL = 60
+		}
+	}
+
+	if cachePeers == "" {
+		if value, ok := os.LookupEnv("CACHE_PEERS"); ok {
+			cachePeers = value
+		}
+	}
+
+	if cacheSelf == "" {
+		if value, ok := os.LookupEnv("CACHE_SELF"); ok {
+			cacheSelf = value
+		}
+	}
+
+	if cachePeerSecret == "" {
+		if value, ok := os.LookupEnv("CACHE_PEER_SECRET"); ok {
+			cachePeerSecret = value
+		}
+	}
+
+	if !changeLogFlag {
+		if _, ok := os.LookupEnv("CHANGELOG"); ok {
+			changeLogFlag = true
+		}
+	}
+
+	if changeLogRetention == 0 {
+		if value, ok := os.LookupEnv("CHANGELOG_RETENTION"); ok {
+			valueInt, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Println("'CHANGELOG_RETENTION' environment variable cannot be cast to integer")
+				os.Exit(1)
+			}
+			changeLogRetention = valueInt
+		} else {
+			changeLogRetention = 168
+		}
+	}
+
+	if changeLogSettle == 0 {
+		if value, ok := os.LookupEnv("CHANGELOG_SETTLE"); ok {
+			valueInt, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Println("'CHANGELOG_SETTLE' environment variable cannot be cast to integer")
+				os.Exit(1)
+			}
+			changeLogSettle = valueInt
+		} else {
+			changeLogSettle = 5
+		}
+	}
+
+	if !webhooksFlag {
+		if _, ok := os.LookupEnv("WEBHOOKS"); ok {
+			webhooksFlag = true
+		}
+	}
+
+	if webhookAttempts == 0 {
+		if value, ok := os.LookupEnv("WEBHOOK_ATTEMPTS"); ok {
+			valueInt, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Println("'WEBHOOK_ATTEMPTS' environment variable cannot be cast to integer")
+				os.Exit(1)
+			}
+			webhookAttempts = valueInt
+		} else {
+			webhookAttempts = 5
+		}
+	}
+
+	if deadLetterRetention == 0 {
+		if value, ok := os.LookupEnv("DEADLETTER_RETENTION"); ok {
+			valueInt, err := strconv.Atoi(value)
+			if err != nil {
+				fmt.Println("'DEADLETTER_RETENTION' environment variable cannot be cast to integer")
+				os.Exit(1)
+			}
+			deadLetterRetention = valueInt
+		} else {
+			deadLetterRetention = 168
+		}
+	}
+
+	if !tracingFlag {
+		if _, ok := os.LookupEnv("TRACING"); ok {
+			tracingFlag = true
+		}
+	}
+
+	if authConfigPath == "" {
+		if value, ok := os.LookupEnv("AUTH_CONFIG"); ok {
+			authConfigPath = value
+		}
+	}
+
+	if policyFilePath == "" {
+		if value, ok := os.LookupEnv("POLICY_FILE"); ok {
+			policyFilePath = value
+		}
+	}
+
+	if tlsCertPath == "" {
+		if value, ok := os.LookupEnv("TLS_CERT"); ok {
+			tlsCertPath = value
+		}
+	}
+
+	if tlsKeyPath == "" {
+		if value, ok := os.LookupEnv("TLS_KEY"); ok {
+			tlsKeyPath = value
+		}
+	}
+
+	if tlsClientCAPath == "" {
+		if value, ok := os.LookupEnv("TLS_CLIENT_CA"); ok {
+			tlsClientCAPath = value
+		}
+	}
+}
+
+func initBucket() store.Backend {
+	bucket, err := store.NewBackend(bucketURL)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	bucket = metrics.InstrumentBackend(bucket)
+	if tracingFlag {
+		bucket = tracing.TraceBackend(bucket)
+	}
+
+	// Concurrent identical reads and listings share one bucket request, so it's recorded once in metrics and traces
+	return store.Coalesce(bucket)
+}
+
+// initCache creates the cache of cell reads if enabled, with its stats exposed as metrics
+func initCache() *cache.LRU {
+	if cacheSize <= 0 {
+		return nil
+	}
+	if cacheTTL <= 0 {
+		fmt.Println("--cache-ttl has to be greater than 0")
+		os.Exit(1)
+	}
+	readCache := cache.NewLRU(int64(cacheSize)*1024*1024, time.Duration(cacheTTL)*time.Second)
+	metrics.RegisterCache(readCache)
+	return readCache
+}
+
+// initCachePeers sets up the sharing of the read cache between API replicas if enabled, returning the func
+// stopping the discovery of peers before exiting
+func initCachePeers() (*cache.Peers, func()) {
+	if cachePeers == "" {
+		return nil, func() {}
+	}
+	if cacheSize <= 0 {
+		fmt.Println("--cache-peers needs the read cache to be enabled with --cache-size")
+		os.Exit(1)
+	}
+	peers, err := cache.NewPeers(cacheSelf, cachePeers, cachePeerSecret)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return peers, peers.Close
+}
+
+// initWebhooks creates the dispatcher of webhook deliveries if enabled, returning the func waiting for
+// pending deliveries before exiting
+func initWebhooks(bucket store.Backend) (*webhook.Dispatcher, func()) {
+	if !webhooksFlag {
+		return nil, func() {}
+	}
+	if webhookAttempts <= 0 {
+		fmt.Println("--webhook-attempts has to be greater than 0")
+		os.Exit(1)
+	}
+	webhooks := webhook.NewDispatcher(bucket, webhookAttempts, time.Second)
+
+	return webhooks, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := webhooks.Close(ctx); err != nil {
+			log.Printf("Failed to finish webhook deliveries: %v", err)
+		}
+	}
+}
+
+// initTracing sets up the export of traces if enabled, returning the func flushing them before exiting
+func initTracing(serviceName string) func() {
+	if !tracingFlag {
+		return func() {}
+	}
+	shutdown, err := tracing.Init(context.Background(), serviceName, version)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			log.Printf("Failed to flush traces: %v", err)
+		}
+	}
 }
 
-func initBucket() {
-	if strings.HasPrefix(store.BucketName, "gs://") {
-		store.BucketName = strings.Replace(store.BucketName, "gs://", "", 1)
-		store.InitGoog()
-	} else if strings.HasPrefix(store.BucketName, "s3://") {
-		// TODO: Implement S3 backend
-		fmt.Println("S3 bucket backend is not yet implemented")
+func initAuthenticator() *auth.Authenticator {
+	if authConfigPath == "" {
+		return nil
+	}
+	config, err := auth.LoadConfig(authConfigPath)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
-	} else {
-		fmt.Println("--bucket flag or 'BUCKET' env supports Google Cloud Storage as 'gs://<bucket-name>'")
+	}
+	authenticator, err := auth.NewAuthenticator(config)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
+
+	return authenticator
+}
+
+func initPolicies() *auth.Policies {
+	if policyFilePath == "" {
+		return nil
+	}
+	config, err := auth.LoadPolicies(policyFilePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	policies, err := auth.NewPolicies(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return policies
+}
+
+func initTLSConfig() *tls.Config {
+	if tlsCertPath == "" && tlsKeyPath == "" && tlsClientCAPath == "" {
+		return nil
+	}
+	if tlsCertPath == "" || tlsKeyPath == "" {
+		fmt.Println("Specify both --tls-cert and --tls-key to serve HTTPS")
+		os.Exit(1)
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertPath, tlsKeyPath)
+	if err != nil {
+		fmt.Println("Failed to load TLS certificate:", err)
+		os.Exit(1)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if tlsClientCAPath != "" {
+		caCerts, err := os.ReadFile(tlsClientCAPath)
+		if err != nil {
+			fmt.Println("Failed to read TLS client CA:", err)
+			os.Exit(1)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCerts) {
+			fmt.Println("TLS client CA has no PEM certificates")
+			os.Exit(1)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		// Callers without certificates can still use API keys, bearer tokens or the principal header
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig
 }
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Operation types of backend metrics
+const (
+	opList   = "list"
+	opRead   = "read"
+	opWrite  = "write"
+	opDelete = "delete"
+	opStat   = "stat"
+)
+
+var (
+	backendOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_operations_total",
+		Help:      "Storage backend operations (bucket requests), by operation type.",
+	}, []string{"op"})
+	backendOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_operation_duration_seconds",
+		Help:      "Latency of storage backend operations, by operation type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+	backendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_errors_total",
+		Help:      "Failed storage backend operations, by operation type and error (not_found, precondition_failed, rate_limited, other).",
+	}, []string{"op", "error"})
+	backendRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_rate_limited_total",
+		Help:      "Storage backend operations rejected as rate limited by the bucket (HTTP 429), by operation type.",
+	}, []string{"op"})
+)
+
+// instrumentedBackend records the count, latency and errors of the operations of a backend
+type instrumentedBackend struct {
+	store.Backend
+}
+
+// InstrumentBackend wraps the backend to record metrics of its operations
+func InstrumentBackend(backend store.Backend) store.Backend {
+	return &instrumentedBackend{Backend: backend}
+}
+
+// observe records an operation which started at start and returned err
+func observe(op string, start time.Time, err error) {
+	backendOperations.WithLabelValues(op).Inc()
+	backendOperationDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+
+	switch {
+	case errors.Is(err, store.ErrObjectNotExist):
+		backendErrors.WithLabelValues(op, "not_found").Inc()
+	case errors.Is(err, store.ErrPreconditionFailed):
+		backendErrors.WithLabelValues(op, "precondition_failed").Inc()
+	case errors.Is(err, store.ErrRateLimited):
+		backendErrors.WithLabelValues(op, "rate_limited").Inc()
+		backendRateLimited.WithLabelValues(op).Inc()
+	default:
+		backendErrors.WithLabelValues(op, "other").Inc()
+	}
+}
+
+func (b *instrumentedBackend) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *store.ListOptions) ([]string, error) {
+	start := time.Now()
+	objects, err := b.Backend.ListObjects(ctx, prefix, delimiter, limit, opts)
+	observe(opList, start, err)
+	return objects, err
+}
+
+func (b *instrumentedBackend) ReadObject(ctx context.Context, object string) ([]byte, *store.ObjectAttrs, error) {
+	start := time.Now()
+	data, attrs, err := b.Backend.ReadObject(ctx, object)
+	observe(opRead, start, err)
+	return data, attrs, err
+}
+
+func (b *instrumentedBackend) WriteObject(ctx context.Context, object string, data []byte,
+	opts *store.WriteOptions) (*store.ObjectAttrs, error) {
+	start := time.Now()
+	attrs, err := b.Backend.WriteObject(ctx, object, data, opts)
+	observe(opWrite, start, err)
+	return attrs, err
+}
+
+// ReadObjectStream records the latency until the stream is opened, not until it's read
+func (b *instrumentedBackend) ReadObjectStream(ctx context.Context, object string) (io.ReadCloser, *store.ObjectAttrs, error) {
+	start := time.Now()
+	r, attrs, err := b.Backend.ReadObjectStream(ctx, object)
+	observe(opRead, start, err)
+	return r, attrs, err
+}
+
+func (b *instrumentedBackend) WriteObjectStream(ctx context.Context, object string, r io.Reader,
+	opts *store.WriteOptions) (*store.ObjectAttrs, error) {
+	start := time.Now()
+	attrs, err := b.Backend.WriteObjectStream(ctx, object, r, opts)
+	observe(opWrite, start, err)
+	return attrs, err
+}
+
+func (b *instrumentedBackend) DeleteObject(ctx context.Context, object string) error {
+	start := time.Now()
+	err := b.Backend.DeleteObject(ctx, object)
+	observe(opDelete, start, err)
+	return err
+}
+
+func (b *instrumentedBackend) StatObject(ctx context.Context, object string) (*store.ObjectAttrs, error) {
+	start := time.Now()
+	attrs, err := b.Backend.StatObject(ctx, object)
+	observe(opStat, start, err)
+	return attrs, err
+}
+
+func (b *instrumentedBackend) ListObjectVersions(ctx context.Context, object string) ([]store.ObjectAttrs, error) {
+	start := time.Now()
+	versions, err := b.Backend.ListObjectVersions(ctx, object)
+	observe(opList, start, err)
+	return versions, err
+}
+
+func (b *instrumentedBackend) ReadObjectVersion(ctx context.Context, object string, version string) ([]byte, error) {
+	start := time.Now()
+	data, err := b.Backend.ReadObjectVersion(ctx, object, version)
+	observe(opRead, start, err)
+	return data, err
+}
+
+func (b *instrumentedBackend) ListExpiredObjects(ctx context.Context, prefix string) ([]string, error) {
+	start := time.Now()
+	objects, err := b.Backend.ListExpiredObjects(ctx, prefix)
+	observe(opList, start, err)
+	return objects, err
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"github.com/adrianchifor/Bigbucket/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RegisterCache exposes the stats of the read cache, it has to be called only once
+func RegisterCache(c *cache.LRU) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Cell reads served from the read cache.",
+	}, func() float64 { return float64(c.Stats().Hits) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Cell reads not found in the read cache (or expired), read from the bucket.",
+	}, func() float64 { return float64(c.Stats().Misses) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_evictions_total",
+		Help:      "Cells evicted from the read cache to stay under its max size.",
+	}, func() float64 { return float64(c.Stats().Evictions) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_entries",
+		Help:      "Cells in the read cache.",
+	}, func() float64 { return float64(c.Stats().Entries) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_bytes",
+		Help:      "Approximate memory used by the cells in the read cache.",
+	}, func() float64 { return float64(c.Stats().Bytes) })
+}
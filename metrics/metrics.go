@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bigbucket"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by server, route, method and status code.",
+	}, []string{"server", "route", "method", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by server, route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"server", "route", "method", "status"})
+
+	jobPoolQueuedJobs = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_pool_queued_jobs",
+		Help:      "Jobs added to job pools and not started yet, by pool.",
+	}, []string{"pool"})
+
+	cleanerRuns = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleaner_runs_total",
+		Help:      "Cleaner runs.",
+	})
+	cleanerDeletedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleaner_deleted_objects_total",
+		Help:      "Objects deleted by the cleaner, by kind (table, column, expired, changes).",
+	}, []string{"kind"})
+	cleanerLastRunDeletedObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cleaner_last_run_deleted_objects",
+		Help:      "Objects deleted by the last cleaner run, by kind (table, column, expired, changes).",
+	}, []string{"kind"})
+	cleanerLastRunDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cleaner_last_run_duration_seconds",
+		Help:      "Duration of the last cleaner run.",
+	})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts and outcomes, by result (delivered, retried, dead_letter, dropped).",
+	}, []string{"result"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// Middleware records the count and latency of requests to the server by route. Requests not matching
+// any route are recorded as "unmatched", so unknown paths don't add labels
+func Middleware(server string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(server, route, c.Request.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(server, route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// TrackJob wraps a job added to a job pool, so it's counted in the queue depth of the pool until it starts
+func TrackJob(pool string, job func()) func() {
+	queued := jobPoolQueuedJobs.WithLabelValues(pool)
+	queued.Inc()
+	return func() {
+		queued.Dec()
+		job()
+	}
+}
+
+// ObserveCleanerRun records the duration of a cleaner run and the objects it deleted by kind
+func ObserveCleanerRun(duration time.Duration, deletedObjects map[string]int) {
+	cleanerRuns.Inc()
+	cleanerLastRunDuration.Set(duration.Seconds())
+	for kind, count := range deletedObjects {
+		cleanerDeletedObjects.WithLabelValues(kind).Add(float64(count))
+		cleanerLastRunDeletedObjects.WithLabelValues(kind).Set(float64(count))
+	}
+}
+
+// ObserveWebhookDelivery records the result of a webhook delivery attempt, or of events dropped before delivery
+func ObserveWebhookDelivery(result string) {
+	webhookDeliveries.WithLabelValues(result).Inc()
+}
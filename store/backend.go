@@ -0,0 +1,420 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/zstd"
+)
+
+var (
+	// ErrObjectNotExist is returned by backends when the requested object does not exist
+	ErrObjectNotExist = errors.New("store: object does not exist")
+	// ErrRateLimited is wrapped by backend errors when the bucket is rate limiting requests
+	ErrRateLimited = errors.New("store: bucket is rate limiting")
+	// ErrPreconditionFailed is returned by conditional writes when the object generation doesn't match
+	ErrPreconditionFailed = errors.New("store: precondition failed")
+)
+
+// NoGeneration is the generation precondition of objects that must not exist
+const NoGeneration = "0"
+
+const (
+	// statExpiredConcurrency is the count of objects stated at once by backends listing expired objects with stats
+	statExpiredConcurrency = 16
+	// expiresAtMetadata is the object metadata key of the expiry time, for backends with object metadata
+	expiresAtMetadata = "bigbucket-expires-at"
+	// expiryFrameMagic starts the zstd skippable frame holding the expiry time (unix nanoseconds) at the start
+	// of expiring objects, so reads don't need another request to get their metadata
+	expiryFrameMagic = 0x184D2A5B
+	expiryFrameSize  = 16
+	// generationFrameMagic starts the zstd skippable frame holding a unique generation (unix nanoseconds) at the
+	// start of objects, for backends whose own attributes can't tell writes apart: file modification times can be
+	// too coarse, and S3 ETags are the same for writes of the same data
+	generationFrameMagic = 0x184D2A5C
+	generationFrameSize  = 16
+)
+
+// Backend is the storage layer behind Bigbucket, objects are addressed by their full name
+// (e.g. bigbucket/<table>/<key>/<column>) and their data is compressed with zstd
+type Backend interface {
+	// ListObjects lists object names starting with prefix, in lexicographic order and within the
+	// optional range in opts (can be nil). If delimiter is set, only the common prefixes up to and
+	// including the delimiter are returned. A limit of 0 means no limit
+	ListObjects(ctx context.Context, prefix string, delimiter string, limit int, opts *ListOptions) ([]string, error)
+	// ReadObject reads and decompresses the object data, also returning the attributes of the version read
+	ReadObject(ctx context.Context, object string) ([]byte, *ObjectAttrs, error)
+	// WriteObject compresses and writes the object data, overwriting any existing object unless
+	// preconditions are set in opts (can be nil). Returns the attributes of the written object
+	WriteObject(ctx context.Context, object string, data []byte, opts *WriteOptions) (*ObjectAttrs, error)
+	// ReadObjectStream is like ReadObject, but returns a reader decompressing the object data as it's read,
+	// which has to be closed. Meant for large objects, so there's no timeout other than the context
+	ReadObjectStream(ctx context.Context, object string) (io.ReadCloser, *ObjectAttrs, error)
+	// WriteObjectStream is like WriteObject, but compresses and writes the data as it's read from r until EOF,
+	// without buffering all of it in memory. Nothing is written if reading r fails
+	WriteObjectStream(ctx context.Context, object string, r io.Reader, opts *WriteOptions) (*ObjectAttrs, error)
+	// DeleteObject deletes the object
+	DeleteObject(ctx context.Context, object string) error
+	// StatObject returns the object attributes without reading its data
+	StatObject(ctx context.Context, object string) (*ObjectAttrs, error)
+	// ListObjectVersions lists the live and noncurrent versions of an object, newest first, with the expiry
+	// time of at least the newest one. Buckets without versioning enabled only return the live version
+	ListObjectVersions(ctx context.Context, object string) ([]ObjectAttrs, error)
+	// ReadObjectVersion reads and decompresses a specific version of the object
+	ReadObjectVersion(ctx context.Context, object string, version string) ([]byte, error)
+	// ListExpiredObjects lists the names of the expired objects starting with prefix, in lexicographic order.
+	// Backends returning object metadata in listings (GCS) take their expiry from it, others stat each object
+	ListExpiredObjects(ctx context.Context, prefix string) ([]string, error)
+}
+
+// ObjectAttrs holds the attributes of a stored object
+type ObjectAttrs struct {
+	Name string
+	Size int64
+	// Version identifies this version of the object (GCS generation, S3 version ID)
+	Version string
+	// Generation identifies the write of the object for conditional writes (GCS generation, S3 ETag)
+	Generation string
+	Updated    time.Time
+	// ExpiresAt is the time after which the object is expired, zero if it doesn't expire
+	ExpiresAt time.Time
+}
+
+// IsExpired returns true if the object has an expiry time in the past
+func (attrs *ObjectAttrs) IsExpired() bool {
+	return !attrs.ExpiresAt.IsZero() && !time.Now().Before(attrs.ExpiresAt)
+}
+
+// ListOptions holds an optional range of object names for listings, like GCS StartOffset/EndOffset
+type ListOptions struct {
+	// StartOffset filters out object names lexicographically before it (inclusive)
+	StartOffset string
+	// EndOffset filters out object names lexicographically equal to or after it (exclusive)
+	EndOffset string
+}
+
+// offsets returns the start and end offsets of the list options, empty if none
+func (opts *ListOptions) offsets() (string, string) {
+	if opts == nil {
+		return "", ""
+	}
+	return opts.StartOffset, opts.EndOffset
+}
+
+// WriteOptions holds optional preconditions and attributes for writes
+type WriteOptions struct {
+	// IfGenerationMatch makes the write fail with ErrPreconditionFailed, unless the live object
+	// generation matches it or the object doesn't exist and it's NoGeneration
+	IfGenerationMatch string
+	// ExpiresAt is stored with the object, which is still readable after it. Expired objects have to be
+	// filtered out by readers and deleted by the cleaner
+	ExpiresAt time.Time
+}
+
+// ifGenerationMatch returns the generation precondition of the write options, empty if none
+func (opts *WriteOptions) ifGenerationMatch() string {
+	if opts == nil {
+		return ""
+	}
+	return opts.IfGenerationMatch
+}
+
+// expiresAt returns the expiry time of the write options, zero if none
+func (opts *WriteOptions) expiresAt() time.Time {
+	if opts == nil {
+		return time.Time{}
+	}
+	return opts.ExpiresAt
+}
+
+// expiryMetadata returns the object metadata holding the expiry time of the write options, nil if none
+func (opts *WriteOptions) expiryMetadata() map[string]string {
+	if opts.expiresAt().IsZero() {
+		return nil
+	}
+	return map[string]string{expiresAtMetadata: opts.expiresAt().UTC().Format(time.RFC3339Nano)}
+}
+
+// metadataExpiry parses the expiry time of object metadata, zero if none
+func metadataExpiry(metadata map[string]string) time.Time {
+	expiresAt, _ := time.Parse(time.RFC3339Nano, metadata[expiresAtMetadata])
+	return expiresAt
+}
+
+// NewBackend creates the storage backend matching the bucket URL scheme (e.g. gs://<bucket-name>)
+func NewBackend(bucketURL string) (Backend, error) {
+	switch {
+	case strings.HasPrefix(bucketURL, "gs://"):
+		return newGCSBucket(strings.TrimPrefix(bucketURL, "gs://"))
+	case strings.HasPrefix(bucketURL, "file://"):
+		path, options, _ := strings.Cut(strings.TrimPrefix(bucketURL, "file://"), "?")
+		maxVersions, err := parseMaxVersions(options)
+		if err != nil {
+			return nil, err
+		}
+		return newFileBucket(path, maxVersions)
+	case strings.HasPrefix(bucketURL, "s3://"):
+		return newS3Bucket(bucketURL)
+	case strings.HasPrefix(bucketURL, "mem://"):
+		_, options, _ := strings.Cut(strings.TrimPrefix(bucketURL, "mem://"), "?")
+		maxVersions, err := parseMaxVersions(options)
+		if err != nil {
+			return nil, err
+		}
+		return newMemBucket(maxVersions), nil
+	default:
+		return nil, fmt.Errorf("Bucket '%s' is not supported, use Google Cloud Storage as 'gs://<bucket-name>', "+
+			"AWS S3 as 's3://<bucket-name>', local filesystem as 'file:///<path>' or in-memory as 'mem://'", bucketURL)
+	}
+}
+
+// parseMaxVersions parses the 'versions' option of backends emulating object versioning, which is the
+// max number of versions kept per object (including the live one). Defaults to 1, no previous versions
+func parseMaxVersions(options string) (int, error) {
+	query, err := url.ParseQuery(options)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse bucket URL options: %v", err)
+	}
+	if query.Get("versions") == "" {
+		return 1, nil
+	}
+
+	maxVersions, err := strconv.Atoi(query.Get("versions"))
+	if err != nil || maxVersions < 1 {
+		return 0, errors.New("Bucket 'versions' option has to be an integer greater than 0")
+	}
+	return maxVersions, nil
+}
+
+var (
+	lastVersion      int64
+	lastVersionMutex = &sync.Mutex{}
+)
+
+// newVersion returns a unique and increasing version timestamp (in nanoseconds),
+// for backends emulating object versioning
+func newVersion() time.Time {
+	lastVersionMutex.Lock()
+	defer lastVersionMutex.Unlock()
+
+	version := time.Now().UnixNano()
+	if version <= lastVersion {
+		version = lastVersion + 1
+	}
+	lastVersion = version
+
+	return time.Unix(0, version)
+}
+
+// formatVersion formats a version timestamp as ID, fixed width so IDs sort lexicographically
+func formatVersion(version time.Time) string {
+	return fmt.Sprintf("%020d", version.UnixNano())
+}
+
+// parseVersion parses a version ID created by formatVersion
+func parseVersion(version string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || len(version) != 20 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// compress compresses the data with zstd, prefixed by the expiry frame if expiresAt is set
+func compress(data []byte, expiresAt time.Time) ([]byte, error) {
+	compressedData, err := zstd.Compress(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.IsZero() {
+		return compressedData, nil
+	}
+	return append(expiryFrame(expiresAt), compressedData...), nil
+}
+
+// decompress decompresses object data, skipping its generation and expiry frames
+func decompress(compressedData []byte) ([]byte, error) {
+	compressedData = stripGenerationFrame(compressedData)
+	if !frameExpiry(compressedData).IsZero() {
+		compressedData = compressedData[expiryFrameSize:]
+	}
+	return zstd.Decompress(nil, compressedData)
+}
+
+func expiryFrame(expiresAt time.Time) []byte {
+	frame := make([]byte, expiryFrameSize)
+	binary.LittleEndian.PutUint32(frame, expiryFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:], expiryFrameSize-8)
+	binary.LittleEndian.PutUint64(frame[8:], uint64(expiresAt.UnixNano()))
+	return frame
+}
+
+// frameExpiry parses the expiry time of the frame at the start of compressed data, zero if none
+func frameExpiry(compressedData []byte) time.Time {
+	if len(compressedData) < expiryFrameSize || binary.LittleEndian.Uint32(compressedData) != expiryFrameMagic {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(compressedData[8:])))
+}
+
+func generationFrame(version time.Time) []byte {
+	frame := make([]byte, generationFrameSize)
+	binary.LittleEndian.PutUint32(frame, generationFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:], generationFrameSize-8)
+	binary.LittleEndian.PutUint64(frame[8:], uint64(version.UnixNano()))
+	return frame
+}
+
+// frameGeneration parses the generation of the frame at the start of object data, zero if none
+func frameGeneration(data []byte) int64 {
+	if len(data) < generationFrameSize || binary.LittleEndian.Uint32(data) != generationFrameMagic {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(data[8:]))
+}
+
+// stripGenerationFrame returns the object data after its generation frame, all of it if it has none
+func stripGenerationFrame(data []byte) []byte {
+	if frameGeneration(data) == 0 {
+		return data
+	}
+	return data[generationFrameSize:]
+}
+
+// compressStream copies the data read from r to w compressed with zstd, prefixed by the expiry frame
+// if expiresAt is set
+func compressStream(w io.Writer, r io.Reader, expiresAt time.Time) error {
+	if !expiresAt.IsZero() {
+		if _, err := w.Write(expiryFrame(expiresAt)); err != nil {
+			return err
+		}
+	}
+	zw := zstd.NewWriter(w)
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// decompressReader decompresses the data of an object reader, closing both when done
+type decompressReader struct {
+	io.ReadCloser
+	object io.Closer
+}
+
+// newDecompressReader returns the reader of the decompressed object data and the object expiry time,
+// skipping its generation and expiry frames
+func newDecompressReader(object io.ReadCloser) (io.ReadCloser, time.Time) {
+	compressedReader := bufio.NewReader(object)
+	if frame, _ := compressedReader.Peek(generationFrameSize); frameGeneration(frame) != 0 {
+		compressedReader.Discard(generationFrameSize)
+	}
+	frame, _ := compressedReader.Peek(expiryFrameSize)
+	expiresAt := frameExpiry(frame)
+	if !expiresAt.IsZero() {
+		compressedReader.Discard(expiryFrameSize)
+	}
+	return &decompressReader{ReadCloser: zstd.NewReader(compressedReader), object: object}, expiresAt
+}
+
+func (r *decompressReader) Close() error {
+	r.ReadCloser.Close()
+	return r.object.Close()
+}
+
+// statExpired returns the expired objects of a listing by stating them concurrently, for backends whose listings
+// don't return object metadata. Objects deleted meanwhile are skipped
+func statExpired(ctx context.Context, stat func(context.Context, string) (*ObjectAttrs, error),
+	objects []string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	expired := make([]bool, len(objects))
+	slots := make(chan struct{}, statExpiredConcurrency)
+	wg := &sync.WaitGroup{}
+	var statErr error
+	errOnce := &sync.Once{}
+	for i, object := range objects {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, object string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			attrs, err := stat(ctx, object)
+			if err != nil {
+				if !errors.Is(err, ErrObjectNotExist) {
+					errOnce.Do(func() {
+						statErr = err
+						cancel()
+					})
+				}
+				return
+			}
+			expired[i] = attrs.IsExpired()
+		}(i, object)
+	}
+	wg.Wait()
+	if statErr != nil {
+		return nil, statErr
+	}
+
+	expiredObjects := []string{}
+	for i, object := range objects {
+		if expired[i] {
+			expiredObjects = append(expiredObjects, object)
+		}
+	}
+	return expiredObjects, nil
+}
+
+func validateObject(op string, object string) error {
+	if len(object) == 0 {
+		return fmt.Errorf("store.%s: object cannot be empty string", op)
+	}
+	return nil
+}
+
+// filterListing applies the range, delimiter and limit to sorted object names matching prefix,
+// for backends without native listing
+func filterListing(names []string, prefix string, delimiter string, limit int, opts *ListOptions) []string {
+	startOffset, endOffset := opts.offsets()
+	objects := []string{}
+	for _, name := range names {
+		if limit > 0 && len(objects) == limit {
+			break
+		}
+		if startOffset != "" && name < startOffset {
+			continue
+		}
+		if endOffset != "" && name >= endOffset {
+			break
+		}
+		if delimiter != "" {
+			i := strings.Index(name[len(prefix):], delimiter)
+			if i == -1 {
+				// Skip objects at the prefix level, only common prefixes are returned
+				continue
+			}
+			commonPrefix := name[:len(prefix)+i+len(delimiter)]
+			if len(objects) > 0 && objects[len(objects)-1] == commonPrefix {
+				continue
+			}
+			name = commonPrefix
+		}
+		objects = append(objects, name)
+	}
+
+	return objects
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// coalescingBackend shares the in-flight reads and listings of a backend between concurrent identical calls,
+// so a burst of requests for the same cells or rows costs one bucket request
+type coalescingBackend struct {
+	Backend
+
+	mutex sync.Mutex
+	reads map[string]*call
+	lists map[string]*call
+}
+
+// call is an in-flight backend call, its results are set before done is closed
+type call struct {
+	done chan struct{}
+	// prefix of listings, to stop sharing them when an object under it is written or deleted
+	prefix string
+
+	data    []byte
+	attrs   *ObjectAttrs
+	objects []string
+	err     error
+}
+
+// Coalesce wraps the backend to share concurrent identical ReadObject and ListObjects calls. Calls started after
+// a write or delete of an object (through the wrapper) don't share calls started before, so they read it
+func Coalesce(backend Backend) Backend {
+	return &coalescingBackend{
+		Backend: backend,
+		reads:   make(map[string]*call),
+		lists:   make(map[string]*call),
+	}
+}
+
+// join returns the in-flight call of key, or a new one if there's none with true to run it
+func (b *coalescingBackend) join(calls map[string]*call, key string, prefix string) (*call, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if c, exists := calls[key]; exists {
+		return c, false
+	}
+	c := &call{done: make(chan struct{}), prefix: prefix}
+	calls[key] = c
+	return c, true
+}
+
+// finish shares the results of the call with the calls waiting for it
+func (b *coalescingBackend) finish(calls map[string]*call, key string, c *call) {
+	b.mutex.Lock()
+	if calls[key] == c {
+		delete(calls, key)
+	}
+	b.mutex.Unlock()
+	close(c.done)
+}
+
+// wait waits for the results of a call run by another caller. If it failed as that caller went away,
+// retry is returned to run the call again
+func wait(ctx context.Context, c *call) (retry bool, err error) {
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	if (errors.Is(c.err, context.Canceled) || errors.Is(c.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+		return true, nil
+	}
+	return false, nil
+}
+
+// forget stops sharing the in-flight calls which might not see the write or delete of the object
+func (b *coalescingBackend) forget(object string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.reads, object)
+	for key, c := range b.lists {
+		if strings.HasPrefix(object, c.prefix) {
+			delete(b.lists, key)
+		}
+	}
+}
+
+func (b *coalescingBackend) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *ListOptions) ([]string, error) {
+	startOffset, endOffset := opts.offsets()
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00%s", prefix, delimiter, limit, startOffset, endOffset)
+	c, run := b.join(b.lists, key, prefix)
+	if run {
+		c.objects, c.err = b.Backend.ListObjects(ctx, prefix, delimiter, limit, opts)
+		b.finish(b.lists, key, c)
+		return c.objects, c.err
+	}
+
+	retry, err := wait(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if retry {
+		return b.Backend.ListObjects(ctx, prefix, delimiter, limit, opts)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	// Callers sort and filter the listings they get
+	return append([]string(nil), c.objects...), nil
+}
+
+func (b *coalescingBackend) ReadObject(ctx context.Context, object string) ([]byte, *ObjectAttrs, error) {
+	c, run := b.join(b.reads, object, "")
+	if run {
+		c.data, c.attrs, c.err = b.Backend.ReadObject(ctx, object)
+		b.finish(b.reads, object, c)
+		return c.data, c.attrs, c.err
+	}
+
+	retry, err := wait(ctx, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if retry {
+		return b.Backend.ReadObject(ctx, object)
+	}
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	attrs := *c.attrs
+	return append([]byte(nil), c.data...), &attrs, nil
+}
+
+func (b *coalescingBackend) WriteObject(ctx context.Context, object string, data []byte,
+	opts *WriteOptions) (*ObjectAttrs, error) {
+	attrs, err := b.Backend.WriteObject(ctx, object, data, opts)
+	b.forget(object)
+	return attrs, err
+}
+
+func (b *coalescingBackend) WriteObjectStream(ctx context.Context, object string, r io.Reader,
+	opts *WriteOptions) (*ObjectAttrs, error) {
+	attrs, err := b.Backend.WriteObjectStream(ctx, object, r, opts)
+	b.forget(object)
+	return attrs, err
+}
+
+func (b *coalescingBackend) DeleteObject(ctx context.Context, object string) error {
+	err := b.Backend.DeleteObject(ctx, object)
+	b.forget(object)
+	return err
+}
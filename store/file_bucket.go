@@ -0,0 +1,547 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileTempPrefix  = ".bigbucket-tmp-"
+	fileVersionsDir = ".versions"
+)
+
+// fileBucket is the local filesystem backend, objects are stored as zstd files under the root directory.
+// Object versioning is emulated by keeping previous versions under <root>/.versions/<object>/<version>,
+// where the version is the generation of the file
+type fileBucket struct {
+	root        string
+	maxVersions int
+	// locks serialize writes and deletes of the same object, sharded by object name hash
+	locks [64]sync.Mutex
+}
+
+func newFileBucket(root string, maxVersions int) (*fileBucket, error) {
+	if root == "" {
+		return nil, errors.New("File bucket path cannot be empty, use 'file:///<path>'")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create file bucket directory: %v", err)
+	}
+
+	return &fileBucket{root: root, maxVersions: maxVersions}, nil
+}
+
+// ListObjects lists objects in the bucket directory, in lexicographic order like GCS
+func (b *fileBucket) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *ListOptions) ([]string, error) {
+	// Only walk the deepest directory that can contain objects matching the prefix
+	walkRoot := b.root
+	if i := strings.LastIndex(prefix, "/"); i > -1 {
+		walkRoot = filepath.Join(b.root, filepath.FromSlash(prefix[:i]))
+	}
+
+	names := []string{}
+	err := filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if d.IsDir() {
+			if path == filepath.Join(b.root, fileVersionsDir) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), fileTempPrefix) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relPath)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	return filterListing(names, prefix, delimiter, limit, opts), nil
+}
+
+// WriteObject writes data to a file, will be compressed with zstd.
+// Preconditions are only guaranteed between writers of the same process
+func (b *fileBucket) WriteObject(ctx context.Context, object string, data []byte, opts *WriteOptions) (*ObjectAttrs, error) {
+	path, err := b.objectPath("WriteObject", object)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("store.WriteObject: data cannot be nil")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	compressedData, err := compress(data, opts.expiresAt())
+	if err != nil {
+		return nil, err
+	}
+
+	return b.writeFile(object, path, opts, func(w io.Writer) error {
+		_, err := w.Write(compressedData)
+		return err
+	})
+}
+
+// WriteObjectStream writes the data read from r to a file, will be compressed with zstd.
+// Preconditions are only guaranteed between writers of the same process
+func (b *fileBucket) WriteObjectStream(ctx context.Context, object string, r io.Reader,
+	opts *WriteOptions) (*ObjectAttrs, error) {
+	path, err := b.objectPath("WriteObjectStream", object)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return b.writeFile(object, path, opts, func(w io.Writer) error {
+		return compressStream(w, r, opts.expiresAt())
+	})
+}
+
+// writeFile writes the compressed data of an object to a temp file first, which is renamed to the object path
+// once the preconditions are checked, so readers never see partial objects
+func (b *fileBucket) writeFile(object string, path string, opts *WriteOptions,
+	write func(w io.Writer) error) (*ObjectAttrs, error) {
+	tmpFile, err := b.createTempFile(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	// The generation frame is filled in once the generation is known
+	if _, err := tmpFile.Write(make([]byte, generationFrameSize)); err != nil {
+		return nil, err
+	}
+	if err := write(tmpFile); err != nil {
+		return nil, err
+	}
+	info, err := tmpFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := b.objectLock(object)
+	lock.Lock()
+	defer lock.Unlock()
+
+	liveAttrs, err := b.statFile(object, path)
+	if err != nil && !errors.Is(err, ErrObjectNotExist) {
+		return nil, err
+	}
+	if ifGeneration := opts.ifGenerationMatch(); ifGeneration != "" {
+		generation := NoGeneration
+		if liveAttrs != nil {
+			generation = liveAttrs.Generation
+		}
+		if generation != ifGeneration {
+			return nil, ErrPreconditionFailed
+		}
+	}
+
+	// Generations of an object only increase, even if the clock went back since the live file was written
+	version := newVersion()
+	if liveAttrs != nil {
+		if liveVersion, ok := parseVersion(liveAttrs.Generation); ok && !version.After(liveVersion) {
+			version = liveVersion.Add(1)
+		}
+	}
+	if _, err := tmpFile.WriteAt(generationFrame(version), 0); err != nil {
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chtimes(tmpFile.Name(), version, version); err != nil {
+		return nil, err
+	}
+	if b.maxVersions > 1 {
+		if err := b.addVersion(object, tmpFile.Name(), formatVersion(version)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return nil, err
+	}
+
+	return &ObjectAttrs{
+		Name:       object,
+		Size:       info.Size() - generationFrameSize,
+		Version:    formatVersion(version),
+		Generation: formatVersion(version),
+		Updated:    version,
+		ExpiresAt:  opts.expiresAt(),
+	}, nil
+}
+
+// ReadObject reads data from a file, will be automatically decompressed
+func (b *fileBucket) ReadObject(ctx context.Context, object string) ([]byte, *ObjectAttrs, error) {
+	path, err := b.objectPath("ReadObject", object)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fileError(err)
+	}
+	defer file.Close()
+
+	// Stat the opened file, as the path might be replaced by a concurrent write
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	compressedData, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs := fileObjectAttrs(object, info, compressedData)
+	compressedData = stripGenerationFrame(compressedData)
+	data, err := decompress(compressedData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attrs.ExpiresAt = frameExpiry(compressedData)
+	return data, attrs, nil
+}
+
+// ReadObjectStream reads data from a file, decompressed as it's read
+func (b *fileBucket) ReadObjectStream(ctx context.Context, object string) (io.ReadCloser, *ObjectAttrs, error) {
+	path, err := b.objectPath("ReadObjectStream", object)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fileError(err)
+	}
+	// Stat the opened file, as the path might be replaced by a concurrent write
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	frame := make([]byte, generationFrameSize)
+	n, _ := io.ReadFull(file, frame)
+	if frameGeneration(frame[:n]) == 0 {
+		// Written without a generation frame, the data starts at the beginning
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	attrs := fileObjectAttrs(object, info, frame[:n])
+	r, expiresAt := newDecompressReader(file)
+	attrs.ExpiresAt = expiresAt
+	return r, attrs, nil
+}
+
+// DeleteObject deletes a file and its parent directories if left empty
+func (b *fileBucket) DeleteObject(ctx context.Context, object string) error {
+	path, err := b.objectPath("DeleteObject", object)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	lock := b.objectLock(object)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.Remove(path); err != nil {
+		return fileError(err)
+	}
+
+	for dir := filepath.Dir(path); dir != b.root; dir = filepath.Dir(dir) {
+		// Fails and stops when directory is not empty
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+// StatObject gets the attributes of a file
+func (b *fileBucket) StatObject(ctx context.Context, object string) (*ObjectAttrs, error) {
+	path, err := b.objectPath("StatObject", object)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return b.statFile(object, path)
+}
+
+// ListExpiredObjects lists the expired files starting with prefix, reading the expiry frame of each
+func (b *fileBucket) ListExpiredObjects(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := b.ListObjects(ctx, prefix, "", 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return statExpired(ctx, b.StatObject, objects)
+}
+
+// ListObjectVersions lists the live file and previous versions kept under the versions directory
+func (b *fileBucket) ListObjectVersions(ctx context.Context, object string) ([]ObjectAttrs, error) {
+	path, err := b.objectPath("ListObjectVersions", object)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	versions := []ObjectAttrs{}
+	entries, err := os.ReadDir(b.versionsPath(object))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		attrs, err := b.statFile(object, filepath.Join(b.versionsPath(object), entry.Name()))
+		if errors.Is(err, ErrObjectNotExist) {
+			// Removed by a concurrent write over the versions limit
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		attrs.Version = entry.Name()
+		attrs.Generation = entry.Name()
+		versions = append(versions, *attrs)
+	}
+
+	// The live file is only missing from versions if written while versioning was disabled
+	if attrs, err := b.statFile(object, path); err == nil {
+		found := false
+		for _, version := range versions {
+			if version.Version == attrs.Version {
+				found = true
+				break
+			}
+		}
+		if !found {
+			versions = append(versions, *attrs)
+		}
+	}
+	if len(versions) == 0 {
+		return nil, ErrObjectNotExist
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	return versions, nil
+}
+
+// ReadObjectVersion reads data from a file version, will be automatically decompressed
+func (b *fileBucket) ReadObjectVersion(ctx context.Context, object string, version string) ([]byte, error) {
+	path, err := b.objectPath("ReadObjectVersion", object)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := parseVersion(version); !ok {
+		return nil, ErrObjectNotExist
+	}
+
+	compressedData, err := ioutil.ReadFile(filepath.Join(b.versionsPath(object), version))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Fallback to the live file, if it is the requested version
+		attrs, statErr := b.statFile(object, path)
+		if statErr != nil || attrs.Version != version {
+			return nil, ErrObjectNotExist
+		}
+		compressedData, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fileError(err)
+	}
+	return decompress(stripGenerationFrame(compressedData))
+}
+
+// addVersion links the new file to the versions directory and removes the oldest versions over the limit
+func (b *fileBucket) addVersion(object string, filePath string, version string) error {
+	versionsPath := b.versionsPath(object)
+	if err := os.MkdirAll(versionsPath, 0755); err != nil {
+		return err
+	}
+
+	versionPath := filepath.Join(versionsPath, version)
+	if err := os.Link(filePath, versionPath); err != nil {
+		// Filesystem might not support hard links, copy the file instead
+		data, readErr := ioutil.ReadFile(filePath)
+		if readErr != nil {
+			return readErr
+		}
+		if err := ioutil.WriteFile(versionPath, data, 0644); err != nil {
+			return err
+		}
+		versionTime, _ := parseVersion(version)
+		if err := os.Chtimes(versionPath, versionTime, versionTime); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(versionsPath)
+	if err != nil {
+		return err
+	}
+	// Entries are sorted by name, so oldest versions first
+	for i := 0; i < len(entries)-b.maxVersions; i++ {
+		os.Remove(filepath.Join(versionsPath, entries[i].Name()))
+	}
+
+	return nil
+}
+
+func (b *fileBucket) objectLock(object string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(object))
+	return &b.locks[hash.Sum32()%uint32(len(b.locks))]
+}
+
+// createTempFile creates a temp file in dir, creating dir if it doesn't exist
+func (b *fileBucket) createTempFile(dir string) (*os.File, error) {
+	var err error
+	// Retry as empty directories are removed by concurrent deletes
+	for i := 0; i < 3; i++ {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		var tmpFile *os.File
+		tmpFile, err = ioutil.TempFile(dir, fileTempPrefix)
+		if err == nil {
+			return tmpFile, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (b *fileBucket) versionsPath(object string) string {
+	return filepath.Join(b.root, fileVersionsDir, filepath.FromSlash(object))
+}
+
+// statFile gets the attributes of a file from its info and the frames at its start, opened once so they're
+// of the same file if the path is replaced by a concurrent write
+func (b *fileBucket) statFile(object string, path string) (*ObjectAttrs, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrObjectNotExist
+	}
+
+	frames := make([]byte, generationFrameSize+expiryFrameSize)
+	n, _ := io.ReadFull(file, frames)
+	attrs := fileObjectAttrs(object, info, frames[:n])
+	attrs.ExpiresAt = frameExpiry(stripGenerationFrame(frames[:n]))
+	return attrs, nil
+}
+
+// fileObjectAttrs returns the attributes of a file from its info and data (at least the generation frame)
+func fileObjectAttrs(object string, info fs.FileInfo, data []byte) *ObjectAttrs {
+	size := info.Size()
+	generation := frameGeneration(data)
+	if generation == 0 {
+		// Written without a generation frame, the modification time was the generation
+		generation = info.ModTime().UnixNano()
+	} else {
+		size -= generationFrameSize
+	}
+	return &ObjectAttrs{
+		Name:       object,
+		Size:       size,
+		Version:    formatVersion(time.Unix(0, generation)),
+		Generation: formatVersion(time.Unix(0, generation)),
+		Updated:    info.ModTime(),
+	}
+}
+
+func (b *fileBucket) objectPath(op string, object string) (string, error) {
+	if err := validateObject(op, object); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(b.root, filepath.FromSlash(object))
+	if !strings.HasPrefix(path, b.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("store.%s: object '%s' is outside of the bucket", op, object)
+	}
+	return path, nil
+}
+
+// fileError maps filesystem errors to store errors
+func fileError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrObjectNotExist
+	}
+	return err
+}
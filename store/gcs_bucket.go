@@ -3,38 +3,45 @@ package store
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"sort"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/storage"
-	"github.com/DataDog/zstd"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
-var (
-	// BucketName is the GCS bucket name
-	BucketName string
-	googBucket storage.BucketHandle
-)
+// gcsBucket is the Google Cloud Storage backend
+type gcsBucket struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSBucket(name string) (*gcsBucket, error) {
+	if name == "" {
+		return nil, errors.New("GCS bucket name cannot be empty, use 'gs://<bucket-name>'")
+	}
 
-// InitGoog initializes the GCS bucket client
-func InitGoog() {
 	gcsClient, err := storage.NewClient(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to create Google Storage client: %v", err)
+		return nil, fmt.Errorf("Failed to create Google Storage client: %v", err)
 	}
 
-	googBucket = *gcsClient.Bucket(BucketName)
+	return &gcsBucket{bucket: gcsClient.Bucket(name)}, nil
 }
 
 // ListObjects lists objects in GCS bucket
-func ListObjects(prefix string, delimiter string, limit int) ([]string, error) {
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*30)
+func (b *gcsBucket) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *ListOptions) ([]string, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
 
-	query := &storage.Query{Prefix: prefix, Delimiter: delimiter}
-	it := googBucket.Objects(ctxTimeout, query)
+	startOffset, endOffset := opts.offsets()
+	query := &storage.Query{Prefix: prefix, Delimiter: delimiter, StartOffset: startOffset, EndOffset: endOffset}
+	it := b.bucket.Objects(ctxTimeout, query)
 
 	var objects []string
 	count := 0
@@ -47,9 +54,13 @@ func ListObjects(prefix string, delimiter string, limit int) ([]string, error) {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, gcsError(err)
 		}
 		if delimiter != "" {
+			if attrs.Prefix == "" {
+				// Skip objects at the prefix level, only common prefixes are returned
+				continue
+			}
 			objects = append(objects, attrs.Prefix)
 		} else {
 			objects = append(objects, attrs.Name)
@@ -61,76 +72,295 @@ func ListObjects(prefix string, delimiter string, limit int) ([]string, error) {
 }
 
 // WriteObject writes data to GCS object, will be compressed with zstd
-func WriteObject(object string, data []byte) error {
-	if len(object) == 0 {
-		return errors.New("store.WriteObject: object cannot be empty string")
+func (b *gcsBucket) WriteObject(ctx context.Context, object string, data []byte, opts *WriteOptions) (*ObjectAttrs, error) {
+	if err := validateObject("WriteObject", object); err != nil {
+		return nil, err
 	}
 	if data == nil {
-		return errors.New("store.WriteObject: data cannot be nil")
+		return nil, errors.New("store.WriteObject: data cannot be nil")
 	}
 
-	compressedData, err := zstd.Compress(nil, data)
+	compressedData, err := compress(data, opts.expiresAt())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*30)
-	defer cancel()
+	obj, err := b.conditionalObject(object, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	obj := googBucket.Object(object)
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
 
 	w := obj.NewWriter(ctxTimeout)
+	w.Metadata = opts.expiryMetadata()
 	w.Write(compressedData)
 
 	if err := w.Close(); err != nil {
-		return err
+		return nil, gcsError(err)
 	}
 
-	return nil
+	return gcsObjectAttrs(w.Attrs()), nil
 }
 
-// ReadObject reads data from GCS object, will be automatically decompressed
-func ReadObject(object string) ([]byte, error) {
-	if len(object) == 0 {
-		return nil, errors.New("store.ReadObject: object cannot be empty string")
+// WriteObjectStream writes the data read from r to GCS object, will be compressed with zstd.
+// The upload is aborted if reading r fails
+func (b *gcsBucket) WriteObjectStream(ctx context.Context, object string, r io.Reader,
+	opts *WriteOptions) (*ObjectAttrs, error) {
+	if err := validateObject("WriteObjectStream", object); err != nil {
+		return nil, err
+	}
+	obj, err := b.conditionalObject(object, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	ctxCancel, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	obj := googBucket.Object(object)
+	w := obj.NewWriter(ctxCancel)
+	w.Metadata = opts.expiryMetadata()
+	if err := compressStream(w, r, opts.expiresAt()); err != nil {
+		// Canceling the writer context aborts the upload
+		cancel()
+		w.Close()
+		return nil, gcsError(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, gcsError(err)
+	}
+
+	return gcsObjectAttrs(w.Attrs()), nil
+}
+
+// conditionalObject returns the object handle with the preconditions of the write options
+func (b *gcsBucket) conditionalObject(object string, opts *WriteOptions) (*storage.ObjectHandle, error) {
+	obj := b.bucket.Object(object)
+	if ifGeneration := opts.ifGenerationMatch(); ifGeneration == NoGeneration {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	} else if ifGeneration != "" {
+		generation, err := strconv.ParseInt(ifGeneration, 10, 64)
+		if err != nil {
+			return nil, ErrPreconditionFailed
+		}
+		obj = obj.If(storage.Conditions{GenerationMatch: generation})
+	}
+	return obj, nil
+}
+
+// ReadObject reads data from GCS object, will be automatically decompressed
+func (b *gcsBucket) ReadObject(ctx context.Context, object string) ([]byte, *ObjectAttrs, error) {
+	if err := validateObject("ReadObject", object); err != nil {
+		return nil, nil, err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
 
-	r, err := obj.NewReader(ctxTimeout)
+	r, err := b.bucket.Object(object).NewReader(ctxTimeout)
 	if err != nil {
-		return nil, err
+		return nil, nil, gcsError(err)
 	}
 	defer r.Close()
 
 	compressedData, err := ioutil.ReadAll(r)
 	if err != nil {
+		return nil, nil, err
+	}
+	data, err := decompress(compressedData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Readers don't return the object metadata, the expiry time is read from the data instead
+	attrs := gcsReaderAttrs(object, r)
+	attrs.ExpiresAt = frameExpiry(compressedData)
+	return data, attrs, nil
+}
+
+// ReadObjectStream reads data from GCS object, decompressed as it's read
+func (b *gcsBucket) ReadObjectStream(ctx context.Context, object string) (io.ReadCloser, *ObjectAttrs, error) {
+	if err := validateObject("ReadObjectStream", object); err != nil {
+		return nil, nil, err
+	}
+
+	r, err := b.bucket.Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, nil, gcsError(err)
+	}
+
+	attrs := gcsReaderAttrs(object, r)
+	decompressReader, expiresAt := newDecompressReader(r)
+	attrs.ExpiresAt = expiresAt
+	return decompressReader, attrs, nil
+}
+
+// DeleteObject deletes a GCS object
+func (b *gcsBucket) DeleteObject(ctx context.Context, object string) error {
+	if err := validateObject("DeleteObject", object); err != nil {
+		return err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	if err := b.bucket.Object(object).Delete(ctxTimeout); err != nil {
+		return gcsError(err)
+	}
+
+	return nil
+}
+
+// StatObject gets the attributes of a GCS object
+func (b *gcsBucket) StatObject(ctx context.Context, object string) (*ObjectAttrs, error) {
+	if err := validateObject("StatObject", object); err != nil {
 		return nil, err
 	}
-	data, err := zstd.Decompress(nil, compressedData)
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	attrs, err := b.bucket.Object(object).Attrs(ctxTimeout)
 	if err != nil {
+		return nil, gcsError(err)
+	}
+
+	return gcsObjectAttrs(attrs), nil
+}
+
+// ListExpiredObjects lists the expired GCS objects starting with prefix, from the metadata in listings
+func (b *gcsBucket) ListExpiredObjects(ctx context.Context, prefix string) ([]string, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Metadata"}); err != nil {
 		return nil, err
 	}
-	return data, nil
+	it := b.bucket.Objects(ctxTimeout, query)
+
+	expired := []string{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, gcsError(err)
+		}
+		if (&ObjectAttrs{ExpiresAt: metadataExpiry(attrs.Metadata)}).IsExpired() {
+			expired = append(expired, attrs.Name)
+		}
+	}
+
+	return expired, nil
 }
 
-// DeleteObject deletes a GCS object
-func DeleteObject(object string) error {
-	if len(object) == 0 {
-		return errors.New("store.DeleteObject: object cannot be empty string")
+// ListObjectVersions lists the generations of a GCS object
+func (b *gcsBucket) ListObjectVersions(ctx context.Context, object string) ([]ObjectAttrs, error) {
+	if err := validateObject("ListObjectVersions", object); err != nil {
+		return nil, err
 	}
 
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
 
-	obj := googBucket.Object(object)
+	it := b.bucket.Objects(ctxTimeout, &storage.Query{Prefix: object, Versions: true})
 
-	if err := obj.Delete(ctxTimeout); err != nil {
-		return err
+	generations := []*storage.ObjectAttrs{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, gcsError(err)
+		}
+		// Prefix also matches other objects starting with the object name
+		if attrs.Name == object {
+			generations = append(generations, attrs)
+		}
+	}
+	if len(generations) == 0 {
+		return nil, ErrObjectNotExist
 	}
 
-	return nil
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Generation > generations[j].Generation
+	})
+	versions := make([]ObjectAttrs, len(generations))
+	for i, attrs := range generations {
+		versions[i] = *gcsObjectAttrs(attrs)
+	}
+
+	return versions, nil
+}
+
+// ReadObjectVersion reads data from a GCS object generation, will be automatically decompressed
+func (b *gcsBucket) ReadObjectVersion(ctx context.Context, object string, version string) ([]byte, error) {
+	if err := validateObject("ReadObjectVersion", object); err != nil {
+		return nil, err
+	}
+	generation, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, ErrObjectNotExist
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	r, err := b.bucket.Object(object).Generation(generation).NewReader(ctxTimeout)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	defer r.Close()
+
+	compressedData, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(compressedData)
+}
+
+func gcsObjectAttrs(attrs *storage.ObjectAttrs) *ObjectAttrs {
+	generation := strconv.FormatInt(attrs.Generation, 10)
+	return &ObjectAttrs{
+		Name:       attrs.Name,
+		Size:       attrs.Size,
+		Version:    generation,
+		Generation: generation,
+		Updated:    attrs.Updated,
+		ExpiresAt:  metadataExpiry(attrs.Metadata),
+	}
+}
+
+func gcsReaderAttrs(object string, r *storage.Reader) *ObjectAttrs {
+	generation := strconv.FormatInt(r.Attrs.Generation, 10)
+	return &ObjectAttrs{
+		Name:       object,
+		Size:       r.Attrs.Size,
+		Version:    generation,
+		Generation: generation,
+		Updated:    r.Attrs.LastModified,
+	}
+}
+
+// gcsError maps GCS client errors to store errors
+func gcsError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrObjectNotExist
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case 412:
+			return ErrPreconditionFailed
+		case 429:
+			return fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+	}
+
+	return err
 }
@@ -0,0 +1,300 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memBucket is the in-process backend, objects are kept in a map with sorted names for listing.
+// Everything is lost when the process exits, meant for tests and ephemeral instances
+type memBucket struct {
+	mutex   sync.RWMutex
+	objects map[string]memObject
+	names   []string
+	// versions keeps the latest versions of each object, oldest first, if maxVersions > 1
+	versions    map[string][]memObject
+	maxVersions int
+}
+
+type memObject struct {
+	data    []byte
+	version time.Time
+}
+
+func newMemBucket(maxVersions int) *memBucket {
+	return &memBucket{
+		objects:     make(map[string]memObject),
+		versions:    make(map[string][]memObject),
+		maxVersions: maxVersions,
+	}
+}
+
+// ListObjects lists objects in memory, in lexicographic order like GCS
+func (b *memBucket) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *ListOptions) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	start := prefix
+	if startOffset, _ := opts.offsets(); startOffset > start {
+		start = startOffset
+	}
+
+	names := []string{}
+	for i := sort.SearchStrings(b.names, start); i < len(b.names); i++ {
+		if !strings.HasPrefix(b.names[i], prefix) {
+			break
+		}
+		names = append(names, b.names[i])
+	}
+
+	return filterListing(names, prefix, delimiter, limit, opts), nil
+}
+
+// WriteObject writes data to memory, will be compressed with zstd
+func (b *memBucket) WriteObject(ctx context.Context, object string, data []byte, opts *WriteOptions) (*ObjectAttrs, error) {
+	if err := validateObject("WriteObject", object); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("store.WriteObject: data cannot be nil")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	compressedData, err := compress(data, opts.expiresAt())
+	if err != nil {
+		return nil, err
+	}
+
+	return b.putObject(object, compressedData, opts)
+}
+
+// WriteObjectStream writes the data read from r to memory, will be compressed with zstd
+func (b *memBucket) WriteObjectStream(ctx context.Context, object string, r io.Reader,
+	opts *WriteOptions) (*ObjectAttrs, error) {
+	if err := validateObject("WriteObjectStream", object); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var compressedData bytes.Buffer
+	if err := compressStream(&compressedData, r, opts.expiresAt()); err != nil {
+		return nil, err
+	}
+
+	return b.putObject(object, compressedData.Bytes(), opts)
+}
+
+// putObject stores the compressed data of an object, checking the preconditions
+func (b *memBucket) putObject(object string, compressedData []byte, opts *WriteOptions) (*ObjectAttrs, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if ifGeneration := opts.ifGenerationMatch(); ifGeneration != "" {
+		generation := NoGeneration
+		if obj, exists := b.objects[object]; exists {
+			generation = formatVersion(obj.version)
+		}
+		if generation != ifGeneration {
+			return nil, ErrPreconditionFailed
+		}
+	}
+
+	if _, exists := b.objects[object]; !exists {
+		i := sort.SearchStrings(b.names, object)
+		b.names = append(b.names, "")
+		copy(b.names[i+1:], b.names[i:])
+		b.names[i] = object
+	}
+	obj := memObject{data: compressedData, version: newVersion()}
+	b.objects[object] = obj
+	if b.maxVersions > 1 {
+		versions := append(b.versions[object], obj)
+		if len(versions) > b.maxVersions {
+			versions = versions[len(versions)-b.maxVersions:]
+		}
+		b.versions[object] = versions
+	}
+
+	return obj.attrs(object), nil
+}
+
+// ReadObject reads data from memory, will be automatically decompressed
+func (b *memBucket) ReadObject(ctx context.Context, object string) ([]byte, *ObjectAttrs, error) {
+	if err := validateObject("ReadObject", object); err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	b.mutex.RLock()
+	obj, exists := b.objects[object]
+	b.mutex.RUnlock()
+	if !exists {
+		return nil, nil, ErrObjectNotExist
+	}
+
+	data, err := decompress(obj.data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, obj.attrs(object), nil
+}
+
+// ReadObjectStream reads data from memory, decompressed as it's read
+func (b *memBucket) ReadObjectStream(ctx context.Context, object string) (io.ReadCloser, *ObjectAttrs, error) {
+	if err := validateObject("ReadObjectStream", object); err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	b.mutex.RLock()
+	obj, exists := b.objects[object]
+	b.mutex.RUnlock()
+	if !exists {
+		return nil, nil, ErrObjectNotExist
+	}
+
+	r, _ := newDecompressReader(ioutil.NopCloser(bytes.NewReader(obj.data)))
+	return r, obj.attrs(object), nil
+}
+
+// DeleteObject deletes an object from memory
+func (b *memBucket) DeleteObject(ctx context.Context, object string) error {
+	if err := validateObject("DeleteObject", object); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, exists := b.objects[object]; !exists {
+		return ErrObjectNotExist
+	}
+	delete(b.objects, object)
+	i := sort.SearchStrings(b.names, object)
+	b.names = append(b.names[:i], b.names[i+1:]...)
+
+	return nil
+}
+
+// StatObject gets the attributes of an object in memory
+func (b *memBucket) StatObject(ctx context.Context, object string) (*ObjectAttrs, error) {
+	if err := validateObject("StatObject", object); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mutex.RLock()
+	obj, exists := b.objects[object]
+	b.mutex.RUnlock()
+	if !exists {
+		return nil, ErrObjectNotExist
+	}
+
+	return obj.attrs(object), nil
+}
+
+// ListExpiredObjects lists the expired objects in memory starting with prefix
+func (b *memBucket) ListExpiredObjects(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	expired := []string{}
+	for i := sort.SearchStrings(b.names, prefix); i < len(b.names) && strings.HasPrefix(b.names[i], prefix); i++ {
+		if b.objects[b.names[i]].attrs(b.names[i]).IsExpired() {
+			expired = append(expired, b.names[i])
+		}
+	}
+	return expired, nil
+}
+
+// ListObjectVersions lists the live and previous versions of an object in memory
+func (b *memBucket) ListObjectVersions(ctx context.Context, object string) ([]ObjectAttrs, error) {
+	if err := validateObject("ListObjectVersions", object); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	objVersions := b.versions[object]
+	if obj, exists := b.objects[object]; exists && len(objVersions) == 0 {
+		objVersions = []memObject{obj}
+	}
+	if len(objVersions) == 0 {
+		return nil, ErrObjectNotExist
+	}
+
+	versions := make([]ObjectAttrs, len(objVersions))
+	for i, obj := range objVersions {
+		versions[len(objVersions)-1-i] = *obj.attrs(object)
+	}
+
+	return versions, nil
+}
+
+// ReadObjectVersion reads data from an object version in memory, will be automatically decompressed
+func (b *memBucket) ReadObjectVersion(ctx context.Context, object string, version string) ([]byte, error) {
+	if err := validateObject("ReadObjectVersion", object); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if obj, exists := b.objects[object]; exists && formatVersion(obj.version) == version {
+		return decompress(obj.data)
+	}
+	for _, obj := range b.versions[object] {
+		if formatVersion(obj.version) == version {
+			return decompress(obj.data)
+		}
+	}
+
+	return nil, ErrObjectNotExist
+}
+
+func (obj memObject) attrs(object string) *ObjectAttrs {
+	return &ObjectAttrs{
+		Name:       object,
+		Size:       int64(len(obj.data)),
+		Version:    formatVersion(obj.version),
+		Generation: formatVersion(obj.version),
+		Updated:    obj.version,
+		ExpiresAt:  frameExpiry(obj.data),
+	}
+}
@@ -0,0 +1,535 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// s3PartSize is the size of the parts of multipart uploads, S3 requires at least 5MiB except for the last part
+const s3PartSize = 8 << 20
+
+// s3Bucket is the AWS S3 (and S3-compatible, e.g. MinIO/LocalStack) backend
+type s3Bucket struct {
+	client *s3.Client
+	name   string
+}
+
+// newS3Bucket creates the S3 client from a bucket URL like
+// s3://<bucket-name>?region=<region>&endpoint=<url>&pathStyle=true
+func newS3Bucket(bucketURL string) (*s3Bucket, error) {
+	parsedURL, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse S3 bucket URL: %v", err)
+	}
+	if parsedURL.Host == "" {
+		return nil, errors.New("S3 bucket name cannot be empty, use 's3://<bucket-name>'")
+	}
+
+	query := parsedURL.Query()
+	region := query.Get("region")
+	endpoint := query.Get("endpoint")
+	pathStyle := false
+	if value := query.Get("pathStyle"); value != "" {
+		pathStyle, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New("S3 bucket 'pathStyle' option has to be a boolean")
+		}
+	}
+
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load AWS config: %v", err)
+	}
+	if region != "" {
+		cfg.Region = region
+	}
+	if cfg.Region == "" {
+		// Custom endpoints usually don't care about the region, but requests still need to be signed with one
+		cfg.Region = "us-east-1"
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+		if endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint, func(e *aws.Endpoint) {
+				e.HostnameImmutable = pathStyle
+			})
+		}
+	})
+
+	return &s3Bucket{client: client, name: parsedURL.Host}, nil
+}
+
+// ListObjects lists objects in S3 bucket, paginating through ListObjectsV2.
+// S3 only supports an exclusive StartAfter, so the range is also checked on the listed names
+func (b *s3Bucket) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *ListOptions) ([]string, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	startOffset, endOffset := opts.offsets()
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(b.name), Prefix: aws.String(prefix)}
+	if _, size := utf8.DecodeLastRuneInString(startOffset); len(startOffset) > size {
+		// Start after startOffset without its last char, names before startOffset are filtered below
+		input.StartAfter = aws.String(startOffset[:len(startOffset)-size])
+	}
+	if delimiter != "" {
+		input.Delimiter = aws.String(delimiter)
+	}
+	if limit > 0 && limit < 1000 {
+		input.MaxKeys = int32(limit)
+	}
+
+	objects := []string{}
+	paginator := s3.NewListObjectsV2Paginator(b.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctxTimeout)
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		names := []string{}
+		if delimiter != "" {
+			for _, commonPrefix := range page.CommonPrefixes {
+				names = append(names, aws.ToString(commonPrefix.Prefix))
+			}
+		} else {
+			for _, object := range page.Contents {
+				names = append(names, aws.ToString(object.Key))
+			}
+		}
+		for _, name := range names {
+			// Common prefixes are in range if they can contain object names after startOffset
+			if startOffset != "" && name < startOffset && !strings.HasPrefix(startOffset, name) {
+				continue
+			}
+			if endOffset != "" && name >= endOffset {
+				return objects, nil
+			}
+			objects = append(objects, name)
+			if limit > 0 && len(objects) == limit {
+				return objects, nil
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+// WriteObject writes data to S3 object, will be compressed with zstd and prefixed by a generation frame.
+// Preconditions are sent as If-Match/If-None-Match headers on the ETag
+func (b *s3Bucket) WriteObject(ctx context.Context, object string, data []byte, opts *WriteOptions) (*ObjectAttrs, error) {
+	if err := validateObject("WriteObject", object); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("store.WriteObject: data cannot be nil")
+	}
+
+	compressedData, err := compress(data, opts.expiresAt())
+	if err != nil {
+		return nil, err
+	}
+	// ETags are derived from the data, so a generation frame makes them unique per write
+	compressedData = append(generationFrame(newVersion()), compressedData...)
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	return b.putObject(ctxTimeout, object, compressedData, opts)
+}
+
+func (b *s3Bucket) putObject(ctx context.Context, object string, compressedData []byte,
+	opts *WriteOptions) (*ObjectAttrs, error) {
+	output, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(b.name),
+		Key:      aws.String(object),
+		Body:     bytes.NewReader(compressedData),
+		Metadata: opts.expiryMetadata(),
+	}, s3Preconditions(opts)...)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return &ObjectAttrs{
+		Name:       object,
+		Size:       int64(len(compressedData)),
+		Version:    s3VersionID(output.VersionId),
+		Generation: s3Generation(output.ETag),
+		Updated:    time.Now(),
+		ExpiresAt:  opts.expiresAt(),
+	}, nil
+}
+
+// WriteObjectStream writes the data read from r to S3 object, will be compressed with zstd. Objects smaller
+// than s3PartSize are written with a single request, larger ones with a multipart upload buffering a part
+// at a time. The upload is aborted if reading r fails
+func (b *s3Bucket) WriteObjectStream(ctx context.Context, object string, r io.Reader,
+	opts *WriteOptions) (*ObjectAttrs, error) {
+	if err := validateObject("WriteObjectStream", object); err != nil {
+		return nil, err
+	}
+
+	compressedReader, compressedWriter := io.Pipe()
+	go func() {
+		// ETags are derived from the data, so a generation frame makes them unique per write
+		if _, err := compressedWriter.Write(generationFrame(newVersion())); err != nil {
+			compressedWriter.CloseWithError(err)
+			return
+		}
+		compressedWriter.CloseWithError(compressStream(compressedWriter, r, opts.expiresAt()))
+	}()
+	// Unblocks the compression if the upload fails
+	defer compressedReader.Close()
+
+	part := make([]byte, s3PartSize)
+	n, err := io.ReadFull(compressedReader, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return b.putObject(ctx, object, part[:n], opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upload, err := b.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(b.name),
+		Key:      aws.String(object),
+		Metadata: opts.expiryMetadata(),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+			b.client.AbortMultipartUpload(ctxTimeout, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(b.name),
+				Key:      aws.String(object),
+				UploadId: upload.UploadId,
+			})
+		}
+	}()
+
+	parts := []types.CompletedPart{}
+	size := int64(0)
+	for partNumber := int32(1); n > 0; partNumber++ {
+		output, err := b.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(b.name),
+			Key:           aws.String(object),
+			UploadId:      upload.UploadId,
+			PartNumber:    partNumber,
+			Body:          bytes.NewReader(part[:n]),
+			ContentLength: int64(n),
+		})
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: output.ETag, PartNumber: partNumber})
+		size += int64(n)
+
+		n, err = io.ReadFull(compressedReader, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	}
+
+	output, err := b.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.name),
+		Key:             aws.String(object),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}, s3Preconditions(opts)...)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	completed = true
+
+	return &ObjectAttrs{
+		Name:       object,
+		Size:       size,
+		Version:    s3VersionID(output.VersionId),
+		Generation: s3Generation(output.ETag),
+		Updated:    time.Now(),
+		ExpiresAt:  opts.expiresAt(),
+	}, nil
+}
+
+// ReadObject reads data from S3 object, will be automatically decompressed
+func (b *s3Bucket) ReadObject(ctx context.Context, object string) ([]byte, *ObjectAttrs, error) {
+	if err := validateObject("ReadObject", object); err != nil {
+		return nil, nil, err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	output, err := b.client.GetObject(ctxTimeout, &s3.GetObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(object),
+	})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+	defer output.Body.Close()
+
+	compressedData, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := decompress(compressedData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, &ObjectAttrs{
+		Name:       object,
+		Size:       output.ContentLength,
+		Version:    s3VersionID(output.VersionId),
+		Generation: s3Generation(output.ETag),
+		Updated:    aws.ToTime(output.LastModified),
+		ExpiresAt:  metadataExpiry(output.Metadata),
+	}, nil
+}
+
+// ReadObjectStream reads data from S3 object, decompressed as it's read
+func (b *s3Bucket) ReadObjectStream(ctx context.Context, object string) (io.ReadCloser, *ObjectAttrs, error) {
+	if err := validateObject("ReadObjectStream", object); err != nil {
+		return nil, nil, err
+	}
+
+	output, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(object),
+	})
+	if err != nil {
+		return nil, nil, s3Error(err)
+	}
+
+	r, _ := newDecompressReader(output.Body)
+	return r, &ObjectAttrs{
+		Name:       object,
+		Size:       output.ContentLength,
+		Version:    s3VersionID(output.VersionId),
+		Generation: s3Generation(output.ETag),
+		Updated:    aws.ToTime(output.LastModified),
+		ExpiresAt:  metadataExpiry(output.Metadata),
+	}, nil
+}
+
+// DeleteObject deletes a S3 object
+func (b *s3Bucket) DeleteObject(ctx context.Context, object string) error {
+	if err := validateObject("DeleteObject", object); err != nil {
+		return err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	_, err := b.client.DeleteObject(ctxTimeout, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(object),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+
+	return nil
+}
+
+// StatObject gets the attributes of a S3 object
+func (b *s3Bucket) StatObject(ctx context.Context, object string) (*ObjectAttrs, error) {
+	if err := validateObject("StatObject", object); err != nil {
+		return nil, err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	output, err := b.client.HeadObject(ctxTimeout, &s3.HeadObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(object),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return &ObjectAttrs{
+		Name:       object,
+		Size:       output.ContentLength,
+		Version:    s3VersionID(output.VersionId),
+		Generation: s3Generation(output.ETag),
+		Updated:    aws.ToTime(output.LastModified),
+		ExpiresAt:  metadataExpiry(output.Metadata),
+	}, nil
+}
+
+// ListExpiredObjects lists the expired S3 objects starting with prefix. Listings don't return object metadata,
+// so each object is stated
+func (b *s3Bucket) ListExpiredObjects(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := b.ListObjects(ctx, prefix, "", 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return statExpired(ctx, b.StatObject, objects)
+}
+
+// ListObjectVersions lists the versions of a S3 object
+func (b *s3Bucket) ListObjectVersions(ctx context.Context, object string) ([]ObjectAttrs, error) {
+	if err := validateObject("ListObjectVersions", object); err != nil {
+		return nil, err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	versions := []ObjectAttrs{}
+	paginator := s3.NewListObjectVersionsPaginator(b.client, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(b.name),
+		Prefix: aws.String(object),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctxTimeout)
+		if err != nil {
+			return nil, s3Error(err)
+		}
+		for _, version := range page.Versions {
+			// Prefix also matches other objects starting with the object name
+			if aws.ToString(version.Key) != object {
+				continue
+			}
+			versions = append(versions, ObjectAttrs{
+				Name:       object,
+				Size:       version.Size,
+				Version:    s3VersionID(version.VersionId),
+				Generation: s3Generation(version.ETag),
+				Updated:    aws.ToTime(version.LastModified),
+			})
+		}
+	}
+	if len(versions) == 0 {
+		return nil, ErrObjectNotExist
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Updated.After(versions[j].Updated)
+	})
+
+	// Listings don't return object metadata, so the expiry of the latest version is read from its head
+	latest, err := b.client.HeadObject(ctxTimeout, &s3.HeadObjectInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(object),
+		VersionId: s3VersionIDInput(versions[0].Version),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	versions[0].ExpiresAt = metadataExpiry(latest.Metadata)
+
+	return versions, nil
+}
+
+// ReadObjectVersion reads data from a S3 object version, will be automatically decompressed
+func (b *s3Bucket) ReadObjectVersion(ctx context.Context, object string, version string) ([]byte, error) {
+	if err := validateObject("ReadObjectVersion", object); err != nil {
+		return nil, err
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	output, err := b.client.GetObject(ctxTimeout, &s3.GetObjectInput{
+		Bucket:    aws.String(b.name),
+		Key:       aws.String(object),
+		VersionId: aws.String(version),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	defer output.Body.Close()
+
+	compressedData, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(compressedData)
+}
+
+// s3VersionID returns the object version ID, which is "null" for buckets without versioning
+func s3VersionID(versionID *string) string {
+	if versionID == nil || *versionID == "" {
+		return "null"
+	}
+	return *versionID
+}
+
+// s3VersionIDInput returns the version ID to request, nil for the "null" version of buckets without versioning
+func s3VersionIDInput(version string) *string {
+	if version == "null" {
+		return nil
+	}
+	return aws.String(version)
+}
+
+// s3Generation returns the object ETag without quotes, used as generation for conditional writes. ETags are
+// unique per write thanks to the generation frame written with objects, except for objects written before it
+func s3Generation(etag *string) string {
+	return strings.Trim(aws.ToString(etag), `"`)
+}
+
+// s3Preconditions returns the options sending the write preconditions as If-Match/If-None-Match headers on the ETag
+func s3Preconditions(opts *WriteOptions) []func(*s3.Options) {
+	if ifGeneration := opts.ifGenerationMatch(); ifGeneration == NoGeneration {
+		return []func(*s3.Options){s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-None-Match", "*"))}
+	} else if ifGeneration != "" {
+		return []func(*s3.Options){s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-Match", `"`+ifGeneration+`"`))}
+	}
+	return nil
+}
+
+// s3Error maps S3 client errors to store errors
+func s3Error(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return ErrObjectNotExist
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrPreconditionFailed
+		case "SlowDown":
+			return fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case 412:
+			return ErrPreconditionFailed
+		case 429:
+			return fmt.Errorf("%w: %v", ErrRateLimited, err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,443 @@
+package tests
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	authAPIKey   = "test-api-key"
+	authIssuer   = "https://issuer.example.com"
+	authAudience = "bigbucket"
+)
+
+// authKeys are the signing keys of test tokens, published in the test JWKS
+type authKeys struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func TestAuth(t *testing.T) {
+	keys, jwks := newAuthKeys(t)
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	t.Cleanup(jwksServer.Close)
+
+	apiServer := newAuthServer(t, jwksServer.URL)
+
+	if err := authMissingCredentials(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := authAPIKeys(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := authValidTokens(apiServer.URL, keys); err != nil {
+		t.Error(err)
+	}
+	if err := authInvalidTokens(apiServer.URL, keys); err != nil {
+		t.Error(err)
+	}
+
+	// JWKS can also be loaded from a file
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksPath, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fileServer := newAuthServer(t, jwksPath)
+	if err := authValidTokens(fileServer.URL, keys); err != nil {
+		t.Error(err)
+	}
+
+	if err := authRejectedKeys(t.TempDir(), keys); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := auth.NewAuthenticator(&auth.Config{}); err == nil {
+		t.Error("NewAuthenticator accepted a config without API keys nor JWT")
+	}
+	if _, err := auth.NewAuthenticator(&auth.Config{APIKeys: []auth.APIKeyConfig{{Name: "bad", SHA256: "abc"}}}); err == nil {
+		t.Error("NewAuthenticator accepted an API key with an invalid hash")
+	}
+}
+
+// newAuthKeys generates RSA and EC signing keys and their JWKS
+func newAuthKeys(t *testing.T) (*authKeys, []byte) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec1",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authKeys{rsaKey: rsaKey, ecKey: ecKey}, jwks
+}
+
+// newAuthServer starts an API test server accepting authAPIKey and tokens signed by the keys of the JWKS
+func newAuthServer(t *testing.T, jwks string) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+
+	keyHash := sha256.Sum256([]byte(authAPIKey))
+	authenticator, err := auth.NewAuthenticator(&auth.Config{
+		APIKeys: []auth.APIKeyConfig{{Name: "service1", SHA256: hex.EncodeToString(keyHash[:])}},
+		JWT:     &auth.JWTConfig{JWKS: jwks, Issuer: authIssuer, Audience: authAudience},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiServer := httptest.NewServer(api.NewRouter(bucket, &api.Options{Authenticator: authenticator}))
+	t.Cleanup(apiServer.Close)
+
+	return apiServer
+}
+
+// signToken creates a JWT with the given claims, signed with RS256, PS256 or ES256
+func signToken(keys *authKeys, alg string, kid string, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsaKey, crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, keys.rsaKey, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		r, s, signErr := ecdsa.Sign(rand.Reader, keys.ecKey, digest[:])
+		signature, err = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...), signErr
+	default:
+		return "", fmt.Errorf("signToken unsupported algorithm '%s'", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// validClaims returns claims accepted by the test servers, overridden by the given claims (nil values are removed)
+func validClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": "user1",
+		"iss": authIssuer,
+		"aud": authAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for claim, value := range overrides {
+		if value == nil {
+			delete(claims, claim)
+		} else {
+			claims[claim] = value
+		}
+	}
+	return claims
+}
+
+// doAuthRequest sends a GET request with the given header and decodes the JSON response into out (if not nil)
+func doAuthRequest(url string, header string, value string, out interface{}) (int, error) {
+	req, err := http.NewRequest("GET", url, http.NoBody)
+	if err != nil {
+		return 0, err
+	}
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func authMissingCredentials(baseURL string) error {
+	for _, path := range []string{"/api/table", "/api/row?table=auth1", "/api/identity"} {
+		status, err := doAuthRequest(baseURL+path, "", "", nil)
+		if err != nil {
+			return err
+		}
+		if status != 401 {
+			return fmt.Errorf("authMissingCredentials %s returned %d, expected 401", path, status)
+		}
+	}
+
+	status, err := doAuthRequest(baseURL+"/api/table", "Authorization", "Basic dXNlcjpwYXNz", nil)
+	if err != nil {
+		return err
+	}
+	if status != 401 {
+		return fmt.Errorf("authMissingCredentials basic auth returned %d, expected 401", status)
+	}
+
+	status, err = doAuthRequest(baseURL+"/health", "", "", nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("authMissingCredentials /health returned %d, expected 200", status)
+	}
+	return nil
+}
+
+func authAPIKeys(baseURL string) error {
+	var identity auth.Identity
+	status, err := doAuthRequest(baseURL+"/api/identity", "X-API-Key", authAPIKey, &identity)
+	if err != nil {
+		return err
+	}
+	if status != 200 || identity.Subject != "service1" || identity.Method != auth.MethodAPIKey {
+		return fmt.Errorf("authAPIKeys returned %d with identity %+v, expected service1", status, identity)
+	}
+
+	status, err = doAuthRequest(baseURL+"/api/table", "X-API-Key", authAPIKey, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("authAPIKeys listing tables returned %d, expected 200", status)
+	}
+
+	status, err = doAuthRequest(baseURL+"/api/identity", "X-API-Key", "unknown-key", nil)
+	if err != nil {
+		return err
+	}
+	if status != 401 {
+		return fmt.Errorf("authAPIKeys unknown key returned %d, expected 401", status)
+	}
+	return nil
+}
+
+func authValidTokens(baseURL string, keys *authKeys) error {
+	tokens := map[string]map[string]interface{}{
+		"RS256": validClaims(nil),
+		"PS256": validClaims(map[string]interface{}{"aud": []string{"other", authAudience}}),
+		"ES256": validClaims(map[string]interface{}{"email": "user1@example.com"}),
+	}
+	kids := map[string]string{"RS256": "rsa1", "PS256": "rsa1", "ES256": "ec1"}
+
+	for alg, claims := range tokens {
+		token, err := signToken(keys, alg, kids[alg], claims)
+		if err != nil {
+			return err
+		}
+
+		var identity auth.Identity
+		status, err := doAuthRequest(baseURL+"/api/identity", "Authorization", "Bearer "+token, &identity)
+		if err != nil {
+			return err
+		}
+		if status != 200 || identity.Subject != "user1" || identity.Method != auth.MethodJWT {
+			return fmt.Errorf("authValidTokens %s token returned %d with identity %+v, expected user1", alg, status, identity)
+		}
+		if alg == "ES256" && identity.Claims["email"] != "user1@example.com" {
+			return fmt.Errorf("authValidTokens identity claims %v are missing email", identity.Claims)
+		}
+	}
+
+	// Tokens without kid are checked against all keys
+	token, err := signToken(keys, "ES256", "", validClaims(nil))
+	if err != nil {
+		return err
+	}
+	status, err := doAuthRequest(baseURL+"/api/identity", "Authorization", "Bearer "+token, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("authValidTokens token without kid returned %d, expected 200", status)
+	}
+	return nil
+}
+
+func authInvalidTokens(baseURL string, keys *authKeys) error {
+	invalidClaims := map[string]map[string]interface{}{
+		"expired":        validClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}),
+		"without exp":    validClaims(map[string]interface{}{"exp": nil}),
+		"not valid yet":  validClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}),
+		"wrong issuer":   validClaims(map[string]interface{}{"iss": "https://other.example.com"}),
+		"wrong audience": validClaims(map[string]interface{}{"aud": "other"}),
+		"without sub":    validClaims(map[string]interface{}{"sub": nil}),
+	}
+	tokens := make(map[string]string)
+	for name, claims := range invalidClaims {
+		token, err := signToken(keys, "RS256", "rsa1", claims)
+		if err != nil {
+			return err
+		}
+		tokens[name] = token
+	}
+
+	token, err := signToken(keys, "RS256", "rsa1", validClaims(nil))
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(token, ".")
+	tampered, _ := json.Marshal(validClaims(map[string]interface{}{"sub": "admin"}))
+	tokens["tampered"] = parts[0] + "." + base64.RawURLEncoding.EncodeToString(tampered) + "." + parts[2]
+
+	noneHeader, _ := json.Marshal(map[string]string{"alg": "none"})
+	tokens["alg none"] = base64.RawURLEncoding.EncodeToString(noneHeader) + "." + parts[1] + "."
+	hsHeader, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa1"})
+	tokens["alg HS256"] = base64.RawURLEncoding.EncodeToString(hsHeader) + "." + parts[1] + "." + parts[2]
+
+	// ES256 signature checked against the RSA key
+	token, err = signToken(keys, "ES256", "rsa1", validClaims(nil))
+	if err != nil {
+		return err
+	}
+	tokens["wrong key type"] = token
+	tokens["malformed"] = "not-a-token"
+
+	for name, token := range tokens {
+		status, err := doAuthRequest(baseURL+"/api/identity", "Authorization", "Bearer "+token, nil)
+		if err != nil {
+			return err
+		}
+		if status != 401 {
+			return fmt.Errorf("authInvalidTokens %s token returned %d, expected 401", name, status)
+		}
+	}
+	return nil
+}
+
+// authRejectedKeys checks RSA keys under 2048 bits are skipped, and keys restricted to an algorithm
+// don't verify tokens of other algorithms
+func authRejectedKeys(dir string, keys *authKeys) error {
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return err
+	}
+	rsaJWK := func(kid string, alg string, key *rsa.PrivateKey) map[string]string {
+		return map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"alg": alg,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	}
+	writeJWKS := func(name string, jwks ...map[string]string) (string, error) {
+		data, err := json.Marshal(map[string]interface{}{"keys": jwks})
+		if err != nil {
+			return "", err
+		}
+		path := filepath.Join(dir, name)
+		return path, os.WriteFile(path, data, 0o600)
+	}
+
+	weakPath, err := writeJWKS("weak.json", rsaJWK("weak", "", weakKey))
+	if err != nil {
+		return err
+	}
+	_, err = auth.NewAuthenticator(&auth.Config{JWT: &auth.JWTConfig{JWKS: weakPath, Issuer: authIssuer, Audience: authAudience}})
+	if err == nil {
+		return fmt.Errorf("authRejectedKeys NewAuthenticator accepted a JWKS with only a 1024 bits RSA key")
+	}
+
+	mixedPath, err := writeJWKS("mixed.json", rsaJWK("weak", "", weakKey), rsaJWK("rsa1", "RS256", keys.rsaKey))
+	if err != nil {
+		return err
+	}
+	authenticator, err := auth.NewAuthenticator(&auth.Config{
+		JWT: &auth.JWTConfig{JWKS: mixedPath, Issuer: authIssuer, Audience: authAudience},
+	})
+	if err != nil {
+		return err
+	}
+
+	tokens := map[string]struct {
+		keys  *authKeys
+		alg   string
+		kid   string
+		valid bool
+	}{
+		"RS256 with 2048 bits key":    {keys, "RS256", "rsa1", true},
+		"RS256 with 1024 bits key":    {&authKeys{rsaKey: weakKey}, "RS256", "weak", false},
+		"RS256 with 1024 bits no kid": {&authKeys{rsaKey: weakKey}, "RS256", "", false},
+		"PS256 with RS256 only key":   {keys, "PS256", "rsa1", false},
+	}
+	for name, test := range tokens {
+		token, err := signToken(test.keys, test.alg, test.kid, validClaims(nil))
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("GET", "/api/identity", http.NoBody)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err = authenticator.Authenticate(req)
+		if test.valid && err != nil {
+			return fmt.Errorf("authRejectedKeys %s token was rejected: %v", name, err)
+		}
+		if !test.valid && !errors.Is(err, auth.ErrInvalidCredentials) {
+			return fmt.Errorf("authRejectedKeys %s token returned error %v, expected invalid credentials", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,463 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/store"
+)
+
+func TestBackends(t *testing.T) {
+	fileDir, err := os.MkdirTemp("", "bigbucket-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fileDir)
+
+	for _, bucketURL := range []string{"mem://?versions=2", "file://" + fileDir + "?versions=2"} {
+		bucket, err := store.NewBackend(bucketURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backendReadWrite(bucket); err != nil {
+			t.Errorf("%s: %v", bucketURL, err)
+		}
+		if err := backendListObjects(bucket); err != nil {
+			t.Errorf("%s: %v", bucketURL, err)
+		}
+		if err := backendVersions(bucket); err != nil {
+			t.Errorf("%s: %v", bucketURL, err)
+		}
+		if err := backendConditionalWrites(bucket); err != nil {
+			t.Errorf("%s: %v", bucketURL, err)
+		}
+		if err := backendStreams(bucket); err != nil {
+			t.Errorf("%s: %v", bucketURL, err)
+		}
+		if err := backendExpiry(bucket); err != nil {
+			t.Errorf("%s: %v", bucketURL, err)
+		}
+		if err := backendDelete(bucket); err != nil {
+			t.Errorf("%s: %v", bucketURL, err)
+		}
+	}
+
+	if err := backendFileGenerations(fileDir); err != nil {
+		t.Error(err)
+	}
+}
+
+func backendReadWrite(bucket store.Backend) error {
+	ctx := context.Background()
+	if _, err := bucket.WriteObject(ctx, "bigbucket/rw/key1/col1", []byte("val1"), nil); err != nil {
+		return err
+	}
+	data, _, err := bucket.ReadObject(ctx, "bigbucket/rw/key1/col1")
+	if err != nil {
+		return err
+	}
+	if string(data) != "val1" {
+		return errors.New("backendReadWrite read data does not match written data")
+	}
+
+	if _, err := bucket.WriteObject(ctx, "bigbucket/rw/key1/col1", []byte("val2"), nil); err != nil {
+		return err
+	}
+	data, _, err = bucket.ReadObject(ctx, "bigbucket/rw/key1/col1")
+	if err != nil {
+		return err
+	}
+	if string(data) != "val2" {
+		return errors.New("backendReadWrite read data does not match overwritten data")
+	}
+
+	attrs, err := bucket.StatObject(ctx, "bigbucket/rw/key1/col1")
+	if err != nil {
+		return err
+	}
+	if attrs.Name != "bigbucket/rw/key1/col1" || attrs.Size == 0 {
+		return errors.New("backendReadWrite stat attributes do not match written object")
+	}
+
+	if _, _, err := bucket.ReadObject(ctx, "bigbucket/rw/key1/missing"); !errors.Is(err, store.ErrObjectNotExist) {
+		return fmt.Errorf("backendReadWrite read of missing object returned %v", err)
+	}
+	if _, err := bucket.StatObject(ctx, "bigbucket/rw/key1/missing"); !errors.Is(err, store.ErrObjectNotExist) {
+		return fmt.Errorf("backendReadWrite stat of missing object returned %v", err)
+	}
+	return nil
+}
+
+func backendListObjects(bucket store.Backend) error {
+	ctx := context.Background()
+	objects := []string{
+		"bigbucket/.delete_tables",
+		"bigbucket/list/key1/col1",
+		"bigbucket/list/key1/col2",
+		"bigbucket/list/key10/col1",
+		"bigbucket/list/key2/col1",
+		"bigbucket/list-other/key1/col1",
+	}
+	for _, object := range objects {
+		if _, err := bucket.WriteObject(ctx, object, []byte("val"), nil); err != nil {
+			return err
+		}
+	}
+
+	listings := []struct {
+		prefix    string
+		delimiter string
+		limit     int
+		expected  []string
+	}{
+		{"bigbucket/list/", "", 0, []string{"bigbucket/list/key1/col1", "bigbucket/list/key1/col2",
+			"bigbucket/list/key10/col1", "bigbucket/list/key2/col1"}},
+		{"bigbucket/list/key1", "", 0, []string{"bigbucket/list/key1/col1", "bigbucket/list/key1/col2",
+			"bigbucket/list/key10/col1"}},
+		{"bigbucket/list/key1/", "", 0, []string{"bigbucket/list/key1/col1", "bigbucket/list/key1/col2"}},
+		{"bigbucket/list/", "", 2, []string{"bigbucket/list/key1/col1", "bigbucket/list/key1/col2"}},
+		{"bigbucket/list/", "/", 0, []string{"bigbucket/list/key1/", "bigbucket/list/key10/", "bigbucket/list/key2/"}},
+		{"bigbucket/list/", "/", 1, []string{"bigbucket/list/key1/"}},
+		{"bigbucket/", "/", 0, []string{"bigbucket/list-other/", "bigbucket/list/", "bigbucket/rw/"}},
+		{"bigbucket/missing/", "", 0, []string{}},
+	}
+	for _, listing := range listings {
+		listed, err := bucket.ListObjects(ctx, listing.prefix, listing.delimiter, listing.limit, nil)
+		if err != nil {
+			return err
+		}
+		if len(listed) == 0 && len(listing.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(listed, listing.expected) {
+			return fmt.Errorf("backendListObjects listing prefix '%s' delimiter '%s' limit %d got %v",
+				listing.prefix, listing.delimiter, listing.limit, listed)
+		}
+	}
+
+	rangeListings := []struct {
+		prefix    string
+		delimiter string
+		opts      *store.ListOptions
+		expected  []string
+	}{
+		{"bigbucket/list/", "", &store.ListOptions{StartOffset: "bigbucket/list/key10"},
+			[]string{"bigbucket/list/key10/col1", "bigbucket/list/key2/col1"}},
+		{"bigbucket/list/", "", &store.ListOptions{EndOffset: "bigbucket/list/key10"},
+			[]string{"bigbucket/list/key1/col1", "bigbucket/list/key1/col2"}},
+		{"bigbucket/list/", "/", &store.ListOptions{StartOffset: "bigbucket/list/key1/col2", EndOffset: "bigbucket/list/key2"},
+			[]string{"bigbucket/list/key1/", "bigbucket/list/key10/"}},
+		{"bigbucket/", "", &store.ListOptions{StartOffset: "bigbucket/list/key2", EndOffset: "bigbucket/list/key3"},
+			[]string{"bigbucket/list/key2/col1"}},
+	}
+	for _, listing := range rangeListings {
+		listed, err := bucket.ListObjects(ctx, listing.prefix, listing.delimiter, 0, listing.opts)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(listed, listing.expected) {
+			return fmt.Errorf("backendListObjects listing prefix '%s' delimiter '%s' range %+v got %v",
+				listing.prefix, listing.delimiter, *listing.opts, listed)
+		}
+	}
+	return nil
+}
+
+func backendVersions(bucket store.Backend) error {
+	ctx := context.Background()
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if _, err := bucket.WriteObject(ctx, "bigbucket/ver/key1/col1", []byte(value), nil); err != nil {
+			return err
+		}
+	}
+
+	versions, err := bucket.ListObjectVersions(ctx, "bigbucket/ver/key1/col1")
+	if err != nil {
+		return err
+	}
+	if len(versions) != 2 {
+		return fmt.Errorf("backendVersions expected 2 versions kept, got %d", len(versions))
+	}
+	attrs, err := bucket.StatObject(ctx, "bigbucket/ver/key1/col1")
+	if err != nil {
+		return err
+	}
+	if versions[0].Version != attrs.Version {
+		return errors.New("backendVersions newest version is not the live object")
+	}
+
+	data, err := bucket.ReadObjectVersion(ctx, "bigbucket/ver/key1/col1", versions[1].Version)
+	if err != nil {
+		return err
+	}
+	if string(data) != "v2" {
+		return errors.New("backendVersions previous version data does not match")
+	}
+
+	// Previous versions are kept after the live object is deleted
+	if err := bucket.DeleteObject(ctx, "bigbucket/ver/key1/col1"); err != nil {
+		return err
+	}
+	versions, err = bucket.ListObjectVersions(ctx, "bigbucket/ver/key1/col1")
+	if err != nil {
+		return err
+	}
+	if len(versions) != 2 {
+		return errors.New("backendVersions versions not kept after delete")
+	}
+	if _, err := bucket.ReadObjectVersion(ctx, "bigbucket/ver/key1/col1", "123"); !errors.Is(err, store.ErrObjectNotExist) {
+		return fmt.Errorf("backendVersions read of missing version returned %v", err)
+	}
+	return nil
+}
+
+func backendConditionalWrites(bucket store.Backend) error {
+	ctx := context.Background()
+	object := "bigbucket/cas/key1/col1"
+	attrs, err := bucket.WriteObject(ctx, object, []byte("v1"), &store.WriteOptions{IfGenerationMatch: store.NoGeneration})
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.WriteObject(ctx, object, []byte("v2"), &store.WriteOptions{IfGenerationMatch: store.NoGeneration}); !errors.Is(err, store.ErrPreconditionFailed) {
+		return fmt.Errorf("backendConditionalWrites write of existing object with no generation returned %v", err)
+	}
+
+	_, readAttrs, err := bucket.ReadObject(ctx, object)
+	if err != nil {
+		return err
+	}
+	if readAttrs.Generation != attrs.Generation {
+		return errors.New("backendConditionalWrites read generation does not match written generation")
+	}
+
+	newAttrs, err := bucket.WriteObject(ctx, object, []byte("v2"), &store.WriteOptions{IfGenerationMatch: attrs.Generation})
+	if err != nil {
+		return err
+	}
+	if newAttrs.Generation == attrs.Generation {
+		return errors.New("backendConditionalWrites generation did not change after write")
+	}
+	if _, err := bucket.WriteObject(ctx, object, []byte("v3"), &store.WriteOptions{IfGenerationMatch: attrs.Generation}); !errors.Is(err, store.ErrPreconditionFailed) {
+		return fmt.Errorf("backendConditionalWrites write with stale generation returned %v", err)
+	}
+
+	data, _, err := bucket.ReadObject(ctx, object)
+	if err != nil {
+		return err
+	}
+	if string(data) != "v2" {
+		return errors.New("backendConditionalWrites failed precondition overwrote data")
+	}
+	return bucket.DeleteObject(ctx, object)
+}
+
+// backendFileGenerations checks generations of file buckets don't depend on the precision of modification times,
+// which is coarse on some filesystems
+func backendFileGenerations(fileDir string) error {
+	ctx := context.Background()
+	bucket, err := store.NewBackend("file://" + fileDir)
+	if err != nil {
+		return err
+	}
+	object := "bigbucket/generations/key1/col1"
+	path := filepath.Join(fileDir, filepath.FromSlash(object))
+	coarseTime := time.Now().Truncate(time.Second)
+
+	attrs, err := bucket.WriteObject(ctx, object, []byte("v1"), nil)
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(path, coarseTime, coarseTime); err != nil {
+		return err
+	}
+	newAttrs, err := bucket.WriteObject(ctx, object, []byte("v2"), &store.WriteOptions{IfGenerationMatch: attrs.Generation})
+	if err != nil {
+		return fmt.Errorf("backendFileGenerations write with live generation returned %v", err)
+	}
+	if err := os.Chtimes(path, coarseTime, coarseTime); err != nil {
+		return err
+	}
+
+	statAttrs, err := bucket.StatObject(ctx, object)
+	if err != nil {
+		return err
+	}
+	if statAttrs.Generation != newAttrs.Generation || newAttrs.Generation <= attrs.Generation {
+		return fmt.Errorf("backendFileGenerations generations are %s then %s, stat returned %s",
+			attrs.Generation, newAttrs.Generation, statAttrs.Generation)
+	}
+	if _, err := bucket.WriteObject(ctx, object, []byte("v3"), &store.WriteOptions{IfGenerationMatch: attrs.Generation}); !errors.Is(err, store.ErrPreconditionFailed) {
+		return fmt.Errorf("backendFileGenerations write with stale generation returned %v", err)
+	}
+	data, readAttrs, err := bucket.ReadObject(ctx, object)
+	if err != nil {
+		return err
+	}
+	if string(data) != "v2" || readAttrs.Generation != newAttrs.Generation {
+		return fmt.Errorf("backendFileGenerations read %s with generation %s", data, readAttrs.Generation)
+	}
+	return bucket.DeleteObject(ctx, object)
+}
+
+// failingReader returns an error after the data is read, like a client disconnecting mid-upload
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func backendStreams(bucket store.Backend) error {
+	ctx := context.Background()
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	if _, err := bucket.WriteObjectStream(ctx, "bigbucket/stream/key1/col1", bytes.NewReader(data), nil); err != nil {
+		return err
+	}
+	readData, _, err := bucket.ReadObject(ctx, "bigbucket/stream/key1/col1")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(readData, data) {
+		return errors.New("backendStreams read data does not match streamed data")
+	}
+
+	r, attrs, err := bucket.ReadObjectStream(ctx, "bigbucket/stream/key1/col1")
+	if err != nil {
+		return err
+	}
+	readData, err = io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(readData, data) || attrs.Generation == "" {
+		return errors.New("backendStreams streamed read does not match streamed data")
+	}
+
+	_, err = bucket.WriteObjectStream(ctx, "bigbucket/stream/key1/col1", &failingReader{data: bytes.NewReader([]byte("partial"))}, nil)
+	if err == nil {
+		return errors.New("backendStreams write with failing reader did not return an error")
+	}
+	_, err = bucket.WriteObjectStream(ctx, "bigbucket/stream/key1/col1", bytes.NewReader([]byte("val")),
+		&store.WriteOptions{IfGenerationMatch: store.NoGeneration})
+	if !errors.Is(err, store.ErrPreconditionFailed) {
+		return fmt.Errorf("backendStreams write of existing object with generation 0 returned %v", err)
+	}
+	readData, _, err = bucket.ReadObject(ctx, "bigbucket/stream/key1/col1")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(readData, data) {
+		return errors.New("backendStreams failed writes changed the object")
+	}
+
+	if _, _, err := bucket.ReadObjectStream(ctx, "bigbucket/stream/key1/missing"); !errors.Is(err, store.ErrObjectNotExist) {
+		return fmt.Errorf("backendStreams streamed read of missing object returned %v", err)
+	}
+	return nil
+}
+
+func backendExpiry(bucket store.Backend) error {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	opts := &store.WriteOptions{ExpiresAt: expiresAt}
+	if _, err := bucket.WriteObject(ctx, "bigbucket/ttl/key1/col1", []byte("val1"), opts); err != nil {
+		return err
+	}
+	if _, err := bucket.WriteObjectStream(ctx, "bigbucket/ttl/key1/col2", bytes.NewReader([]byte("val2")), opts); err != nil {
+		return err
+	}
+	if _, err := bucket.WriteObject(ctx, "bigbucket/ttl/key1/col3", []byte("val3"),
+		&store.WriteOptions{ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		return err
+	}
+
+	data, attrs, err := bucket.ReadObject(ctx, "bigbucket/ttl/key1/col1")
+	if err != nil {
+		return err
+	}
+	if string(data) != "val1" || !attrs.ExpiresAt.Equal(expiresAt) || attrs.IsExpired() {
+		return fmt.Errorf("backendExpiry read data %q with expiry %v, expected %v", data, attrs.ExpiresAt, expiresAt)
+	}
+	r, attrs, err := bucket.ReadObjectStream(ctx, "bigbucket/ttl/key1/col2")
+	if err != nil {
+		return err
+	}
+	data, err = io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if string(data) != "val2" || !attrs.ExpiresAt.Equal(expiresAt) {
+		return fmt.Errorf("backendExpiry stream read data %q with expiry %v, expected %v", data, attrs.ExpiresAt, expiresAt)
+	}
+
+	attrs, err = bucket.StatObject(ctx, "bigbucket/ttl/key1/col3")
+	if err != nil {
+		return err
+	}
+	if !attrs.IsExpired() {
+		return errors.New("backendExpiry stat of expired object is not expired")
+	}
+	data, _, err = bucket.ReadObject(ctx, "bigbucket/ttl/key1/col3")
+	if err != nil || string(data) != "val3" {
+		return errors.New("backendExpiry expired object is not readable until deleted")
+	}
+	versions, err := bucket.ListObjectVersions(ctx, "bigbucket/ttl/key1/col3")
+	if err != nil {
+		return err
+	}
+	if !versions[0].IsExpired() {
+		return errors.New("backendExpiry latest version of expired object is not expired")
+	}
+	expired, err := bucket.ListExpiredObjects(ctx, "bigbucket/ttl/")
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(expired, []string{"bigbucket/ttl/key1/col3"}) {
+		return fmt.Errorf("backendExpiry listed expired objects %v, expected col3", expired)
+	}
+
+	attrs, err = bucket.StatObject(ctx, "bigbucket/rw/key1/col1")
+	if err == nil && !attrs.ExpiresAt.IsZero() {
+		return errors.New("backendExpiry object written without expiry has an expiry time")
+	}
+	return nil
+}
+
+func backendDelete(bucket store.Backend) error {
+	ctx := context.Background()
+	if err := bucket.DeleteObject(ctx, "bigbucket/rw/key1/col1"); err != nil {
+		return err
+	}
+	if _, _, err := bucket.ReadObject(ctx, "bigbucket/rw/key1/col1"); !errors.Is(err, store.ErrObjectNotExist) {
+		return errors.New("backendDelete object still readable after delete")
+	}
+	listed, err := bucket.ListObjects(ctx, "bigbucket/rw/", "", 0, nil)
+	if err != nil {
+		return err
+	}
+	if len(listed) != 0 {
+		return errors.New("backendDelete object still listed after delete")
+	}
+	if err := bucket.DeleteObject(ctx, "bigbucket/rw/key1/col1"); !errors.Is(err, store.ErrObjectNotExist) {
+		return fmt.Errorf("backendDelete delete of missing object returned %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/store"
+)
+
+func TestBatchRows(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	if err := batchSetRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := batchSetRowsBadPayloads(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := batchGetRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := batchGetRowsBadPayloads(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failingServer := httptest.NewServer(api.NewRouter(&failingWritesBucket{Backend: bucket}, nil))
+	defer failingServer.Close()
+
+	if err := batchSetRowsFailures(failingServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := batchRequiredColumns(); err != nil {
+		t.Error(err)
+	}
+}
+
+// failingWritesBucket fails writes of columns named 'fail', as rate limited
+type failingWritesBucket struct {
+	store.Backend
+}
+
+func (b *failingWritesBucket) WriteObject(ctx context.Context, object string, data []byte,
+	opts *store.WriteOptions) (*store.ObjectAttrs, error) {
+	if strings.HasSuffix(object, "/fail") {
+		return nil, fmt.Errorf("%w: test", store.ErrRateLimited)
+	}
+	return b.Backend.WriteObject(ctx, object, data, opts)
+}
+
+// slowStatsBucket delays stats of objects, recording the most stats in flight at once
+type slowStatsBucket struct {
+	store.Backend
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (b *slowStatsBucket) StatObject(ctx context.Context, object string) (*store.ObjectAttrs, error) {
+	b.mutex.Lock()
+	b.inFlight++
+	if b.inFlight > b.maxInFlight {
+		b.maxInFlight = b.inFlight
+	}
+	b.mutex.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	b.mutex.Lock()
+	b.inFlight--
+	b.mutex.Unlock()
+	return b.Backend.StatObject(ctx, object)
+}
+
+type testBatchResponse struct {
+	Error string                                  `json:"error"`
+	Rows  map[string]map[string]map[string]string `json:"rows"`
+}
+
+func batchSetRows(baseURL string) error {
+	payload := map[string]map[string]string{}
+	for i := 0; i < 50; i++ {
+		payload[fmt.Sprintf("key%02d", i)] = map[string]string{"col1": fmt.Sprintf("val%d", i), "col2": "val2"}
+	}
+
+	var data testBatchResponse
+	status, err := doRequest("POST", baseURL+"/api/rows?table=batch1", payload, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("batchSetRows /api/rows POST response status code is not 200")
+	}
+	if len(data.Rows) != 50 || data.Rows["key07"]["col1"]["generation"] == "" {
+		return errors.New("batchSetRows response rows do not match rows set")
+	}
+
+	var rows map[string]map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row?table=batch1", nil, &rows); err != nil {
+		return err
+	}
+	if len(rows) != 50 || rows["key07"]["col1"] != "val7" || rows["key49"]["col2"] != "val2" {
+		return errors.New("batchSetRows read rows do not match rows set")
+	}
+	return nil
+}
+
+func batchSetRowsBadPayloads(baseURL string) error {
+	badPayloads := []interface{}{
+		map[string]map[string]string{},
+		map[string]map[string]string{"key1": {}},
+		map[string]map[string]string{"key#1": {"col1": "val1"}},
+		map[string]map[string]string{"key1": {".col1": "val1"}},
+		map[string]string{"key1": "val1"},
+	}
+	for _, payload := range badPayloads {
+		status, err := doRequest("POST", baseURL+"/api/rows?table=batch1", payload, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("batchSetRowsBadPayloads /api/rows POST (%v) response status code is not 400", payload)
+		}
+	}
+	return nil
+}
+
+func batchGetRows(baseURL string) error {
+	var data struct {
+		Rows        map[string]map[string]string `json:"rows"`
+		MissingKeys []string                     `json:"missingKeys"`
+	}
+	status, err := doRequest("POST", baseURL+"/api/rows/get?table=batch1", map[string][]string{
+		"keys":    {"key03", "key42", "missing1", "key03", "missing2"},
+		"columns": {"col1", "col3"},
+	}, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("batchGetRows /api/rows/get POST response status code is not 200")
+	}
+	if len(data.Rows) != 2 || len(data.Rows["key03"]) != 1 || data.Rows["key42"]["col1"] != "val42" {
+		return errors.New("batchGetRows rows do not match rows set")
+	}
+	if len(data.MissingKeys) != 2 || data.MissingKeys[0] != "missing1" || data.MissingKeys[1] != "missing2" {
+		return fmt.Errorf("batchGetRows missing keys do not match, got %v", data.MissingKeys)
+	}
+	return nil
+}
+
+func batchGetRowsBadPayloads(baseURL string) error {
+	badPayloads := []interface{}{
+		map[string][]string{"keys": {"key1"}},
+		map[string][]string{"columns": {"col1"}},
+		map[string][]string{"keys": {"key1", ""}, "columns": {"col1"}},
+		map[string][]string{"keys": {"key1"}, "columns": {"col/1"}},
+		map[string]string{"keys": "key1", "columns": "col1"},
+	}
+	for _, payload := range badPayloads {
+		status, err := doRequest("POST", baseURL+"/api/rows/get?table=batch1", payload, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("batchGetRowsBadPayloads /api/rows/get POST (%v) response status code is not 400", payload)
+		}
+	}
+	return nil
+}
+
+func batchSetRowsFailures(baseURL string) error {
+	var data testBatchResponse
+	status, err := doRequest("POST", baseURL+"/api/rows?table=batch2",
+		map[string]map[string]string{"key1": {"col1": "val1", "fail": "val"}, "key2": {"col1": "val1"}}, &data)
+	if err != nil {
+		return err
+	}
+	if status != 500 || !strings.Contains(data.Error, "1 of 3 columns failed") {
+		return fmt.Errorf("batchSetRowsFailures expected 500 with 1 failed column, got %d '%s'", status, data.Error)
+	}
+	if data.Rows["key1"]["fail"]["error"] == "" || data.Rows["key1"]["col1"]["generation"] == "" ||
+		data.Rows["key2"]["col1"]["generation"] == "" {
+		return errors.New("batchSetRowsFailures per cell results do not match")
+	}
+	return nil
+}
+
+// batchRequiredColumns checks the required columns missing from the rows of a batch are checked in parallel
+func batchRequiredColumns() error {
+	memBucket, err := store.NewBackend("mem://")
+	if err != nil {
+		return err
+	}
+	bucket := &slowStatsBucket{Backend: memBucket}
+	apiServer := httptest.NewServer(api.NewRouter(bucket, nil))
+	defer apiServer.Close()
+
+	schema := map[string]interface{}{"columns": map[string]interface{}{"name": map[string]interface{}{"required": true}}}
+	if status, err := doRequest("PUT", apiServer.URL+"/api/table?table=batch3", schema, nil); err != nil || status != 200 {
+		return fmt.Errorf("batchRequiredColumns set schema returned %d: %v", status, err)
+	}
+	payload := map[string]map[string]string{}
+	for i := 0; i < 20; i++ {
+		payload[fmt.Sprintf("key%02d", i)] = map[string]string{"name": "val", "age": "1"}
+	}
+	if status, err := doRequest("POST", apiServer.URL+"/api/rows?table=batch3", payload, nil); err != nil || status != 200 {
+		return fmt.Errorf("batchRequiredColumns set rows returned %d: %v", status, err)
+	}
+
+	// The names are already set, so each row is checked in the bucket
+	for key := range payload {
+		payload[key] = map[string]string{"age": "2"}
+	}
+	payload["key20"] = map[string]string{"age": "2"}
+	var data struct {
+		Violations map[string][]string `json:"violations"`
+	}
+	status, err := doRequest("POST", apiServer.URL+"/api/rows?table=batch3", payload, &data)
+	if err != nil {
+		return err
+	}
+	if status != 400 || len(data.Violations) != 1 || len(data.Violations["key20"]) != 1 {
+		return fmt.Errorf("batchRequiredColumns returned %d with violations %v, expected 400 for key20", status, data.Violations)
+	}
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if bucket.maxInFlight < 2 {
+		return fmt.Errorf("batchRequiredColumns checked the rows one at a time")
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+)
+
+func TestBlobs(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	if err := blobUploadAndDownload(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := blobMultipartUpload(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := blobTypedCells(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := blobSchema(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+// putBlob uploads the body to a cell with the content type, returning the response status code
+func putBlob(url string, body io.Reader, contentType string) (int, error) {
+	req, err := http.NewRequest("PUT", url, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// getBlob downloads a cell, returning the response status code, content type and body
+func getBlob(url string) (int, string, []byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), data, nil
+}
+
+func blobUploadAndDownload(baseURL string) error {
+	data := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	status, err := putBlob(baseURL+"/api/cell?table=blob1&key=key1&column=image", bytes.NewReader(data), "image/png")
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("blobUploadAndDownload upload returned %d", status)
+	}
+
+	status, contentType, readData, err := getBlob(baseURL + "/api/cell?table=blob1&key=key1&column=image")
+	if err != nil {
+		return err
+	}
+	if status != 200 || contentType != "image/png" || !bytes.Equal(readData, data) {
+		return fmt.Errorf("blobUploadAndDownload download returned %d with content type '%s' and %d bytes",
+			status, contentType, len(readData))
+	}
+
+	var rows map[string]map[string]map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row?table=blob1&key=key1", nil, &rows); err != nil {
+		return err
+	}
+	if rows["key1"]["image"]["$bytes"] != base64.StdEncoding.EncodeToString(data) {
+		return errors.New("blobUploadAndDownload row read does not return the blob as bytes")
+	}
+
+	status, _, _, err = getBlob(baseURL + "/api/cell?table=blob1&key=key1&column=missing")
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return fmt.Errorf("blobUploadAndDownload download of missing column returned %d, expected 404", status)
+	}
+	return nil
+}
+
+func blobMultipartUpload(baseURL string) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Disposition", `form-data; name="file"; filename="data.csv"`)
+	partHeader.Set("Content-Type", "text/csv")
+	part, err := writer.CreatePart(partHeader)
+	if err != nil {
+		return err
+	}
+	part.Write([]byte("a,b\n1,2\n"))
+	writer.Close()
+
+	status, err := putBlob(baseURL+"/api/cell?table=blob1&key=key2&column=csv", &body, writer.FormDataContentType())
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("blobMultipartUpload upload returned %d", status)
+	}
+
+	status, contentType, data, err := getBlob(baseURL + "/api/cell?table=blob1&key=key2&column=csv")
+	if err != nil {
+		return err
+	}
+	if status != 200 || contentType != "text/csv" || string(data) != "a,b\n1,2\n" {
+		return fmt.Errorf("blobMultipartUpload download returned %d with content type '%s' and data %q", status, contentType, data)
+	}
+	return nil
+}
+
+func blobTypedCells(baseURL string) error {
+	payload := map[string]interface{}{"text": "hello", "object": map[string]int{"a": 1}, "number": 42}
+	if _, err := doRequest("POST", baseURL+"/api/row?table=blob2&key=key1", payload, nil); err != nil {
+		return err
+	}
+
+	expected := map[string][]string{
+		"text":   {"text/plain; charset=utf-8", "hello"},
+		"object": {"application/json", `{"a":1}`},
+		"number": {"text/plain; charset=utf-8", "42"},
+	}
+	for column, expectedBlob := range expected {
+		status, contentType, data, err := getBlob(baseURL + "/api/cell?table=blob2&key=key1&column=" + column)
+		if err != nil {
+			return err
+		}
+		if status != 200 || contentType != expectedBlob[0] || string(data) != expectedBlob[1] {
+			return fmt.Errorf("blobTypedCells column '%s' returned %d with content type '%s' and data %q",
+				column, status, contentType, data)
+		}
+	}
+	return nil
+}
+
+func blobSchema(baseURL string) error {
+	schema := map[string]interface{}{
+		"columns": map[string]interface{}{
+			"thumbnail": map[string]interface{}{"maxSize": 10},
+			"count":     map[string]interface{}{"type": "int"},
+		},
+	}
+	if _, err := doRequest("PUT", baseURL+"/api/table?table=blob3", schema, nil); err != nil {
+		return err
+	}
+
+	status, err := putBlob(baseURL+"/api/cell?table=blob3&key=key1&column=thumbnail",
+		bytes.NewReader(make([]byte, 11)), "image/jpeg")
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return fmt.Errorf("blobSchema upload over max size returned %d, expected 400", status)
+	}
+	status, _, _, err = getBlob(baseURL + "/api/cell?table=blob3&key=key1&column=thumbnail")
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("blobSchema upload over max size was set")
+	}
+
+	status, err = putBlob(baseURL+"/api/cell?table=blob3&key=key1&column=thumbnail",
+		bytes.NewReader(make([]byte, 10)), "image/jpeg")
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("blobSchema upload within max size returned %d", status)
+	}
+
+	status, err = putBlob(baseURL+"/api/cell?table=blob3&key=key1&column=count",
+		bytes.NewReader([]byte("1")), "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return fmt.Errorf("blobSchema upload to int column returned %d, expected 400", status)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/cache"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingReadsBucket{Backend: bucket}
+	readCache := cache.NewLRU(1024*1024, time.Minute)
+	apiServer := httptest.NewServer(api.NewRouter(counting, &api.Options{Cache: readCache}))
+	t.Cleanup(apiServer.Close)
+
+	if err := cacheReadRows(apiServer.URL, counting, readCache); err != nil {
+		t.Error(err)
+	}
+	if err := cacheInvalidateWrites(apiServer.URL, counting); err != nil {
+		t.Error(err)
+	}
+	if err := cacheInvalidateDeletes(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := cacheExpiry(); err != nil {
+		t.Error(err)
+	}
+	if err := cacheEviction(); err != nil {
+		t.Error(err)
+	}
+	if err := cacheRacingInvalidation(); err != nil {
+		t.Error(err)
+	}
+}
+
+// countingReadsBucket counts the cell object reads sent to the bucket (not of table state or schemas)
+type countingReadsBucket struct {
+	store.Backend
+	reads int64
+}
+
+func (b *countingReadsBucket) ReadObject(ctx context.Context, object string) ([]byte, *store.ObjectAttrs, error) {
+	if strings.Count(object, "/") == 3 && !strings.Contains(object, "/.") {
+		atomic.AddInt64(&b.reads, 1)
+	}
+	return b.Backend.ReadObject(ctx, object)
+}
+
+func (b *countingReadsBucket) readsCount() int64 {
+	return atomic.LoadInt64(&b.reads)
+}
+
+type testRowsResponse map[string]map[string]interface{}
+
+func cacheReadRows(baseURL string, bucket *countingReadsBucket, readCache *cache.LRU) error {
+	if _, err := doRequest("POST", baseURL+"/api/row?table=cache1&key=config", map[string]interface{}{"mode": "fast", "workers": 4}, nil); err != nil {
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		var rows testRowsResponse
+		status, err := doRequest("GET", baseURL+"/api/row?table=cache1&key=config&columns=mode,workers", nil, &rows)
+		if err != nil {
+			return err
+		}
+		if status != 200 || rows["config"]["mode"] != "fast" || rows["config"]["workers"] != float64(4) {
+			return fmt.Errorf("cacheReadRows read %d returned %d: %v", i, status, rows)
+		}
+	}
+	if reads := bucket.readsCount(); reads != 2 {
+		return fmt.Errorf("cacheReadRows read %d objects from the bucket, expected 2 (then cached)", reads)
+	}
+
+	// Scans list the bucket, but read the cells from the cache
+	var rows testRowsResponse
+	status, err := doRequest("GET", baseURL+"/api/row?table=cache1", nil, &rows)
+	if err != nil {
+		return err
+	}
+	if status != 200 || rows["config"]["mode"] != "fast" {
+		return fmt.Errorf("cacheReadRows scan returned %d: %v", status, rows)
+	}
+	if reads := bucket.readsCount(); reads != 2 {
+		return fmt.Errorf("cacheReadRows scan read %d objects from the bucket, expected 2", reads)
+	}
+
+	stats := readCache.Stats()
+	if stats.Hits != 6 || stats.Misses != 2 || stats.Entries != 2 || stats.Bytes == 0 {
+		return fmt.Errorf("cacheReadRows cache stats are %+v, expected 6 hits, 2 misses and 2 entries", stats)
+	}
+	return nil
+}
+
+func cacheInvalidateWrites(baseURL string, bucket *countingReadsBucket) error {
+	writes := []struct {
+		method string
+		url    string
+		body   interface{}
+		value  interface{}
+	}{
+		{"POST", "/api/row?table=cache1&key=config", map[string]string{"mode": "safe"}, "safe"},
+		{"POST", "/api/rows?table=cache1", map[string]map[string]string{"config": {"mode": "batch"}}, "batch"},
+		{"POST", "/api/row/increment?table=cache1&key=config&column=mode&by=1", nil, nil},
+	}
+	for _, write := range writes {
+		if _, err := doRequest("GET", baseURL+"/api/row?table=cache1&key=config&columns=mode", nil, nil); err != nil {
+			return err
+		}
+		status, err := doRequest(write.method, baseURL+write.url, write.body, nil)
+		if err != nil {
+			return err
+		}
+		if write.value == nil {
+			// Incrementing a non integer cell fails, but still invalidates it
+			continue
+		}
+		if status != 200 {
+			return fmt.Errorf("cacheInvalidateWrites %s %s returned %d", write.method, write.url, status)
+		}
+
+		readsBefore := bucket.readsCount()
+		var rows testRowsResponse
+		if _, err := doRequest("GET", baseURL+"/api/row?table=cache1&key=config&columns=mode", nil, &rows); err != nil {
+			return err
+		}
+		if rows["config"]["mode"] != write.value {
+			return fmt.Errorf("cacheInvalidateWrites read %v after %s %s, expected %v",
+				rows["config"]["mode"], write.method, write.url, write.value)
+		}
+		if bucket.readsCount() != readsBefore+1 {
+			return fmt.Errorf("cacheInvalidateWrites didn't read the bucket after %s %s", write.method, write.url)
+		}
+	}
+
+	var setResp map[string]interface{}
+	status, err := doRequest("POST", baseURL+"/api/row?table=cache1&key=counter", map[string]int{"hits": 1}, &setResp)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("cacheInvalidateWrites set counter returned %d", status)
+	}
+	if _, err := doRequest("GET", baseURL+"/api/row?table=cache1&key=counter&columns=hits", nil, nil); err != nil {
+		return err
+	}
+	if _, err := doRequest("POST", baseURL+"/api/row/increment?table=cache1&key=counter&column=hits&by=2", nil, nil); err != nil {
+		return err
+	}
+	var rows testRowsResponse
+	if _, err := doRequest("GET", baseURL+"/api/row?table=cache1&key=counter&columns=hits", nil, &rows); err != nil {
+		return err
+	}
+	if rows["counter"]["hits"] != float64(3) {
+		return fmt.Errorf("cacheInvalidateWrites read %v after increment, expected 3", rows["counter"]["hits"])
+	}
+
+	if status, err := putBlob(baseURL+"/api/cell?table=cache1&key=config&column=mode",
+		strings.NewReader("uploaded"), "text/plain"); err != nil || status != 200 {
+		return fmt.Errorf("cacheInvalidateWrites upload returned %d: %v", status, err)
+	}
+	status, _, body, err := getBlob(baseURL + "/api/cell?table=cache1&key=config&column=mode")
+	if err != nil || status != 200 || string(body) != "uploaded" {
+		return fmt.Errorf("cacheInvalidateWrites download after upload returned %d: %s", status, body)
+	}
+	rows = testRowsResponse{}
+	if _, err := doRequest("GET", baseURL+"/api/row?table=cache1&key=config&columns=mode", nil, &rows); err != nil {
+		return err
+	}
+	if _, isString := rows["config"]["mode"].(string); isString {
+		return fmt.Errorf("cacheInvalidateWrites read %v after upload, expected the uploaded bytes", rows["config"]["mode"])
+	}
+	return nil
+}
+
+func cacheInvalidateDeletes(baseURL string) error {
+	if _, err := doRequest("POST", baseURL+"/api/row?table=cache2&key=key1", map[string]string{"col1": "val1"}, nil); err != nil {
+		return err
+	}
+	if status, err := doRequest("GET", baseURL+"/api/row?table=cache2&key=key1&columns=col1", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("cacheInvalidateDeletes read returned %d: %v", status, err)
+	}
+	if status, err := doRequest("DELETE", baseURL+"/api/row?table=cache2&key=key1", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("cacheInvalidateDeletes delete returned %d: %v", status, err)
+	}
+
+	var rows testRowsResponse
+	if _, err := doRequest("GET", baseURL+"/api/row?table=cache2&key=key1&columns=col1", nil, &rows); err != nil {
+		return err
+	}
+	if _, exists := rows["key1"]["col1"]; exists {
+		return fmt.Errorf("cacheInvalidateDeletes read deleted cell from the cache: %v", rows)
+	}
+	return nil
+}
+
+func cacheExpiry() error {
+	readCache := cache.NewLRU(1024*1024, 50*time.Millisecond)
+	_, _, epoch, _ := readCache.Get("bigbucket/t/k/c")
+	readCache.Add("bigbucket/t/k/c", []byte("value"), &store.ObjectAttrs{}, epoch)
+	if _, _, _, cached := readCache.Get("bigbucket/t/k/c"); !cached {
+		return fmt.Errorf("cacheExpiry cell wasn't cached")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, _, _, cached := readCache.Get("bigbucket/t/k/c"); cached {
+		return fmt.Errorf("cacheExpiry cell was still cached after the TTL")
+	}
+	if stats := readCache.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		return fmt.Errorf("cacheExpiry cache stats are %+v after expiry, expected no entries", stats)
+	}
+	return nil
+}
+
+func cacheEviction() error {
+	// Room for 3 cells of 1KB
+	readCache := cache.NewLRU(4000, time.Minute)
+	value := make([]byte, 1000)
+	for i := 0; i < 3; i++ {
+		object := fmt.Sprintf("bigbucket/t/key%d/c", i)
+		_, _, epoch, _ := readCache.Get(object)
+		readCache.Add(object, value, &store.ObjectAttrs{}, epoch)
+	}
+	// key0 becomes the most recently used, so key1 is evicted
+	if _, _, _, cached := readCache.Get("bigbucket/t/key0/c"); !cached {
+		return fmt.Errorf("cacheEviction key0 wasn't cached")
+	}
+	_, _, epoch, _ := readCache.Get("bigbucket/t/key3/c")
+	readCache.Add("bigbucket/t/key3/c", value, &store.ObjectAttrs{}, epoch)
+
+	for key, expected := range map[string]bool{"key0": true, "key1": false, "key2": true, "key3": true} {
+		if _, _, _, cached := readCache.Get(fmt.Sprintf("bigbucket/t/%s/c", key)); cached != expected {
+			return fmt.Errorf("cacheEviction %s cached is %v, expected %v", key, cached, expected)
+		}
+	}
+	stats := readCache.Stats()
+	if stats.Evictions != 1 || stats.Bytes > 4000 {
+		return fmt.Errorf("cacheEviction cache stats are %+v, expected 1 eviction and at most 4000 bytes", stats)
+	}
+
+	// Cells larger than the cache are not cached
+	_, _, epoch, _ = readCache.Get("bigbucket/t/large/c")
+	readCache.Add("bigbucket/t/large/c", make([]byte, 4000), &store.ObjectAttrs{}, epoch)
+	if _, _, _, cached := readCache.Get("bigbucket/t/large/c"); cached {
+		return fmt.Errorf("cacheEviction cell larger than the cache was cached")
+	}
+	return nil
+}
+
+func cacheRacingInvalidation() error {
+	readCache := cache.NewLRU(1024*1024, time.Minute)
+
+	// A read which started before a write finished has to not cache what it read
+	_, _, epoch, _ := readCache.Get("bigbucket/t/k/c")
+	readCache.Remove("bigbucket/t/k/c")
+	readCache.Add("bigbucket/t/k/c", []byte("old"), &store.ObjectAttrs{}, epoch)
+	if _, _, _, cached := readCache.Get("bigbucket/t/k/c"); cached {
+		return fmt.Errorf("cacheRacingInvalidation cached a read which raced with an invalidation")
+	}
+
+	_, _, epoch, _ = readCache.Get("bigbucket/t/k/c")
+	readCache.Add("bigbucket/t/k/c", []byte("new"), &store.ObjectAttrs{}, epoch)
+	data, _, _, cached := readCache.Get("bigbucket/t/k/c")
+	if !cached || string(data) != "new" {
+		return fmt.Errorf("cacheRacingInvalidation didn't cache a read after the invalidation")
+	}
+	return nil
+}
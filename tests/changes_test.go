@@ -0,0 +1,474 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/utils"
+	"github.com/adrianchifor/Bigbucket/worker"
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+)
+
+const testChangesPolicies = `
+principalHeader: X-Principal
+policies:
+  - principals: [analytics]
+    tables: [changes4]
+    permissions: [read]
+    excludeColumns: [secret]
+`
+
+// testChangesSettle holds back change log segments from readers for a shorter time than the default, so tests
+// wait for it after writes
+const testChangesSettle = 200 * time.Millisecond
+
+func TestChanges(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiServer := httptest.NewServer(api.NewRouter(bucket, &api.Options{ChangeLog: true, ChangeLogSettle: testChangesSettle}))
+	t.Cleanup(apiServer.Close)
+
+	if err := changesDisabled(); err != nil {
+		t.Error(err)
+	}
+	if err := changesMutations(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := changesPaging(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := changesWatch(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := changesEventStream(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := changesLateSegment(bucket, apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := changesRedacted(t, bucket, apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := changesRetention(bucket, apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+// testChangesResponse is the response of GET /api/changes
+type testChangesResponse struct {
+	Table   string `json:"table"`
+	Changes []struct {
+		Table       string            `json:"table"`
+		Op          string            `json:"op"`
+		Key         string            `json:"key"`
+		Columns     []string          `json:"columns"`
+		Generations map[string]string `json:"generations"`
+		Timestamp   time.Time         `json:"timestamp"`
+	} `json:"changes"`
+	Cursor string `json:"cursor"`
+}
+
+// describeChanges summarizes change events as 'op key columns' strings
+func describeChanges(changes testChangesResponse) []string {
+	described := []string{}
+	for _, change := range changes.Changes {
+		described = append(described, strings.TrimSpace(fmt.Sprintf("%s %s %s", change.Op, change.Key, strings.Join(change.Columns, ","))))
+	}
+	return described
+}
+
+func getChanges(url string) (testChangesResponse, error) {
+	var changes testChangesResponse
+	status, err := doRequest("GET", url, nil, &changes)
+	if err != nil {
+		return changes, err
+	}
+	if status != 200 {
+		return changes, fmt.Errorf("GET %s returned %d", url, status)
+	}
+	return changes, nil
+}
+
+func changesDisabled() error {
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		return err
+	}
+	apiServer := httptest.NewServer(api.NewRouter(bucket, nil))
+	defer apiServer.Close()
+
+	if _, err := doRequest("POST", apiServer.URL+"/api/row?table=changes0&key=key1", map[string]string{"col1": "val1"}, nil); err != nil {
+		return err
+	}
+	status, err := doRequest("GET", apiServer.URL+"/api/changes?table=changes0", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return fmt.Errorf("changesDisabled returned %d, expected 404", status)
+	}
+	objects, err := bucket.ListObjects(context.Background(), utils.ChangesPrefix, "", 0, nil)
+	if err != nil {
+		return err
+	}
+	if len(objects) != 0 {
+		return fmt.Errorf("changesDisabled wrote the change log: %v", objects)
+	}
+	return nil
+}
+
+func changesMutations(baseURL string) error {
+	requests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"POST", "/api/row?table=changes1&key=key1", map[string]string{"col1": "val1", "col2": "val2"}},
+		{"POST", "/api/rows?table=changes1", map[string]map[string]string{"key3": {"col1": "val1"}, "key2": {"col1": "val1"}}},
+		{"POST", "/api/row/increment?table=changes1&key=key1&column=counter", nil},
+		{"DELETE", "/api/row?table=changes1&key=key2", nil},
+		{"DELETE", "/api/column?table=changes1&column=col2", nil},
+		{"DELETE", "/api/table?table=changes1", nil},
+	}
+	for _, request := range requests {
+		status, err := doRequest(request.method, baseURL+request.path, request.body, nil)
+		if err != nil {
+			return err
+		}
+		if status != 200 {
+			return fmt.Errorf("changesMutations %s %s returned %d", request.method, request.path, status)
+		}
+	}
+	time.Sleep(testChangesSettle)
+
+	changes, err := getChanges(baseURL + "/api/changes?table=changes1")
+	if err != nil {
+		return err
+	}
+	expected := []string{
+		"set key1 col1,col2",
+		"set key2 col1",
+		"set key3 col1",
+		"set key1 counter",
+		"delete key2 col1",
+		"deleteColumn  col2",
+		"deleteTable",
+	}
+	if described := describeChanges(changes); !reflect.DeepEqual(described, expected) {
+		return fmt.Errorf("changesMutations returned %v, expected %v", described, expected)
+	}
+	first := changes.Changes[0]
+	if first.Table != "changes1" || first.Generations["col1"] == "" || first.Generations["col2"] == "" || first.Timestamp.IsZero() {
+		return fmt.Errorf("changesMutations returned set event without table, generations or timestamp: %+v", first)
+	}
+
+	// Tables listings skip the change log
+	var tables map[string][]string
+	if _, err := doRequest("GET", baseURL+"/api/table", nil, &tables); err != nil {
+		return err
+	}
+	for _, table := range tables["tables"] {
+		if strings.HasPrefix(table, ".") {
+			return fmt.Errorf("changesMutations listed the change log as table: %v", tables)
+		}
+	}
+	return nil
+}
+
+func changesPaging(baseURL string) error {
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=changes2&key=key%d", baseURL, i), map[string]string{"col1": "val1"}, nil); err != nil {
+			return err
+		}
+	}
+	time.Sleep(testChangesSettle)
+
+	keys := []string{}
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		changes, err := getChanges(fmt.Sprintf("%s/api/changes?table=changes2&limit=2&since=%s", baseURL, cursor))
+		if err != nil {
+			return err
+		}
+		for _, change := range changes.Changes {
+			keys = append(keys, change.Key)
+		}
+		cursor = changes.Cursor
+	}
+	if expected := []string{"key0", "key1", "key2", "key3", "key4"}; !reflect.DeepEqual(keys, expected) {
+		return fmt.Errorf("changesPaging returned %v, expected %v", keys, expected)
+	}
+	changes, err := getChanges(fmt.Sprintf("%s/api/changes?table=changes2&since=%s", baseURL, cursor))
+	if err != nil {
+		return err
+	}
+	if len(changes.Changes) != 0 || changes.Cursor != cursor {
+		return fmt.Errorf("changesPaging after the last cursor returned %+v", changes)
+	}
+
+	// Times are read as the changes logged from then
+	since := url.QueryEscape(start.Add(-time.Second).Format(time.RFC3339Nano))
+	if changes, err = getChanges(fmt.Sprintf("%s/api/changes?table=changes2&since=%s", baseURL, since)); err != nil {
+		return err
+	}
+	if len(changes.Changes) != 5 {
+		return fmt.Errorf("changesPaging since %s returned %d changes, expected 5", since, len(changes.Changes))
+	}
+	since = url.QueryEscape(time.Now().Add(time.Minute).Format(time.RFC3339))
+	if changes, err = getChanges(fmt.Sprintf("%s/api/changes?table=changes2&since=%s", baseURL, since)); err != nil {
+		return err
+	}
+	if len(changes.Changes) != 0 {
+		return fmt.Errorf("changesPaging since %s returned %d changes, expected 0", since, len(changes.Changes))
+	}
+
+	for _, params := range []string{"since=yesterday", "limit=0", "limit=abc", "watch=maybe", "timeout=0"} {
+		status, err := doRequest("GET", baseURL+"/api/changes?table=changes2&"+params, nil, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("changesPaging with %s returned %d, expected 400", params, status)
+		}
+	}
+	return nil
+}
+
+func changesWatch(baseURL string) error {
+	changes, err := getChanges(baseURL + "/api/changes?table=changes3")
+	if err != nil {
+		return err
+	}
+
+	// Long polls without changes return when timing out
+	start := time.Now()
+	if changes, err = getChanges(baseURL + "/api/changes?table=changes3&watch=true&timeout=1"); err != nil {
+		return err
+	}
+	if elapsed := time.Since(start); len(changes.Changes) != 0 || elapsed < time.Second {
+		return fmt.Errorf("changesWatch without changes returned %d changes after %v", len(changes.Changes), elapsed)
+	}
+
+	watched := make(chan testChangesResponse)
+	watchErr := make(chan error, 1)
+	start = time.Now()
+	go func() {
+		changes, err := getChanges(fmt.Sprintf("%s/api/changes?table=changes3&watch=true&timeout=20&since=%s", baseURL, changes.Cursor))
+		watchErr <- err
+		watched <- changes
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := doRequest("POST", baseURL+"/api/row?table=changes3&key=key1", map[string]string{"col1": "val1"}, nil); err != nil {
+		return err
+	}
+	if err := <-watchErr; err != nil {
+		return err
+	}
+	changes = <-watched
+	// Watchers are woken up by the changes of this instance, before polling the bucket again
+	if elapsed := time.Since(start); elapsed > time.Second {
+		return fmt.Errorf("changesWatch returned the change after %v", elapsed)
+	}
+	if described := describeChanges(changes); !reflect.DeepEqual(described, []string{"set key1 col1"}) {
+		return fmt.Errorf("changesWatch returned %v", described)
+	}
+	return nil
+}
+
+func changesEventStream(baseURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := doRequest("POST", baseURL+"/api/row?table=changes5&key=key1", map[string]string{"col1": "val1"}, nil); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/api/changes?table=changes5", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		return fmt.Errorf("changesEventStream returned %d (%s)", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		doRequest("POST", baseURL+"/api/row?table=changes5&key=key2", map[string]string{"col1": "val1"}, nil)
+	}()
+
+	ids := []string{}
+	data := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for len(data) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		} else if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(data) != 2 || !strings.Contains(data[0], `"key":"key1"`) || !strings.Contains(data[1], `"key":"key2"`) {
+		return fmt.Errorf("changesEventStream streamed %v", data)
+	}
+	if len(ids) != 2 || ids[0] >= ids[1] {
+		return fmt.Errorf("changesEventStream streamed ids %v, expected 2 increasing cursors", ids)
+	}
+
+	// Reconnecting resumes after the last event id
+	changes, err := getChanges(fmt.Sprintf("%s/api/changes?table=changes5&since=%s", baseURL, ids[0]))
+	if err != nil {
+		return err
+	}
+	if described := describeChanges(changes); !reflect.DeepEqual(described, []string{"set key2 col1"}) {
+		return fmt.Errorf("changesEventStream since first id returned %v", described)
+	}
+	return nil
+}
+
+// changesLateSegment checks a segment written after a later one doesn't get skipped by readers, like a segment
+// of a slow write or of an instance with its clock behind
+func changesLateSegment(bucket store.Backend, baseURL string) error {
+	ctx := context.Background()
+	prefix := utils.ChangesPrefix + "changes6/"
+	// Both named in the past, but still within the settle window
+	named := time.Now().Add(-testChangesSettle / 2)
+	lateSegment := fmt.Sprintf("%s%020d-00000000", prefix, named.UnixNano())
+	laterSegment := fmt.Sprintf("%s%020d-00000000", prefix, named.Add(time.Millisecond).UnixNano())
+
+	if _, err := bucket.WriteObject(ctx, laterSegment, []byte(`{"table":"changes6","op":"set","key":"key2","columns":["col1"]}`+"\n"), nil); err != nil {
+		return err
+	}
+	changes, err := getChanges(baseURL + "/api/changes?table=changes6")
+	if err != nil {
+		return err
+	}
+	// Segments are held back until settled, so the cursor doesn't move past the late one
+	if len(changes.Changes) != 0 || changes.Cursor != "" {
+		return fmt.Errorf("changesLateSegment returned unsettled changes %v with cursor %s", describeChanges(changes), changes.Cursor)
+	}
+
+	if _, err := bucket.WriteObject(ctx, lateSegment, []byte(`{"table":"changes6","op":"set","key":"key1","columns":["col1"]}`+"\n"), nil); err != nil {
+		return err
+	}
+	time.Sleep(time.Until(named.Add(testChangesSettle + 10*time.Millisecond)))
+	if changes, err = getChanges(baseURL + "/api/changes?table=changes6&since=" + changes.Cursor); err != nil {
+		return err
+	}
+	if described := describeChanges(changes); !reflect.DeepEqual(described, []string{"set key1 col1", "set key2 col1"}) {
+		return fmt.Errorf("changesLateSegment returned %v, expected the late segment first", described)
+	}
+	return nil
+}
+
+func changesRedacted(t *testing.T, bucket store.Backend, baseURL string) error {
+	policiesPath := filepath.Join(t.TempDir(), "policies.yaml")
+	if err := os.WriteFile(policiesPath, []byte(testChangesPolicies), 0o600); err != nil {
+		return err
+	}
+	config, err := auth.LoadPolicies(policiesPath)
+	if err != nil {
+		return err
+	}
+	policies, err := auth.NewPolicies(config)
+	if err != nil {
+		return err
+	}
+	policyServer := httptest.NewServer(api.NewRouter(bucket, &api.Options{Policies: policies, ChangeLog: true, ChangeLogSettle: testChangesSettle}))
+	defer policyServer.Close()
+
+	if _, err := doRequest("POST", baseURL+"/api/row?table=changes4&key=key1", map[string]string{"name": "val1", "secret": "val2"}, nil); err != nil {
+		return err
+	}
+	if _, err := doRequest("POST", baseURL+"/api/row?table=changes4&key=key2", map[string]string{"secret": "val2"}, nil); err != nil {
+		return err
+	}
+	time.Sleep(testChangesSettle)
+
+	var changes testChangesResponse
+	status, err := doPrincipalRequest("GET", policyServer.URL+"/api/changes?table=changes4", "analytics", nil, &changes)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("changesRedacted returned %d", status)
+	}
+	if described := describeChanges(changes); !reflect.DeepEqual(described, []string{"set key1 name"}) {
+		return fmt.Errorf("changesRedacted returned %v, expected only the readable column", described)
+	}
+	if _, exists := changes.Changes[0].Generations["secret"]; exists {
+		return fmt.Errorf("changesRedacted returned the generation of an excluded column: %v", changes.Changes[0].Generations)
+	}
+
+	status, err = doPrincipalRequest("GET", policyServer.URL+"/api/changes?table=changes1", "analytics", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 403 {
+		return fmt.Errorf("changesRedacted of a table without read permission returned %d, expected 403", status)
+	}
+	return nil
+}
+
+func changesRetention(bucket store.Backend, baseURL string) error {
+	ctx := context.Background()
+	oldSegment := fmt.Sprintf("%s%s/%020d-00000000", utils.ChangesPrefix, "changes2", time.Now().Add(-2*time.Hour).UnixNano())
+	if _, err := bucket.WriteObject(ctx, oldSegment, []byte(`{"table":"changes2","op":"set","key":"old","columns":["col1"]}`+"\n"), nil); err != nil {
+		return err
+	}
+	changes, err := getChanges(baseURL + "/api/changes?table=changes2")
+	if err != nil {
+		return err
+	}
+	if len(changes.Changes) != 6 || changes.Changes[0].Key != "old" {
+		return fmt.Errorf("changesRetention returned %v before cleanup", describeChanges(changes))
+	}
+
+	worker.ChangeLogRetention = time.Hour
+	defer func() { worker.ChangeLogRetention = 0 }()
+	deleteJobPool := parallel.SmallJobPool()
+	defer deleteJobPool.Close()
+	cleanerServer := httptest.NewServer(worker.NewCleanerRouter(bucket, deleteJobPool))
+	defer cleanerServer.Close()
+
+	if status, err := doRequest("POST", cleanerServer.URL+"/", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("changesRetention cleaner returned %d: %v", status, err)
+	}
+	if _, _, err := bucket.ReadObject(ctx, oldSegment); !errors.Is(err, store.ErrObjectNotExist) {
+		return fmt.Errorf("changesRetention old segment wasn't deleted: %v", err)
+	}
+	if changes, err = getChanges(baseURL + "/api/changes?table=changes2"); err != nil {
+		return err
+	}
+	if len(changes.Changes) != 5 {
+		return fmt.Errorf("changesRetention returned %v after cleanup, expected the 5 recent changes", describeChanges(changes))
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCoalesce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocking := &blockingBucket{Backend: bucket}
+	coalescing := store.Coalesce(blocking)
+	apiServer := httptest.NewServer(api.NewRouter(coalescing, nil))
+	t.Cleanup(apiServer.Close)
+
+	if err := coalesceRowReads(apiServer.URL, blocking); err != nil {
+		t.Error(err)
+	}
+	if err := coalesceListings(apiServer.URL, blocking); err != nil {
+		t.Error(err)
+	}
+	if err := coalesceAfterWrite(coalescing, blocking); err != nil {
+		t.Error(err)
+	}
+	if err := coalesceCanceledCaller(coalescing, blocking); err != nil {
+		t.Error(err)
+	}
+}
+
+// blockingBucket counts reads of cells and listings of rows, and blocks them until released when blocked
+type blockingBucket struct {
+	store.Backend
+	reads    int64
+	lists    int64
+	mutex    sync.Mutex
+	released chan struct{}
+}
+
+// block makes cell reads and listings wait until the returned func is called
+func (b *blockingBucket) block() func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	released := make(chan struct{})
+	b.released = released
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.released = nil
+		close(released)
+	}
+}
+
+func (b *blockingBucket) wait(ctx context.Context) error {
+	b.mutex.Lock()
+	released := b.released
+	b.mutex.Unlock()
+	if released == nil {
+		return nil
+	}
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *blockingBucket) ReadObject(ctx context.Context, object string) ([]byte, *store.ObjectAttrs, error) {
+	if isCellObject(object) {
+		atomic.AddInt64(&b.reads, 1)
+		if err := b.wait(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	return b.Backend.ReadObject(ctx, object)
+}
+
+func (b *blockingBucket) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *store.ListOptions) ([]string, error) {
+	if strings.Count(prefix, "/") >= 2 {
+		atomic.AddInt64(&b.lists, 1)
+		if err := b.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return b.Backend.ListObjects(ctx, prefix, delimiter, limit, opts)
+}
+
+func (b *blockingBucket) counts() (int64, int64) {
+	return atomic.LoadInt64(&b.reads), atomic.LoadInt64(&b.lists)
+}
+
+// isCellObject returns true for cell objects, not table state or schemas
+func isCellObject(object string) bool {
+	return strings.Count(object, "/") == 3 && !strings.HasSuffix(object, "/") && !strings.Contains(object, "/.")
+}
+
+// concurrentRequests sends the same GET request from many clients at once, while the bucket is blocked
+func concurrentRequests(url string, clients int, bucket *blockingBucket) ([]testRowsResponse, error) {
+	release := bucket.block()
+	responses := make([]testRowsResponse, clients)
+	errs := make(chan error, clients)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, err := doRequest("GET", url, nil, &responses[i])
+			if err == nil && status != 200 {
+				err = fmt.Errorf("GET %s returned %d", url, status)
+			}
+			errs <- err
+		}(i)
+	}
+	// Give all requests the time to reach the bucket before releasing it
+	time.Sleep(200 * time.Millisecond)
+	release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return responses, nil
+}
+
+func coalesceRowReads(baseURL string, bucket *blockingBucket) error {
+	if _, err := doRequest("POST", baseURL+"/api/row?table=coalesce1&key=hot", map[string]string{"col1": "val1", "col2": "val2"}, nil); err != nil {
+		return err
+	}
+
+	readsBefore, _ := bucket.counts()
+	responses, err := concurrentRequests(baseURL+"/api/row?table=coalesce1&key=hot&columns=col1,col2", 20, bucket)
+	if err != nil {
+		return err
+	}
+	for _, rows := range responses {
+		if rows["hot"]["col1"] != "val1" || rows["hot"]["col2"] != "val2" {
+			return fmt.Errorf("coalesceRowReads returned %v", rows)
+		}
+	}
+	if reads, _ := bucket.counts(); reads-readsBefore != 2 {
+		return fmt.Errorf("coalesceRowReads read %d cells from the bucket for 20 reads of 2 cells, expected 2", reads-readsBefore)
+	}
+	return nil
+}
+
+func coalesceListings(baseURL string, bucket *blockingBucket) error {
+	for i := 0; i < 3; i++ {
+		if _, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=coalesce2&key=key%d", baseURL, i), map[string]string{"col1": "val1"}, nil); err != nil {
+			return err
+		}
+	}
+
+	_, listsBefore := bucket.counts()
+	responses, err := concurrentRequests(baseURL+"/api/row?table=coalesce2", 20, bucket)
+	if err != nil {
+		return err
+	}
+	for _, rows := range responses {
+		if len(rows) != 3 || rows["key2"]["col1"] != "val1" {
+			return fmt.Errorf("coalesceListings returned %v", rows)
+		}
+	}
+	if _, lists := bucket.counts(); lists-listsBefore != 1 {
+		return fmt.Errorf("coalesceListings listed the bucket %d times for 20 scans, expected 1", lists-listsBefore)
+	}
+	return nil
+}
+
+func coalesceAfterWrite(coalescing store.Backend, bucket *blockingBucket) error {
+	ctx := context.Background()
+	object := "bigbucket/coalesce3/key1/col1"
+	if _, err := coalescing.WriteObject(ctx, object, []byte("old"), nil); err != nil {
+		return err
+	}
+
+	release := bucket.block()
+	readsBefore, _ := bucket.counts()
+	firstRead := make(chan []byte)
+	go func() {
+		data, _, _ := coalescing.ReadObject(ctx, object)
+		firstRead <- data
+	}()
+	for reads, _ := bucket.counts(); reads == readsBefore; reads, _ = bucket.counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A read after the write has to not share the read started before it
+	if _, err := coalescing.WriteObject(ctx, object, []byte("new"), nil); err != nil {
+		return err
+	}
+	secondRead := make(chan []byte)
+	go func() {
+		data, _, _ := coalescing.ReadObject(ctx, object)
+		secondRead <- data
+	}()
+	time.Sleep(50 * time.Millisecond)
+	release()
+
+	<-firstRead
+	if data := <-secondRead; string(data) != "new" {
+		return fmt.Errorf("coalesceAfterWrite read '%s' after the write, expected 'new'", data)
+	}
+	if reads, _ := bucket.counts(); reads-readsBefore != 2 {
+		return fmt.Errorf("coalesceAfterWrite read %d times from the bucket, expected 2", reads-readsBefore)
+	}
+	return nil
+}
+
+func coalesceCanceledCaller(coalescing store.Backend, bucket *blockingBucket) error {
+	object := "bigbucket/coalesce3/key1/col1"
+	release := bucket.block()
+	readsBefore, _ := bucket.counts()
+
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, _, err := coalescing.ReadObject(firstCtx, object)
+		firstErr <- err
+	}()
+	for reads, _ := bucket.counts(); reads == readsBefore; reads, _ = bucket.counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	secondRead := make(chan []byte)
+	go func() {
+		data, _, _ := coalescing.ReadObject(context.Background(), object)
+		secondRead <- data
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The caller running the shared read went away, the other one reads again
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("coalesceCanceledCaller canceled read returned %v, expected context canceled", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	release()
+	if data := <-secondRead; string(data) != "new" {
+		return fmt.Errorf("coalesceCanceledCaller read '%s' after the shared read was canceled, expected 'new'", data)
+	}
+	return nil
+}
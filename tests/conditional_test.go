@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/store"
+)
+
+func TestConditionalWrites(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	status, err := doRequest("POST", apiServer.URL+"/api/row?table=cas1&key=key1",
+		map[string]string{"col1": "val1", "col2": "val2"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 200 {
+		t.Fatal("TestConditionalWrites /api/row POST response status code is not 200")
+	}
+
+	generation, err := readGeneration(apiServer.URL, "col1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setWithGeneration(apiServer.URL, generation); err != nil {
+		t.Error(err)
+	}
+	if err := setWithStaleGeneration(apiServer.URL, generation); err != nil {
+		t.Error(err)
+	}
+	if err := setIfNotExists(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := setGenerationsBadParams(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := setWithConcurrentWrite(); err != nil {
+		t.Error(err)
+	}
+}
+
+type testSetResponse struct {
+	Generations map[string]string `json:"generations"`
+	Conflicts   []string          `json:"conflicts"`
+	Written     []string          `json:"written"`
+}
+
+func readGeneration(baseURL string, column string) (string, error) {
+	var row map[string]map[string]struct {
+		Value      string `json:"value"`
+		Generation string `json:"generation"`
+	}
+	status, err := doRequest("GET", baseURL+"/api/row?table=cas1&key=key1&generations=true", nil, &row)
+	if err != nil {
+		return "", err
+	}
+	if status != 200 {
+		return "", errors.New("readGeneration /api/row GET response status code is not 200")
+	}
+	cell, exists := row["key1"][column]
+	if !exists || cell.Value == "" || cell.Generation == "" {
+		return "", fmt.Errorf("readGeneration cell '%s' has no value or generation", column)
+	}
+	return cell.Generation, nil
+}
+
+func setWithGeneration(baseURL string, generation string) error {
+	var data testSetResponse
+	status, err := doRequest("POST", baseURL+"/api/row?table=cas1&key=key1&ifGenerations=col1:"+generation,
+		map[string]string{"col1": "newval1", "col2": "newval2"}, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("setWithGeneration /api/row POST response status code is not 200")
+	}
+	if len(data.Generations) != 2 || data.Generations["col1"] == generation {
+		return errors.New("setWithGeneration response generations do not match columns set")
+	}
+
+	newGeneration, err := readGeneration(baseURL, "col1")
+	if err != nil {
+		return err
+	}
+	if newGeneration != data.Generations["col1"] {
+		return errors.New("setWithGeneration read generation does not match the one returned")
+	}
+	return nil
+}
+
+func setWithStaleGeneration(baseURL string, generation string) error {
+	var data testSetResponse
+	status, err := doRequest("POST", baseURL+"/api/row?table=cas1&key=key1&ifGenerations=col1:"+generation,
+		map[string]string{"col1": "staleval1", "col2": "staleval2"}, &data)
+	if err != nil {
+		return err
+	}
+	if status != 412 {
+		return errors.New("setWithStaleGeneration /api/row POST response status code is not 412")
+	}
+	if len(data.Conflicts) != 1 || data.Conflicts[0] != "col1" {
+		return fmt.Errorf("setWithStaleGeneration expected conflict on col1, got %v", data.Conflicts)
+	}
+	// Nothing is set if a precondition fails
+	if len(data.Written) != 0 || len(data.Generations) != 0 {
+		return fmt.Errorf("setWithStaleGeneration set columns %v", data.Written)
+	}
+
+	var row map[string]map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row?table=cas1&key=key1", nil, &row); err != nil {
+		return err
+	}
+	if row["key1"]["col1"] != "newval1" || row["key1"]["col2"] != "newval2" {
+		return fmt.Errorf("setWithStaleGeneration overwrote columns, got %v", row["key1"])
+	}
+	return nil
+}
+
+// racingBucket writes a cell right after its generation is checked, like a concurrent write between the check
+// of the preconditions and the writes
+type racingBucket struct {
+	store.Backend
+	object string
+}
+
+func (b *racingBucket) StatObject(ctx context.Context, object string) (*store.ObjectAttrs, error) {
+	attrs, err := b.Backend.StatObject(ctx, object)
+	if object == b.object {
+		if _, writeErr := b.Backend.WriteObject(ctx, object, []byte("concurrent"), nil); writeErr != nil {
+			return nil, writeErr
+		}
+	}
+	return attrs, err
+}
+
+func setWithConcurrentWrite() error {
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		return err
+	}
+	racing := &racingBucket{Backend: bucket}
+	apiServer := httptest.NewServer(api.NewRouter(racing, nil))
+	defer apiServer.Close()
+
+	var data testSetResponse
+	if _, err := doRequest("POST", apiServer.URL+"/api/row?table=cas2&key=key1&generations=true",
+		map[string]string{"col1": "val1", "col2": "val2"}, &data); err != nil {
+		return err
+	}
+	racing.object = "bigbucket/cas2/key1/col1"
+
+	status, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=cas2&key=key1&ifGenerations=col1:%s,col2:%s",
+		apiServer.URL, data.Generations["col1"], data.Generations["col2"]),
+		map[string]string{"col1": "newval1", "col2": "newval2", "col3": "newval3"}, &data)
+	if err != nil {
+		return err
+	}
+	if status != 412 {
+		return fmt.Errorf("setWithConcurrentWrite /api/row POST returned %d, expected 412", status)
+	}
+	// Other columns with preconditions are set, the ones without are not
+	if !reflect.DeepEqual(data.Conflicts, []string{"col1"}) || !reflect.DeepEqual(data.Written, []string{"col2"}) ||
+		data.Generations["col2"] == "" {
+		return fmt.Errorf("setWithConcurrentWrite returned conflicts %v and written %v", data.Conflicts, data.Written)
+	}
+
+	var row map[string]map[string]string
+	if _, err := doRequest("GET", apiServer.URL+"/api/row?table=cas2&key=key1", nil, &row); err != nil {
+		return err
+	}
+	expected := map[string]string{"col1": "concurrent", "col2": "newval2"}
+	if !reflect.DeepEqual(row["key1"], expected) {
+		return fmt.Errorf("setWithConcurrentWrite row is %v, expected %v", row["key1"], expected)
+	}
+	return nil
+}
+
+func setIfNotExists(baseURL string) error {
+	status, err := doRequest("POST", baseURL+"/api/row?table=cas1&key=key2&ifGenerations=col1:0",
+		map[string]string{"col1": "val1"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("setIfNotExists /api/row POST (new column) response status code is not 200")
+	}
+
+	status, err = doRequest("POST", baseURL+"/api/row?table=cas1&key=key2&ifGenerations=col1:0",
+		map[string]string{"col1": "val2"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 412 {
+		return errors.New("setIfNotExists /api/row POST (existing column) response status code is not 412")
+	}
+	return nil
+}
+
+func setGenerationsBadParams(baseURL string) error {
+	badParams := []string{
+		"ifGenerations=col1",
+		"ifGenerations=col1:",
+		"ifGenerations=col3:0",
+	}
+	for _, param := range badParams {
+		status, err := doRequest("POST", baseURL+"/api/row?table=cas1&key=key1&"+param,
+			map[string]string{"col1": "val1"}, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("setGenerationsBadParams /api/row POST (%s) response status code is not 400", param)
+		}
+	}
+
+	status, err := doRequest("GET", baseURL+"/api/row?table=cas1&key=key1&generations=true&versions=2", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return errors.New("setGenerationsBadParams /api/row GET (generations and versions) response status code is not 400")
+	}
+	return nil
+}
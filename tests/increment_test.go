@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestIncrement(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	if err := incrementNewColumn(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := incrementStringColumn(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := incrementConcurrently(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := incrementBadParams(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := incrementSchemaMaxSize(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+type testIncrementResponse struct {
+	Value      json.RawMessage `json:"value"`
+	Generation string          `json:"generation"`
+}
+
+// readCounter reads a cell of table inc1 as its raw JSON value
+func readCounter(baseURL string, key string) (string, error) {
+	var row map[string]map[string]json.RawMessage
+	status, err := doRequest("GET", baseURL+"/api/row?table=inc1&key="+key+"&columns=counter", nil, &row)
+	if err != nil {
+		return "", err
+	}
+	if status != 200 {
+		return "", fmt.Errorf("readCounter /api/row GET returned %d", status)
+	}
+	return string(row[key]["counter"]), nil
+}
+
+func incrementNewColumn(baseURL string) error {
+	var data testIncrementResponse
+	status, err := doRequest("POST", baseURL+"/api/row/increment?table=inc1&key=key1&column=counter", nil, &data)
+	if err != nil {
+		return err
+	}
+	// Counters are integers, returned as JSON numbers
+	if status != 200 || string(data.Value) != "1" || data.Generation == "" {
+		return fmt.Errorf("incrementNewColumn missing column was incremented to %s, expected 1", data.Value)
+	}
+
+	status, err = doRequest("POST", baseURL+"/api/row/increment?table=inc1&key=key1&column=counter&by=-5", nil, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 || string(data.Value) != "-4" {
+		return fmt.Errorf("incrementNewColumn column was decremented to %s, expected -4", data.Value)
+	}
+
+	counter, err := readCounter(baseURL, "key1")
+	if err != nil {
+		return err
+	}
+	if counter != "-4" {
+		return fmt.Errorf("incrementNewColumn read %s, expected the integer -4", counter)
+	}
+	return nil
+}
+
+func incrementStringColumn(baseURL string) error {
+	if _, err := doRequest("POST", baseURL+"/api/row?table=inc1&key=key4", map[string]string{"counter": "41"}, nil); err != nil {
+		return err
+	}
+
+	var data testIncrementResponse
+	status, err := doRequest("POST", baseURL+"/api/row/increment?table=inc1&key=key4&column=counter", nil, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 || string(data.Value) != "42" {
+		return fmt.Errorf("incrementStringColumn returned %d with value %s, expected 42", status, data.Value)
+	}
+
+	// Strings holding integers become integers
+	counter, err := readCounter(baseURL, "key4")
+	if err != nil {
+		return err
+	}
+	if counter != "42" {
+		return fmt.Errorf("incrementStringColumn read %s, expected the integer 42", counter)
+	}
+	return nil
+}
+
+func incrementConcurrently(baseURL string) error {
+	workers, increments := 5, 10
+	succeeded := 0
+	mutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				status, err := doRequest("POST", baseURL+"/api/row/increment?table=inc1&key=key2&column=counter", nil, nil)
+				if err == nil && status == 200 {
+					mutex.Lock()
+					succeeded++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	counter, err := readCounter(baseURL, "key2")
+	if err != nil {
+		return err
+	}
+	if counter != fmt.Sprint(succeeded) {
+		return fmt.Errorf("incrementConcurrently counter is %s, expected %d successful increments", counter, succeeded)
+	}
+	if succeeded == 0 {
+		return errors.New("incrementConcurrently no increments succeeded")
+	}
+	return nil
+}
+
+func incrementBadParams(baseURL string) error {
+	status, err := doRequest("POST", baseURL+"/api/row?table=inc1&key=key3", map[string]string{"text": "val"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("incrementBadParams /api/row POST response status code is not 200")
+	}
+
+	badParams := []string{
+		"table=inc1&key=key3",
+		"table=inc1&key=key3&column=counter&by=one",
+		"table=inc1&key=key3&column=text",
+		"table=inc1&key=key1&column=counter&by=-9223372036854775807",
+	}
+	for _, param := range badParams {
+		status, err := doRequest("POST", baseURL+"/api/row/increment?"+param, nil, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("incrementBadParams /api/row/increment POST (%s) response status code is not 400", param)
+		}
+	}
+	return nil
+}
+
+// incrementSchemaMaxSize checks the incremented value is validated against the schema, not 'by'
+func incrementSchemaMaxSize(baseURL string) error {
+	schema := map[string]interface{}{"columns": map[string]interface{}{"counter": map[string]interface{}{"type": "int", "maxSize": 1}}}
+	if status, err := doRequest("PUT", baseURL+"/api/table?table=inc2", schema, nil); err != nil || status != 200 {
+		return fmt.Errorf("incrementSchemaMaxSize set schema returned %d: %v", status, err)
+	}
+
+	var data testIncrementResponse
+	status, err := doRequest("POST", baseURL+"/api/row/increment?table=inc2&key=key1&column=counter&by=5", nil, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 || string(data.Value) != "5" {
+		return fmt.Errorf("incrementSchemaMaxSize returned %d with value %s, expected 5", status, data.Value)
+	}
+
+	var violations testSchemaViolations
+	status, err = doRequest("POST", baseURL+"/api/row/increment?table=inc2&key=key1&column=counter&by=5", nil, &violations)
+	if err != nil {
+		return err
+	}
+	expected := []string{"Column 'counter' value is over the max size of 1 bytes"}
+	if status != 400 || !reflect.DeepEqual(violations.Violations, expected) {
+		return fmt.Errorf("incrementSchemaMaxSize to 10 returned %d with %v, expected 400 with %v", status, violations.Violations, expected)
+	}
+
+	var row map[string]map[string]json.RawMessage
+	if _, err := doRequest("GET", baseURL+"/api/row?table=inc2&key=key1", nil, &row); err != nil {
+		return err
+	}
+	if counter := string(row["key1"]["counter"]); counter != "5" {
+		return fmt.Errorf("incrementSchemaMaxSize stored %s, expected 5", counter)
+	}
+	return nil
+}
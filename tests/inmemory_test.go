@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/worker"
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+)
+
+// TestInMemory runs the API and cleaner routers against an in-memory bucket, no live server needed
+func TestInMemory(t *testing.T) {
+	apiServer, cleanerServer := newInMemoryServers(t)
+
+	if err := memSetRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := memReadRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := memListAndCountRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := memDeleteRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := memCleanColumn(apiServer.URL, cleanerServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := memCleanTable(apiServer.URL, cleanerServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+// newInMemoryServers starts API and cleaner test servers sharing a new in-memory bucket
+func newInMemoryServers(t *testing.T) (*httptest.Server, *httptest.Server) {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiServer := httptest.NewServer(api.NewRouter(bucket, nil))
+	t.Cleanup(apiServer.Close)
+
+	deleteJobPool := parallel.SmallJobPool()
+	cleanerServer := httptest.NewServer(worker.NewCleanerRouter(bucket, deleteJobPool))
+	t.Cleanup(func() {
+		cleanerServer.Close()
+		deleteJobPool.Close()
+	})
+
+	return apiServer, cleanerServer
+}
+
+// newTestServer starts an API test server against a new bucket, e.g. mem://?versions=3
+func newTestServer(t *testing.T, bucketURL string) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend(bucketURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiServer := httptest.NewServer(api.NewRouter(bucket, nil))
+	t.Cleanup(apiServer.Close)
+
+	return apiServer
+}
+
+// doRequest sends a request with an optional JSON body and decodes the JSON response into out (if not nil)
+func doRequest(method string, url string, body interface{}, out interface{}) (int, error) {
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func memSetRows(baseURL string) error {
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{"key", "rowkey"} {
+			status, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=mem1&key=%s%d", baseURL, key, i),
+				map[string]string{"col1": "val1", "col2": "val2", "col3": "val3"}, nil)
+			if err != nil {
+				return err
+			}
+			if status != 200 {
+				return errors.New("memSetRows /api/row POST response status code is not 200")
+			}
+		}
+	}
+	return nil
+}
+
+func memReadRows(baseURL string) error {
+	var row map[string]map[string]string
+	status, err := doRequest("GET", baseURL+"/api/row?table=mem1&key=key1&columns=col1,col3", nil, &row)
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(row["key1"]) != 2 || row["key1"]["col3"] != "val3" {
+		return errors.New("memReadRows single row with columns does not match the one set")
+	}
+
+	var rows map[string]map[string]string
+	status, err = doRequest("GET", baseURL+"/api/row?table=mem1&prefix=row", nil, &rows)
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(rows) != 5 || len(rows["rowkey4"]) != 3 {
+		return errors.New("memReadRows rows with prefix do not match those set")
+	}
+
+	status, err = doRequest("GET", baseURL+"/api/row?table=mem1&key=missing", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("memReadRows /api/row GET (missing key) response status code is not 404")
+	}
+	return nil
+}
+
+func memListAndCountRows(baseURL string) error {
+	var list struct {
+		RowKeys []string `json:"rowKeys"`
+	}
+	status, err := doRequest("GET", baseURL+"/api/row/list?table=mem1&prefix=key", nil, &list)
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(list.RowKeys) != 5 || list.RowKeys[0] != "key0" {
+		return errors.New("memListAndCountRows row keys do not match those set")
+	}
+
+	var count map[string]string
+	status, err = doRequest("GET", baseURL+"/api/row/count?table=mem1", nil, &count)
+	if err != nil {
+		return err
+	}
+	if status != 200 || count["rowsCount"] != "10" {
+		return errors.New("memListAndCountRows rows count does not match rows set")
+	}
+	return nil
+}
+
+func memDeleteRows(baseURL string) error {
+	status, err := doRequest("DELETE", baseURL+"/api/row?table=mem1&prefix=key", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("memDeleteRows /api/row DELETE response status code is not 200")
+	}
+
+	var count map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row/count?table=mem1", nil, &count); err != nil {
+		return err
+	}
+	if count["rowsCount"] != "5" {
+		return errors.New("memDeleteRows rows with prefix were not deleted")
+	}
+	return nil
+}
+
+func memCleanColumn(baseURL string, cleanerURL string) error {
+	status, err := doRequest("DELETE", baseURL+"/api/column?table=mem1&column=col1", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("memCleanColumn /api/column DELETE response status code is not 200")
+	}
+	if status, err := doRequest("POST", cleanerURL+"/", nil, nil); err != nil || status != 200 {
+		return errors.New("memCleanColumn cleaner POST failed")
+	}
+
+	var rows map[string]map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row?table=mem1", nil, &rows); err != nil {
+		return err
+	}
+	for key, columns := range rows {
+		if _, exists := columns["col1"]; exists {
+			return fmt.Errorf("memCleanColumn column was not cleaned up in row '%s'", key)
+		}
+	}
+	return nil
+}
+
+func memCleanTable(baseURL string, cleanerURL string) error {
+	status, err := doRequest("DELETE", baseURL+"/api/table?table=mem1", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("memCleanTable /api/table DELETE response status code is not 200")
+	}
+	if status, err := doRequest("POST", cleanerURL+"/", nil, nil); err != nil || status != 200 {
+		return errors.New("memCleanTable cleaner POST failed")
+	}
+
+	status, err = doRequest("GET", baseURL+"/api/row?table=mem1", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("memCleanTable /api/row GET response status code is not 404")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/metrics"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/worker"
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket = metrics.InstrumentBackend(&failingWritesBucket{Backend: bucket})
+	apiServer := httptest.NewServer(api.NewRouter(bucket, nil))
+	t.Cleanup(apiServer.Close)
+
+	deleteJobPool := parallel.SmallJobPool()
+	cleanerServer := httptest.NewServer(worker.NewCleanerRouter(bucket, deleteJobPool))
+	t.Cleanup(func() {
+		cleanerServer.Close()
+		deleteJobPool.Close()
+	})
+
+	// Metrics are global, so they are compared before and after the requests
+	before, err := scrapeMetrics(apiServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=metrics1&key=key%d", apiServer.URL, i),
+			map[string]string{"col1": "val1", "col2": "val2"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := doRequest("GET", apiServer.URL+"/api/row?table=metrics1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doRequest("GET", apiServer.URL+"/api/row?table=metrics1&key=missing&columns=col1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doRequest("POST", apiServer.URL+"/api/row?table=metrics1&key=key0", map[string]string{"fail": "val"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doRequest("DELETE", apiServer.URL+"/api/table?table=metrics1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doRequest("GET", apiServer.URL+"/unknown/path", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := doRequest("POST", cleanerServer.URL+"/", nil, nil); err != nil || status != 200 {
+		t.Fatal("cleaner POST failed")
+	}
+
+	after, err := scrapeMetrics(apiServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanerMetrics, err := scrapeMetrics(cleanerServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	increases := map[string]float64{
+		`bigbucket_http_requests_total{method="POST",route="/api/row",server="api",status="200"}`:                3,
+		`bigbucket_http_requests_total{method="POST",route="/api/row",server="api",status="500"}`:                1,
+		`bigbucket_http_requests_total{method="GET",route="unmatched",server="api",status="404"}`:                1,
+		`bigbucket_http_request_duration_seconds_count{method="GET",route="/api/row",server="api",status="200"}`: 2,
+		`bigbucket_backend_operations_total{op="write"}`:                                                         7,
+		`bigbucket_backend_errors_total{error="not_found",op="read"}`:                                            1,
+		`bigbucket_backend_errors_total{error="rate_limited",op="write"}`:                                        1,
+		`bigbucket_backend_rate_limited_total{op="write"}`:                                                       1,
+		`bigbucket_cleaner_runs_total`:                                                                           1,
+		`bigbucket_cleaner_deleted_objects_total{kind="table"}`:                                                  6,
+	}
+	for metric, increase := range increases {
+		if after[metric]-before[metric] < increase {
+			t.Errorf("Metric %s increased by %v, expected at least %v", metric, after[metric]-before[metric], increase)
+		}
+	}
+
+	if after[`bigbucket_job_pool_queued_jobs{pool="write"}`] != 0 {
+		t.Errorf("Metric bigbucket_job_pool_queued_jobs of write pool is %v after all requests, expected 0",
+			after[`bigbucket_job_pool_queued_jobs{pool="write"}`])
+	}
+	if cleanerMetrics[`bigbucket_cleaner_last_run_deleted_objects{kind="table"}`] != 6 {
+		t.Errorf("Metric bigbucket_cleaner_last_run_deleted_objects of tables is %v, expected 6",
+			cleanerMetrics[`bigbucket_cleaner_last_run_deleted_objects{kind="table"}`])
+	}
+	if cleanerMetrics[`bigbucket_http_requests_total{method="POST",route="/",server="cleaner",status="200"}`] < 1 {
+		t.Error("Cleaner server metrics are missing its POST / requests")
+	}
+}
+
+// scrapeMetrics reads the metrics of a server, keyed by name and labels
+func scrapeMetrics(baseURL string) (map[string]float64, error) {
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET /metrics returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float64)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[separator+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse metric line '%s': %v", line, err)
+		}
+		values[line[:separator]] = value
+	}
+	return values, nil
+}
@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPagination(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	// More objects than listed per bucket request, to scan rows across listing pages
+	for i := 0; i < 400; i++ {
+		status, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=page1&key=key%03d", apiServer.URL, i),
+			map[string]string{"col1": "val1", "col2": "val2", "col3": "val3"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Fatal("TestPagination /api/row POST response status code is not 200")
+		}
+	}
+
+	if err := pageReadRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := pageListRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := pageBadParams(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+func pageReadRows(baseURL string) error {
+	rowsRead := map[string]bool{}
+	pageToken := ""
+	for pages := 1; ; pages++ {
+		reqURL := baseURL + "/api/row?table=page1&start=key050&limit=150"
+		if pageToken != "" {
+			reqURL += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		resp, err := http.Get(reqURL)
+		if err != nil {
+			return err
+		}
+		var rows map[string]map[string]string
+		err = json.NewDecoder(resp.Body).Decode(&rows)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 {
+			return errors.New("pageReadRows /api/row GET response status code is not 200")
+		}
+		if len(rows) > 150 {
+			return fmt.Errorf("pageReadRows page %d has %d rows, over the limit", pages, len(rows))
+		}
+		for key, columns := range rows {
+			if rowsRead[key] || len(columns) != 3 {
+				return fmt.Errorf("pageReadRows row '%s' read twice or incomplete", key)
+			}
+			rowsRead[key] = true
+		}
+
+		pageToken = resp.Header.Get("X-Next-Page-Token")
+		if pageToken == "" {
+			if pages != 3 {
+				return fmt.Errorf("pageReadRows expected 3 pages, got %d", pages)
+			}
+			break
+		}
+	}
+	if len(rowsRead) != 350 || !rowsRead["key050"] || !rowsRead["key399"] {
+		return fmt.Errorf("pageReadRows expected 350 rows read across pages, got %d", len(rowsRead))
+	}
+	return nil
+}
+
+func pageListRows(baseURL string) error {
+	rowKeys := []string{}
+	pageToken := ""
+	for {
+		var list struct {
+			RowKeys       []string `json:"rowKeys"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		reqURL := baseURL + "/api/row/list?table=page1&limit=100"
+		if pageToken != "" {
+			reqURL += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		status, err := doRequest("GET", reqURL, nil, &list)
+		if err != nil {
+			return err
+		}
+		if status != 200 || len(list.RowKeys) > 100 {
+			return errors.New("pageListRows /api/row/list GET page does not match limit")
+		}
+		rowKeys = append(rowKeys, list.RowKeys...)
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+	if len(rowKeys) != 400 || rowKeys[0] != "key000" || rowKeys[399] != "key399" {
+		return fmt.Errorf("pageListRows expected 400 row keys in order across pages, got %d", len(rowKeys))
+	}
+
+	var count map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row/count?table=page1", nil, &count); err != nil {
+		return err
+	}
+	if count["rowsCount"] != "400" {
+		return errors.New("pageListRows rows count does not match rows set")
+	}
+	return nil
+}
+
+func pageBadParams(baseURL string) error {
+	badParams := []string{
+		"pageToken=not-base64!",
+		"pageToken=a2V5MTAw&end=key050",
+		"pageToken=a2V5MTAw&key=key100",
+	}
+	for _, param := range badParams {
+		status, err := doRequest("GET", baseURL+"/api/row?table=page1&"+param, nil, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("pageBadParams /api/row GET (%s) response status code is not 400", param)
+		}
+	}
+	return nil
+}
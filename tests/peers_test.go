@@ -0,0 +1,229 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/cache"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+const testPeerSecret = "peer-secret"
+
+func TestCachePeers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingReadsBucket{Backend: bucket}
+	replicas := newPeerServers(t, counting, 3)
+
+	if err := peersShareCache(replicas, counting); err != nil {
+		t.Error(err)
+	}
+	if err := peersInvalidateWrites(replicas); err != nil {
+		t.Error(err)
+	}
+	if err := peersRejectWithoutSecret(replicas[0].URL); err != nil {
+		t.Error(err)
+	}
+	if err := peersOwnerDown(replicas, counting); err != nil {
+		t.Error(err)
+	}
+	if err := peersCloseDiscovery(); err != nil {
+		t.Error(err)
+	}
+}
+
+// newPeerServers runs API replicas sharing their read caches, the listeners are created first so each replica
+// knows the URLs of the others
+func newPeerServers(t *testing.T, bucket store.Backend, count int) []*httptest.Server {
+	replicas := []*httptest.Server{}
+	urls := []string{}
+	for i := 0; i < count; i++ {
+		replica := httptest.NewUnstartedServer(nil)
+		replicas = append(replicas, replica)
+		urls = append(urls, "http://"+replica.Listener.Addr().String())
+	}
+	for i, replica := range replicas {
+		peers, err := cache.NewPeers(urls[i], strings.Join(urls, ","), testPeerSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(peers.Close)
+		replica.Config.Handler = api.NewRouter(bucket, &api.Options{
+			Cache: cache.NewLRU(1024*1024, time.Minute),
+			Peers: peers,
+		})
+		replica.Start()
+		t.Cleanup(replica.Close)
+	}
+	return replicas
+}
+
+func peersShareCache(replicas []*httptest.Server, bucket *countingReadsBucket) error {
+	keys := []string{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		if _, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=peers1&key=%s", replicas[i%len(replicas)].URL, key),
+			map[string]string{"col1": "val" + key}, nil); err != nil {
+			return err
+		}
+	}
+
+	readsBefore := bucket.readsCount()
+	for _, replica := range replicas {
+		for _, key := range keys {
+			var rows testRowsResponse
+			status, err := doRequest("GET", fmt.Sprintf("%s/api/row?table=peers1&key=%s&columns=col1", replica.URL, key), nil, &rows)
+			if err != nil {
+				return err
+			}
+			if status != 200 || rows[key]["col1"] != "val"+key {
+				return fmt.Errorf("peersShareCache read of %s from %s returned %d: %v", key, replica.URL, status, rows)
+			}
+		}
+	}
+	// Each cell is read from the bucket once, by the replica owning it
+	if reads := bucket.readsCount() - readsBefore; reads != int64(len(keys)) {
+		return fmt.Errorf("peersShareCache read %d cells from the bucket for %d cells on %d replicas, expected %d",
+			reads, len(keys), len(replicas), len(keys))
+	}
+	return nil
+}
+
+func peersInvalidateWrites(replicas []*httptest.Server) error {
+	for i, replica := range replicas {
+		if _, err := doRequest("GET", replica.URL+"/api/row?table=peers1&key=key0&columns=col1", nil, nil); err != nil {
+			return err
+		}
+
+		value := fmt.Sprintf("updated%d", i)
+		if status, err := doRequest("POST", replica.URL+"/api/row?table=peers1&key=key0",
+			map[string]string{"col1": value}, nil); err != nil || status != 200 {
+			return fmt.Errorf("peersInvalidateWrites write to %s returned %d: %v", replica.URL, status, err)
+		}
+		for _, reader := range replicas {
+			var rows testRowsResponse
+			if _, err := doRequest("GET", reader.URL+"/api/row?table=peers1&key=key0&columns=col1", nil, &rows); err != nil {
+				return err
+			}
+			if rows["key0"]["col1"] != value {
+				return fmt.Errorf("peersInvalidateWrites read %v from %s after write to %s, expected %s",
+					rows["key0"]["col1"], reader.URL, replica.URL, value)
+			}
+		}
+	}
+
+	if status, err := doRequest("DELETE", replicas[1].URL+"/api/row?table=peers1&key=key1", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("peersInvalidateWrites delete returned %d: %v", status, err)
+	}
+	for _, reader := range replicas {
+		var rows testRowsResponse
+		if _, err := doRequest("GET", reader.URL+"/api/row?table=peers1&key=key1&columns=col1", nil, &rows); err != nil {
+			return err
+		}
+		if _, exists := rows["key1"]["col1"]; exists {
+			return fmt.Errorf("peersInvalidateWrites read deleted cell from %s: %v", reader.URL, rows)
+		}
+	}
+	return nil
+}
+
+func peersRejectWithoutSecret(baseURL string) error {
+	status, err := doRequest("GET", baseURL+cache.PeerCellPath+"?object=bigbucket/peers1/key2/col1", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 401 {
+		return fmt.Errorf("peersRejectWithoutSecret cell read without secret returned %d, expected 401", status)
+	}
+	status, err = doRequest("POST", baseURL+cache.PeerInvalidatePath, cache.InvalidateRequest{Objects: []string{"x"}}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 401 {
+		return fmt.Errorf("peersRejectWithoutSecret invalidate without secret returned %d, expected 401", status)
+	}
+
+	req, err := http.NewRequest("GET", baseURL+cache.PeerCellPath+"?object=bigbucket/peers1/key2/col1", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(cache.PeerSecretHeader, testPeerSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("peersRejectWithoutSecret cell read with secret returned %d, expected 200", resp.StatusCode)
+	}
+	return nil
+}
+
+func peersOwnerDown(replicas []*httptest.Server, bucket *countingReadsBucket) error {
+	replicas[2].Close()
+
+	readsBefore := bucket.readsCount()
+	for i := 2; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		var rows testRowsResponse
+		status, err := doRequest("GET", fmt.Sprintf("%s/api/row?table=peers1&key=%s&columns=col1", replicas[0].URL, key), nil, &rows)
+		if err != nil {
+			return err
+		}
+		if status != 200 || rows[key]["col1"] != "val"+key {
+			return fmt.Errorf("peersOwnerDown read of %s returned %d: %v", key, status, rows)
+		}
+	}
+	// Cells owned by the replica down are read from the bucket
+	if bucket.readsCount() == readsBefore {
+		return fmt.Errorf("peersOwnerDown didn't read the bucket for the cells owned by the replica down")
+	}
+
+	if status, err := doRequest("POST", replicas[0].URL+"/api/row?table=peers1&key=key2",
+		map[string]string{"col1": "afterdown"}, nil); err != nil || status != 200 {
+		return fmt.Errorf("peersOwnerDown write with a replica down returned %d: %v", status, err)
+	}
+	return nil
+}
+
+// peersCloseDiscovery checks closing peers discovered with DNS SRV records stops their discovery goroutine.
+// Other goroutines of the test can start or stop meanwhile, so the counts are compared with a margin
+func peersCloseDiscovery() error {
+	const count = 200
+	before := runtime.NumGoroutine()
+
+	discovered := []*cache.Peers{}
+	for i := 0; i < count; i++ {
+		peers, err := cache.NewPeers("http://127.0.0.1:8080", "srv:_bigbucket._tcp.peers.invalid", testPeerSecret)
+		if err != nil {
+			return err
+		}
+		discovered = append(discovered, peers)
+	}
+	if running := runtime.NumGoroutine(); running < before+count/2 {
+		return fmt.Errorf("peersCloseDiscovery has %d goroutines with %d discovering peers, expected at least %d",
+			running, count, before+count/2)
+	}
+
+	for _, peers := range discovered {
+		peers.Close()
+	}
+	if running := runtime.NumGoroutine(); running >= before+count/2 {
+		return fmt.Errorf("peersCloseDiscovery has %d goroutines after closing the peers, expected under %d",
+			running, before+count/2)
+	}
+	return nil
+}
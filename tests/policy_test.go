@@ -0,0 +1,380 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/auth"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/gin-gonic/gin"
+)
+
+const principalHeader = "X-Principal"
+
+const testPolicies = `
+principalHeader: X-Principal
+policies:
+  - principals: [admin]
+    tables: ["*"]
+    permissions: [admin]
+  - principals: [analytics]
+    tables: [users]
+    permissions: [read]
+    excludeColumns: [email, "pii_*"]
+  - principals: [ingest]
+    tables: ["events_*"]
+    permissions: [write]
+  - principals: [gdpr]
+    tables: [users]
+    permissions: [delete]
+    columns: ["pii_*"]
+  - principals: ["*"]
+    tables: [public]
+    permissions: [read]
+`
+
+func TestPolicies(t *testing.T) {
+	policiesPath := filepath.Join(t.TempDir(), "policies.yaml")
+	if err := os.WriteFile(policiesPath, []byte(testPolicies), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := auth.LoadPolicies(policiesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := auth.NewPolicies(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := api.NewRouter(bucket, &api.Options{Policies: policies})
+	apiServer := httptest.NewServer(router)
+	t.Cleanup(apiServer.Close)
+
+	if err := policySetup(apiServer.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := policyRedactedReads(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := policyDeniedOperations(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := policyTablePatterns(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := policyColumnDeletes(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := policyClientCertificate(router); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := auth.NewPolicies(&auth.PolicyConfig{Policies: []auth.Policy{
+		{Principals: []string{"admin"}, Tables: []string{"*"}, Permissions: []string{"owner"}},
+	}}); err == nil {
+		t.Error("NewPolicies accepted an unknown permission")
+	}
+}
+
+// doPrincipalRequest sends a request as the principal (no principal header if empty), with an optional
+// JSON body, and decodes the JSON response into out (if not nil)
+func doPrincipalRequest(method string, url string, principal string, body interface{}, out interface{}) (int, error) {
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	if principal != "" {
+		req.Header.Set(principalHeader, principal)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func policySetup(baseURL string) error {
+	rows := map[string]map[string]string{
+		"user1": {"name": "Ann", "country": "UK", "email": "ann@example.com", "pii_phone": "123"},
+		"user2": {"name": "Bob", "country": "FR", "email": "bob@example.com"},
+		"user3": {"email": "eve@example.com"},
+	}
+	for table, payload := range map[string]map[string]map[string]string{"users": rows, "public": {"doc1": {"title": "Hi"}}} {
+		status, err := doPrincipalRequest("POST", baseURL+"/api/rows?table="+table, "admin", payload, nil)
+		if err != nil {
+			return err
+		}
+		if status != 200 {
+			return fmt.Errorf("policySetup admin set rows in '%s' returned %d, expected 200", table, status)
+		}
+	}
+	return nil
+}
+
+func policyRedactedReads(baseURL string) error {
+	var rows map[string]map[string]string
+	status, err := doPrincipalRequest("GET", baseURL+"/api/row?table=users", "analytics", nil, &rows)
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(rows) != 2 || len(rows["user1"]) != 2 || rows["user1"]["country"] != "UK" {
+		return fmt.Errorf("policyRedactedReads read %d %v, expected user1 and user2 without PII columns", status, rows)
+	}
+
+	rows = nil
+	status, err = doPrincipalRequest("GET", baseURL+"/api/row?table=users&key=user1&columns=name,email", "analytics", nil, &rows)
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(rows["user1"]) != 1 || rows["user1"]["name"] != "Ann" {
+		return fmt.Errorf("policyRedactedReads read %d %v by columns, expected only name", status, rows)
+	}
+
+	var batch struct {
+		Rows        map[string]map[string]string `json:"rows"`
+		MissingKeys []string                     `json:"missingKeys"`
+	}
+	payload := map[string][]string{"keys": {"user1", "user3"}, "columns": {"name", "email"}}
+	if _, err := doPrincipalRequest("POST", baseURL+"/api/rows/get?table=users", "analytics", payload, &batch); err != nil {
+		return err
+	}
+	if len(batch.Rows) != 1 || len(batch.Rows["user1"]) != 1 || len(batch.MissingKeys) != 1 {
+		return fmt.Errorf("policyRedactedReads batch read %+v, expected user1 name and user3 missing", batch)
+	}
+
+	req, err := http.NewRequest("GET", baseURL+"/api/row?table=users", http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(principalHeader, "analytics")
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "email") || strings.Contains(string(body), "user3") {
+		return fmt.Errorf("policyRedactedReads streamed %s, expected no PII columns", body)
+	}
+
+	var columns struct {
+		Columns []string `json:"columns"`
+	}
+	if _, err := doPrincipalRequest("GET", baseURL+"/api/column?table=users", "analytics", nil, &columns); err != nil {
+		return err
+	}
+	for _, column := range columns.Columns {
+		if column == "email" || column == "pii_phone" {
+			return fmt.Errorf("policyRedactedReads listed columns %v, expected no PII columns", columns.Columns)
+		}
+	}
+
+	var tables struct {
+		Tables []string `json:"tables"`
+	}
+	if _, err := doPrincipalRequest("GET", baseURL+"/api/table", "analytics", nil, &tables); err != nil {
+		return err
+	}
+	if len(tables.Tables) != 2 {
+		return fmt.Errorf("policyRedactedReads listed tables %v, expected public and users", tables.Tables)
+	}
+	return nil
+}
+
+func policyDeniedOperations(baseURL string) error {
+	denied := []struct {
+		method    string
+		url       string
+		principal string
+		body      interface{}
+	}{
+		{"GET", "/api/cell?table=users&key=user1&column=email", "analytics", nil},
+		{"GET", "/api/row/versions?table=users&key=user1&column=pii_phone", "analytics", nil},
+		{"POST", "/api/row?table=users&key=user4", "analytics", map[string]string{"name": "Dan"}},
+		{"POST", "/api/row/increment?table=users&key=user1&column=logins", "analytics", nil},
+		{"DELETE", "/api/row?table=users&key=user1", "analytics", nil},
+		{"DELETE", "/api/column?table=users&column=name", "analytics", nil},
+		{"DELETE", "/api/table?table=users", "analytics", nil},
+		{"PUT", "/api/table?table=users", "analytics", map[string]string{"mode": "strict"}},
+		{"GET", "/api/row?table=users", "", nil},
+		{"GET", "/api/row/count?table=users", "unknown", nil},
+		{"GET", "/api/row?table=users", "ingest", nil},
+		{"POST", "/api/row?table=public&key=doc2", "", map[string]string{"title": "Hello"}},
+	}
+	for _, request := range denied {
+		status, err := doPrincipalRequest(request.method, baseURL+request.url, request.principal, request.body, nil)
+		if err != nil {
+			return err
+		}
+		if status != 403 {
+			return fmt.Errorf("policyDeniedOperations %s %s as '%s' returned %d, expected 403",
+				request.method, request.url, request.principal, status)
+		}
+	}
+
+	var rows map[string]map[string]string
+	status, err := doPrincipalRequest("GET", baseURL+"/api/row?table=public", "", nil, &rows)
+	if err != nil {
+		return err
+	}
+	if status != 200 || rows["doc1"]["title"] != "Hi" {
+		return fmt.Errorf("policyDeniedOperations anonymous read of public table returned %d %v", status, rows)
+	}
+	return nil
+}
+
+func policyTablePatterns(baseURL string) error {
+	status, err := doPrincipalRequest("POST", baseURL+"/api/row?table=events_2024&key=e1", "ingest", map[string]string{"type": "click"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("policyTablePatterns write to events_2024 returned %d, expected 200", status)
+	}
+	status, err = doPrincipalRequest("POST", baseURL+"/api/row?table=events&key=e1", "ingest", map[string]string{"type": "click"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 403 {
+		return fmt.Errorf("policyTablePatterns write to events returned %d, expected 403", status)
+	}
+	status, err = doPrincipalRequest("GET", baseURL+"/api/row?table=events_2024", "ingest", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 403 {
+		return fmt.Errorf("policyTablePatterns read of events_2024 without read permission returned %d, expected 403", status)
+	}
+	return nil
+}
+
+func policyColumnDeletes(baseURL string) error {
+	status, err := doPrincipalRequest("DELETE", baseURL+"/api/column?table=users&column=pii_phone", "gdpr", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("policyColumnDeletes delete of pii_phone returned %d, expected 200", status)
+	}
+	// Row deletes affect all columns, so column limited access is not enough
+	status, err = doPrincipalRequest("DELETE", baseURL+"/api/row?table=users&key=user1", "gdpr", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 403 {
+		return fmt.Errorf("policyColumnDeletes delete of row returned %d, expected 403", status)
+	}
+	return nil
+}
+
+// policyClientCertificate checks callers are identified by the common name of verified client certificates
+func policyClientCertificate(router *gin.Engine) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "analytics"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	tlsServer := httptest.NewUnstartedServer(router)
+	tlsServer.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	client := tlsServer.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{
+		{Certificate: [][]byte{clientDER}, PrivateKey: clientKey},
+	}
+
+	resp, err := client.Get(tlsServer.URL + "/api/row?table=users&key=user2")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var rows map[string]map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 || rows["user2"]["name"] != "Bob" || rows["user2"]["email"] != "" {
+		return errors.New("policyClientCertificate read as client certificate 'analytics' did not redact PII columns")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRowRanges(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	// Keys that are a prefix of others, to check ranges compare row keys and not object names
+	for _, key := range []string{"2020", "2020-01", "2020-01-01", "2020-01-02", "2020-01-03", "2020-02-01", "2021"} {
+		status, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=range1&key=%s", apiServer.URL, key),
+			map[string]string{"col1": "val1", "col2": "val2"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Fatal("TestRowRanges /api/row POST response status code is not 200")
+		}
+	}
+
+	if err := readRowRanges(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := listAndCountRowRanges(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := rowRangesBadParams(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := deleteRowRange(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+func readRowRanges(baseURL string) error {
+	ranges := []struct {
+		params   string
+		expected []string
+	}{
+		{"start=2020-01-01&end=2020-01-03", []string{"2020-01-01", "2020-01-02"}},
+		{"startAfter=2020-01-01&end=2020-02", []string{"2020-01-02", "2020-01-03"}},
+		{"start=2020-01-03", []string{"2020-01-03", "2020-02-01", "2021"}},
+		{"end=2020-01-01", []string{"2020", "2020-01"}},
+		{"startAfter=2020", []string{"2020-01", "2020-01-01", "2020-01-02", "2020-01-03", "2020-02-01", "2021"}},
+		{"prefix=2020-01-&start=2020-01-02", []string{"2020-01-02", "2020-01-03"}},
+		{"start=2020-01-01&end=2021&limit=2", []string{"2020-01-01", "2020-01-02"}},
+	}
+	for _, keyRange := range ranges {
+		var rows map[string]map[string]string
+		status, err := doRequest("GET", baseURL+"/api/row?table=range1&"+keyRange.params, nil, &rows)
+		if err != nil {
+			return err
+		}
+		if status != 200 {
+			return fmt.Errorf("readRowRanges /api/row GET (%s) response status code is not 200", keyRange.params)
+		}
+		rowKeys := []string{}
+		for _, key := range keyRange.expected {
+			if len(rows[key]) != 2 {
+				return fmt.Errorf("readRowRanges (%s) row '%s' missing or incomplete", keyRange.params, key)
+			}
+			rowKeys = append(rowKeys, key)
+		}
+		if len(rows) != len(rowKeys) {
+			return fmt.Errorf("readRowRanges (%s) got %d rows, expected %v", keyRange.params, len(rows), keyRange.expected)
+		}
+	}
+
+	status, err := doRequest("GET", baseURL+"/api/row?table=range1&start=2022", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("readRowRanges /api/row GET (empty range) response status code is not 404")
+	}
+	return nil
+}
+
+func listAndCountRowRanges(baseURL string) error {
+	var list struct {
+		RowKeys []string `json:"rowKeys"`
+	}
+	status, err := doRequest("GET", baseURL+"/api/row/list?table=range1&start=2020-01&end=2020-01-02", nil, &list)
+	if err != nil {
+		return err
+	}
+	if status != 200 || !reflect.DeepEqual(list.RowKeys, []string{"2020-01", "2020-01-01"}) {
+		return fmt.Errorf("listAndCountRowRanges row keys in range do not match, got %v", list.RowKeys)
+	}
+
+	var count map[string]string
+	status, err = doRequest("GET", baseURL+"/api/row/count?table=range1&startAfter=2020-01-03", nil, &count)
+	if err != nil {
+		return err
+	}
+	if status != 200 || count["rowsCount"] != "2" {
+		return errors.New("listAndCountRowRanges rows count in range does not match")
+	}
+	return nil
+}
+
+func rowRangesBadParams(baseURL string) error {
+	badParams := []string{
+		"key=2020&start=2020",
+		"start=2020&startAfter=2020",
+		"start=2021&end=2020",
+		"startAfter=2020&end=2020",
+	}
+	for _, param := range badParams {
+		status, err := doRequest("GET", baseURL+"/api/row?table=range1&"+param, nil, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("rowRangesBadParams /api/row GET (%s) response status code is not 400", param)
+		}
+	}
+	return nil
+}
+
+func deleteRowRange(baseURL string) error {
+	status, err := doRequest("DELETE", baseURL+"/api/row?table=range1&start=2020-01-01&end=2020-02", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("deleteRowRange /api/row DELETE response status code is not 200")
+	}
+
+	// Table state objects are not rows, so they're kept
+	if _, err := doRequest("DELETE", baseURL+"/api/column?table=range1&column=col2", nil, nil); err != nil {
+		return err
+	}
+	status, err = doRequest("DELETE", baseURL+"/api/row?table=range1&end=2020-01", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("deleteRowRange /api/row DELETE (to 2020-01) response status code is not 200")
+	}
+	var columns struct {
+		Columns []string `json:"columns"`
+	}
+	if _, err := doRequest("GET", baseURL+"/api/column?table=range1", nil, &columns); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(columns.Columns, []string{"col1"}) {
+		return fmt.Errorf("deleteRowRange deleted column is listed again, got %v", columns.Columns)
+	}
+
+	var list struct {
+		RowKeys []string `json:"rowKeys"`
+	}
+	if _, err := doRequest("GET", baseURL+"/api/row/list?table=range1", nil, &list); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(list.RowKeys, []string{"2020-01", "2020-02-01", "2021"}) {
+		return fmt.Errorf("deleteRowRange rows left do not match, got %v", list.RowKeys)
+	}
+	return nil
+}
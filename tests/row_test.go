@@ -111,7 +111,7 @@ func setRowsBadParams() error {
 	}
 
 	reqBody, err := json.Marshal(map[string]interface{}{
-		"col1": 1, // Value not a string
+		"col1": nil, // Null value
 	})
 	if err != nil {
 		return err
@@ -122,7 +122,7 @@ func setRowsBadParams() error {
 		return err
 	}
 	if resp.StatusCode != 400 {
-		return errors.New("setRowsBadParams /api/row POST (bad json, int value) response status code is not 400")
+		return errors.New("setRowsBadParams /api/row POST (bad json, null value) response status code is not 400")
 	}
 
 	reqBody, err = json.Marshal(map[string]interface{}{
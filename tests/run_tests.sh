@@ -9,7 +9,13 @@ BUCKET="$1"
 
 function cleanup() {
   echo -e "\nCleaning up test bucket"
-  gsutil rm -r "$BUCKET/bigbucket" > /dev/null 2>&1 || true
+  if [[ "$BUCKET" == file://* ]]; then
+    rm -rf "${BUCKET#file://}/bigbucket"
+  elif [[ "$BUCKET" == s3://* ]]; then
+    aws s3 rm --recursive "${BUCKET%%\?*}/bigbucket" > /dev/null 2>&1 || true
+  else
+    gsutil rm -r "$BUCKET/bigbucket" > /dev/null 2>&1 || true
+  fi
 
   echo "Cleaning up bigbucket processes"
   for process in $(pgrep bigbucket); do
@@ -0,0 +1,281 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	if err := schemaSetAndGet(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := schemaInvalid(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := schemaStrictRow(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := schemaRequiredColumns(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := schemaFlexibleRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := schemaIncrement(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := schemaStringColumns(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+type testSchemaViolations struct {
+	Error      string   `json:"error"`
+	Violations []string `json:"violations"`
+}
+
+var testStrictSchema = map[string]interface{}{
+	"mode": "strict",
+	"columns": map[string]interface{}{
+		"name":  map[string]interface{}{"required": true, "maxSize": 8},
+		"age":   map[string]interface{}{"type": "int"},
+		"extra": map[string]interface{}{"type": "json"},
+	},
+}
+
+func schemaSetAndGet(baseURL string) error {
+	status, err := doRequest("GET", baseURL+"/api/table/schema?table=schema1", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return fmt.Errorf("schemaSetAndGet missing schema returned %d, expected 404", status)
+	}
+
+	status, err = doRequest("PUT", baseURL+"/api/table?table=schema1", testStrictSchema, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("schemaSetAndGet set schema returned %d", status)
+	}
+
+	var data struct {
+		Schema struct {
+			Mode    string `json:"mode"`
+			Columns map[string]struct {
+				Required bool   `json:"required"`
+				Type     string `json:"type"`
+				MaxSize  int    `json:"maxSize"`
+			} `json:"columns"`
+		} `json:"schema"`
+	}
+	if _, err := doRequest("GET", baseURL+"/api/table/schema?table=schema1", nil, &data); err != nil {
+		return err
+	}
+	name := data.Schema.Columns["name"]
+	if data.Schema.Mode != "strict" || len(data.Schema.Columns) != 3 || !name.Required || name.Type != "" ||
+		name.MaxSize != 8 || data.Schema.Columns["age"].Type != "int" {
+		return fmt.Errorf("schemaSetAndGet schema does not match the one set: %+v", data.Schema)
+	}
+	return nil
+}
+
+func schemaInvalid(baseURL string) error {
+	schemas := []interface{}{
+		map[string]interface{}{"mode": "loose"},
+		map[string]interface{}{"mode": "strict"},
+		map[string]interface{}{"columns": map[string]interface{}{"col1": map[string]interface{}{"type": "date"}}},
+		map[string]interface{}{"columns": map[string]interface{}{"col1": map[string]interface{}{"maxSize": -1}}},
+		map[string]interface{}{"columns": map[string]interface{}{".col1": map[string]interface{}{}}},
+		"schema",
+	}
+	for _, schema := range schemas {
+		status, err := doRequest("PUT", baseURL+"/api/table?table=schema2", schema, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("schemaInvalid schema %v returned %d, expected 400", schema, status)
+		}
+	}
+
+	status, err := doRequest("GET", baseURL+"/api/table/schema?table=schema2", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("schemaInvalid invalid schema was set")
+	}
+	return nil
+}
+
+func schemaStrictRow(baseURL string) error {
+	var data testSchemaViolations
+	status, err := doRequest("POST", baseURL+"/api/row?table=schema1&key=key1",
+		map[string]string{"name": "too long name", "age": "abc", "extra": "{", "unknown": "val"}, &data)
+	if err != nil {
+		return err
+	}
+	expected := []string{
+		"Column 'age' value is not of type int",
+		"Column 'extra' value is not of type json",
+		"Column 'name' value is over the max size of 8 bytes",
+		"Column 'unknown' is not in the schema",
+	}
+	if status != 400 || !reflect.DeepEqual(data.Violations, expected) {
+		return fmt.Errorf("schemaStrictRow returned %d with violations %v, expected 400 with %v", status, data.Violations, expected)
+	}
+
+	status, err = doRequest("GET", baseURL+"/api/row?table=schema1&key=key1", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("schemaStrictRow invalid row was set")
+	}
+
+	status, err = doRequest("POST", baseURL+"/api/row?table=schema1&key=key1",
+		map[string]string{"name": "bob", "age": "42", "extra": `{"a": 1}`}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("schemaStrictRow valid row returned %d", status)
+	}
+	return nil
+}
+
+func schemaRequiredColumns(baseURL string) error {
+	var data testSchemaViolations
+	status, err := doRequest("POST", baseURL+"/api/row?table=schema1&key=key2", map[string]string{"age": "1"}, &data)
+	if err != nil {
+		return err
+	}
+	if status != 400 || !reflect.DeepEqual(data.Violations, []string{"Column 'name' is required"}) {
+		return fmt.Errorf("schemaRequiredColumns missing required column returned %d with %v", status, data.Violations)
+	}
+
+	// Already set in key1
+	status, err = doRequest("POST", baseURL+"/api/row?table=schema1&key=key1", map[string]string{"age": "43"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("schemaRequiredColumns required column already set returned %d", status)
+	}
+	return nil
+}
+
+func schemaFlexibleRows(baseURL string) error {
+	schema := map[string]interface{}{
+		"columns": map[string]interface{}{"score": map[string]interface{}{"type": "float"}},
+	}
+	if _, err := doRequest("PUT", baseURL+"/api/table?table=schema3", schema, nil); err != nil {
+		return err
+	}
+
+	var data struct {
+		Violations map[string][]string `json:"violations"`
+	}
+	status, err := doRequest("POST", baseURL+"/api/rows?table=schema3", map[string]map[string]string{
+		"key1": {"score": "1.5", "other": "val"},
+		"key2": {"score": "high"},
+	}, &data)
+	if err != nil {
+		return err
+	}
+	if status != 400 || len(data.Violations) != 1 || len(data.Violations["key2"]) != 1 {
+		return fmt.Errorf("schemaFlexibleRows returned %d with violations %v, expected 400 for key2", status, data.Violations)
+	}
+
+	status, err = doRequest("GET", baseURL+"/api/row?table=schema3&key=key1", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("schemaFlexibleRows rows were set despite violations")
+	}
+
+	status, err = doRequest("POST", baseURL+"/api/rows?table=schema3", map[string]map[string]string{
+		"key1": {"score": "1.5", "other": "val"},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("schemaFlexibleRows valid rows returned %d", status)
+	}
+	return nil
+}
+
+func schemaIncrement(baseURL string) error {
+	status, err := doRequest("POST", baseURL+"/api/row/increment?table=schema1&key=key1&column=age", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("schemaIncrement int column returned %d", status)
+	}
+
+	status, err = doRequest("POST", baseURL+"/api/row/increment?table=schema1&key=key1&column=unknown", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return fmt.Errorf("schemaIncrement column not in strict schema returned %d, expected 400", status)
+	}
+	return nil
+}
+
+// schemaStringColumns checks columns typed string only accept strings, and columns without a type any value
+func schemaStringColumns(baseURL string) error {
+	schema := map[string]interface{}{
+		"columns": map[string]interface{}{
+			"label": map[string]interface{}{"type": "string"},
+			"any":   map[string]interface{}{"maxSize": 64},
+		},
+	}
+	if status, err := doRequest("PUT", baseURL+"/api/table?table=schema4", schema, nil); err != nil || status != 200 {
+		return fmt.Errorf("schemaStringColumns set schema returned %d: %v", status, err)
+	}
+
+	for _, value := range []string{`42`, `1.5`, `true`, `{"a": 1}`, `[1, 2]`} {
+		var data testSchemaViolations
+		status, err := doRequest("POST", baseURL+"/api/row?table=schema4&key=key1",
+			map[string]json.RawMessage{"label": json.RawMessage(value)}, &data)
+		if err != nil {
+			return err
+		}
+		expected := []string{"Column 'label' value is not of type string"}
+		if status != 400 || !reflect.DeepEqual(data.Violations, expected) {
+			return fmt.Errorf("schemaStringColumns set label to %s returned %d with %v, expected 400 with %v",
+				value, status, data.Violations, expected)
+		}
+	}
+	status, err := putBlob(baseURL+"/api/cell?table=schema4&key=key1&column=label", bytes.NewReader([]byte("blob")), "image/png")
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return fmt.Errorf("schemaStringColumns upload to label returned %d, expected 400", status)
+	}
+
+	for _, value := range []string{`"text"`, `42`, `true`, `{"a": 1}`} {
+		status, err := doRequest("POST", baseURL+"/api/row?table=schema4&key=key1",
+			map[string]json.RawMessage{"label": json.RawMessage(`"text"`), "any": json.RawMessage(value)}, nil)
+		if err != nil {
+			return err
+		}
+		if status != 200 {
+			return fmt.Errorf("schemaStringColumns set any to %s returned %d, expected 200", value, status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func TestStreaming(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	// More rows than read ahead while streaming
+	for i := 0; i < 200; i++ {
+		status, err := doRequest("POST", fmt.Sprintf("%s/api/row?table=stream1&key=key%03d", apiServer.URL, i),
+			map[string]string{"col1": fmt.Sprintf("val%d", i), "col2": "val2"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Fatal("TestStreaming /api/row POST response status code is not 200")
+		}
+	}
+
+	if err := streamAllRows(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := streamRowsPage(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := streamSingleRow(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := streamNotFound(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+type testStreamedLine struct {
+	Key           string            `json:"key"`
+	Columns       map[string]string `json:"columns"`
+	NextPageToken string            `json:"nextPageToken"`
+	Error         string            `json:"error"`
+}
+
+// getNDJSON sends a GET request asking for NDJSON and decodes the response lines
+func getNDJSON(url string) (int, []testStreamedLine, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, nil, nil
+	}
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		return resp.StatusCode, nil, errors.New("getNDJSON response content type is not application/x-ndjson")
+	}
+
+	lines := []testStreamedLine{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line testStreamedLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return resp.StatusCode, nil, err
+		}
+		lines = append(lines, line)
+	}
+	return resp.StatusCode, lines, scanner.Err()
+}
+
+func streamAllRows(baseURL string) error {
+	status, lines, err := getNDJSON(baseURL + "/api/row?table=stream1")
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(lines) != 200 {
+		return fmt.Errorf("streamAllRows expected 200 streamed rows, got %d", len(lines))
+	}
+	keys := []string{}
+	for i, line := range lines {
+		if line.Columns["col1"] != fmt.Sprintf("val%d", i) || line.Columns["col2"] != "val2" {
+			return fmt.Errorf("streamAllRows row '%s' columns do not match those set", line.Key)
+		}
+		keys = append(keys, line.Key)
+	}
+	if !sort.StringsAreSorted(keys) {
+		return errors.New("streamAllRows rows are not streamed in key order")
+	}
+	return nil
+}
+
+func streamRowsPage(baseURL string) error {
+	status, lines, err := getNDJSON(baseURL + "/api/row?table=stream1&start=key100&limit=10&columns=col1")
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(lines) != 11 {
+		return fmt.Errorf("streamRowsPage expected 10 rows and a next page token, got %d lines", len(lines))
+	}
+	if lines[0].Key != "key100" || lines[9].Key != "key109" || len(lines[9].Columns) != 1 {
+		return errors.New("streamRowsPage rows do not match the range and columns requested")
+	}
+	if lines[10].NextPageToken == "" {
+		return errors.New("streamRowsPage last line is not the next page token")
+	}
+
+	_, lines, err = getNDJSON(baseURL + "/api/row?table=stream1&limit=10&pageToken=" + lines[10].NextPageToken)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 || lines[0].Key != "key110" {
+		return errors.New("streamRowsPage next page does not start after the previous one")
+	}
+	return nil
+}
+
+func streamSingleRow(baseURL string) error {
+	status, lines, err := getNDJSON(baseURL + "/api/row?table=stream1&key=key005&columns=col1,col2")
+	if err != nil {
+		return err
+	}
+	if status != 200 || len(lines) != 1 || lines[0].Key != "key005" || lines[0].Columns["col1"] != "val5" {
+		return errors.New("streamSingleRow row does not match the one set")
+	}
+	return nil
+}
+
+func streamNotFound(baseURL string) error {
+	status, _, err := getNDJSON(baseURL + "/api/row?table=stream1&prefix=missing")
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("streamNotFound /api/row GET (missing prefix) response status code is not 404")
+	}
+	return nil
+}
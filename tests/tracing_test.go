@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/tracing"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentSpanID = "00f067aa0ba902b7"
+)
+
+func TestTracing(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// The tracer provider is global, so it's restored after the test
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiServer := httptest.NewServer(api.NewRouter(tracing.TraceBackend(bucket), nil))
+	t.Cleanup(apiServer.Close)
+
+	req, err := http.NewRequest("POST", apiServer.URL+"/api/row?table=tracing1&key=key1",
+		strings.NewReader(`{"col1": "val1", "col2": "val2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", fmt.Sprintf("00-%s-%s-01", testTraceID, testParentSpanID))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST /api/row returned %d", resp.StatusCode)
+	}
+
+	// The server span ends after the response is sent
+	var spans []sdktrace.ReadOnlySpan
+	var serverSpan sdktrace.ReadOnlySpan
+	for i := 0; i < 100 && serverSpan == nil; i++ {
+		spans = recorder.Ended()
+		for _, span := range spans {
+			if span.Name() == "POST /api/row" {
+				serverSpan = span
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if serverSpan == nil {
+		t.Fatal("No span of the POST /api/row request")
+	}
+
+	if serverSpan.SpanContext().TraceID().String() != testTraceID {
+		t.Errorf("Request span has trace ID %s, expected %s from traceparent",
+			serverSpan.SpanContext().TraceID(), testTraceID)
+	}
+	if serverSpan.Parent().SpanID().String() != testParentSpanID {
+		t.Errorf("Request span has parent %s, expected %s from traceparent",
+			serverSpan.Parent().SpanID(), testParentSpanID)
+	}
+	if serverSpan.SpanKind() != trace.SpanKindServer {
+		t.Errorf("Request span has kind %s, expected server", serverSpan.SpanKind())
+	}
+
+	jobSpans := make(map[trace.SpanID]bool)
+	for _, span := range spans {
+		if span.Name() == "write job" && span.Parent().SpanID() == serverSpan.SpanContext().SpanID() {
+			jobSpans[span.SpanContext().SpanID()] = true
+		}
+	}
+	if len(jobSpans) != 2 {
+		t.Errorf("Request span has %d write job spans, expected 2", len(jobSpans))
+	}
+
+	writes := 0
+	for _, span := range spans {
+		if span.Name() != "store.WriteObject" {
+			continue
+		}
+		writes++
+		if !jobSpans[span.Parent().SpanID()] {
+			t.Errorf("store.WriteObject span isn't a child of a write job span")
+		}
+		if span.SpanContext().TraceID().String() != testTraceID {
+			t.Errorf("store.WriteObject span has trace ID %s, expected %s", span.SpanContext().TraceID(), testTraceID)
+		}
+	}
+	if writes != 2 {
+		t.Errorf("Found %d store.WriteObject spans, expected 2", writes)
+	}
+}
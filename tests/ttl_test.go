@@ -0,0 +1,248 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/worker"
+	"github.com/adrianchifor/go-parallel"
+)
+
+func TestTTL(t *testing.T) {
+	apiServer, cleanerServer := newInMemoryServers(t)
+
+	if err := ttlSetAndExpire(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := ttlTableDefault(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := ttlIncrement(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := ttlCleaner(apiServer.URL, cleanerServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := ttlCleanerListing(); err != nil {
+		t.Error(err)
+	}
+}
+
+func ttlSetAndExpire(baseURL string) error {
+	var setResp map[string]interface{}
+	status, err := doRequest("POST", baseURL+"/api/row?table=ttl1&key=key1&ttl=1s", map[string]string{"session": "abc"}, &setResp)
+	if err != nil {
+		return err
+	}
+	if status != 200 || setResp["expiresAt"] == nil {
+		return fmt.Errorf("ttlSetAndExpire set row returned %d without expiresAt", status)
+	}
+	if _, err := doRequest("POST", baseURL+"/api/row?table=ttl1&key=key1", map[string]string{"user": "u1"}, nil); err != nil {
+		return err
+	}
+	if _, err := doRequest("POST", baseURL+"/api/row?table=ttl1&key=key2&ttl=1s", map[string]string{"session": "def"}, nil); err != nil {
+		return err
+	}
+
+	var rows map[string]map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row?table=ttl1", nil, &rows); err != nil {
+		return err
+	}
+	if len(rows) != 2 || rows["key1"]["session"] != "abc" {
+		return fmt.Errorf("ttlSetAndExpire read %v before expiry", rows)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	rows = nil
+	if _, err := doRequest("GET", baseURL+"/api/row?table=ttl1", nil, &rows); err != nil {
+		return err
+	}
+	if len(rows) != 1 || len(rows["key1"]) != 1 || rows["key1"]["user"] != "u1" {
+		return fmt.Errorf("ttlSetAndExpire read %v after expiry, expected only the user column of key1", rows)
+	}
+
+	rows = nil
+	if _, err := doRequest("GET", baseURL+"/api/row?table=ttl1&key=key1&columns=session,user", nil, &rows); err != nil {
+		return err
+	}
+	if _, exists := rows["key1"]["session"]; exists {
+		return errors.New("ttlSetAndExpire read expired column of key1 by name")
+	}
+
+	status, err = doRequest("GET", baseURL+"/api/row?table=ttl1&key=key2", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return fmt.Errorf("ttlSetAndExpire read of expired row returned %d, expected 404", status)
+	}
+	status, _, _, err = getBlob(baseURL + "/api/cell?table=ttl1&key=key2&column=session")
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return fmt.Errorf("ttlSetAndExpire download of expired cell returned %d, expected 404", status)
+	}
+
+	status, err = doRequest("POST", baseURL+"/api/row?table=ttl1&key=key1&ttl=-1s", map[string]string{"col": "val"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return fmt.Errorf("ttlSetAndExpire negative ttl returned %d, expected 400", status)
+	}
+	return nil
+}
+
+func ttlTableDefault(baseURL string) error {
+	status, err := doRequest("PUT", baseURL+"/api/table?table=ttl2", map[string]string{"ttl": "forever"}, nil)
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return fmt.Errorf("ttlTableDefault invalid schema ttl returned %d, expected 400", status)
+	}
+	if _, err := doRequest("PUT", baseURL+"/api/table?table=ttl2", map[string]string{"ttl": "1s"}, nil); err != nil {
+		return err
+	}
+
+	if _, err := doRequest("POST", baseURL+"/api/row?table=ttl2&key=key1", map[string]string{"col": "val"}, nil); err != nil {
+		return err
+	}
+	if _, err := doRequest("POST", baseURL+"/api/row?table=ttl2&key=key2&ttl=0", map[string]string{"col": "val"}, nil); err != nil {
+		return err
+	}
+	payload := map[string]map[string]string{"key3": {"col": "val"}}
+	if _, err := doRequest("POST", baseURL+"/api/rows?table=ttl2&ttl=1h", payload, nil); err != nil {
+		return err
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	var rows map[string]map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row?table=ttl2", nil, &rows); err != nil {
+		return err
+	}
+	if len(rows) != 2 || rows["key2"]["col"] != "val" || rows["key3"]["col"] != "val" {
+		return fmt.Errorf("ttlTableDefault read %v, expected key2 (no ttl) and key3 (1h ttl)", rows)
+	}
+	return nil
+}
+
+func ttlIncrement(baseURL string) error {
+	if _, err := doRequest("POST", baseURL+"/api/row?table=ttl3&key=key1&ttl=1s", map[string]int{"counter": 5}, nil); err != nil {
+		return err
+	}
+
+	var incrResp map[string]interface{}
+	if _, err := doRequest("POST", baseURL+"/api/row/increment?table=ttl3&key=key1&column=counter", nil, &incrResp); err != nil {
+		return err
+	}
+	if incrResp["value"] != float64(6) || incrResp["expiresAt"] == nil {
+		return fmt.Errorf("ttlIncrement returned %v, expected value 6 keeping the expiry", incrResp)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	incrResp = nil
+	if _, err := doRequest("POST", baseURL+"/api/row/increment?table=ttl3&key=key1&column=counter", nil, &incrResp); err != nil {
+		return err
+	}
+	if incrResp["value"] != float64(1) || incrResp["expiresAt"] != nil {
+		return fmt.Errorf("ttlIncrement of expired cell returned %v, expected value 1 without expiry", incrResp)
+	}
+	return nil
+}
+
+func ttlCleaner(baseURL string, cleanerURL string) error {
+	payload := map[string]map[string]string{"key1": {"col": "val"}, "key2": {"col": "val"}}
+	if _, err := doRequest("POST", baseURL+"/api/rows?table=ttl4&ttl=1s", payload, nil); err != nil {
+		return err
+	}
+	if _, err := doRequest("POST", baseURL+"/api/row?table=ttl4&key=key3", map[string]string{"col": "val"}, nil); err != nil {
+		return err
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// Expired cells are still listed until the cleaner deletes them
+	var count map[string]string
+	if _, err := doRequest("GET", baseURL+"/api/row/count?table=ttl4", nil, &count); err != nil {
+		return err
+	}
+	if count["rowsCount"] != "3" {
+		return fmt.Errorf("ttlCleaner counted %s rows before cleanup, expected 3", count["rowsCount"])
+	}
+
+	if status, err := doRequest("POST", cleanerURL+"/", nil, nil); err != nil || status != 200 {
+		return errors.New("ttlCleaner cleaner POST failed")
+	}
+
+	count = nil
+	if _, err := doRequest("GET", baseURL+"/api/row/count?table=ttl4", nil, &count); err != nil {
+		return err
+	}
+	if count["rowsCount"] != "1" {
+		return fmt.Errorf("ttlCleaner counted %s rows after cleanup, expected 1", count["rowsCount"])
+	}
+	return nil
+}
+
+// countingStatsBucket counts the stats of objects
+type countingStatsBucket struct {
+	store.Backend
+	stats int64
+}
+
+func (b *countingStatsBucket) StatObject(ctx context.Context, object string) (*store.ObjectAttrs, error) {
+	atomic.AddInt64(&b.stats, 1)
+	return b.Backend.StatObject(ctx, object)
+}
+
+// ttlCleanerListing checks the cleaner finds expired cells from the listing of backends returning their expiry,
+// without a stat per cell
+func ttlCleanerListing() error {
+	memBucket, err := store.NewBackend("mem://")
+	if err != nil {
+		return err
+	}
+	bucket := &countingStatsBucket{Backend: memBucket}
+	ctx := context.Background()
+	cells := map[string]time.Time{
+		"bigbucket/ttl5/key1/col1": time.Now().Add(-time.Second),
+		"bigbucket/ttl5/key1/col2": time.Now().Add(time.Hour),
+		"bigbucket/ttl5/key2/col1": {},
+	}
+	for cell, expiresAt := range cells {
+		if _, err := bucket.WriteObject(ctx, cell, []byte("val"), &store.WriteOptions{ExpiresAt: expiresAt}); err != nil {
+			return err
+		}
+	}
+
+	deleteJobPool := parallel.SmallJobPool()
+	defer deleteJobPool.Close()
+	cleanerServer := httptest.NewServer(worker.NewCleanerRouter(bucket, deleteJobPool))
+	defer cleanerServer.Close()
+	if status, err := doRequest("POST", cleanerServer.URL+"/", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("ttlCleanerListing cleaner returned %d: %v", status, err)
+	}
+
+	objects, err := bucket.ListObjects(ctx, "bigbucket/ttl5/", "", 0, nil)
+	if err != nil {
+		return err
+	}
+	if len(objects) != 2 || objects[0] != "bigbucket/ttl5/key1/col2" {
+		return fmt.Errorf("ttlCleanerListing kept %v, expected the cells not expired", objects)
+	}
+	if stats := atomic.LoadInt64(&bucket.stats); stats != 0 {
+		return fmt.Errorf("ttlCleanerListing stated %d cells, expected none", stats)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestTypedValues(t *testing.T) {
+	apiServer := newTestServer(t, "mem://")
+
+	if err := typedSetAndRead(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := typedBatch(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := typedInvalidValues(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := typedIncrement(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+// testTypedRow is set with native JSON values and the values are expected to be read back as they were set
+var testTypedRow = map[string]string{
+	"string": `"text"`,
+	"int":    `-42`,
+	"float":  `1.5`,
+	"bool":   `true`,
+	"json":   `{"a":[1,2,{"b":null}]}`,
+	"array":  `["x","y"]`,
+	"bytes":  `{"$bytes":"AAFiaW4="}`,
+	"header": `"\u0000s is not a type header"`,
+}
+
+func typedPayload() map[string]json.RawMessage {
+	payload := make(map[string]json.RawMessage)
+	for column, value := range testTypedRow {
+		payload[column] = json.RawMessage(value)
+	}
+	return payload
+}
+
+func compareTypedRow(name string, row map[string]json.RawMessage) error {
+	if len(row) != len(testTypedRow) {
+		return fmt.Errorf("%s read %d columns, expected %d", name, len(row), len(testTypedRow))
+	}
+	for column, value := range testTypedRow {
+		if string(row[column]) != value {
+			return fmt.Errorf("%s column '%s' read as %s, expected %s", name, column, row[column], value)
+		}
+	}
+	return nil
+}
+
+func typedSetAndRead(baseURL string) error {
+	status, err := doRequest("POST", baseURL+"/api/row?table=typed1&key=key1", typedPayload(), nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("typedSetAndRead set row returned %d", status)
+	}
+
+	var rows map[string]map[string]json.RawMessage
+	if _, err := doRequest("GET", baseURL+"/api/row?table=typed1&key=key1", nil, &rows); err != nil {
+		return err
+	}
+	if err := compareTypedRow("typedSetAndRead", rows["key1"]); err != nil {
+		return err
+	}
+
+	var generations map[string]map[string]struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if _, err := doRequest("GET", baseURL+"/api/row?table=typed1&key=key1&columns=int&generations=true", nil, &generations); err != nil {
+		return err
+	}
+	if string(generations["key1"]["int"].Value) != testTypedRow["int"] {
+		return fmt.Errorf("typedSetAndRead value with generation read as %s", generations["key1"]["int"].Value)
+	}
+	return nil
+}
+
+func typedBatch(baseURL string) error {
+	payload := map[string]map[string]json.RawMessage{"key1": typedPayload(), "key2": typedPayload()}
+	status, err := doRequest("POST", baseURL+"/api/rows?table=typed2", payload, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("typedBatch set rows returned %d", status)
+	}
+
+	columns := []string{}
+	for column := range testTypedRow {
+		columns = append(columns, column)
+	}
+	var data struct {
+		Rows map[string]map[string]json.RawMessage `json:"rows"`
+	}
+	getPayload := map[string][]string{"keys": {"key1", "key2"}, "columns": columns}
+	if _, err := doRequest("POST", baseURL+"/api/rows/get?table=typed2", getPayload, &data); err != nil {
+		return err
+	}
+	for _, rowKey := range []string{"key1", "key2"} {
+		if err := compareTypedRow("typedBatch "+rowKey, data.Rows[rowKey]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func typedInvalidValues(baseURL string) error {
+	for _, value := range []string{`null`, `{"$bytes":"not base64!"}`, `99999999999999999999`, `1e400`} {
+		payload := map[string]json.RawMessage{"col": json.RawMessage(value)}
+		status, err := doRequest("POST", baseURL+"/api/row?table=typed3&key=key1", payload, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("typedInvalidValues value %s returned %d, expected 400", value, status)
+		}
+	}
+	return nil
+}
+
+func typedIncrement(baseURL string) error {
+	payload := map[string]interface{}{"counter": 41, "flag": false}
+	if _, err := doRequest("POST", baseURL+"/api/row?table=typed4&key=key1", payload, nil); err != nil {
+		return err
+	}
+
+	status, err := doRequest("POST", baseURL+"/api/row/increment?table=typed4&key=key1&column=counter", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return fmt.Errorf("typedIncrement int column returned %d", status)
+	}
+	var rows map[string]map[string]json.RawMessage
+	if _, err := doRequest("GET", baseURL+"/api/row?table=typed4&key=key1&columns=counter", nil, &rows); err != nil {
+		return err
+	}
+	if string(rows["key1"]["counter"]) != "42" {
+		return fmt.Errorf("typedIncrement int column read as %s, expected 42", rows["key1"]["counter"])
+	}
+
+	status, err = doRequest("POST", baseURL+"/api/row/increment?table=typed4&key=key1&column=flag", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 400 {
+		return fmt.Errorf("typedIncrement bool column returned %d, expected 400", status)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	apiServer := newTestServer(t, "mem://?versions=3")
+
+	for i := 1; i <= 4; i++ {
+		status, err := doRequest("POST", apiServer.URL+"/api/row?table=ver1&key=key1",
+			map[string]string{"col1": fmt.Sprintf("val%d", i), "col2": "static"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Fatal("TestVersions /api/row POST response status code is not 200")
+		}
+	}
+
+	if err := listVersions(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := readRowVersions(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := readSingleVersion(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := readVersionsBadParams(apiServer.URL); err != nil {
+		t.Error(err)
+	}
+}
+
+type testCellVersion struct {
+	Version string `json:"version"`
+	Value   string `json:"value"`
+	Size    int64  `json:"size"`
+}
+
+func listVersions(baseURL string) error {
+	var data struct {
+		Versions []testCellVersion `json:"versions"`
+	}
+	status, err := doRequest("GET", baseURL+"/api/row/versions?table=ver1&key=key1&column=col1", nil, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("listVersions /api/row/versions GET response status code is not 200")
+	}
+	if len(data.Versions) != 3 {
+		return fmt.Errorf("listVersions expected 3 versions kept, got %d", len(data.Versions))
+	}
+	if data.Versions[0].Version <= data.Versions[1].Version || data.Versions[0].Size == 0 {
+		return errors.New("listVersions versions are not sorted newest first")
+	}
+
+	status, err = doRequest("GET", baseURL+"/api/row/versions?table=ver1&key=key1&column=missing", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("listVersions /api/row/versions GET (missing column) response status code is not 404")
+	}
+	return nil
+}
+
+func readRowVersions(baseURL string) error {
+	var data map[string]map[string][]testCellVersion
+	status, err := doRequest("GET", baseURL+"/api/row?table=ver1&key=key1&versions=2", nil, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 {
+		return errors.New("readRowVersions /api/row GET response status code is not 200")
+	}
+	col1 := data["key1"]["col1"]
+	if len(col1) != 2 || col1[0].Value != "val4" || col1[1].Value != "val3" {
+		return fmt.Errorf("readRowVersions got unexpected col1 versions: %v", col1)
+	}
+	if len(data["key1"]["col2"]) != 2 {
+		return errors.New("readRowVersions got unexpected col2 versions")
+	}
+
+	// Fast path with specific columns
+	data = nil
+	if _, err := doRequest("GET", baseURL+"/api/row?table=ver1&key=key1&columns=col1&versions=5", nil, &data); err != nil {
+		return err
+	}
+	if len(data["key1"]["col1"]) != 3 || data["key1"]["col1"][2].Value != "val2" {
+		return errors.New("readRowVersions got unexpected col1 versions with columns")
+	}
+	return nil
+}
+
+func readSingleVersion(baseURL string) error {
+	var versions struct {
+		Versions []testCellVersion `json:"versions"`
+	}
+	if _, err := doRequest("GET", baseURL+"/api/row/versions?table=ver1&key=key1&column=col1", nil, &versions); err != nil {
+		return err
+	}
+	if len(versions.Versions) < 2 {
+		return errors.New("readSingleVersion not enough versions listed")
+	}
+
+	var data map[string]map[string]string
+	status, err := doRequest("GET", fmt.Sprintf("%s/api/row?table=ver1&key=key1&columns=col1&version=%s",
+		baseURL, versions.Versions[1].Version), nil, &data)
+	if err != nil {
+		return err
+	}
+	if status != 200 || data["key1"]["col1"] != "val3" {
+		return errors.New("readSingleVersion value does not match the previous version")
+	}
+
+	status, err = doRequest("GET", baseURL+"/api/row?table=ver1&key=key1&columns=col1&version=123", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return errors.New("readSingleVersion /api/row GET (missing version) response status code is not 404")
+	}
+	return nil
+}
+
+func readVersionsBadParams(baseURL string) error {
+	badURLs := []string{
+		"/api/row?table=ver1&key=key1&version=1&versions=1",
+		"/api/row?table=ver1&key=key1&version=1",
+		"/api/row?table=ver1&prefix=key&columns=col1&version=1",
+		"/api/row?table=ver1&key=key1&versions=0",
+		"/api/row/versions?table=ver1&key=key1",
+	}
+	for _, badURL := range badURLs {
+		status, err := doRequest("GET", baseURL+badURL, nil, nil)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("readVersionsBadParams GET %s response status code is not 400", badURL)
+		}
+	}
+	return nil
+}
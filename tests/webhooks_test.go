@@ -0,0 +1,537 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/api"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/webhook"
+	"github.com/adrianchifor/Bigbucket/worker"
+	"github.com/adrianchifor/go-parallel"
+	"github.com/gin-gonic/gin"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+func TestWebhooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher := webhook.NewDispatcher(bucket, 3, 10*time.Millisecond)
+	apiServer := httptest.NewServer(api.NewRouter(bucket, &api.Options{Webhooks: dispatcher}))
+	t.Cleanup(apiServer.Close)
+	receiver := newWebhookReceiver()
+	receiverServer := httptest.NewServer(receiver)
+	t.Cleanup(receiverServer.Close)
+
+	if err := webhooksDisabled(); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksConfig(apiServer.URL, receiverServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksDelivery(apiServer.URL, receiverServer.URL, receiver); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksRetries(apiServer.URL, receiverServer.URL, receiver); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksDeadLetters(bucket, apiServer.URL, receiverServer.URL, receiver); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksTableState(apiServer.URL, receiverServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksClose(dispatcher, apiServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksRetryQueue(receiverServer.URL); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksDeniedAddress(); err != nil {
+		t.Error(err)
+	}
+	if err := webhooksDeadLetterRetention(bucket); err != nil {
+		t.Error(err)
+	}
+}
+
+// webhookReceiver is a stub of webhooks recording their deliveries by path. Path /flaky fails the first
+// 2 attempts of each delivery, /down always fails and /reject rejects deliveries
+type webhookReceiver struct {
+	mutex      sync.Mutex
+	deliveries map[string][]webhook.Payload
+	attempts   map[string]int
+}
+
+func newWebhookReceiver() *webhookReceiver {
+	return &webhookReceiver{deliveries: make(map[string][]webhook.Payload), attempts: make(map[string]int)}
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil || req.Header.Get(webhook.SignatureHeader) != webhook.Sign(testWebhookSecret, body) {
+		w.WriteHeader(401)
+		return
+	}
+	var payload webhook.Payload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.ID != req.Header.Get(webhook.DeliveryHeader) {
+		w.WriteHeader(400)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.attempts[payload.ID]++
+	switch {
+	case req.URL.Path == "/flaky" && r.attempts[payload.ID] <= 2:
+		w.WriteHeader(503)
+	case req.URL.Path == "/down":
+		w.WriteHeader(500)
+	case req.URL.Path == "/reject":
+		w.WriteHeader(404)
+	default:
+		r.deliveries[req.URL.Path] = append(r.deliveries[req.URL.Path], payload)
+		w.WriteHeader(204)
+	}
+}
+
+// waitDeliveries waits for count deliveries to the path, returning them
+func (r *webhookReceiver) waitDeliveries(path string, count int) ([]webhook.Payload, error) {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		r.mutex.Lock()
+		deliveries := append([]webhook.Payload(nil), r.deliveries[path]...)
+		r.mutex.Unlock()
+		if len(deliveries) >= count {
+			return deliveries, nil
+		}
+	}
+	return nil, fmt.Errorf("Webhook %s didn't receive %d deliveries", path, count)
+}
+
+func (r *webhookReceiver) attemptsOf(id string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.attempts[id]
+}
+
+// describeDeliveries summarizes the events of deliveries as 'table op key columns' strings
+func describeDeliveries(deliveries []webhook.Payload) []string {
+	described := []string{}
+	for _, delivery := range deliveries {
+		for _, event := range delivery.Events {
+			described = append(described, fmt.Sprintf("%s %s %s %s", delivery.Table, event.Op, event.Key, strings.Join(event.Columns, ",")))
+		}
+	}
+	return described
+}
+
+func setWebhooks(baseURL string, table string, targets ...webhook.Target) (int, error) {
+	return doRequest("PUT", fmt.Sprintf("%s/api/table/webhooks?table=%s", baseURL, table), webhook.Config{Webhooks: targets}, nil)
+}
+
+func webhooksDisabled() error {
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		return err
+	}
+	apiServer := httptest.NewServer(api.NewRouter(bucket, nil))
+	defer apiServer.Close()
+
+	status, err := setWebhooks(apiServer.URL, "webhooks0", webhook.Target{Name: "hook", URL: "http://localhost/", Secret: "secret"})
+	if err != nil {
+		return err
+	}
+	if status != 404 {
+		return fmt.Errorf("webhooksDisabled returned %d, expected 404", status)
+	}
+	return nil
+}
+
+func webhooksConfig(baseURL string, receiverURL string) error {
+	invalid := [][]webhook.Target{
+		{{Name: "", URL: receiverURL + "/ok", Secret: testWebhookSecret}},
+		{{Name: "hook", URL: "ftp://localhost/", Secret: testWebhookSecret}},
+		{{Name: "hook", URL: "/ok", Secret: testWebhookSecret}},
+		{{Name: "hook", URL: "http://169.254.169.254/latest/meta-data/", Secret: testWebhookSecret}},
+		{{Name: "hook", URL: "http://[fe80::1]:8080/", Secret: testWebhookSecret}},
+		{{Name: "hook", URL: receiverURL + "/ok"}},
+		{{Name: "hook", URL: receiverURL + "/ok", Secret: testWebhookSecret}, {Name: "hook", URL: receiverURL + "/ok", Secret: testWebhookSecret}},
+	}
+	for _, targets := range invalid {
+		status, err := setWebhooks(baseURL, "webhooks1", targets...)
+		if err != nil {
+			return err
+		}
+		if status != 400 {
+			return fmt.Errorf("webhooksConfig with %+v returned %d, expected 400", targets, status)
+		}
+	}
+
+	target := webhook.Target{Name: "hook", URL: receiverURL + "/ok", Secret: testWebhookSecret, KeyPrefix: "user_", Columns: []string{"email"}}
+	if status, err := setWebhooks(baseURL, "webhooks1", target); err != nil || status != 200 {
+		return fmt.Errorf("webhooksConfig set returned %d: %v", status, err)
+	}
+	var config struct {
+		Webhooks []webhook.Target `json:"webhooks"`
+	}
+	if _, err := doRequest("GET", baseURL+"/api/table/webhooks?table=webhooks1", nil, &config); err != nil {
+		return err
+	}
+	target.Secret = ""
+	if !reflect.DeepEqual(config.Webhooks, []webhook.Target{target}) {
+		return fmt.Errorf("webhooksConfig returned %+v, expected %+v without secret", config.Webhooks, target)
+	}
+
+	// Setting no webhooks removes them
+	if status, err := setWebhooks(baseURL, "webhooks1"); err != nil || status != 200 {
+		return fmt.Errorf("webhooksConfig removal returned %d: %v", status, err)
+	}
+	if _, err := doRequest("GET", baseURL+"/api/table/webhooks?table=webhooks1", nil, &config); err != nil {
+		return err
+	}
+	if len(config.Webhooks) != 0 {
+		return fmt.Errorf("webhooksConfig returned %+v after removal", config.Webhooks)
+	}
+	return nil
+}
+
+func webhooksDelivery(baseURL string, receiverURL string, receiver *webhookReceiver) error {
+	if status, err := setWebhooks(baseURL, "webhooks2",
+		webhook.Target{Name: "all", URL: receiverURL + "/all", Secret: testWebhookSecret},
+		webhook.Target{Name: "users", URL: receiverURL + "/users", Secret: testWebhookSecret, KeyPrefix: "user_", Columns: []string{"email"}},
+	); err != nil || status != 200 {
+		return fmt.Errorf("webhooksDelivery set returned %d: %v", status, err)
+	}
+
+	requests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"POST", "/api/row?table=webhooks2&key=user_1", map[string]string{"email": "a@b.c", "name": "a"}},
+		{"POST", "/api/row?table=webhooks2&key=other", map[string]string{"email": "d@e.f"}},
+		{"POST", "/api/row?table=webhooks2&key=user_2", map[string]string{"name": "b"}},
+		{"DELETE", "/api/row?table=webhooks2&key=user_1", nil},
+	}
+	for _, request := range requests {
+		if status, err := doRequest(request.method, baseURL+request.path, request.body, nil); err != nil || status != 200 {
+			return fmt.Errorf("webhooksDelivery %s %s returned %d: %v", request.method, request.path, status, err)
+		}
+		// Deliveries are concurrent, so they're waited for to check their order
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	all, err := receiver.waitDeliveries("/all", 4)
+	if err != nil {
+		return err
+	}
+	expected := []string{
+		"webhooks2 set user_1 email,name",
+		"webhooks2 set other email",
+		"webhooks2 set user_2 name",
+		"webhooks2 delete user_1 email,name",
+	}
+	if described := describeDeliveries(all); !reflect.DeepEqual(described, expected) {
+		return fmt.Errorf("webhooksDelivery delivered %v to 'all', expected %v", described, expected)
+	}
+	if all[0].Webhook != "all" || all[0].Events[0].Generations["email"] == "" || all[0].Timestamp.IsZero() {
+		return fmt.Errorf("webhooksDelivery delivered payload without webhook, generations or timestamp: %+v", all[0])
+	}
+
+	users, err := receiver.waitDeliveries("/users", 2)
+	if err != nil {
+		return err
+	}
+	expected = []string{"webhooks2 set user_1 email", "webhooks2 delete user_1 email"}
+	if described := describeDeliveries(users); !reflect.DeepEqual(described, expected) {
+		return fmt.Errorf("webhooksDelivery delivered %v to 'users', expected %v", described, expected)
+	}
+	if generations := users[0].Events[0].Generations; len(generations) != 1 || generations["email"] == "" {
+		return fmt.Errorf("webhooksDelivery delivered generations %v to 'users', expected only email", generations)
+	}
+	return nil
+}
+
+func webhooksRetries(baseURL string, receiverURL string, receiver *webhookReceiver) error {
+	if status, err := setWebhooks(baseURL, "webhooks3",
+		webhook.Target{Name: "flaky", URL: receiverURL + "/flaky", Secret: testWebhookSecret},
+	); err != nil || status != 200 {
+		return fmt.Errorf("webhooksRetries set returned %d: %v", status, err)
+	}
+	if status, err := doRequest("POST", baseURL+"/api/rows?table=webhooks3", map[string]map[string]string{
+		"key1": {"col1": "val1"},
+		"key2": {"col1": "val1"},
+	}, nil); err != nil || status != 200 {
+		return fmt.Errorf("webhooksRetries set returned %d: %v", status, err)
+	}
+
+	deliveries, err := receiver.waitDeliveries("/flaky", 1)
+	if err != nil {
+		return err
+	}
+	if described := describeDeliveries(deliveries); !reflect.DeepEqual(described, []string{"webhooks3 set key1 col1", "webhooks3 set key2 col1"}) {
+		return fmt.Errorf("webhooksRetries delivered %v", described)
+	}
+	if attempts := receiver.attemptsOf(deliveries[0].ID); attempts != 3 {
+		return fmt.Errorf("webhooksRetries delivered after %d attempts with the same delivery ID, expected 3", attempts)
+	}
+	return nil
+}
+
+func webhooksDeadLetters(bucket store.Backend, baseURL string, receiverURL string, receiver *webhookReceiver) error {
+	if status, err := setWebhooks(baseURL, "webhooks4",
+		webhook.Target{Name: "down", URL: receiverURL + "/down", Secret: testWebhookSecret},
+		webhook.Target{Name: "reject", URL: receiverURL + "/reject", Secret: testWebhookSecret},
+	); err != nil || status != 200 {
+		return fmt.Errorf("webhooksDeadLetters set returned %d: %v", status, err)
+	}
+	if status, err := doRequest("POST", baseURL+"/api/row?table=webhooks4&key=key1", map[string]string{"col1": "val1"}, nil); err != nil || status != 200 {
+		return fmt.Errorf("webhooksDeadLetters set returned %d: %v", status, err)
+	}
+
+	ctx := context.Background()
+	var objects []string
+	for start := time.Now(); time.Since(start) < 5*time.Second && len(objects) < 2; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if objects, err = bucket.ListObjects(ctx, webhook.DeadLettersPrefix+"webhooks4/", "", 0, nil); err != nil {
+			return err
+		}
+	}
+	if len(objects) != 2 {
+		return fmt.Errorf("webhooksDeadLetters recorded %d dead letters, expected 2", len(objects))
+	}
+
+	// Failing webhooks are retried, rejecting ones aren't
+	expectedAttempts := map[string]int{"down": 3, "reject": 1}
+	for _, object := range objects {
+		data, _, err := bucket.ReadObject(ctx, object)
+		if err != nil {
+			return err
+		}
+		var deadLetter webhook.DeadLetter
+		if err := json.Unmarshal(data, &deadLetter); err != nil {
+			return err
+		}
+		var payload webhook.Payload
+		if err := json.Unmarshal(deadLetter.Payload, &payload); err != nil {
+			return err
+		}
+		if deadLetter.Attempts != expectedAttempts[deadLetter.Webhook] || receiver.attemptsOf(payload.ID) != deadLetter.Attempts {
+			return fmt.Errorf("webhooksDeadLetters recorded %d attempts (%d received) for '%s', expected %d",
+				deadLetter.Attempts, receiver.attemptsOf(payload.ID), deadLetter.Webhook, expectedAttempts[deadLetter.Webhook])
+		}
+		if deadLetter.Error == "" || !strings.HasSuffix(object, payload.ID) ||
+			!reflect.DeepEqual(describeDeliveries([]webhook.Payload{payload}), []string{"webhooks4 set key1 col1"}) {
+			return fmt.Errorf("webhooksDeadLetters recorded %s: %+v", object, deadLetter)
+		}
+	}
+	return nil
+}
+
+// webhooksTableState checks columns are still found in tables with all state objects (schema, webhooks and
+// deleted columns) listed before their first row
+func webhooksTableState(baseURL string, receiverURL string) error {
+	if _, err := doRequest("POST", baseURL+"/api/row?table=hooks9&key=key1", map[string]interface{}{"name": "val1", "age": 30, "tmp": "val3"}, nil); err != nil {
+		return err
+	}
+	schema := map[string]interface{}{"columns": map[string]interface{}{"age": map[string]interface{}{"type": "int"}}}
+	if status, err := doRequest("PUT", baseURL+"/api/table?table=hooks9", schema, nil); err != nil || status != 200 {
+		return fmt.Errorf("webhooksTableState set schema returned %d: %v", status, err)
+	}
+	if status, err := setWebhooks(baseURL, "hooks9", webhook.Target{Name: "state", URL: receiverURL + "/state", Secret: testWebhookSecret}); err != nil || status != 200 {
+		return fmt.Errorf("webhooksTableState set webhooks returned %d: %v", status, err)
+	}
+	if status, err := doRequest("DELETE", baseURL+"/api/column?table=hooks9&column=tmp", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("webhooksTableState delete column returned %d: %v", status, err)
+	}
+
+	var columns struct {
+		Columns []string `json:"columns"`
+	}
+	if _, err := doRequest("GET", baseURL+"/api/column?table=hooks9", nil, &columns); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(columns.Columns, []string{"age", "name"}) {
+		return fmt.Errorf("webhooksTableState listed columns %v, expected [age name]", columns.Columns)
+	}
+	if status, err := doRequest("DELETE", baseURL+"/api/column?table=hooks9&column=age", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("webhooksTableState delete column after state objects returned %d: %v", status, err)
+	}
+	return nil
+}
+
+func webhooksClose(dispatcher *webhook.Dispatcher, baseURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dispatcher.Close(ctx); err != nil {
+		return fmt.Errorf("webhooksClose didn't finish the deliveries: %v", err)
+	}
+
+	// Writes still succeed after webhooks are closed
+	if status, err := doRequest("POST", baseURL+"/api/row?table=webhooks2&key=user_3", map[string]string{"email": "g@h.i"}, nil); err != nil || status != 200 {
+		return fmt.Errorf("webhooksClose write returned %d: %v", status, err)
+	}
+	return nil
+}
+
+// webhooksRetryQueue checks deliveries to a webhook which is down are retried through a bounded queue, recording
+// the ones failing when it's full as dead letters instead of holding a goroutine for each
+func webhooksRetryQueue(receiverURL string) error {
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	config, err := json.Marshal(webhook.Config{Webhooks: []webhook.Target{
+		{Name: "down", URL: receiverURL + "/down", Secret: testWebhookSecret},
+	}})
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.WriteObject(ctx, webhook.ConfigObject("webhooks5"), config, nil); err != nil {
+		return err
+	}
+
+	goroutines := runtime.NumGoroutine()
+	dispatcher := webhook.NewDispatcher(bucket, 3, time.Hour)
+	mutations, retryQueueSize := 1100, 1000
+	for i := 0; i < mutations; i++ {
+		dispatcher.Notify("webhooks5", []webhook.Event{{Op: "set", Key: fmt.Sprintf("key%d", i), Columns: []string{"col1"}}})
+	}
+
+	var objects []string
+	for start := time.Now(); time.Since(start) < 10*time.Second && len(objects) < mutations-retryQueueSize; time.Sleep(10 * time.Millisecond) {
+		if objects, err = bucket.ListObjects(ctx, webhook.DeadLettersPrefix+"webhooks5/", "", 0, nil); err != nil {
+			return err
+		}
+	}
+	if len(objects) != mutations-retryQueueSize {
+		return fmt.Errorf("webhooksRetryQueue recorded %d dead letters with a full retry queue, expected %d",
+			len(objects), mutations-retryQueueSize)
+	}
+	data, _, err := bucket.ReadObject(ctx, objects[0])
+	if err != nil {
+		return err
+	}
+	var deadLetter webhook.DeadLetter
+	if err := json.Unmarshal(data, &deadLetter); err != nil {
+		return err
+	}
+	if deadLetter.Attempts != 1 || !strings.Contains(deadLetter.Error, "retry queue is full") {
+		return fmt.Errorf("webhooksRetryQueue recorded %+v", deadLetter)
+	}
+	// Workers and connections to the webhook, not a goroutine per waiting retry
+	if running := runtime.NumGoroutine() - goroutines; running > 500 {
+		return fmt.Errorf("webhooksRetryQueue has %d goroutines running for %d waiting retries", running, retryQueueSize)
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := dispatcher.Close(closeCtx); err != nil {
+		return fmt.Errorf("webhooksRetryQueue didn't finish the deliveries: %v", err)
+	}
+	if objects, err = bucket.ListObjects(ctx, webhook.DeadLettersPrefix+"webhooks5/", "", 0, nil); err != nil {
+		return err
+	}
+	if len(objects) != mutations {
+		return fmt.Errorf("webhooksRetryQueue recorded %d dead letters after closing, expected %d", len(objects), mutations)
+	}
+	return nil
+}
+
+// webhooksDeniedAddress checks deliveries to link-local addresses (e.g. cloud metadata services) are refused when
+// connecting, for webhooks set before they were validated
+func webhooksDeniedAddress() error {
+	bucket, err := store.NewBackend("mem://")
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	config, err := json.Marshal(webhook.Config{Webhooks: []webhook.Target{
+		{Name: "metadata", URL: "http://169.254.169.254/latest/meta-data/", Secret: testWebhookSecret},
+	}})
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.WriteObject(ctx, webhook.ConfigObject("webhooks6"), config, nil); err != nil {
+		return err
+	}
+
+	dispatcher := webhook.NewDispatcher(bucket, 3, 10*time.Millisecond)
+	dispatcher.Notify("webhooks6", []webhook.Event{{Op: "set", Key: "key1", Columns: []string{"col1"}}})
+	closeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := dispatcher.Close(closeCtx); err != nil {
+		return fmt.Errorf("webhooksDeniedAddress didn't finish the deliveries: %v", err)
+	}
+
+	objects, err := bucket.ListObjects(ctx, webhook.DeadLettersPrefix+"webhooks6/", "", 0, nil)
+	if err != nil {
+		return err
+	}
+	if len(objects) != 1 {
+		return fmt.Errorf("webhooksDeniedAddress recorded %d dead letters, expected 1", len(objects))
+	}
+	data, _, err := bucket.ReadObject(ctx, objects[0])
+	if err != nil {
+		return err
+	}
+	var deadLetter webhook.DeadLetter
+	if err := json.Unmarshal(data, &deadLetter); err != nil {
+		return err
+	}
+	// Not retried, like rejected deliveries
+	if deadLetter.Attempts != 1 || !strings.Contains(deadLetter.Error, "denied") {
+		return fmt.Errorf("webhooksDeniedAddress recorded %+v", deadLetter)
+	}
+	return nil
+}
+
+func webhooksDeadLetterRetention(bucket store.Backend) error {
+	ctx := context.Background()
+	recent, err := bucket.ListObjects(ctx, webhook.DeadLettersPrefix+"webhooks4/", "", 0, nil)
+	if err != nil {
+		return err
+	}
+	if len(recent) == 0 {
+		return fmt.Errorf("webhooksDeadLetterRetention found no recent dead letters")
+	}
+	oldDeadLetter := fmt.Sprintf("%swebhooks4/%020d-00000000", webhook.DeadLettersPrefix, time.Now().Add(-2*time.Hour).UnixNano())
+	if _, err := bucket.WriteObject(ctx, oldDeadLetter, []byte(`{"webhook":"down"}`), nil); err != nil {
+		return err
+	}
+
+	worker.DeadLetterRetention = time.Hour
+	defer func() { worker.DeadLetterRetention = 0 }()
+	deleteJobPool := parallel.SmallJobPool()
+	defer deleteJobPool.Close()
+	cleanerServer := httptest.NewServer(worker.NewCleanerRouter(bucket, deleteJobPool))
+	defer cleanerServer.Close()
+
+	if status, err := doRequest("POST", cleanerServer.URL+"/", nil, nil); err != nil || status != 200 {
+		return fmt.Errorf("webhooksDeadLetterRetention cleaner returned %d: %v", status, err)
+	}
+	objects, err := bucket.ListObjects(ctx, webhook.DeadLettersPrefix+"webhooks4/", "", 0, nil)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(objects, recent) {
+		return fmt.Errorf("webhooksDeadLetterRetention kept %v, expected the recent %v", objects, recent)
+	}
+	return nil
+}
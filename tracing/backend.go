@@ -0,0 +1,118 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/adrianchifor/Bigbucket/store"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedBackend starts a span for each call to a backend
+type tracedBackend struct {
+	store.Backend
+}
+
+// TraceBackend wraps the backend to start a span for each of its calls
+func TraceBackend(backend store.Backend) store.Backend {
+	return &tracedBackend{Backend: backend}
+}
+
+// startCall starts the span of a backend call on the object (or prefix for listings)
+func startCall(ctx context.Context, method string, object string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "store."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("bigbucket.object", object)),
+	)
+}
+
+// endCall ends the span of a backend call, objects not found are recorded without an error status
+// as reads of deleted or missing cells are expected
+func endCall(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if !errors.Is(err, store.ErrObjectNotExist) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+func (b *tracedBackend) ListObjects(ctx context.Context, prefix string, delimiter string, limit int,
+	opts *store.ListOptions) ([]string, error) {
+	ctx, span := startCall(ctx, "ListObjects", prefix)
+	objects, err := b.Backend.ListObjects(ctx, prefix, delimiter, limit, opts)
+	span.SetAttributes(attribute.Int("bigbucket.objects", len(objects)))
+	endCall(span, err)
+	return objects, err
+}
+
+func (b *tracedBackend) ReadObject(ctx context.Context, object string) ([]byte, *store.ObjectAttrs, error) {
+	ctx, span := startCall(ctx, "ReadObject", object)
+	data, attrs, err := b.Backend.ReadObject(ctx, object)
+	endCall(span, err)
+	return data, attrs, err
+}
+
+func (b *tracedBackend) WriteObject(ctx context.Context, object string, data []byte,
+	opts *store.WriteOptions) (*store.ObjectAttrs, error) {
+	ctx, span := startCall(ctx, "WriteObject", object)
+	attrs, err := b.Backend.WriteObject(ctx, object, data, opts)
+	endCall(span, err)
+	return attrs, err
+}
+
+// ReadObjectStream spans until the stream is opened, not until it's read
+func (b *tracedBackend) ReadObjectStream(ctx context.Context, object string) (io.ReadCloser, *store.ObjectAttrs, error) {
+	spanCtx, span := startCall(ctx, "ReadObjectStream", object)
+	r, attrs, err := b.Backend.ReadObjectStream(spanCtx, object)
+	endCall(span, err)
+	return r, attrs, err
+}
+
+func (b *tracedBackend) WriteObjectStream(ctx context.Context, object string, r io.Reader,
+	opts *store.WriteOptions) (*store.ObjectAttrs, error) {
+	ctx, span := startCall(ctx, "WriteObjectStream", object)
+	attrs, err := b.Backend.WriteObjectStream(ctx, object, r, opts)
+	endCall(span, err)
+	return attrs, err
+}
+
+func (b *tracedBackend) DeleteObject(ctx context.Context, object string) error {
+	ctx, span := startCall(ctx, "DeleteObject", object)
+	err := b.Backend.DeleteObject(ctx, object)
+	endCall(span, err)
+	return err
+}
+
+func (b *tracedBackend) StatObject(ctx context.Context, object string) (*store.ObjectAttrs, error) {
+	ctx, span := startCall(ctx, "StatObject", object)
+	attrs, err := b.Backend.StatObject(ctx, object)
+	endCall(span, err)
+	return attrs, err
+}
+
+func (b *tracedBackend) ListObjectVersions(ctx context.Context, object string) ([]store.ObjectAttrs, error) {
+	ctx, span := startCall(ctx, "ListObjectVersions", object)
+	versions, err := b.Backend.ListObjectVersions(ctx, object)
+	endCall(span, err)
+	return versions, err
+}
+
+func (b *tracedBackend) ReadObjectVersion(ctx context.Context, object string, version string) ([]byte, error) {
+	ctx, span := startCall(ctx, "ReadObjectVersion", object)
+	data, err := b.Backend.ReadObjectVersion(ctx, object, version)
+	endCall(span, err)
+	return data, err
+}
+
+func (b *tracedBackend) ListExpiredObjects(ctx context.Context, prefix string) ([]string, error) {
+	ctx, span := startCall(ctx, "ListExpiredObjects", prefix)
+	objects, err := b.Backend.ListExpiredObjects(ctx, prefix)
+	span.SetAttributes(attribute.Int("bigbucket.objects", len(objects)))
+	endCall(span, err)
+	return objects, err
+}
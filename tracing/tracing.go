@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/adrianchifor/Bigbucket"
+
+// tracer uses the global tracer provider, which doesn't record anything until Init is called
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Init exports spans with OTLP over HTTP, configured by the standard OTEL_EXPORTER_OTLP_* environment
+// variables (e.g. OTEL_EXPORTER_OTLP_ENDPOINT, default https://localhost:4318). The returned func
+// flushes the remaining spans and has to be called before exiting
+func Init(ctx context.Context, serviceName string, serviceVersion string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create OTLP trace exporter: %v", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String(serviceName),
+		semconv.ServiceVersionKey.String(serviceVersion),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tracing resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, its context has to be passed to the calls it covers and the span ended
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Detach returns a context with the span of ctx, which isn't canceled with ctx
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// Inject sets the W3C traceparent header of the span in ctx on an outgoing request, to continue its trace
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Middleware starts a span for each request to the server, continuing the trace of the W3C traceparent
+// header if set. Handlers get the span in the context of their request
+func Middleware(server string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		ctx, span := tracer().Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("bigbucket.server", server),
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(c.Request.URL.RequestURI()),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Job wraps a job added to a job pool in a span, started when the job runs and child of the span in ctx.
+// The job gets the context of its span
+func Job(ctx context.Context, pool string, job func(ctx context.Context)) func() {
+	queuedAt := time.Now()
+	return func() {
+		jobCtx, span := tracer().Start(ctx, pool+" job", trace.WithAttributes(
+			attribute.String("bigbucket.job.pool", pool),
+			attribute.Float64("bigbucket.job.wait_seconds", time.Since(queuedAt).Seconds()),
+		))
+		defer span.End()
+		job(jobCtx)
+	}
+}
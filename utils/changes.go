@@ -0,0 +1,4 @@
+package utils
+
+// ChangesPrefix prefixes the change log segments, stored as bigbucket/.changes/<table>/<segment>
+const ChangesPrefix = "bigbucket/.changes/"
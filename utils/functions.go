@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"strings"
+	"time"
 )
 
 // Search returns first index where found, otherwise -1
@@ -35,15 +39,24 @@ func MergeMaps(maps ...map[string]string) map[string]string {
 	return mergedMap
 }
 
-// CleanupTables filters out 'bigbucket' and '/' from tables []string
+// CleanupTables filters out 'bigbucket' and '/' from tables []string, and state objects or directories
+// (e.g. .delete_tables, .changes) as table names can't start with '.'
 func CleanupTables(tables []string) []string {
 	cleanTables := []string{}
 	for _, table := range tables {
 		cleanTable := strings.Replace(strings.Replace(table, "bigbucket", "", 1), "/", "", -1)
-		if cleanTable != "" {
+		if cleanTable != "" && !strings.HasPrefix(cleanTable, ".") {
 			cleanTables = append(cleanTables, cleanTable)
 		}
 	}
 
 	return cleanTables
 }
+
+// NewOrderedID returns a unique ID ordered by its creation time then a random suffix, so IDs of different
+// instances created at the same time don't collide. Used to name change log segments and webhook deliveries
+func NewOrderedID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+}
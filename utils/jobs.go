@@ -0,0 +1,15 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/adrianchifor/Bigbucket/metrics"
+	"github.com/adrianchifor/Bigbucket/tracing"
+	"github.com/adrianchifor/go-parallel"
+)
+
+// AddJob adds a job to the job pool, counted in the queue depth metric of the pool until it starts and
+// traced in a span child of ctx. The job gets the context of its span
+func AddJob(ctx context.Context, jobPool *parallel.JobPool, pool string, job func(ctx context.Context)) {
+	jobPool.AddJob(metrics.TrackJob(pool, tracing.Job(ctx, pool, job)))
+}
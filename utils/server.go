@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -15,16 +16,27 @@ import (
 
 // RunServer creates and runs a new Gin HTTP server with graceful shutdown
 func RunServer(port int, router *gin.Engine) {
+	RunTLSServer(port, router, nil)
+}
+
+// RunTLSServer creates and runs a new Gin HTTPS server with graceful shutdown, or HTTP if tlsConfig is nil
+func RunTLSServer(port int, router *gin.Engine, tlsConfig *tls.Config) {
 	done := make(chan bool, 1)
 	quit := make(chan os.Signal, 1)
 
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	server, listenAddr := newServer(port, router)
+	server.TLSConfig = tlsConfig
 	go serverGracefulShutdown(server, quit, done)
 
 	log.Println("HTTP server is ready to handle requests at", listenAddr)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	listen := server.ListenAndServe
+	if tlsConfig != nil {
+		// Certificates are already loaded in tlsConfig
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+	}
+	if err := listen(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("HTTP server could not listen on %s: %v\n", listenAddr, err)
 	}
 
@@ -2,16 +2,17 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 
 	"github.com/adrianchifor/Bigbucket/store"
 )
 
 // GetState gets object content as string[]
-func GetState(object string) []string {
+func GetState(ctx context.Context, bucket store.Backend, object string) []string {
 	state := []string{}
 
-	data, err := store.ReadObject(object)
+	data, _, err := bucket.ReadObject(ctx, object)
 	if err != nil {
 		return state
 	}
@@ -22,12 +23,12 @@ func GetState(object string) []string {
 }
 
 // WriteState writes string[] to object
-func WriteState(object string, state []string) error {
+func WriteState(ctx context.Context, bucket store.Backend, object string, state []string) error {
 	buf := &bytes.Buffer{}
 	gob.NewEncoder(buf).Encode(state)
 	data := buf.Bytes()
 
-	err := store.WriteObject(object, data)
+	_, err := bucket.WriteObject(ctx, object, data, nil)
 	if err != nil {
 		return err
 	}
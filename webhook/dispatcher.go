@@ -0,0 +1,436 @@
+package webhook
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/metrics"
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/utils"
+)
+
+const (
+	queueSize = 10000
+	// deliveryWorkers is the count of workers posting deliveries, so the requests to webhooks in flight
+	deliveryWorkers = 64
+	// retryQueueSize limits the deliveries waiting for their backoff, deliveries failing when it's full are
+	// recorded as dead letters
+	retryQueueSize  = 1000
+	deliveryTimeout = 10 * time.Second
+	maxBackoff      = time.Minute
+	// configTTL is how long the webhooks of tables are cached for, so changes made through other instances
+	// are delivered with the old webhooks for at most that long
+	configTTL = 10 * time.Second
+)
+
+// errRejected is returned for responses which won't succeed on retries, e.g. 400 or 404
+var errRejected = errors.New("not retried")
+
+// DeadLetter is a delivery which failed all its attempts, stored as JSON in the bucket
+type DeadLetter struct {
+	Webhook  string          `json:"webhook"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failedAt"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// mutation holds the events of a write request, queued for delivery to the webhooks of its table
+type mutation struct {
+	table     string
+	events    []Event
+	timestamp time.Time
+}
+
+// delivery is a payload posted to a webhook, retried until it succeeds or runs out of attempts
+type delivery struct {
+	target  Target
+	payload Payload
+	body    []byte
+	attempt int
+	retryAt time.Time
+	// err is the error of the last attempt
+	err error
+}
+
+// retryQueue holds the deliveries waiting for their backoff, ordered by their retry time
+type retryQueue []*delivery
+
+func (q retryQueue) Len() int            { return len(q) }
+func (q retryQueue) Less(i, j int) bool  { return q[i].retryAt.Before(q[j].retryAt) }
+func (q retryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *retryQueue) Push(x interface{}) { *q = append(*q, x.(*delivery)) }
+func (q *retryQueue) Pop() interface{} {
+	old := *q
+	last := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return last
+}
+
+type cachedConfig struct {
+	config *Config
+	readAt time.Time
+}
+
+// Dispatcher delivers the mutations of tables to their webhooks asynchronously through a fixed set of workers,
+// retrying failed deliveries with exponential backoff and recording the ones failing all attempts as dead
+// letters in the bucket
+type Dispatcher struct {
+	bucket   store.Backend
+	attempts int
+	backoff  time.Duration
+	client   *http.Client
+
+	queue    chan mutation
+	due      chan *delivery
+	stopping chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+
+	retriesMutex  sync.Mutex
+	retries       retryQueue
+	retriesClosed bool
+	retriesWake   chan struct{}
+
+	mutex   sync.Mutex
+	configs map[string]cachedConfig
+}
+
+// NewDispatcher creates a dispatcher making up to attempts per delivery, waiting backoff (doubled on each retry)
+// between them
+func NewDispatcher(bucket store.Backend, attempts int, backoff time.Duration) *Dispatcher {
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := &Dispatcher{
+		bucket:   bucket,
+		attempts: attempts,
+		backoff:  backoff,
+		client: &http.Client{
+			Timeout:   deliveryTimeout,
+			Transport: newTransport(),
+			// Redirects are responses like others, so they're not followed with a GET
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue:       make(chan mutation, queueSize),
+		due:         make(chan *delivery),
+		stopping:    make(chan struct{}),
+		retriesWake: make(chan struct{}, 1),
+		configs:     make(map[string]cachedConfig),
+	}
+	d.workers.Add(deliveryWorkers + 1)
+	for i := 0; i < deliveryWorkers; i++ {
+		go d.work()
+	}
+	go d.scheduleRetries()
+	return d
+}
+
+// newTransport returns the transport of deliveries, like the default one but checking the addresses it
+// connects to
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkDialAddress,
+	}
+	transport.DialContext = dialer.DialContext
+	// Connections are reused by the workers
+	transport.MaxIdleConnsPerHost = deliveryWorkers
+	return transport
+}
+
+// Notify queues the events of a write request to a table for delivery to its webhooks, without blocking.
+// Events are dropped (and logged) if the queue is full or the dispatcher is closed
+func (d *Dispatcher) Notify(table string, events []Event) {
+	select {
+	case <-d.stopping:
+		log.Printf("Webhooks are closed, dropped %d events of table '%s'", len(events), table)
+		metrics.ObserveWebhookDelivery("dropped")
+		return
+	default:
+	}
+
+	select {
+	case d.queue <- mutation{table: table, events: events, timestamp: time.Now().UTC()}:
+	default:
+		log.Printf("Webhooks queue is full, dropped %d events of table '%s'", len(events), table)
+		metrics.ObserveWebhookDelivery("dropped")
+	}
+}
+
+// Reload drops the cached webhooks of a table, after they were set through this instance
+func (d *Dispatcher) Reload(table string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.configs, table)
+}
+
+// Close stops queueing events and waits for the queued and in-flight deliveries. Retries waiting for their
+// backoff are recorded as dead letters right away
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.stopOnce.Do(func() { close(d.stopping) })
+
+	finished := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work delivers queued mutations and retries which are due, until the dispatcher is closed
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+	for {
+		select {
+		case m := <-d.queue:
+			d.dispatch(m)
+		case retry := <-d.due:
+			metrics.ObserveWebhookDelivery("retried")
+			retry.attempt++
+			d.deliver(retry)
+		case <-d.stopping:
+			// Events queued before closing are still delivered
+			for {
+				select {
+				case m := <-d.queue:
+					d.dispatch(m)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// dispatch delivers a mutation to the webhooks of its table subscribed to its events
+func (d *Dispatcher) dispatch(m mutation) {
+	config, err := d.config(m.table)
+	if err != nil {
+		log.Printf("Failed to read webhooks of table '%s', dropped %d events: %v", m.table, len(m.events), err)
+		metrics.ObserveWebhookDelivery("dropped")
+		return
+	}
+	if config == nil {
+		return
+	}
+
+	for _, target := range config.Webhooks {
+		events := target.filter(m.events)
+		if len(events) == 0 {
+			continue
+		}
+		payload := Payload{
+			ID:        utils.NewOrderedID(),
+			Table:     m.table,
+			Webhook:   target.Name,
+			Timestamp: m.timestamp,
+			Events:    events,
+		}
+		body, err := json.Marshal(&payload)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		d.deliver(&delivery{target: target, payload: payload, body: body, attempt: 1})
+	}
+}
+
+// config returns the webhooks of a table, cached for configTTL
+func (d *Dispatcher) config(table string) (*Config, error) {
+	d.mutex.Lock()
+	cached, exists := d.configs[table]
+	d.mutex.Unlock()
+	if exists && time.Since(cached.readAt) < configTTL {
+		return cached.config, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	config, err := ReadConfig(ctx, d.bucket, table)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.configs[table] = cachedConfig{config: config, readAt: time.Now()}
+	return config, nil
+}
+
+// deliver makes an attempt to post the payload to the webhook, queueing a retry if it failed and can be
+// retried, or recording it as a dead letter otherwise
+func (d *Dispatcher) deliver(del *delivery) {
+	err := d.post(del.target, del.payload.ID, del.body)
+	if err == nil {
+		metrics.ObserveWebhookDelivery("delivered")
+		return
+	}
+	if errors.Is(err, errRejected) || del.attempt >= d.attempts {
+		d.deadLetter(del, err)
+		return
+	}
+	d.retry(del, err)
+}
+
+// retry queues a failed delivery until its backoff passed, with jitter so retries of many deliveries are
+// spread. Deliveries are recorded as dead letters instead if the retry queue is full or the dispatcher is closed
+func (d *Dispatcher) retry(del *delivery, err error) {
+	backoff := d.backoff << (del.attempt - 1)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = maxBackoff
+	}
+	backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+
+	d.retriesMutex.Lock()
+	if d.retriesClosed {
+		d.retriesMutex.Unlock()
+		d.deadLetter(del, fmt.Errorf("%v, not retried as the instance is shutting down", err))
+		return
+	}
+	if d.retries.Len() >= retryQueueSize {
+		d.retriesMutex.Unlock()
+		d.deadLetter(del, fmt.Errorf("%v, not retried as the retry queue is full", err))
+		return
+	}
+	del.err = err
+	del.retryAt = time.Now().Add(backoff)
+	heap.Push(&d.retries, del)
+	d.retriesMutex.Unlock()
+
+	select {
+	case d.retriesWake <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleRetries hands the queued retries to the workers once their backoff passed. When the dispatcher is
+// closed, the queued retries are recorded as dead letters
+func (d *Dispatcher) scheduleRetries() {
+	defer d.workers.Done()
+	for {
+		wait := maxBackoff
+		var next *delivery
+		d.retriesMutex.Lock()
+		if d.retries.Len() > 0 {
+			if wait = time.Until(d.retries[0].retryAt); wait <= 0 {
+				next = heap.Pop(&d.retries).(*delivery)
+			}
+		}
+		d.retriesMutex.Unlock()
+
+		if next != nil {
+			select {
+			case d.due <- next:
+			case <-d.stopping:
+				d.deadLetter(next, fmt.Errorf("%v, not retried as the instance is shutting down", next.err))
+			}
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.retriesWake:
+			timer.Stop()
+		case <-d.stopping:
+			timer.Stop()
+			d.closeRetries()
+			return
+		}
+	}
+}
+
+// closeRetries records the queued retries as dead letters, and the ones failing from now on
+func (d *Dispatcher) closeRetries() {
+	d.retriesMutex.Lock()
+	d.retriesClosed = true
+	retries := d.retries
+	d.retries = nil
+	d.retriesMutex.Unlock()
+
+	for _, del := range retries {
+		d.deadLetter(del, fmt.Errorf("%v, not retried as the instance is shutting down", del.err))
+	}
+}
+
+// post makes a delivery attempt, successful if the webhook responds with 2xx. Responses other than 5xx,
+// 408 and 429 are returned as errRejected
+func (d *Dispatcher) post(target Target, id string, body []byte) error {
+	req, err := http.NewRequest("POST", target.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%v, %w", err, errRejected)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bigbucket-Webhook")
+	req.Header.Set(DeliveryHeader, id)
+	req.Header.Set(SignatureHeader, Sign(target.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drained so the connection is reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == 408 || resp.StatusCode == 429 {
+		return fmt.Errorf("Webhook responded with %d", resp.StatusCode)
+	}
+	return fmt.Errorf("Webhook responded with %d, %w", resp.StatusCode, errRejected)
+}
+
+// deadLetter records a delivery which failed in the bucket, to be inspected and replayed
+func (d *Dispatcher) deadLetter(del *delivery, err error) {
+	metrics.ObserveWebhookDelivery("dead_letter")
+	target, payload, body, attempts := del.target, del.payload, del.body, del.attempt
+	deadLetter := DeadLetter{
+		Webhook:  target.Name,
+		URL:      target.URL,
+		Attempts: attempts,
+		Error:    err.Error(),
+		FailedAt: time.Now().UTC(),
+		Payload:  body,
+	}
+	data, err := json.Marshal(&deadLetter)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	object := DeadLettersPrefix + payload.Table + "/" + payload.ID
+	if _, err := d.bucket.WriteObject(ctx, object, data, nil); err != nil {
+		log.Printf("Failed to record dead letter of webhook '%s' (%s): %v, payload: %s", target.Name, object, err, body)
+		return
+	}
+	log.Printf("Delivery to webhook '%s' of table '%s' failed after %d attempts, recorded in %s: %s",
+		target.Name, payload.Table, attempts, object, deadLetter.Error)
+}
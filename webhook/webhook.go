@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/utils"
+)
+
+// Headers of webhook deliveries
+const (
+	// SignatureHeader holds 'sha256=<hex>', the HMAC-SHA256 of the body with the secret of the webhook
+	SignatureHeader = "X-Bigbucket-Signature"
+	// DeliveryHeader holds the ID of the delivery, the same on retries so receivers can skip duplicates
+	DeliveryHeader = "X-Bigbucket-Delivery"
+)
+
+// DeadLettersPrefix prefixes the deliveries which failed all attempts, stored as bigbucket/.deadletters/<table>/<id>
+const DeadLettersPrefix = "bigbucket/.deadletters/"
+
+// metadataIPv6 is the IPv6 address of the AWS instance metadata service, outside of the link-local range
+var metadataIPv6 = net.ParseIP("fd00:ec2::254")
+
+// Config holds the webhooks of a table, stored as JSON in bigbucket/<table>/.webhooks
+type Config struct {
+	Webhooks []Target `json:"webhooks"`
+}
+
+// Target is a webhook receiving the mutations of a table
+type Target struct {
+	// Name identifies the webhook in deliveries and dead letters
+	Name string `json:"name"`
+	// URL receives the events as a JSON POST
+	URL string `json:"url"`
+	// Secret signs the deliveries with HMAC-SHA256
+	Secret string `json:"secret,omitempty"`
+	// KeyPrefix only delivers the events of row keys with the prefix, empty for all rows
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+	// Columns only delivers the events of the columns, empty for all columns
+	Columns []string `json:"columns,omitempty"`
+}
+
+// Event is a mutation of a table delivered to webhooks, like the events of the change log
+type Event struct {
+	Op          string            `json:"op"`
+	Key         string            `json:"key,omitempty"`
+	Columns     []string          `json:"columns,omitempty"`
+	Generations map[string]string `json:"generations,omitempty"`
+}
+
+// Payload is the JSON body of deliveries
+type Payload struct {
+	ID        string    `json:"id"`
+	Table     string    `json:"table"`
+	Webhook   string    `json:"webhook"`
+	Timestamp time.Time `json:"timestamp"`
+	Events    []Event   `json:"events"`
+}
+
+// ConfigObject returns the object holding the webhooks of a table
+func ConfigObject(table string) string {
+	return fmt.Sprintf("bigbucket/%s/.webhooks", table)
+}
+
+// ReadConfig reads the webhooks of a table, nil if the table has none
+func ReadConfig(ctx context.Context, bucket store.Backend, table string) (*Config, error) {
+	data, _, err := bucket.ReadObject(ctx, ConfigObject(table))
+	if errors.Is(err, store.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse webhooks of table '%s': %v", table, err)
+	}
+	return &config, nil
+}
+
+// Validate checks the webhooks have unique names, HTTP(S) URLs and secrets. URLs with denied IP addresses
+// (see deniedAddress) are rejected here, the ones with host names when delivering to their resolved address
+func (config *Config) Validate() error {
+	names := map[string]bool{}
+	for _, target := range config.Webhooks {
+		if target.Name == "" || names[target.Name] {
+			return errors.New("Webhooks need a unique 'name'")
+		}
+		names[target.Name] = true
+
+		targetURL, err := url.Parse(target.URL)
+		if err != nil || (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+			return fmt.Errorf("URL of webhook '%s' has to be an absolute http(s) URL", target.Name)
+		}
+		if ip := net.ParseIP(targetURL.Hostname()); ip != nil && deniedAddress(ip) {
+			return fmt.Errorf("URL of webhook '%s' cannot be a link-local, multicast or unspecified address", target.Name)
+		}
+		if target.Secret == "" {
+			return fmt.Errorf("Webhook '%s' needs a 'secret' to sign deliveries", target.Name)
+		}
+		for _, column := range target.Columns {
+			if column == "" {
+				return fmt.Errorf("Columns of webhook '%s' cannot be empty", target.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// deniedAddress reports whether webhooks can't be delivered to an IP address. Link-local addresses are denied,
+// as they reach the metadata services of cloud instances (e.g. 169.254.169.254) holding their credentials,
+// along with multicast and unspecified addresses
+func deniedAddress(ip net.IP) bool {
+	return ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		ip.Equal(metadataIPv6)
+}
+
+// checkDialAddress is the net.Dialer control of deliveries, refusing to connect to denied addresses after
+// host names of webhooks are resolved
+func checkDialAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%v, %w", err, errRejected)
+	}
+	if ip := net.ParseIP(host); ip == nil || deniedAddress(ip) {
+		return fmt.Errorf("address %s is denied for webhooks, %w", host, errRejected)
+	}
+	return nil
+}
+
+// Redacted returns the webhooks without their secrets
+func (config *Config) Redacted() *Config {
+	redacted := &Config{Webhooks: []Target{}}
+	for _, target := range config.Webhooks {
+		target.Secret = ""
+		redacted.Webhooks = append(redacted.Webhooks, target)
+	}
+	return redacted
+}
+
+// filter returns the events the target subscribes to, with only the columns it subscribes to. Table deletes
+// are delivered to all targets
+func (target *Target) filter(events []Event) []Event {
+	filtered := []Event{}
+	for _, event := range events {
+		if event.Key != "" && !strings.HasPrefix(event.Key, target.KeyPrefix) {
+			continue
+		}
+		if len(target.Columns) == 0 || len(event.Columns) == 0 {
+			filtered = append(filtered, event)
+			continue
+		}
+
+		columns := []string{}
+		generations := map[string]string{}
+		for _, column := range event.Columns {
+			if utils.Search(target.Columns, column) == -1 {
+				continue
+			}
+			columns = append(columns, column)
+			if generation, exists := event.Generations[column]; exists {
+				generations[column] = generation
+			}
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		event.Columns = columns
+		event.Generations = nil
+		if len(generations) > 0 {
+			event.Generations = generations
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
+// Sign returns the signature of a delivery body with the secret of the webhook, as set in SignatureHeader
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
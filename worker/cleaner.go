@@ -11,8 +11,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/adrianchifor/Bigbucket/metrics"
 	"github.com/adrianchifor/Bigbucket/store"
+	"github.com/adrianchifor/Bigbucket/tracing"
 	"github.com/adrianchifor/Bigbucket/utils"
+	"github.com/adrianchifor/Bigbucket/webhook"
 	"github.com/adrianchifor/go-parallel"
 	"github.com/gin-gonic/gin"
 )
@@ -22,8 +25,15 @@ var (
 	stopCleanerMutex = &sync.Mutex{}
 )
 
+var (
+	// ChangeLogRetention is how long change log segments are kept before the cleaner deletes them, 0 to keep them
+	ChangeLogRetention time.Duration
+	// DeadLetterRetention is how long webhook dead letters are kept before the cleaner deletes them, 0 to keep them
+	DeadLetterRetention time.Duration
+)
+
 // RunCleaner runs the cleaner once or on an interval
-func RunCleaner(interval int) {
+func RunCleaner(interval int, bucket store.Backend) {
 	done := make(chan bool, 1)
 	quit := make(chan os.Signal, 1)
 
@@ -35,8 +45,7 @@ func RunCleaner(interval int) {
 	go cleanerGracefulShutdown(deleteJobPool, quit, done)
 
 	log.Printf("Running cleaner...")
-	cleanupTables(deleteJobPool)
-	cleanupColumns(deleteJobPool)
+	runCleanup(context.Background(), bucket, deleteJobPool)
 
 	if interval > 0 {
 		log.Printf("Running cleaner every %d seconds...", interval)
@@ -46,8 +55,7 @@ func RunCleaner(interval int) {
 		for {
 			select {
 			case <-ticker.C:
-				cleanupTables(deleteJobPool)
-				cleanupColumns(deleteJobPool)
+				runCleanup(context.Background(), bucket, deleteJobPool)
 			case <-done:
 				log.Println("Cleaner schedule has been cancelled")
 				break loop
@@ -59,23 +67,47 @@ func RunCleaner(interval int) {
 }
 
 // RunCleanerHttp runs an HTTP server+router for cleaner
-func RunCleanerHttp(port int) {
+func RunCleanerHttp(port int, bucket store.Backend) {
 	deleteJobPool := parallel.LargeJobPool()
 	defer deleteJobPool.Close()
 
+	utils.RunServer(port, NewCleanerRouter(bucket, deleteJobPool))
+}
+
+// NewCleanerRouter creates the router for cleaner HTTP mode, deleting objects through the given job pool
+func NewCleanerRouter(bucket store.Backend, deleteJobPool *parallel.JobPool) *gin.Engine {
 	router := gin.Default()
+	router.Use(metrics.Middleware("cleaner"), tracing.Middleware("cleaner"))
 
 	router.POST("/", func(c *gin.Context) {
 		log.Printf("Running cleaner...")
-		cleanupTables(deleteJobPool)
-		cleanupColumns(deleteJobPool)
+		// Not canceled with the request, so a scheduler timing out doesn't stop deletes half way
+		runCleanup(tracing.Detach(c.Request.Context()), bucket, deleteJobPool)
 		c.String(200, "OK")
 	})
 	router.GET("/health", func(c *gin.Context) {
 		c.String(200, "UP")
 	})
+	router.GET("/metrics", metrics.Handler())
 
-	utils.RunServer(port, router)
+	return router
+}
+
+// runCleanup garbage collects deleted tables, deleted columns, expired cells, old change log segments and
+// old webhook dead letters, recording the objects deleted
+func runCleanup(ctx context.Context, bucket store.Backend, jobPool *parallel.JobPool) {
+	ctx, span := tracing.Start(ctx, "cleaner run")
+	defer span.End()
+
+	start := time.Now()
+	deletedObjects := map[string]int{
+		"table":       cleanupTables(ctx, bucket, jobPool),
+		"column":      cleanupColumns(ctx, bucket, jobPool),
+		"expired":     cleanupExpired(ctx, bucket, jobPool),
+		"changes":     cleanupOrdered(ctx, bucket, jobPool, utils.ChangesPrefix, ChangeLogRetention, "change log segments"),
+		"deadletters": cleanupOrdered(ctx, bucket, jobPool, webhook.DeadLettersPrefix, DeadLetterRetention, "dead letters"),
+	}
+	metrics.ObserveCleanerRun(time.Since(start), deletedObjects)
 }
 
 func cleanerGracefulShutdown(jobPool *parallel.JobPool, quit <-chan os.Signal, done chan<- bool) {
@@ -96,20 +128,23 @@ func cleanerGracefulShutdown(jobPool *parallel.JobPool, quit <-chan os.Signal, d
 	close(done)
 }
 
-func cleanupTables(jobPool *parallel.JobPool) {
-	tablesToDelete := utils.GetState("bigbucket/.delete_tables")
+// cleanupTables deletes the objects of tables marked for deletion, returning the count of deleted objects
+func cleanupTables(ctx context.Context, bucket store.Backend, jobPool *parallel.JobPool) int {
+	tablesToDelete := utils.GetState(ctx, bucket, "bigbucket/.delete_tables")
 	if len(tablesToDelete) == 0 {
-		return
+		return 0
 	}
 
+	deleted := &deletedCounter{}
+
 	for i, table := range tablesToDelete {
-		objects, err := store.ListObjects(fmt.Sprintf("bigbucket/%s/", table), "", 0)
+		objects, err := bucket.ListObjects(ctx, fmt.Sprintf("bigbucket/%s/", table), "", 0, nil)
 		if err != nil {
 			log.Printf("Failed to list objects in table '%s': %v", table, err)
 			continue
 		}
 		if len(objects) == 0 {
-			err := utils.WriteState("bigbucket/.delete_tables", utils.RemoveIndex(tablesToDelete, i))
+			err := utils.WriteState(ctx, bucket, "bigbucket/.delete_tables", utils.RemoveIndex(tablesToDelete, i))
 			if err != nil {
 				log.Printf("Failed to update .delete_tables state: %v", err)
 			} else {
@@ -120,7 +155,7 @@ func cleanupTables(jobPool *parallel.JobPool) {
 
 		for _, object := range objects {
 			object := object
-			jobPool.AddJob(func() {
+			utils.AddJob(ctx, jobPool, "cleaner", func(ctx context.Context) {
 				stopCleanerMutex.Lock()
 				if stopCleaner {
 					stopCleanerMutex.Unlock()
@@ -128,29 +163,32 @@ func cleanupTables(jobPool *parallel.JobPool) {
 				}
 				stopCleanerMutex.Unlock()
 
-				store.DeleteObject(object)
+				deleted.add(bucket.DeleteObject(ctx, object))
 			})
 		}
 	}
 
 	jobPool.Wait()
 	// Double check objects and update deleted tables state if nothing left
-	cleanupTables(jobPool)
+	return deleted.count + cleanupTables(ctx, bucket, jobPool)
 }
 
-func cleanupColumns(jobPool *parallel.JobPool) {
-	objects, err := store.ListObjects("bigbucket/", "/", 0)
+// cleanupColumns deletes the cells of columns marked for deletion, returning the count of deleted objects
+func cleanupColumns(ctx context.Context, bucket store.Backend, jobPool *parallel.JobPool) int {
+	objects, err := bucket.ListObjects(ctx, "bigbucket/", "/", 0, nil)
 	if err != nil {
 		log.Printf("Failed to list tables: %v", err)
 	}
 	if len(objects) == 0 {
-		return
+		return 0
 	}
 	tables := utils.CleanupTables(objects)
 
+	deleted := &deletedCounter{}
+
 	noColumnsToDelete := true
 	for _, table := range tables {
-		columnsToDelete := utils.GetState(fmt.Sprintf("bigbucket/%s/.delete_columns", table))
+		columnsToDelete := utils.GetState(ctx, bucket, fmt.Sprintf("bigbucket/%s/.delete_columns", table))
 		if len(columnsToDelete) == 0 {
 			continue
 		}
@@ -158,7 +196,7 @@ func cleanupColumns(jobPool *parallel.JobPool) {
 			noColumnsToDelete = false
 		}
 
-		objects, err = store.ListObjects(fmt.Sprintf("bigbucket/%s/", table), "", 0)
+		objects, err = bucket.ListObjects(ctx, fmt.Sprintf("bigbucket/%s/", table), "", 0, nil)
 		if err != nil {
 			log.Printf("Failed to list objects in table '%s': %v", table, err)
 			continue
@@ -170,12 +208,12 @@ func cleanupColumns(jobPool *parallel.JobPool) {
 
 			for _, object := range objects {
 				object := object
-				if strings.HasSuffix(object, column) {
+				if strings.HasSuffix(object, "/"+column) {
 					if noColumnsFound {
 						noColumnsFound = false
 					}
 
-					jobPool.AddJob(func() {
+					utils.AddJob(ctx, jobPool, "cleaner", func(ctx context.Context) {
 						stopCleanerMutex.Lock()
 						if stopCleaner {
 							stopCleanerMutex.Unlock()
@@ -183,7 +221,7 @@ func cleanupColumns(jobPool *parallel.JobPool) {
 						}
 						stopCleanerMutex.Unlock()
 
-						store.DeleteObject(object)
+						deleted.add(bucket.DeleteObject(ctx, object))
 					})
 				}
 			}
@@ -191,7 +229,7 @@ func cleanupColumns(jobPool *parallel.JobPool) {
 			jobPool.Wait()
 
 			if noColumnsFound {
-				err := utils.WriteState(fmt.Sprintf("bigbucket/%s/.delete_columns", table), utils.RemoveIndex(columnsToDelete, i))
+				err := utils.WriteState(ctx, bucket, fmt.Sprintf("bigbucket/%s/.delete_columns", table), utils.RemoveIndex(columnsToDelete, i))
 				if err != nil {
 					log.Printf("Failed to update %s/.delete_columns state: %v", table, err)
 				} else {
@@ -202,8 +240,126 @@ func cleanupColumns(jobPool *parallel.JobPool) {
 	}
 
 	if noColumnsToDelete {
-		return
+		return 0
 	}
 	// Double check objects and update deleted columns state if nothing left
-	cleanupColumns(jobPool)
+	return deleted.count + cleanupColumns(ctx, bucket, jobPool)
+}
+
+// cleanupExpired deletes the expired cells of all tables, listed by the backend from listing metadata where
+// it can (see store.Backend.ListExpiredObjects). A cell rewritten between its listing and delete can still be
+// deleted. Returns the count of deleted cells
+func cleanupExpired(ctx context.Context, bucket store.Backend, jobPool *parallel.JobPool) int {
+	objects, err := bucket.ListObjects(ctx, "bigbucket/", "/", 0, nil)
+	if err != nil {
+		log.Printf("Failed to list tables: %v", err)
+	}
+	if len(objects) == 0 {
+		return 0
+	}
+	tables := utils.CleanupTables(objects)
+
+	totalExpired := 0
+
+	for _, table := range tables {
+		objects, err = bucket.ListExpiredObjects(ctx, fmt.Sprintf("bigbucket/%s/", table))
+		if err != nil {
+			log.Printf("Failed to list expired cells in table '%s': %v", table, err)
+			continue
+		}
+
+		expired := &deletedCounter{}
+		for _, object := range objects {
+			object := object
+			if strings.Count(object, "/") != 3 {
+				// Skip table state objects, only cells expire
+				continue
+			}
+
+			utils.AddJob(ctx, jobPool, "cleaner", func(ctx context.Context) {
+				stopCleanerMutex.Lock()
+				if stopCleaner {
+					stopCleanerMutex.Unlock()
+					return
+				}
+				stopCleanerMutex.Unlock()
+
+				expired.add(bucket.DeleteObject(ctx, object))
+			})
+		}
+
+		jobPool.Wait()
+		if expired.count > 0 {
+			log.Printf("%d expired cells in table '%s' cleaned up", expired.count, table)
+		}
+		totalExpired += expired.count
+	}
+	return totalExpired
+}
+
+// cleanupOrdered deletes the objects under the tables of a prefix (e.g. change log segments or dead letters)
+// older than the retention period. Their names are ordered IDs starting with the time they were written,
+// so only old objects are listed. Returns the count of deleted objects
+func cleanupOrdered(ctx context.Context, bucket store.Backend, jobPool *parallel.JobPool, prefix string,
+	retention time.Duration, kind string) int {
+	if retention <= 0 {
+		return 0
+	}
+	tables, err := bucket.ListObjects(ctx, prefix, "/", 0, nil)
+	if err != nil {
+		log.Printf("Failed to list %s: %v", kind, err)
+		return 0
+	}
+	before := fmt.Sprintf("%020d", time.Now().Add(-retention).UnixNano())
+
+	totalDeleted := 0
+
+	for _, tablePrefix := range tables {
+		if !strings.HasSuffix(tablePrefix, "/") {
+			continue
+		}
+		objects, err := bucket.ListObjects(ctx, tablePrefix, "", 0, &store.ListOptions{EndOffset: tablePrefix + before})
+		if err != nil {
+			log.Printf("Failed to list %s in '%s': %v", kind, tablePrefix, err)
+			continue
+		}
+
+		deleted := &deletedCounter{}
+		for _, object := range objects {
+			object := object
+			utils.AddJob(ctx, jobPool, "cleaner", func(ctx context.Context) {
+				stopCleanerMutex.Lock()
+				if stopCleaner {
+					stopCleanerMutex.Unlock()
+					return
+				}
+				stopCleanerMutex.Unlock()
+
+				deleted.add(bucket.DeleteObject(ctx, object))
+			})
+		}
+
+		jobPool.Wait()
+		if deleted.count > 0 {
+			log.Printf("%d %s in '%s' cleaned up", deleted.count, kind, tablePrefix)
+		}
+		totalDeleted += deleted.count
+	}
+	return totalDeleted
+}
+
+// deletedCounter counts the objects deleted by cleanup jobs
+type deletedCounter struct {
+	mutex sync.Mutex
+	count int
+}
+
+// add counts the object if it was deleted without error
+func (d *deletedCounter) add(err error) {
+	if err != nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.count++
 }